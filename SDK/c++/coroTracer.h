@@ -7,6 +7,8 @@
 #include <iostream>
 #include <cstdlib>
 #include <cstring>
+#include <cstddef>
+#include <string>
 #include <thread>
 
 // POSIX system call
@@ -15,6 +17,9 @@
 #include <sys/stat.h>
 #include <sys/socket.h>
 #include <sys/un.h>
+#include <netdb.h>
+#include <netinet/in.h>
+#include <netinet/tcp.h>
 #include <unistd.h>
 #ifdef __APPLE__
 #include <pthread.h>
@@ -37,12 +42,17 @@ struct alignas(64) Epoch {
     bool is_active;          // 1
 };                           // Total: 64 Bytes
 
-struct alignas(1024) StationData {
+// Stations are GlobalHeader::station_size bytes apart: 1024 for up to 8 slots, plus 64 per
+// slot past the eighth, which follow the StationData (see station_slot)
+struct alignas(64) StationData {
     struct {
         uint64_t probe_id;   // 8
         uint64_t birth_ts;   // 8
         bool is_dead;        // 1
-        char _pad[47];       // 47
+        char _pad0[7];       // 7
+        uint64_t death_ts;   // 8 (written before is_dead)
+        std::atomic<uint32_t> reclaimable; // 4 (set by the tracer once a dead station is finalized)
+        char _pad[28];       // 28
     } header;                // 64 Bytes
 
     Epoch slots[8];          // 512 Bytes (8 * 64)
@@ -59,13 +69,36 @@ struct alignas(1024) GlobalHeader {
     uint32_t max_stations;       // 4
     std::atomic<uint32_t> allocated_count; // 4
     std::atomic<uint32_t> tracer_sleeping; // 4
-    char _reserved[1000];        // 1024 - 24 = 1000 Bytes
+    uint32_t station_size;       // 4 (bytes from one station to the next)
+    uint32_t slots_per_station;  // 4 (1 to kMaxSlotsPerStation)
+    std::atomic<uint32_t> reclaimable_count; // 4 (stations with header.reclaimable set)
+    char _reserved[988];         // 1024 - 36 = 988 Bytes
 };
 
+static_assert(sizeof(Epoch) == 64, "Epoch must be 64 bytes");
+static_assert(sizeof(StationData) == 1024, "StationData must be 1024 bytes");
+static_assert(sizeof(GlobalHeader) == 1024, "GlobalHeader must be 1024 bytes");
+
+constexpr uint64_t kMagicNumber = 0x434F524F54524352; // "COROTRCR"
+constexpr uint32_t kLayoutVersion = 2;                // GlobalHeader::version this SDK writes to
+constexpr uint32_t kMaxSlotsPerStation = 64;
+
 // Global context
 inline GlobalHeader* g_header = nullptr;
-inline StationData* g_stations = nullptr;
+inline char* g_stations = nullptr;
 inline int g_uds_fd = -1;
+inline uint32_t g_station_size = sizeof(StationData); // Negotiated through GlobalHeader::station_size
+inline uint32_t g_slots_per_station = 8;              // Negotiated through GlobalHeader::slots_per_station
+
+inline StationData* station_at(uint32_t idx) {
+    return reinterpret_cast<StationData*>(g_stations + static_cast<size_t>(idx) * g_station_size);
+}
+
+// Slots 0-7 are StationData::slots; the rest follow the StationData inside the station stride
+inline Epoch& station_slot(StationData* station, uint64_t idx) {
+    if (idx < 8) return station->slots[idx];
+    return reinterpret_cast<Epoch*>(station + 1)[idx - 8];
+}
 
 // Get the nanosecond-level timestamp
 inline uint64_t get_ns() {
@@ -128,19 +161,46 @@ public:
         uint32_t idx = g_header->allocated_count.fetch_add(1, std::memory_order_relaxed);
 
         if (idx < max_stat) {
-            my_station = &g_stations[idx];
+            my_station = station_at(idx);
+        } else {
+            my_station = claim_reclaimed_station(max_stat);
+        }
+
+        if (my_station) {
+            // A reclaimed station still carries its last owner's death. Clear it before
+            // publishing the new owner: a tracer that reads this owner must read it alive
+            my_station->header.death_ts = 0;
+            my_station->header.is_dead = false;
+            std::atomic_thread_fence(std::memory_order_release);
             my_station->header.probe_id = reinterpret_cast<uint64_t>(this);
             my_station->header.birth_ts = get_ns();
-            my_station->header.is_dead = false;
         }
     }
 
     ~PromiseMixin() {
         if (my_station) {
+            my_station->header.death_ts = get_ns();
+            // The tracer reads death_ts after seeing is_dead, so publish it first
+            std::atomic_thread_fence(std::memory_order_release);
             my_station->header.is_dead = true;
         }
     }
 
+    // Once the bump allocator is exhausted, reuse a station the tracer finalized after
+    // its coroutine died (coroTracer -death-events). Seqs keep counting across owners.
+    static StationData* claim_reclaimed_station(uint32_t max_stat) {
+        if (g_header->reclaimable_count.load(std::memory_order_acquire) == 0) return nullptr;
+        for (uint32_t i = 0; i < max_stat; ++i) {
+            uint32_t expected = 1;
+            StationData* station = station_at(i);
+            if (station->header.reclaimable.compare_exchange_strong(expected, 0, std::memory_order_acq_rel)) {
+                g_header->reclaimable_count.fetch_sub(1, std::memory_order_relaxed);
+                return station;
+            }
+        }
+        return nullptr;
+    }
+
     template <typename Awaitable>
     auto await_transform(Awaitable&& awaitable) {
         return TracedAwaiter<Awaitable>{std::forward<Awaitable>(awaitable), this};
@@ -150,7 +210,7 @@ public:
         if (!my_station) return;
 
         // 1. Locate the current ring buffer slot to write to
-        auto& slot = my_station->slots[event_count % 8];
+        auto& slot = station_slot(my_station, event_count % g_slots_per_station);
 
         // 🔴 Step A (Lean 4 Contract): Lock before writing (Odd Seq)
         // Retrieve the Seq number from the previous round of this slot (must be even)
@@ -202,6 +262,77 @@ auto TracedAwaiter<InnerAwaiter>::await_resume() {
 // ==========================================
 // 4. SDK initialization
 // ==========================================
+
+// Connect to the tracer's wakeup socket. CTP_SOCK_PATH is a UDS path, "@name" for a
+// Linux abstract socket, or "tcp://host:port". Returns -1 on failure.
+inline int connect_wakeup(const char* sock_path) {
+    if (std::strncmp(sock_path, "tcp://", 6) == 0) {
+        std::string addr(sock_path + 6);
+        size_t colon = addr.rfind(':');
+        if (colon == std::string::npos) {
+            return -1;
+        }
+        std::string host = addr.substr(0, colon);
+        std::string port = addr.substr(colon + 1);
+        if (host.size() >= 2 && host.front() == '[' && host.back() == ']') {
+            host = host.substr(1, host.size() - 2);
+        }
+
+        struct addrinfo hints;
+        std::memset(&hints, 0, sizeof(hints));
+        hints.ai_family = AF_UNSPEC;
+        hints.ai_socktype = SOCK_STREAM;
+        struct addrinfo* res = nullptr;
+        if (::getaddrinfo(host.c_str(), port.c_str(), &hints, &res) != 0) {
+            return -1;
+        }
+        int fd = -1;
+        for (struct addrinfo* ai = res; ai != nullptr; ai = ai->ai_next) {
+            fd = ::socket(ai->ai_family, ai->ai_socktype, ai->ai_protocol);
+            if (fd < 0) {
+                continue;
+            }
+            if (::connect(fd, ai->ai_addr, ai->ai_addrlen) == 0) {
+                break;
+            }
+            ::close(fd);
+            fd = -1;
+        }
+        ::freeaddrinfo(res);
+        if (fd >= 0) {
+            // Doorbell bytes must not sit in Nagle's buffer while the tracer sleeps
+            int one = 1;
+            ::setsockopt(fd, IPPROTO_TCP, TCP_NODELAY, &one, sizeof(one));
+        }
+        return fd;
+    }
+
+    int fd = ::socket(AF_UNIX, SOCK_STREAM, 0);
+    if (fd < 0) {
+        return -1;
+    }
+    struct sockaddr_un addr;
+    std::memset(&addr, 0, sizeof(addr));
+    addr.sun_family = AF_UNIX;
+    socklen_t len = sizeof(addr);
+    if (sock_path[0] == '@') {
+        // Abstract namespace: leading NUL, and the length covers exactly the name
+        size_t name_len = std::strlen(sock_path + 1);
+        if (name_len > sizeof(addr.sun_path) - 1) {
+            name_len = sizeof(addr.sun_path) - 1;
+        }
+        std::memcpy(addr.sun_path + 1, sock_path + 1, name_len);
+        len = static_cast<socklen_t>(offsetof(struct sockaddr_un, sun_path) + 1 + name_len);
+    } else {
+        std::strncpy(addr.sun_path, sock_path, sizeof(addr.sun_path) - 1);
+    }
+    if (::connect(fd, (struct sockaddr*)&addr, len) < 0) {
+        ::close(fd);
+        return -1;
+    }
+    return fd;
+}
+
 inline void InitTracer() {
     const char* shm_path = std::getenv("CTP_SHM_PATH");
     const char* sock_path = std::getenv("CTP_SOCK_PATH");
@@ -212,16 +343,21 @@ inline void InitTracer() {
         return;
     }
 
-    int max_stations = std::atoi(max_stations_str);
-
-    size_t mem_size = 1024 + (max_stations * 1024);
-
     int shm_fd = ::open(shm_path, O_RDWR);
     if (shm_fd < 0) {
         std::cerr << "[coroTracer] Failed to open shm: " << shm_path << std::endl;
         return;
     }
 
+    // The station stride comes from the header, so size the mapping from the file
+    struct stat st;
+    if (::fstat(shm_fd, &st) < 0 || static_cast<size_t>(st.st_size) < sizeof(GlobalHeader)) {
+        std::cerr << "[coroTracer] Shm " << shm_path << " is smaller than its header." << std::endl;
+        ::close(shm_fd);
+        return;
+    }
+    size_t mem_size = static_cast<size_t>(st.st_size);
+
     void* mapped = ::mmap(nullptr, mem_size, PROT_READ | PROT_WRITE, MAP_SHARED, shm_fd, 0);
     if (mapped == MAP_FAILED) {
         std::cerr << "[coroTracer] Failed to mmap." << std::endl;
@@ -230,25 +366,41 @@ inline void InitTracer() {
     }
     ::close(shm_fd);
 
-    g_header = static_cast<GlobalHeader*>(mapped);
+    auto* header = static_cast<GlobalHeader*>(mapped);
+    const char* problem = nullptr;
+    if (header->magic_number != kMagicNumber) {
+        problem = "Shm is not a coroTracer mapping";
+    } else if (header->version != kLayoutVersion) {
+        problem = "Tracer uses another shm layout version";
+    } else if (header->slots_per_station < 1 || header->slots_per_station > kMaxSlotsPerStation) {
+        problem = "Tracer announces an unsupported slot count";
+    } else if (header->station_size != sizeof(StationData) + sizeof(Epoch) * (header->slots_per_station > 8 ? header->slots_per_station - 8 : 0)) {
+        problem = "Tracer station size does not fit its slot count";
+    } else if (mem_size < sizeof(GlobalHeader) + static_cast<size_t>(header->max_stations) * header->station_size) {
+        problem = "Shm is smaller than its stations";
+    }
+    if (problem) {
+        std::cerr << "[coroTracer] " << problem << " (magic 0x" << std::hex << header->magic_number << std::dec
+                  << ", version " << header->version << ", SDK version " << kLayoutVersion
+                  << ", " << header->station_size << "-byte stations, " << header->slots_per_station
+                  << " slots). Running in untraced mode." << std::endl;
+        ::munmap(mapped, mem_size);
+        return;
+    }
+    g_station_size = header->station_size;
+    g_slots_per_station = header->slots_per_station;
 
-    g_stations = reinterpret_cast<StationData*>(static_cast<char*>(mapped) + 1024);
+    g_header = header;
 
-    g_uds_fd = ::socket(AF_UNIX, SOCK_STREAM, 0);
-    if (g_uds_fd >= 0) {
-        struct sockaddr_un addr;
-        std::memset(&addr, 0, sizeof(addr));
-        addr.sun_family = AF_UNIX;
-        std::strncpy(addr.sun_path, sock_path, sizeof(addr.sun_path) - 1);
+    g_stations = static_cast<char*>(mapped) + sizeof(GlobalHeader);
 
-        if (::connect(g_uds_fd, (struct sockaddr*)&addr, sizeof(addr)) < 0) {
-            std::cerr << "[coroTracer] Failed to connect UDS, sleep/wake may not work." << std::endl;
-            ::close(g_uds_fd);
-            g_uds_fd = -1;
-        } else {
-            int flags = ::fcntl(g_uds_fd, F_GETFL, 0);
-            ::fcntl(g_uds_fd, F_SETFL, flags | O_NONBLOCK);
-        }
+    g_uds_fd = connect_wakeup(sock_path);
+    if (g_uds_fd < 0) {
+        std::cerr << "[coroTracer] Failed to connect wakeup socket " << sock_path
+                  << ", sleep/wake may not work." << std::endl;
+    } else {
+        int flags = ::fcntl(g_uds_fd, F_GETFL, 0);
+        ::fcntl(g_uds_fd, F_SETFL, flags | O_NONBLOCK);
     }
 
     std::cout << "[coroTracer] C++ SDK Successfully Attached!" << std::endl;
@@ -12,6 +12,7 @@ use std::fs::OpenOptions;
 use std::future::Future;
 use std::io;
 use std::mem::{align_of, size_of};
+use std::net::TcpStream;
 use std::os::fd::{AsRawFd, IntoRawFd, RawFd};
 use std::os::raw::c_int;
 #[cfg(target_os = "linux")]
@@ -25,8 +26,12 @@ use std::task::{Context, Poll};
 use std::time::Instant;
 
 const MAGIC_NUMBER: u64 = 0x434F524F54524352;
+/// `GlobalHeader::version` of the layout this SDK writes to.
+const LAYOUT_VERSION: u32 = 2;
 const HEADER_SIZE: usize = 1024;
 const STATION_SIZE: usize = 1024;
+const BASE_SLOTS_PER_STATION: u32 = 8;
+const MAX_SLOTS_PER_STATION: u32 = 64;
 const UDS_WAKEUP_BYTE: u8 = b'1';
 const DISCONNECTED_FD: RawFd = -1;
 const SUSPEND_ADDR_NONE: u64 = 0;
@@ -69,10 +74,15 @@ struct StationHeader {
     probe_id: u64,
     birth_ts: u64,
     is_dead: bool,
-    _pad: [u8; 47],
+    _pad0: [u8; 7],
+    death_ts: u64,
+    reclaimable: AtomicU32,
+    _pad: [u8; 28],
 }
 
-#[repr(C, align(1024))]
+/// Stations are `GlobalHeader::station_size` bytes apart: 1024 for up to 8 slots, plus
+/// 64 per slot past the eighth, which follow the `StationData` (see `station_slot`).
+#[repr(C, align(64))]
 struct StationData {
     header: StationHeader,
     slots: [Epoch; 8],
@@ -86,7 +96,10 @@ struct GlobalHeader {
     max_stations: u32,
     allocated_count: AtomicU32,
     tracer_sleeping: AtomicU32,
-    _reserved: [u8; 1000],
+    station_size: u32,
+    slots_per_station: u32,
+    reclaimable_count: AtomicU32,
+    _reserved: [u8; 988],
 }
 
 #[repr(C)]
@@ -98,7 +111,7 @@ struct Timespec {
 const _: [(); 64] = [(); size_of::<Epoch>()];
 const _: [(); 64] = [(); align_of::<Epoch>()];
 const _: [(); 1024] = [(); size_of::<StationData>()];
-const _: [(); 1024] = [(); align_of::<StationData>()];
+const _: [(); 64] = [(); align_of::<StationData>()];
 const _: [(); 1024] = [(); size_of::<GlobalHeader>()];
 const _: [(); 1024] = [(); align_of::<GlobalHeader>()];
 
@@ -109,7 +122,9 @@ enum TracerState {
 
 struct TracerRuntime {
     header: *mut GlobalHeader,
-    stations: *mut StationData,
+    stations: *mut u8,
+    station_size: usize,
+    slots_per_station: u64,
     uds_fd: RawFd,
     _mapping_ptr: *mut core::ffi::c_void,
     _mapping_len: usize,
@@ -125,6 +140,11 @@ enum InitError {
     Overflow,
     OpenShm(io::Error),
     Mmap(io::Error),
+    Magic(u64),
+    Version(u32),
+    SlotCount(u32),
+    StationSize { size: u32, slots: u32 },
+    ShortShm { size: usize, need: usize },
 }
 
 impl fmt::Display for InitError {
@@ -137,6 +157,27 @@ impl fmt::Display for InitError {
             Self::Overflow => write!(f, "Shared memory size overflow"),
             Self::OpenShm(err) => write!(f, "Failed to open shm: {err}"),
             Self::Mmap(err) => write!(f, "Failed to mmap shared memory: {err}"),
+            Self::Magic(magic) => write!(
+                f,
+                "Shm is not a coroTracer mapping (magic 0x{magic:016x})"
+            ),
+            Self::Version(version) => write!(
+                f,
+                "Tracer uses shm layout version {version}, SDK supports {LAYOUT_VERSION}"
+            ),
+            Self::SlotCount(slots) => write!(
+                f,
+                "Tracer announces {slots} slots per station, SDK supports 1 to {MAX_SLOTS_PER_STATION}"
+            ),
+            Self::StationSize { size, slots } => write!(
+                f,
+                "Tracer announces {size}-byte stations, {slots} slots need {}",
+                station_size_for(*slots)
+            ),
+            Self::ShortShm { size, need } => write!(
+                f,
+                "Shm is {size} bytes, its header announces stations needing {need}"
+            ),
         }
     }
 }
@@ -190,15 +231,22 @@ impl PollTrace {
 
         let header = unsafe { &*runtime.header };
         let idx = header.allocated_count.fetch_add(1, Ordering::Relaxed);
-        if idx >= header.max_stations {
-            return Self::disabled();
-        }
-
-        let station = unsafe { runtime.stations.add(idx as usize) };
+        let station = if idx < header.max_stations {
+            runtime.station(idx as usize)
+        } else {
+            match runtime.claim_reclaimed_station() {
+                Some(station) => station,
+                None => return Self::disabled(),
+            }
+        };
         unsafe {
+            // A reclaimed station still carries its last owner's death. Clear it before
+            // publishing the new owner: a tracer that reads this owner must read it alive
+            (*station).header.death_ts = 0;
+            (*station).header.is_dead = false;
+            fence(Ordering::Release);
             (*station).header.probe_id = probe_id;
             (*station).header.birth_ts = birth_ts;
-            (*station).header.is_dead = false;
         }
 
         Self {
@@ -251,6 +299,9 @@ impl PollTrace {
         }
 
         unsafe {
+            (*self.station).header.death_ts = monotonic_ns();
+            // The tracer reads death_ts after seeing is_dead, so publish it first
+            fence(Ordering::Release);
             (*self.station).header.is_dead = true;
         }
         self.pending = false;
@@ -275,8 +326,8 @@ impl PollTrace {
             return;
         }
 
-        let slot_index = (self.event_count % 8) as usize;
-        let slot = unsafe { &mut (*self.station).slots[slot_index] };
+        let slot_index = (self.event_count % runtime.slots_per_station) as usize;
+        let slot = unsafe { &mut *station_slot(self.station, slot_index) };
 
         let old_seq = slot.seq.load(Ordering::Relaxed);
         slot.seq.store(old_seq.wrapping_add(1), Ordering::Release);
@@ -390,29 +441,85 @@ fn tracer_state() -> &'static TracerState {
     })
 }
 
+/// Bytes from one station to the next for a slot count: 1024 for up to 8 slots, plus 64
+/// for each slot past the eighth.
+fn station_size_for(slots: u32) -> usize {
+    STATION_SIZE + slots.saturating_sub(BASE_SLOTS_PER_STATION) as usize * size_of::<Epoch>()
+}
+
+/// Returns Epoch `idx` of a station. Slots 0-7 are `StationData::slots`; the rest follow
+/// the `StationData` inside the station stride.
+///
+/// # Safety
+///
+/// `station` must point into a mapping whose stride covers `idx + 1` slots.
+unsafe fn station_slot(station: *mut StationData, idx: usize) -> *mut Epoch {
+    if idx < BASE_SLOTS_PER_STATION as usize {
+        unsafe { ptr::addr_of_mut!((*station).slots).cast::<Epoch>().add(idx) }
+    } else {
+        unsafe {
+            station
+                .add(1)
+                .cast::<Epoch>()
+                .add(idx - BASE_SLOTS_PER_STATION as usize)
+        }
+    }
+}
+
 impl TracerRuntime {
+    fn station(&self, idx: usize) -> *mut StationData {
+        unsafe {
+            self.stations
+                .add(idx * self.station_size)
+                .cast::<StationData>()
+        }
+    }
+
+    /// Once the bump allocator is exhausted, reuses a station the tracer finalized after
+    /// its coroutine died (coroTracer -death-events). Seqs keep counting across owners.
+    fn claim_reclaimed_station(&self) -> Option<*mut StationData> {
+        let header = unsafe { &*self.header };
+        if header.reclaimable_count.load(Ordering::Acquire) == 0 {
+            return None;
+        }
+        for idx in 0..header.max_stations as usize {
+            let station = self.station(idx);
+            let reclaimable = unsafe { &(*station).header.reclaimable };
+            if reclaimable
+                .compare_exchange(1, 0, Ordering::AcqRel, Ordering::Acquire)
+                .is_ok()
+            {
+                header.reclaimable_count.fetch_sub(1, Ordering::Relaxed);
+                return Some(station);
+            }
+        }
+        None
+    }
+
     fn attach_from_env() -> Result<Self, InitError> {
         let shm_path = env::var("CTP_SHM_PATH").map_err(|_| InitError::MissingEnv)?;
         let sock_path = env::var("CTP_SOCK_PATH").map_err(|_| InitError::MissingEnv)?;
         let max_stations = env::var("CTP_MAX_STATIONS").map_err(|_| InitError::MissingEnv)?;
-        let max_stations = max_stations
+        max_stations
             .parse::<usize>()
             .map_err(|_| InitError::InvalidStationCount(max_stations.clone()))?;
 
-        let mem_size = HEADER_SIZE
-            .checked_add(
-                max_stations
-                    .checked_mul(STATION_SIZE)
-                    .ok_or(InitError::Overflow)?,
-            )
-            .ok_or(InitError::Overflow)?;
-
         let shm = OpenOptions::new()
             .read(true)
             .write(true)
             .open(&shm_path)
             .map_err(InitError::OpenShm)?;
 
+        // The station stride comes from the header, so map the whole file
+        let mem_size = shm.metadata().map_err(InitError::OpenShm)?.len();
+        let mem_size = usize::try_from(mem_size).map_err(|_| InitError::Overflow)?;
+        if mem_size < HEADER_SIZE {
+            return Err(InitError::ShortShm {
+                size: mem_size,
+                need: HEADER_SIZE,
+            });
+        }
+
         let mapped = unsafe {
             mmap(
                 ptr::null_mut(),
@@ -428,28 +535,23 @@ impl TracerRuntime {
         }
 
         let header = mapped as *mut GlobalHeader;
-        let stations = unsafe { (mapped as *mut u8).add(HEADER_SIZE) as *mut StationData };
+        let stations = unsafe { (mapped as *mut u8).add(HEADER_SIZE) };
 
-        unsafe {
-            if (*header).magic_number != MAGIC_NUMBER {
-                eprintln!(
-                    "[coroTracer] Warning: unexpected magic number 0x{:016x}, continuing anyway.",
-                    (*header).magic_number
-                );
+        let station_size = match unsafe { validate_header(&*header, mem_size) } {
+            Ok(station_size) => station_size,
+            Err(err) => {
+                unsafe { munmap(mapped, mem_size) };
+                return Err(err);
             }
-        }
+        };
+        let slots_per_station = u64::from(unsafe { (*header).slots_per_station });
 
-        let uds_fd = match UnixStream::connect(&sock_path) {
-            Ok(stream) => {
-                if let Err(err) = stream.set_nonblocking(true) {
-                    eprintln!(
-                        "[coroTracer] Failed to make UDS non-blocking, sleep/wake may not work: {err}"
-                    );
-                }
-                stream.into_raw_fd()
-            }
+        let uds_fd = match connect_wakeup(&sock_path) {
+            Ok(fd) => fd,
             Err(err) => {
-                eprintln!("[coroTracer] Failed to connect UDS, sleep/wake may not work: {err}");
+                eprintln!(
+                    "[coroTracer] Failed to connect wakeup socket {sock_path}, sleep/wake may not work: {err}"
+                );
                 DISCONNECTED_FD
             }
         };
@@ -457,6 +559,8 @@ impl TracerRuntime {
         Ok(Self {
             header,
             stations,
+            station_size,
+            slots_per_station,
             uds_fd,
             _mapping_ptr: mapped,
             _mapping_len: mem_size,
@@ -464,6 +568,72 @@ impl TracerRuntime {
     }
 }
 
+/// Checks that a mapped header describes a layout this SDK can write to and returns its
+/// station stride. The magic goes first: the other fields mean nothing in a foreign mapping.
+fn validate_header(header: &GlobalHeader, mem_size: usize) -> Result<usize, InitError> {
+    if header.magic_number != MAGIC_NUMBER {
+        return Err(InitError::Magic(header.magic_number));
+    }
+    if header.version != LAYOUT_VERSION {
+        return Err(InitError::Version(header.version));
+    }
+    let slots = header.slots_per_station;
+    if !(1..=MAX_SLOTS_PER_STATION).contains(&slots) {
+        return Err(InitError::SlotCount(slots));
+    }
+    let station_size = station_size_for(slots);
+    if header.station_size as usize != station_size {
+        return Err(InitError::StationSize {
+            size: header.station_size,
+            slots,
+        });
+    }
+    let need = (header.max_stations as usize)
+        .checked_mul(station_size)
+        .and_then(|bytes| bytes.checked_add(HEADER_SIZE))
+        .ok_or(InitError::Overflow)?;
+    if mem_size < need {
+        return Err(InitError::ShortShm {
+            size: mem_size,
+            need,
+        });
+    }
+    Ok(station_size)
+}
+
+/// Connects to the tracer's wakeup socket and returns it as a non-blocking fd.
+/// `sock_path` is a UDS path, `@name` for a Linux abstract socket, or `tcp://host:port`.
+fn connect_wakeup(sock_path: &str) -> io::Result<RawFd> {
+    if let Some(addr) = sock_path.strip_prefix("tcp://") {
+        let stream = TcpStream::connect(addr)?;
+        // Doorbell bytes must not sit in Nagle's buffer while the tracer sleeps
+        stream.set_nodelay(true)?;
+        stream.set_nonblocking(true)?;
+        return Ok(stream.into_raw_fd());
+    }
+    let stream = match sock_path.strip_prefix('@') {
+        Some(name) => connect_abstract(name)?,
+        None => UnixStream::connect(sock_path)?,
+    };
+    stream.set_nonblocking(true)?;
+    Ok(stream.into_raw_fd())
+}
+
+#[cfg(target_os = "linux")]
+fn connect_abstract(name: &str) -> io::Result<UnixStream> {
+    use std::os::linux::net::SocketAddrExt;
+    let addr = std::os::unix::net::SocketAddr::from_abstract_name(name.as_bytes())?;
+    UnixStream::connect_addr(&addr)
+}
+
+#[cfg(not(target_os = "linux"))]
+fn connect_abstract(_name: &str) -> io::Result<UnixStream> {
+    Err(io::Error::new(
+        io::ErrorKind::Unsupported,
+        "abstract sockets are Linux-only",
+    ))
+}
+
 fn map_failed() -> *mut core::ffi::c_void {
     usize::MAX as *mut core::ffi::c_void
 }
@@ -521,6 +691,7 @@ unsafe extern "C" {
         fd: c_int,
         offset: i64,
     ) -> *mut core::ffi::c_void;
+    fn munmap(addr: *mut core::ffi::c_void, len: usize) -> c_int;
     fn write(fd: c_int, buf: *const core::ffi::c_void, count: usize) -> isize;
     fn clock_gettime(clock_id: c_int, tp: *mut Timespec) -> c_int;
     #[cfg(target_os = "macos")]
@@ -542,11 +713,59 @@ mod tests {
         assert_eq!(size_of::<Epoch>(), 64);
         assert_eq!(align_of::<Epoch>(), 64);
         assert_eq!(size_of::<StationData>(), 1024);
-        assert_eq!(align_of::<StationData>(), 1024);
+        assert_eq!(align_of::<StationData>(), 64);
         assert_eq!(size_of::<GlobalHeader>(), 1024);
         assert_eq!(align_of::<GlobalHeader>(), 1024);
     }
 
+    fn header(slots: u32, station_size: u32) -> GlobalHeader {
+        let mut header: GlobalHeader = unsafe { std::mem::zeroed() };
+        header.magic_number = MAGIC_NUMBER;
+        header.version = LAYOUT_VERSION;
+        header.max_stations = 2;
+        header.slots_per_station = slots;
+        header.station_size = station_size;
+        header
+    }
+
+    #[test]
+    fn validate_header_checks_magic_before_layout() {
+        let mut foreign = header(3, 512);
+        foreign.magic_number = 0x1234;
+        assert!(matches!(
+            validate_header(&foreign, 1 << 20),
+            Err(InitError::Magic(0x1234))
+        ));
+
+        let mut legacy = header(8, 1024);
+        legacy.version = 1;
+        assert!(matches!(
+            validate_header(&legacy, 1 << 20),
+            Err(InitError::Version(1))
+        ));
+    }
+
+    #[test]
+    fn validate_header_strides_by_slot_count() {
+        let wide = header(12, 1024 + 4 * 64);
+        assert_eq!(validate_header(&wide, 1024 + 2 * 1280).ok(), Some(1280));
+        assert!(matches!(
+            validate_header(&wide, 1024 + 2 * 1280 - 1),
+            Err(InitError::ShortShm { .. })
+        ));
+        assert!(matches!(
+            validate_header(&header(12, 1024), 1 << 20),
+            Err(InitError::StationSize {
+                size: 1024,
+                slots: 12
+            })
+        ));
+        assert!(matches!(
+            validate_header(&header(0, 1024), 1 << 20),
+            Err(InitError::SlotCount(0))
+        ));
+    }
+
     #[test]
     fn traced_future_preserves_poll_semantics() {
         let polls = AtomicUsize::new(0);
@@ -0,0 +1,36 @@
+package engine
+
+import "github.com/lixiasky-back/coroTracer/structure"
+
+// armCanaries writes the canary into every station before the tracee can attach.
+func (e *TracerEngine) armCanaries() {
+	for i := range e.stations {
+		e.stations[i].ArmCanary()
+	}
+}
+
+// checkCanary flags station i the first time its canary is found clobbered. The station
+// keeps being harvested: the Epoch slots sit before the payload area and may still be sound.
+func (e *TracerEngine) checkCanary(i uint32) {
+	if e.corrupted[i].Load() || e.stations[i].CanaryIntact() {
+		return
+	}
+	e.corrupted[i].Store(true)
+	e.stats.corruptions.Add(1)
+	e.log.Error("station canary clobbered: the probe wrote past its payload area and may have corrupted the next station",
+		"station", i, "probe_id", e.stations[i].Header.ProbeID)
+	ts, _ := monotonicNow()
+	e.writeDiag(structure.NewTraceDiag(structure.DiagCanary, ts, int64(i), e.stations[i].Header.ProbeID, 0))
+}
+
+// CorruptedProbes returns the ProbeIDs of the stations whose canary was clobbered,
+// in station order. It is always empty unless EngineOptions.Canary is set.
+func (e *TracerEngine) CorruptedProbes() []uint64 {
+	var probes []uint64
+	for i := range e.corrupted {
+		if e.corrupted[i].Load() {
+			probes = append(probes, e.stations[i].Header.ProbeID)
+		}
+	}
+	return probes
+}
@@ -0,0 +1,20 @@
+//go:build linux
+
+package engine
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const clockMonotonic = 1
+
+// monotonicNow reads CLOCK_MONOTONIC, the clock the C++ and Rust probes stamp "ts" with.
+func monotonicNow() (uint64, bool) {
+	var ts syscall.Timespec
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ts)), 0)
+	if errno != 0 {
+		return 0, false
+	}
+	return uint64(ts.Sec)*1_000_000_000 + uint64(ts.Nsec), true
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package engine
+
+// monotonicNow has no syscall-package route to CLOCK_MONOTONIC outside Linux,
+// so traces recorded there carry no clock anchor.
+func monotonicNow() (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,25 @@
+package engine
+
+import "sync/atomic"
+
+// skipPreexisting moves lastSeen up to every slot's current seq, so the next scan only
+// harvests epochs committed from here on. It covers every station, not just the allocated
+// ones, since a reused or ExistingShm mapping may hold history past AllocatedCount. A write
+// in progress (odd seq) is kept: it commits after the connection.
+func (e *TracerEngine) skipPreexisting() {
+	skipped := 0
+	for i, station := range e.stations {
+		// Under ResetOnBirthChange the current owner is the baseline, not a rebirth
+		e.birthTS[i] = atomic.LoadUint64(&station.Header.BirthTS)
+		for slot := range e.lastSeen[i] {
+			seq := atomic.LoadUint64(&station.Slot(slot).Seq) &^ 1
+			if seq > e.lastSeen[i][slot] {
+				skipped++
+			}
+			e.lastSeen[i][slot] = seq
+		}
+	}
+	if skipped > 0 {
+		e.log.Info("skipped epochs written before the tracee connected", "epochs", skipped)
+	}
+}
@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+// stationOwner identifies the coroutine holding a station; a recycled station gets a new one.
+type stationOwner struct {
+	probeID uint64
+	birthTS uint64
+}
+
+// deathSnapshot is one read of a station's owner and death fields, owner first. An SDK
+// taking over a reclaimed station clears IsDead and DeathTS before it publishes the new
+// owner (see takeOver), so a snapshot that reads the new owner also reads it alive.
+type deathSnapshot struct {
+	owner   stationOwner
+	dead    bool
+	deathTS uint64
+}
+
+func readDeath(station *structure.StationData) deathSnapshot {
+	var snap deathSnapshot
+	snap.owner.probeID = atomic.LoadUint64(&station.Header.ProbeID)
+	snap.owner.birthTS = atomic.LoadUint64(&station.Header.BirthTS)
+	// IsDead is a single byte; load the aligned word it starts and look at that byte
+	word := atomic.LoadUint32((*uint32)(unsafe.Pointer(&station.Header.IsDead)))
+	snap.dead = (*[4]byte)(unsafe.Pointer(&word))[0] != 0
+	snap.deathTS = atomic.LoadUint64(&station.Header.DeathTS)
+	return snap
+}
+
+// storeDead sets IsDead with an atomic store of the word readDeath loads.
+func storeDead(station *structure.StationData, dead bool) {
+	var word uint32
+	if dead {
+		(*[4]byte)(unsafe.Pointer(&word))[0] = 1
+	}
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&station.Header.IsDead)), word)
+}
+
+// finalizeIfDead emits the death record for station i once per owner and hands the
+// station back to the SDK allocator. before must be read ahead of the station's last
+// harvest, so every epoch written before IsDead is already in the trace. The station is
+// read again afterwards and finalized only if the same owner is still there and dead: a
+// station reclaimed and reused in between belongs to a live coroutine.
+func (e *TracerEngine) finalizeIfDead(i uint32, before deathSnapshot) {
+	if !before.dead || e.finalized[i] == before.owner {
+		return
+	}
+	station := e.stations[i]
+	after := readDeath(station)
+	if after.owner != before.owner || !after.dead {
+		return
+	}
+	owner := after.owner
+	e.finalized[i] = owner
+
+	ts, inferred := after.deathTS, false
+	if ts == 0 {
+		ts, _ = monotonicNow()
+		inferred = true
+	}
+	if deaths, ok := e.sink.(structure.DeathSink); ok {
+		if err := deaths.WriteDeath(structure.NewTraceDeath(owner.probeID, ts, inferred)); err != nil {
+			e.log.Warn("failed to record a coroutine death", "probe_id", owner.probeID, "error", err)
+		}
+	}
+	e.stats.deaths.Add(1)
+
+	// Flag first, count second: an SDK that sees the count is guaranteed to find the flag
+	if atomic.CompareAndSwapUint32(&station.Header.Reclaimable, 0, 1) {
+		atomic.AddUint32(&e.header.ReclaimableCount, 1)
+	}
+}
+
+// claimReclaimed takes a station the tracer finalized, the way the SDK allocators do
+// once the bump allocator is exhausted.
+func (e *TracerEngine) claimReclaimed() *structure.StationData {
+	if atomic.LoadUint32(&e.header.ReclaimableCount) == 0 {
+		return nil
+	}
+	for _, station := range e.stations {
+		if atomic.CompareAndSwapUint32(&station.Header.Reclaimable, 1, 0) {
+			atomic.AddUint32(&e.header.ReclaimableCount, ^uint32(0))
+			return station
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+// diagGapWindow is how often lost epochs are summed into gap records, one per station, so
+// a station overrun on every scan does not flood the trace.
+const diagGapWindow = time.Second
+
+// writeDiag records a harvest anomaly in the trace next to the events it affects.
+func (e *TracerEngine) writeDiag(diag structure.TraceDiag) {
+	if e.writer == nil {
+		return
+	}
+	if err := e.writer.WriteDiag(diag); err != nil {
+		e.log.Warn("failed to record a harvest diagnostic", "kind", diag.Kind, "station", diag.Station, "error", err)
+	}
+}
+
+// reportGaps writes a gap record for every station that lost epochs since the last
+// report, at most once per diagGapWindow unless force is set.
+func (e *TracerEngine) reportGaps(force bool) {
+	if !e.gapsPending {
+		return
+	}
+	now := time.Now()
+	if !force && now.Sub(e.gapsReported) < diagGapWindow {
+		return
+	}
+	e.gapsPending, e.gapsReported = false, now
+
+	ts, _ := monotonicNow()
+	for i, lost := range e.gaps {
+		if lost == 0 {
+			continue
+		}
+		e.writeDiag(structure.NewTraceDiag(structure.DiagGap, ts, int64(i), e.stations[i].Header.ProbeID, lost))
+		e.gaps[i] = 0
+	}
+}
+
+// checkMagic notices the GlobalHeader being overwritten, e.g. by a tracee writing through
+// a stale pointer or initialising the mapping again. Harvesting goes on, but the stations
+// may no longer hold what the header promised. It is reported once.
+func (e *TracerEngine) checkMagic() {
+	magic := atomic.LoadUint64(&e.header.MagicNum)
+	if e.magicLost || magic == shmMagic {
+		return
+	}
+	e.magicLost = true
+	e.log.Error("shm header magic changed under the tracer: the tracee overwrote the header, later events may be garbage",
+		"magic", fmt.Sprintf("%#x", magic))
+	ts, _ := monotonicNow()
+	e.writeDiag(structure.NewTraceDiag(structure.DiagMagic, ts, -1, 0, 0))
+}
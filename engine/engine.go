@@ -1,9 +1,13 @@
 package engine
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"os"
+	"runtime"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -14,124 +18,505 @@ import (
 
 const (
 	// 🔴 Core fix: Must be absolutely consistent with structure.GlobalHeader and occupy a full 1KB!
-	HeaderSize  = 1024
+	HeaderSize = 1024
+	// StationSize is the stride of a station with up to 8 slots; more slots widen it,
+	// see structure.StationSizeFor.
 	StationSize = 1024
 )
 
 type TracerEngine struct {
 	shmFile  *os.File
+	shmPath  string // Removed by Close under CleanupRemove
 	mmapData []byte
 
 	// Memory-mapped pointer (black magic zero-copy)
 	header   *structure.GlobalHeader
-	stations []structure.StationData
+	stations []*structure.StationData // GlobalHeader.StationSize bytes apart
 
-	writer   *structure.StationWriter
+	writer   *structure.StationWriter // nil when the trace goes only to options.Sink
+	sink     structure.EventSink
+	tids     *tidCounter // nil unless options.TrackTIDs
+	log      *slog.Logger
+	sampled  structure.EventSink // sink behind the sampling filter, nil unless options.SampleEvery > 1 or MaxWriteRate is set
+	throttle *throttleSink       // The sampling filter when MaxWriteRate is set
+	recorder *flightRecorder     // nil unless options.FlightRecorder > 0
 	listener net.Listener
 
 	maxStations uint32
-	lastSeen    [][8]uint64
+	lastSeen    [][]uint64     // SlotsPerStation seqs per station
+	seenBefore  []uint64       // Scratch copy of one station's lastSeen for countDropped
+	birthTS     []uint64       // Last BirthTS seen per station, kept only under ResetOnBirthChange
+	finalized   []stationOwner // Owner whose death was last recorded per station, under DeathEvents
+	corrupted   []atomic.Bool  // Stations whose canary was found clobbered, under Canary
+
+	// Harvest diagnostics (see diag.go), owned by the harvest goroutine
+	gaps         []uint64 // Epochs lost per station since the last gap record
+	gapsPending  bool
+	gapsReported time.Time
+	magicLost    bool
+
+	options EngineOptions
+	stats   engineStats
+	failure writeFailure // Owned by the harvest goroutine
+	// fatalErr ends Run once the output has failed for longer than WriteErrorTimeout
+	fatalErr error
+
+	// Shutdown handshake between Stop/Close and the Run goroutine
+	running  atomic.Bool
+	stopping atomic.Bool
+	flushDue atomic.Bool // Set by the flush ticker, acted on by the harvest goroutine
+	paused   atomic.Bool // See Pause
+	stopOnce sync.Once
+	closed   sync.Once // Close releases everything once; main calls it explicitly and deferred
+	done     chan struct{}
+
+	// Readers of the shm outside the harvest goroutine (metric scrapes) hold unmapMu for
+	// reading; Close holds it to unmap, so a scrape never touches a released mapping.
+	unmapMu  sync.RWMutex
+	unmapped bool
+
+	exhaustedAt   atomic.Uint64 // See PoolExhaustedAt
+	throttleEvery atomic.Uint64 // See ThrottleSampleEvery
 }
 
 // NewTracerEngine initializes shared memory, Socket, and log files
 func NewTracerEngine(stationCount uint32, shmPath, sockPath, logPath string) (*TracerEngine, error) {
+	return NewTracerEngineWithOptions(stationCount, shmPath, sockPath, logPath, EngineOptions{})
+}
+
+// NewTracerEngineWithOptions is NewTracerEngine with explicit tuning knobs.
+func NewTracerEngineWithOptions(stationCount uint32, shmPath, sockPath, logPath string, options EngineOptions) (*TracerEngine, error) {
+	if options.SlotsPerStation < 0 || options.SlotsPerStation > structure.MaxSlotsPerStation {
+		return nil, fmt.Errorf("slots per station must be between 1 and %d, got %d", structure.MaxSlotsPerStation, options.SlotsPerStation)
+	}
+	if options.SampleEvery < 0 {
+		return nil, fmt.Errorf("sample rate must be positive, got %d", options.SampleEvery)
+	}
+	if options.WakeupBufferSize < 0 {
+		return nil, fmt.Errorf("wakeup buffer size must not be negative, got %d", options.WakeupBufferSize)
+	}
+	if options.MaxWriteRate < 0 {
+		return nil, fmt.Errorf("max write rate must not be negative, got %g", options.MaxWriteRate)
+	}
+	if options.FlightRecorder < 0 {
+		return nil, fmt.Errorf("flight recorder size must not be negative, got %d", options.FlightRecorder)
+	}
+	if err := structure.CheckLayout(); err != nil {
+		return nil, err
+	}
+	options = options.withDefaults()
+	logger := options.Logger
+
+	// 1. Create a shared memory file, or open the one set up by the tracee's side
+	var f *os.File
+	var existing existingLayout
+	var err error
+	if options.ExistingShm {
+		if f, err = os.OpenFile(shmPath, os.O_RDWR, 0); err != nil {
+			return nil, err
+		}
+		if existing, err = readExistingLayout(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("shm %s: %w", shmPath, err)
+		}
+		// The header owns the layout; -n and -slots give way to it
+		stationCount, options.SlotsPerStation = existing.stations, existing.slots
+		logger.Info("mapping existing shm", "shm", shmPath, "stations", stationCount, "slots", existing.slots, "bytes", existing.size)
+	} else {
+		os.Remove(shmPath)
+		if f, err = os.OpenFile(shmPath, os.O_CREATE|os.O_RDWR, 0666); err != nil {
+			return nil, err
+		}
+	}
+
+	// Undo whatever was acquired when construction fails part-way, so a failed start
+	// leaves no mapping, listener or freshly created shm file behind
+	var (
+		mmapData []byte
+		listener net.Listener
+		writer   *structure.StationWriter
+		built    bool
+	)
+	defer func() {
+		if built {
+			return
+		}
+		if writer != nil {
+			writer.Abandon()
+		}
+		if listener != nil {
+			listener.Close()
+		}
+		if mmapData != nil {
+			syscall.Munmap(mmapData)
+		}
+		f.Close()
+		if !options.ExistingShm {
+			os.Remove(shmPath)
+		}
+	}()
+
 	// Dynamically calculate the total memory size
-	memSize := HeaderSize + (int(stationCount) * StationSize)
+	memSize := int(MappingSize(stationCount, options.SlotsPerStation))
 
-	os.Remove(shmPath)
-	// 1. Create a shared memory file and truncate it to the exact memSize
-	f, err := os.OpenFile(shmPath, os.O_CREATE|os.O_RDWR, 0666)
+	// A disk-backed file silently defeats the zero-copy premise: every probe write becomes writeback traffic
+	fsName, inMemory, err := shmFilesystem(f)
 	if err != nil {
-		return nil, err
+		logger.Warn("could not determine the shm filesystem", "shm", shmPath, "error", err)
+	} else if !inMemory {
+		if options.StrictShmFS {
+			return nil, fmt.Errorf("shm file %s is on a %s filesystem, not tmpfs/ramfs/hugetlbfs", shmPath, fsName)
+		}
+		logger.Warn("shm file is not on tmpfs; expect latency spikes, prefer /dev/shm", "shm", shmPath, "fs", fsName)
+	}
+
+	// hugetlbfs only accepts whole huge pages; the tail past memSize is simply unused
+	mapSize := memSize
+	if options.HugePages {
+		mapSize = hugePageMapSize(fsName, memSize)
 	}
-	if err := f.Truncate(int64(memSize)); err != nil {
+
+	if options.ExistingShm {
+		// Never truncate a mapping someone else owns: it may be larger than the stations need
+		mapSize = existing.size
+	} else if err := f.Truncate(int64(mapSize)); err != nil {
 		return nil, err
 	}
 
 	// 2. Mmap mapping
-	mmapData, err := syscall.Mmap(int(f.Fd()), 0, memSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	mmapData, err = syscall.Mmap(int(f.Fd()), 0, mapSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
 	if err != nil {
+		mmapData = nil
 		return nil, err
 	}
+	if options.HugePages {
+		logger.Info("huge pages", "path", adviseHugePages(mmapData, fsName))
+	}
+	if options.Mlock {
+		// Keep the probe path fault-free: a swapped-out station turns a store into a disk read
+		if err := syscall.Mlock(mmapData); err != nil {
+			logger.Warn("mlock of the shm mapping failed, continuing unlocked; raise the locked-memory limit (ulimit -l, or LimitMEMLOCK= under systemd) or grant CAP_IPC_LOCK",
+				"bytes", len(mmapData), "error", err)
+		} else {
+			logger.Info("shm mapping locked in RAM", "bytes", len(mmapData))
+		}
+	}
 
 	// 3. Struct forced conversion (GlobalHeader is now 1024 bytes)
 	header := (*structure.GlobalHeader)(unsafe.Pointer(&mmapData[0]))
-	header.MagicNum = 0x434F524F54524352
-	header.Version = 1
-	header.MaxStations = stationCount
-	atomic.StoreUint32(&header.AllocatedCount, 0)
+	if !options.ExistingShm {
+		header.MagicNum = shmMagic
+		header.Version = structure.LayoutVersion
+		header.MaxStations = stationCount
+		header.StationSize = uint32(structure.StationSizeFor(options.SlotsPerStation))
+		header.SlotsPerStation = uint32(options.SlotsPerStation)
+		atomic.StoreUint32(&header.AllocatedCount, 0)
+	}
 	atomic.StoreUint32(&header.TracerSleeping, 0)
 
-	// 🔴 Dynamic slice mapping: Perfectly skip the 1024-byte Header and accurately target Station[0]
-	stations := unsafe.Slice((*structure.StationData)(unsafe.Pointer(&mmapData[HeaderSize])), stationCount)
-
-	// 4. Create UDS Socket
-	os.Remove(sockPath)
-	listener, err := net.Listen("unix", sockPath)
-	if err != nil {
-		return nil, fmt.Errorf("listen uds failed: %v", err)
+	// 🔴 Dynamic mapping: Perfectly skip the 1024-byte Header and step by the negotiated station size
+	stride := structure.StationSizeFor(options.SlotsPerStation)
+	stations := make([]*structure.StationData, stationCount)
+	for i := range stations {
+		stations[i] = (*structure.StationData)(unsafe.Pointer(&mmapData[HeaderSize+i*stride]))
+	}
+	seqs := make([]uint64, int(stationCount)*options.SlotsPerStation)
+	lastSeen := make([][]uint64, stationCount)
+	for i := range lastSeen {
+		lastSeen[i] = seqs[i*options.SlotsPerStation : (i+1)*options.SlotsPerStation : (i+1)*options.SlotsPerStation]
 	}
 
-	// 5. Initialize the log writer
-	writer, err := structure.NewStationWriter(logPath)
+	// 4. Create the wakeup socket (UDS, abstract or TCP)
+	listener, err = listenWakeup(sockPath)
 	if err != nil {
 		return nil, err
 	}
 
-	return &TracerEngine{
+	// 5. Initialize the log writer. An embedder with its own sink may skip the file entirely.
+	var sink structure.EventSink
+	if logPath != "" || options.Sink == nil {
+		encoder := traceEncoder(logPath, options)
+		if options.PartialOutput {
+			writer, err = structure.NewPartialStationWriterWithEncoder(logPath, encoder)
+		} else {
+			writer, err = structure.NewStationWriterWithEncoder(logPath, encoder)
+		}
+		if err != nil {
+			writer = nil
+			return nil, err
+		}
+		if options.Index {
+			if err := writer.EnableIndex(); err != nil {
+				return nil, fmt.Errorf("create trace index: %w", err)
+			}
+		}
+		// Anchor the probes' monotonic "ts" to the wall clock so traces can be correlated with logs
+		monoNS, _ := monotonicNow()
+		meta := structure.NewTraceMeta(monoNS, time.Now().UnixNano())
+		if options.SampleEvery > 1 {
+			meta.SampleEvery = uint32(options.SampleEvery)
+		}
+		if options.SlotsPerStation > structure.BaseSlotsPerStation {
+			meta.SlotsPerStation = uint32(options.SlotsPerStation)
+		}
+		if err := writer.WriteMeta(meta); err != nil {
+			return nil, err
+		}
+		sink = writer
+	}
+	switch {
+	case options.Sink == nil:
+	case sink == nil:
+		sink = options.Sink
+	default:
+		sink = structure.MultiSink(writer, options.Sink)
+	}
+	var tids *tidCounter
+	if options.TrackTIDs {
+		tids = newTIDCounter()
+		sink = structure.MultiSink(sink, tids)
+	}
+
+	e := &TracerEngine{
 		shmFile:     f,
+		shmPath:     shmPath,
 		mmapData:    mmapData,
 		header:      header,
 		stations:    stations,
 		writer:      writer,
+		sink:        sink,
+		tids:        tids,
+		log:         logger,
 		listener:    listener,
 		maxStations: stationCount,
-		lastSeen:    make([][8]uint64, stationCount),
-	}, nil
+		lastSeen:    lastSeen,
+		seenBefore:  make([]uint64, options.SlotsPerStation),
+		birthTS:     make([]uint64, stationCount),
+		gaps:        make([]uint64, stationCount),
+		finalized:   make([]stationOwner, stationCount),
+		corrupted:   make([]atomic.Bool, stationCount),
+		options:     options,
+		done:        make(chan struct{}),
+	}
+	if options.Canary {
+		e.armCanaries()
+	}
+	switch {
+	case options.MaxWriteRate > 0:
+		e.throttle = newThrottleSink(options.MaxWriteRate, uint64(max(options.SampleEvery, 1)), sink)
+		e.throttleEvery.Store(e.throttle.every)
+		e.sampled = e.throttle
+	case options.SampleEvery > 1:
+		e.sampled = sampleSink{every: uint64(options.SampleEvery), sink: sink}
+	}
+	if options.FlightRecorder > 0 {
+		e.recorder = newFlightRecorder(options.FlightRecorder)
+	}
+	built = true
+	return e, nil
+}
+
+// traceEncoder picks the encoder from the log extension, applying MinimalHex to JSONL and
+// RecordSlot to both encodings.
+func traceEncoder(logPath string, options EngineOptions) structure.EventEncoder {
+	switch encoder := structure.EncoderForPath(logPath).(type) {
+	case structure.JSONLEncoder:
+		return structure.JSONLEncoder{MinimalHex: options.MinimalHex, Slot: options.RecordSlot}
+	case *structure.BinaryEncoder:
+		encoder.Slot = options.RecordSlot
+		return encoder
+	default:
+		return encoder
+	}
 }
 
 func (e *TracerEngine) Run() error {
-	fmt.Println("Tracer Engine listening on UDS...")
-	wakeBuf := make([]byte, 1024)
+	e.running.Store(true)
+	defer close(e.done)
+
+	if e.options.FlushInterval > 0 {
+		stopTicker := make(chan struct{})
+		defer close(stopTicker)
+		go e.flushTicker(e.options.FlushInterval, stopTicker)
+	}
+
+	e.log.Info("tracer engine listening", "sock", e.SockPath())
+	wakeBuf := make([]byte, e.options.WakeupBufferSize)
 
 	for {
-		conn, err := e.listener.Accept()
-		if err != nil {
-			fmt.Printf("Accept error: %v\n", err)
+		conn, err := e.acceptWakeup()
+		if err != nil || conn == nil {
+			if e.stopping.Load() {
+				return nil
+			}
+			if err != nil {
+				e.log.Error("accept failed", "error", err)
+			}
 			continue
 		}
-		fmt.Println("Tracee connected! Entering hot loop.")
+		if e.options.ColdStart == ColdStartSkip {
+			e.skipPreexisting()
+		}
+		e.stats.connections.Add(1)
+		e.log.Info("tracee connected, entering hot loop")
 
 		e.hotHarvestLoop(conn, wakeBuf)
 
-		fmt.Println("Tracee disconnected. Waiting for next connection...")
 		conn.Close()
+		if e.fatalErr != nil {
+			return e.fatalErr
+		}
+		if e.stopping.Load() {
+			return nil
+		}
+		e.log.Info("tracee disconnected, waiting for the next connection")
+	}
+}
+
+// Stop asks Run to finish: the hot loop does a last scan, flushes, and Run returns.
+// It blocks until that has happened, so the mapping can be torn down safely afterwards.
+func (e *TracerEngine) Stop() {
+	e.stopOnce.Do(func() {
+		e.stopping.Store(true)
+		if e.listener != nil {
+			e.listener.Close()
+		}
+	})
+	if e.running.Load() {
+		<-e.done
 	}
 }
 
 func (e *TracerEngine) doScan() int {
 	totalHarvested := 0
 	allocated := atomic.LoadUint32(&e.header.AllocatedCount)
+	e.checkThrottle()
+	e.checkMagic()
+	sink, paused := e.scanSink()
+	e.checkSaturation(allocated)
 
 	if allocated > e.maxStations {
 		allocated = e.maxStations
 	}
 
 	for i := uint32(0); i < allocated; i++ {
-		totalHarvested += e.stations[i].Harvest(&e.lastSeen[i], e.writer)
+		if e.options.StationReset == ResetOnBirthChange {
+			e.rearmIfReborn(i)
+		}
+		var death deathSnapshot
+		if e.options.DeathEvents {
+			death = readDeath(e.stations[i])
+		}
+		before := e.seenBefore
+		copy(before, e.lastSeen[i])
+		harvested, err := e.stations[i].HarvestSlots(e.lastSeen[i], sink)
+		if harvested > 0 {
+			e.countDropped(i, before, e.lastSeen[i], harvested)
+		}
+		totalHarvested += harvested
+		if err != nil {
+			// Leave the rest in shared memory: it is still intact if the sink recovers soon
+			e.noteWriteError(err)
+			break
+		}
+		e.finalizeIfDead(i, death)
+		if e.options.Canary {
+			e.checkCanary(i)
+		}
+	}
+	e.reportGaps(false)
+	switch {
+	case totalHarvested == 0:
+	case paused:
+		e.stats.skipped.Add(uint64(totalHarvested))
+	default:
+		e.stats.events.Add(uint64(totalHarvested))
 	}
 	return totalHarvested
 }
 
+// countDropped infers overwritten epochs from how far the per-slot seqs moved:
+// every committed write adds 2, so a slot that advanced by 2k carried k events,
+// of which only the newest could be harvested. Losses are also queued for station i's
+// next gap record.
+func (e *TracerEngine) countDropped(i uint32, before, after []uint64, harvested int) {
+	var written uint64
+	for slot := range after {
+		if after[slot] > before[slot] {
+			written += (after[slot] - before[slot]) / 2
+		}
+	}
+	if written > uint64(harvested) {
+		e.stats.dropped.Add(written - uint64(harvested))
+		e.gaps[i] += written - uint64(harvested)
+		e.gapsPending = true
+	}
+}
+
+// rearmIfReborn resets lastSeen for the slots of station i that a new owner has restarted.
+func (e *TracerEngine) rearmIfReborn(i uint32) {
+	station := e.stations[i]
+	birth := atomic.LoadUint64(&station.Header.BirthTS)
+	if birth == e.birthTS[i] {
+		return
+	}
+	e.birthTS[i] = birth
+
+	lastSeen := e.lastSeen[i]
+	for slot := range lastSeen {
+		// A live owner's seq only grows, so going backwards means the counter restarted
+		if atomic.LoadUint64(&station.Slot(slot).Seq) < lastSeen[slot] {
+			lastSeen[slot] = 0
+		}
+	}
+}
+
 func (e *TracerEngine) hotHarvestLoop(conn net.Conn, wakeBuf []byte) {
+	justWoke := false
+	idleScans := 0
+	idle := newIdleWatch(e.options.IdleWarning, time.Now())
 	for {
+		if e.stopping.Load() {
+			e.doScan()
+			e.flush()
+			return
+		}
+
+		if e.failure.err != nil && !e.retryWrites() {
+			if e.writeFailureExpired() {
+				e.fatalErr = fmt.Errorf("trace output failing for %s: %w", time.Since(e.failure.since).Round(time.Second), e.failure.err)
+				return
+			}
+			continue
+		}
+
 		harvested := e.doScan()
 
+		if justWoke {
+			justWoke = false
+			if harvested == 0 {
+				// The doorbell rang but the double-check scan had already taken the data
+				e.stats.spuriousWakeups.Add(1)
+			}
+		}
+
 		if harvested > 0 {
+			idleScans = 0
+			idle.active = true
+			if e.flushDue.Load() {
+				// Sustained load never reaches the flush before sleeping below
+				e.flushDue.Store(false)
+				e.flush()
+			}
 			continue
 		}
 
-		e.writer.Flush()
+		idleScans++
+		if e.backoff(idleScans) {
+			continue
+		}
+
+		e.flush()
 		atomic.StoreUint32(&e.header.TracerSleeping, 1)
 
 		if e.doScan() > 0 {
@@ -144,35 +529,175 @@ func (e *TracerEngine) hotHarvestLoop(conn net.Conn, wakeBuf []byte) {
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				// Just wake up after timeout and continue the next round of cyclic scanning
+				if idleFor, warn := idle.check(time.Now()); warn {
+					e.log.Warn("tracee idle: connection open but no events; it may just be quiet, or wedged", "idle", idleFor.Round(time.Second))
+				}
 				continue
 			}
 			// Non-timeout error, indicating that Tracee has disconnected or is abnormal.
 			e.doScan()
-			e.writer.Flush()
+			e.flush()
 			return
 		}
 
 		if n == 0 {
 			e.doScan()
-			e.writer.Flush()
+			e.flush()
 			return
 		}
 
+		// The probe may have rung several times while we slept. Soak up the whole
+		// backlog now, otherwise the leftovers cause an immediate spurious wakeup next cycle.
+		drained, closed := drainWakeups(conn, wakeBuf)
+		e.stats.wakeups.Add(1)
+		e.stats.wakeupBytes.Add(uint64(n + drained))
+
 		atomic.StoreUint32(&e.header.TracerSleeping, 0)
+
+		if closed {
+			e.doScan()
+			e.flush()
+			return
+		}
+		justWoke = true
+		idleScans = 0
+		idle.active = true
 	}
 }
 
+// idleWatch times how long the tracee has been silent. The hot path only sets active;
+// the clock is read on the 50ms wait timeouts, which keeps time.Now off the harvest path.
+type idleWatch struct {
+	threshold    time.Duration
+	active       bool
+	lastActivity time.Time
+	nextWarn     time.Duration
+}
+
+func newIdleWatch(threshold time.Duration, now time.Time) idleWatch {
+	return idleWatch{threshold: threshold, lastActivity: now, nextWarn: threshold}
+}
+
+// check reports how long the tracee has been idle and whether a warning is due.
+// Warnings repeat every threshold while the silence lasts.
+func (w *idleWatch) check(now time.Time) (time.Duration, bool) {
+	if w.threshold <= 0 {
+		return 0, false
+	}
+	if w.active {
+		w.active = false
+		w.lastActivity = now
+		w.nextWarn = w.threshold
+		return 0, false
+	}
+	idleFor := now.Sub(w.lastActivity)
+	if idleFor < w.nextWarn {
+		return idleFor, false
+	}
+	w.nextWarn += w.threshold
+	return idleFor, true
+}
+
+// backoff decides what to do after the idleScans-th consecutive empty scan.
+// It returns false once the budget is spent and the caller should arm the UDS wait.
+// The double-check before sleeping is left to the caller, so no wakeup can be lost here.
+func (e *TracerEngine) backoff(idleScans int) bool {
+	o := &e.options
+	switch {
+	case idleScans <= o.SpinScans:
+		return true
+	case idleScans <= o.SpinScans+o.YieldScans:
+		runtime.Gosched()
+		return true
+	case idleScans <= o.SpinScans+o.YieldScans+o.SleepScans:
+		time.Sleep(o.BackoffSleep)
+		return true
+	}
+	return false
+}
+
+// drainWakeups consumes every doorbell byte already queued on conn without blocking.
+// It reports how many bytes were drained and whether the peer closed the connection meanwhile.
+func drainWakeups(conn net.Conn, buf []byte) (drained int, closed bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	rc.Read(func(fd uintptr) bool {
+		for {
+			// The runtime keeps the fd non-blocking, so EAGAIN ends the loop
+			n, err := syscall.Read(int(fd), buf)
+			if n > 0 {
+				drained += n
+				continue
+			}
+			if n == 0 && err == nil {
+				closed = true
+			}
+			return true
+		}
+	})
+	return drained, closed
+}
+
+// flushTicker requests a flush every interval. The writer is owned by the harvest
+// goroutine, so the ticker only raises a flag instead of touching it.
+func (e *TracerEngine) flushTicker(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.flushDue.Store(true)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// flush pushes buffered output to the trace file, if there is one.
+func (e *TracerEngine) flush() {
+	if e.writer == nil {
+		return
+	}
+	if err := e.writer.Flush(); err != nil {
+		e.noteWriteError(err)
+	}
+}
+
+// Close stops the harvester (draining what is left) and releases every resource.
+// Later calls do nothing.
 func (e *TracerEngine) Close() {
+	e.closed.Do(e.close)
+}
+
+func (e *TracerEngine) close() {
+	e.Stop()
 	if e.writer != nil {
-		e.writer.Close()
-	}
-	if e.listener != nil {
-		e.listener.Close()
+		// The harvest goroutine is done; gaps from its last window still belong in the trace
+		e.reportGaps(true)
+		if err := e.writer.Close(); err != nil {
+			e.log.Error("closing the trace file failed", "error", err)
+		}
 	}
 	if e.mmapData != nil {
+		e.unmapMu.Lock()
+		e.unmapped = true
 		syscall.Munmap(e.mmapData)
+		e.unmapMu.Unlock()
 	}
 	if e.shmFile != nil {
 		e.shmFile.Close()
 	}
+	// A shm mapped with ExistingShm belongs to the tracee's side, whatever the policy
+	if e.options.Cleanup == CleanupRemove && !e.options.ExistingShm && e.shmPath != "" {
+		if err := os.Remove(e.shmPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			e.log.Warn("removing the shm file failed", "shm", e.shmPath, "error", err)
+		}
+		e.shmPath = ""
+	}
 }
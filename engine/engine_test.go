@@ -2,10 +2,23 @@ package engine
 
 import (
 	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // ─── Helpers ──────────────────────────────────────────────────────────────────
@@ -47,6 +60,29 @@ func TestHeaderAndStationSizeConstants(t *testing.T) {
 	}
 }
 
+func TestMappingSizeMatchesShmFile(t *testing.T) {
+	eng, _ := newEngine(t, 64)
+	if got := MappingSize(64, 0); got != int64(len(eng.mmapData)) {
+		t.Errorf("MappingSize(64, 0) = %d, mapped %d", got, len(eng.mmapData))
+	}
+}
+
+func TestEstimateFootprintUsesTheTraceEncoder(t *testing.T) {
+	jsonl := EstimateFootprint(10, "trace.jsonl", EngineOptions{}, 1000, 2*time.Second)
+	if jsonl.MappingBytes != HeaderSize+10*StationSize || jsonl.Events != 2000 {
+		t.Errorf("estimate = %+v", jsonl)
+	}
+	if jsonl.TraceBytes != jsonl.Events*jsonl.EventBytes {
+		t.Errorf("TraceBytes %d != %d events x %d B", jsonl.TraceBytes, jsonl.Events, jsonl.EventBytes)
+	}
+	compact := EstimateFootprint(10, "trace.jsonl", EngineOptions{MinimalHex: true}, 1000, 2*time.Second)
+	binary := EstimateFootprint(10, "trace.pb", EngineOptions{}, 1000, 2*time.Second)
+	if !(binary.EventBytes < compact.EventBytes && compact.EventBytes < jsonl.EventBytes) {
+		t.Errorf("event sizes binary %d, min-hex %d, jsonl %d; want increasing",
+			binary.EventBytes, compact.EventBytes, jsonl.EventBytes)
+	}
+}
+
 // ─── NewTracerEngine ──────────────────────────────────────────────────────────
 
 func TestNewTracerEngineHeaderMagic(t *testing.T) {
@@ -59,8 +95,8 @@ func TestNewTracerEngineHeaderMagic(t *testing.T) {
 
 func TestNewTracerEngineHeaderVersion(t *testing.T) {
 	eng, _ := newEngine(t, 8)
-	if eng.header.Version != 1 {
-		t.Errorf("version = %d, want 1", eng.header.Version)
+	if eng.header.Version != structure.LayoutVersion {
+		t.Errorf("version = %d, want %d", eng.header.Version, structure.LayoutVersion)
 	}
 }
 
@@ -72,6 +108,48 @@ func TestNewTracerEngineHeaderMaxStations(t *testing.T) {
 	}
 }
 
+func TestNewTracerEngineHeaderLayoutFields(t *testing.T) {
+	eng, _ := newEngine(t, 4)
+	if eng.header.StationSize != StationSize || eng.header.SlotsPerStation != 8 {
+		t.Errorf("station_size = %d, slots_per_station = %d; want %d, 8",
+			eng.header.StationSize, eng.header.SlotsPerStation, StationSize)
+	}
+}
+
+func TestNewTracerEngineWidensStationsPastEightSlots(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	eng, err := NewTracerEngineWithOptions(3, shm, sock, log, EngineOptions{SlotsPerStation: 16})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	t.Cleanup(eng.Close)
+
+	if eng.header.StationSize != 1024+8*64 || eng.header.SlotsPerStation != 16 {
+		t.Errorf("station_size = %d, slots_per_station = %d; want %d, 16",
+			eng.header.StationSize, eng.header.SlotsPerStation, 1024+8*64)
+	}
+	if len(eng.mmapData) != int(MappingSize(3, 16)) || MappingSize(3, 16) != HeaderSize+3*(1024+8*64) {
+		t.Errorf("mapped %d bytes, MappingSize(3, 16) = %d", len(eng.mmapData), MappingSize(3, 16))
+	}
+	eng.Close()
+	meta, err := os.ReadFile(log)
+	if err != nil || !strings.Contains(string(meta), `"slots_per_station":16`) {
+		t.Errorf("trace meta = %q (%v), want slots_per_station recorded", meta, err)
+	}
+}
+
+func TestNewTracerEngineRejectsBadSlotCount(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	for _, slots := range []int{-1, structure.MaxSlotsPerStation + 1} {
+		if eng, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{SlotsPerStation: slots}); err == nil {
+			eng.Close()
+			t.Errorf("SlotsPerStation %d accepted", slots)
+		}
+	}
+}
+
 func TestNewTracerEngineHeaderAllocatedZero(t *testing.T) {
 	eng, _ := newEngine(t, 16)
 	got := atomic.LoadUint32(&eng.header.AllocatedCount)
@@ -145,18 +223,199 @@ func TestNewTracerEngineMinimalStations(t *testing.T) {
 	}
 }
 
+// ─── Existing shm ─────────────────────────────────────────────────────────────
+
+// writeShmHeader writes a shm file of size bytes holding header, as an init container would.
+func writeShmHeader(t *testing.T, path string, header structure.GlobalHeader, size int) {
+	t.Helper()
+	data := make([]byte, size)
+	copy(data, unsafe.Slice((*byte)(unsafe.Pointer(&header)), HeaderSize))
+	if err := os.WriteFile(path, data, 0o666); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+func TestExistingShmKeepsHeaderAndSize(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	size := int(MappingSize(6, 4)) + 4096 // Larger than the stations need
+	writeShmHeader(t, shm, structure.GlobalHeader{
+		MagicNum: shmMagic, Version: structure.LayoutVersion, MaxStations: 6, StationSize: StationSize,
+		SlotsPerStation: 4, AllocatedCount: 3, TracerSleeping: 1,
+	}, size)
+
+	eng, err := NewTracerEngineWithOptions(99, shm, sock, log, EngineOptions{ExistingShm: true})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	t.Cleanup(eng.Close)
+
+	if eng.MaxStations() != 6 || len(eng.stations) != 6 || eng.options.SlotsPerStation != 4 {
+		t.Errorf("stations %d (%d mapped), slots %d; want 6 and 4 from the header",
+			eng.MaxStations(), len(eng.stations), eng.options.SlotsPerStation)
+	}
+	if eng.header.AllocatedCount != 3 || eng.header.SlotsPerStation != 4 || eng.header.TracerSleeping != 0 {
+		t.Errorf("header = %+v, want allocations kept and TracerSleeping cleared", *eng.header)
+	}
+	if info, err := os.Stat(shm); err != nil || info.Size() != int64(size) {
+		t.Errorf("shm size after attaching = %v (%v), want %d", info.Size(), err, size)
+	}
+}
+
+// eightSlotHeader is a GlobalHeader for n stations of the default layout.
+func eightSlotHeader(n uint32) structure.GlobalHeader {
+	return structure.GlobalHeader{
+		MagicNum: shmMagic, Version: structure.LayoutVersion, MaxStations: n,
+		StationSize: StationSize, SlotsPerStation: structure.BaseSlotsPerStation,
+	}
+}
+
+func TestFakeProbeOnExistingShmWithWideStations(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	const slots = 12
+	writeShmHeader(t, shm, structure.GlobalHeader{
+		MagicNum: shmMagic, Version: structure.LayoutVersion, MaxStations: 2,
+		StationSize: uint32(structure.StationSizeFor(slots)), SlotsPerStation: slots,
+	}, int(MappingSize(2, slots)))
+	eng, err := NewTracerEngineWithOptions(2, shm, sock, log, EngineOptions{ExistingShm: true})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	t.Cleanup(eng.Close)
+
+	if _, err := eng.NewFakeProbe(1, 1); err != nil {
+		t.Fatalf("NewFakeProbe: %v", err)
+	}
+	probe, err := eng.NewFakeProbe(2, 1)
+	if err != nil {
+		t.Fatalf("NewFakeProbe: %v", err)
+	}
+	for ts := uint64(1); ts <= slots+1; ts++ {
+		probe.Write(1, 0, true, ts)
+	}
+	if probe.station.Slot(0).Timestamp != slots+1 || probe.station.Slot(slots-1).Timestamp != slots {
+		t.Errorf("writes did not cycle through all %d slots", slots)
+	}
+	// The second station starts one negotiated stride after the first
+	if got := uintptr(unsafe.Pointer(eng.stations[1])) - uintptr(unsafe.Pointer(eng.stations[0])); got != uintptr(structure.StationSizeFor(slots)) {
+		t.Errorf("station stride = %d, want %d", got, structure.StationSizeFor(slots))
+	}
+	if n, err := eng.DrainOnce(); err != nil || n != slots {
+		t.Errorf("DrainOnce = %d, %v; want all %d slots of the second station", n, err, slots)
+	}
+}
+
+func TestExistingShmRejectsBadHeaders(t *testing.T) {
+	valid := eightSlotHeader(4)
+	legacy := valid
+	legacy.Version = 1
+	narrow := valid
+	narrow.SlotsPerStation = 12 // Needs wider stations than StationSize
+	noSlots := valid
+	noSlots.SlotsPerStation = 0
+	for _, tc := range []struct {
+		name   string
+		header structure.GlobalHeader
+		size   int
+	}{
+		{"uninitialised", structure.GlobalHeader{}, int(MappingSize(4, 8))},
+		{"short file", valid, int(MappingSize(3, 8))},
+		{"layout version", legacy, int(MappingSize(4, 8))},
+		{"station size", narrow, int(MappingSize(4, 12))},
+		{"no slots", noSlots, int(MappingSize(4, 8))},
+		{"header only", valid, HeaderSize - 1},
+	} {
+		shm, sock, log, cleanup := tempPaths(t)
+		writeShmHeader(t, shm, tc.header, max(tc.size, HeaderSize))
+		if tc.size < HeaderSize {
+			os.Truncate(shm, int64(tc.size))
+		}
+		eng, err := NewTracerEngineWithOptions(4, shm, sock, log, EngineOptions{ExistingShm: true})
+		if err == nil {
+			eng.Close()
+			t.Errorf("%s: expected an error", tc.name)
+		}
+		cleanup()
+	}
+
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	if _, err := NewTracerEngineWithOptions(4, shm, sock, log, EngineOptions{ExistingShm: true}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing shm: error = %v, want ErrNotExist", err)
+	}
+}
+
 // ─── Close ────────────────────────────────────────────────────────────────────
 
 func TestCloseIsIdempotent(t *testing.T) {
 	shm, sock, log, cleanup := tempPaths(t)
 	t.Cleanup(cleanup)
 
-	eng, err := NewTracerEngine(4, shm, sock, log)
+	var buf strings.Builder
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelError}))
+	eng, err := NewTracerEngineWithOptions(4, shm, sock, log, EngineOptions{Logger: logger})
 	if err != nil {
-		t.Fatalf("NewTracerEngine: %v", err)
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
 	}
 	eng.Close()
-	eng.Close() // must not panic
+	eng.Close() // must not panic, nor close the trace or unmap the shm twice
+	if buf.Len() != 0 {
+		t.Errorf("second Close logged errors: %s", buf.String())
+	}
+}
+
+func TestCleanupPolicy(t *testing.T) {
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	for _, tc := range []struct {
+		name     string
+		existing bool
+		keepShm  bool
+	}{
+		{"keep", false, true},
+		{"remove", false, false},
+		{"remove", true, true}, // An existing shm belongs to the tracee
+	} {
+		policy, err := ParseCleanupPolicy(tc.name)
+		if err != nil {
+			t.Fatalf("ParseCleanupPolicy(%q): %v", tc.name, err)
+		}
+		shm, sock, log, cleanup := tempPaths(t)
+		if tc.existing {
+			writeShmHeader(t, shm, eightSlotHeader(2), int(MappingSize(2, 8)))
+		}
+		eng, err := NewTracerEngineWithOptions(2, shm, sock, log, EngineOptions{Cleanup: policy, ExistingShm: tc.existing})
+		if err != nil {
+			t.Fatalf("NewTracerEngineWithOptions: %v", err)
+		}
+		eng.Close()
+		if exists(shm) != tc.keepShm || exists(sock) {
+			t.Errorf("%s (existing %v): shm left %v, sock left %v; want shm %v and no sock",
+				tc.name, tc.existing, exists(shm), exists(sock), tc.keepShm)
+		}
+		cleanup()
+	}
+	if _, err := ParseCleanupPolicy("wipe"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+func TestFailedStartLeavesNoFiles(t *testing.T) {
+	shm, sock, _, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	// A directory cannot be opened as the trace file, so construction fails after listening
+	_, err := NewTracerEngine(2, shm, sock, t.TempDir())
+	if err == nil {
+		t.Fatal("expected an error for a directory as the trace path")
+	}
+	for _, path := range []string{shm, sock} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s left behind after a failed start (%v)", path, err)
+		}
+	}
 }
 
 // ─── doScan ───────────────────────────────────────────────────────────────────
@@ -197,11 +456,15 @@ func TestDoScanWithOneEvent(t *testing.T) {
 	eng.writer.Flush()
 	data, _ := os.ReadFile(log)
 	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
-	if len(lines) != 1 || lines[0] == "" {
-		t.Errorf("expected 1 JSONL line, got %d", len(lines))
+	// The meta header always comes first, then the event
+	if len(lines) != 2 || lines[1] == "" {
+		t.Fatalf("expected meta + 1 JSONL line, got %d", len(lines))
+	}
+	if !strings.Contains(lines[0], `"type":"meta"`) {
+		t.Errorf("first line is not the meta header: %q", lines[0])
 	}
 	var rec map[string]interface{}
-	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil {
 		t.Errorf("invalid JSONL: %v", err)
 	}
 	if rec["probe_id"] != float64(77) {
@@ -285,3 +548,1453 @@ func TestMaxStationsFieldStored(t *testing.T) {
 		t.Errorf("maxStations = %d, want %d", eng.maxStations, n)
 	}
 }
+
+// ─── Stats / wakeup drain ─────────────────────────────────────────────────────
+
+func TestStatsCountsHarvestedEvents(t *testing.T) {
+	eng, _ := newEngine(t, 4)
+	atomic.StoreUint32(&eng.header.AllocatedCount, 1)
+
+	for i := 0; i < 3; i++ {
+		slot := &eng.stations[0].Slots[i]
+		atomic.StoreUint64(&slot.Seq, 1)
+		slot.Timestamp = uint64(i)
+		atomic.StoreUint64(&slot.Seq, 2)
+	}
+	eng.doScan()
+	eng.doScan()
+
+	if got := eng.Stats().Events; got != 3 {
+		t.Errorf("Stats().Events = %d, want 3", got)
+	}
+}
+
+// acceptPair connects a client to the engine's UDS and returns both ends.
+func acceptPair(t *testing.T, eng *TracerEngine) (server, client net.Conn) {
+	t.Helper()
+	client, err := net.Dial("unix", eng.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial uds: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err = eng.listener.Accept()
+	if err != nil {
+		t.Fatalf("accept uds: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, client
+}
+
+func TestDrainWakeupsConsumesBacklog(t *testing.T) {
+	eng, _ := newEngine(t, 1)
+	server, client := acceptPair(t, eng)
+
+	if _, err := client.Write([]byte("11111")); err != nil {
+		t.Fatalf("write doorbell: %v", err)
+	}
+	drained, closed := drainWakeups(server, make([]byte, 2))
+	if drained != 5 || closed {
+		t.Errorf("drainWakeups = (%d, %v), want (5, false)", drained, closed)
+	}
+
+	// Nothing left: a second drain must return immediately with zero.
+	drained, closed = drainWakeups(server, make([]byte, 2))
+	if drained != 0 || closed {
+		t.Errorf("second drainWakeups = (%d, %v), want (0, false)", drained, closed)
+	}
+}
+
+func TestDrainWakeupsDetectsClose(t *testing.T) {
+	eng, _ := newEngine(t, 1)
+	server, client := acceptPair(t, eng)
+
+	client.Write([]byte("1"))
+	client.Close()
+
+	drained, closed := drainWakeups(server, make([]byte, 16))
+	if drained != 1 || !closed {
+		t.Errorf("drainWakeups after close = (%d, %v), want (1, true)", drained, closed)
+	}
+}
+
+// ─── Adaptive backoff ─────────────────────────────────────────────────────────
+
+func TestBackoffZeroOptionsArmsImmediately(t *testing.T) {
+	eng, _ := newEngine(t, 1)
+	if eng.backoff(1) {
+		t.Error("zero options: backoff(1) = true, want false (arm the UDS wait)")
+	}
+}
+
+func TestBackoffPhases(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	eng, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{
+		SpinScans:  2,
+		YieldScans: 1,
+		SleepScans: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	t.Cleanup(eng.Close)
+
+	if eng.options.BackoffSleep != DefaultBackoffSleep {
+		t.Errorf("BackoffSleep = %v, want default %v", eng.options.BackoffSleep, DefaultBackoffSleep)
+	}
+	for idle, want := range map[int]bool{1: true, 2: true, 3: true, 4: true, 5: false} {
+		if got := eng.backoff(idle); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", idle, got, want)
+		}
+	}
+}
+
+// ─── shm filesystem check ─────────────────────────────────────────────────────
+
+func TestShmFilesystemDevShm(t *testing.T) {
+	f, err := os.CreateTemp("/dev/shm", "engine_test_*.shm")
+	if err != nil {
+		t.Skipf("/dev/shm not available: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	name, inMemory, err := shmFilesystem(f)
+	if err != nil {
+		t.Fatalf("shmFilesystem: %v", err)
+	}
+	if !inMemory {
+		t.Errorf("/dev/shm reported as %q, want memory-backed", name)
+	}
+}
+
+func TestStrictShmFSRejectsDiskBacked(t *testing.T) {
+	dir, err := os.MkdirTemp(".", "engine_test_*")
+	if err != nil {
+		t.Fatalf("MkdirTemp: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	probe, _ := os.Create(dir + "/probe")
+	_, inMemory, _ := shmFilesystem(probe)
+	probe.Close()
+	if inMemory {
+		t.Skip("working directory is memory-backed; nothing to reject")
+	}
+
+	_, err = NewTracerEngineWithOptions(1, dir+"/test.shm", dir+"/test.sock", dir+"/test.jsonl", EngineOptions{StrictShmFS: true})
+	if err == nil {
+		t.Fatal("StrictShmFS accepted a disk-backed shm file")
+	}
+}
+
+// ─── Huge pages ───────────────────────────────────────────────────────────────
+
+func TestHugePagesOptionKeepsLayout(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+
+	const n = uint32(16)
+	eng, err := NewTracerEngineWithOptions(n, shm, sock, log, EngineOptions{HugePages: true})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	t.Cleanup(eng.Close)
+
+	if uint32(len(eng.stations)) != n || eng.header.MaxStations != n {
+		t.Errorf("stations = %d, max = %d, want %d", len(eng.stations), eng.header.MaxStations, n)
+	}
+}
+
+func TestPartialOutputAppearsOnClose(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	eng, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{PartialOutput: true})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	if _, err := os.Stat(log); !os.IsNotExist(err) {
+		t.Errorf("final trace visible while running: %v", err)
+	}
+	eng.Close()
+	if _, err := os.Stat(log); err != nil {
+		t.Errorf("final trace missing after Close: %v", err)
+	}
+}
+
+func TestMinimalHexOption(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	eng, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{MinimalHex: true})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	t.Cleanup(eng.Close)
+
+	p, _ := eng.NewFakeProbe(1, 1)
+	p.Write(1, 0x1234, true, 5)
+	eng.DrainOnce()
+
+	data, _ := os.ReadFile(log)
+	if !strings.Contains(string(data), `"addr":"0x1234"`) {
+		t.Errorf("trace = %q, want minimal hex addr", data)
+	}
+}
+
+func TestMlockOptionKeepsEngineUsable(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	// Whether mlock succeeds depends on RLIMIT_MEMLOCK; either way construction must not fail
+	eng, err := NewTracerEngineWithOptions(4, shm, sock, log, EngineOptions{Mlock: true})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions with Mlock: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	if eng.header.MaxStations != 4 {
+		t.Errorf("MaxStations = %d, want 4", eng.header.MaxStations)
+	}
+}
+
+// ─── Stop ─────────────────────────────────────────────────────────────────────
+
+func TestStopDrainsAndReturnsFromRun(t *testing.T) {
+	eng, log := newEngine(t, 2)
+
+	// Publish an event up front; the tracee stays connected, so only Stop's drain can flush it
+	atomic.StoreUint32(&eng.header.AllocatedCount, 1)
+	slot := &eng.stations[0].Slots[0]
+	atomic.StoreUint64(&slot.Seq, 1)
+	slot.Timestamp = 42
+	atomic.StoreUint64(&slot.Seq, 2)
+
+	runDone := make(chan error, 1)
+	go func() { runDone <- eng.Run() }()
+
+	client, err := net.Dial("unix", eng.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial uds: %v", err)
+	}
+	defer client.Close()
+
+	for !eng.running.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	eng.Stop()
+
+	select {
+	case err := <-runDone:
+		if err != nil {
+			t.Errorf("Run returned %v after Stop", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+
+	data, _ := os.ReadFile(log)
+	if !strings.Contains(string(data), `"ts":42`) {
+		t.Errorf("event not flushed on Stop, log = %q", data)
+	}
+}
+
+func TestStopWithoutRunDoesNotBlock(t *testing.T) {
+	eng, _ := newEngine(t, 1)
+	eng.Stop()
+	eng.Stop()
+}
+
+func TestMetaHeaderAnchorsClock(t *testing.T) {
+	eng, log := newEngine(t, 1)
+	eng.writer.Flush()
+
+	data, _ := os.ReadFile(log)
+	line, _, _ := strings.Cut(string(data), "\n")
+	var meta structure.TraceMeta
+	if err := json.Unmarshal([]byte(line), &meta); err != nil {
+		t.Fatalf("invalid meta line %q: %v", line, err)
+	}
+	if meta.Type != "meta" || meta.Version != structure.MetaVersion {
+		t.Errorf("meta = %+v", meta)
+	}
+	if meta.UnixNS == 0 {
+		t.Error("meta has no wall-clock reading")
+	}
+	if _, ok := monotonicNow(); ok && !meta.HasClockAnchor() {
+		t.Error("monotonic clock available but meta carries no anchor")
+	}
+}
+
+// ─── Idle warning ─────────────────────────────────────────────────────────────
+
+func TestIdleWatchWarnsAndRepeats(t *testing.T) {
+	start := time.Unix(0, 0)
+	w := newIdleWatch(10*time.Second, start)
+
+	if _, warn := w.check(start.Add(9 * time.Second)); warn {
+		t.Error("warned before the threshold")
+	}
+	if idleFor, warn := w.check(start.Add(10 * time.Second)); !warn || idleFor != 10*time.Second {
+		t.Errorf("check at threshold = %v, %v; want 10s, true", idleFor, warn)
+	}
+	if _, warn := w.check(start.Add(15 * time.Second)); warn {
+		t.Error("warned twice within one threshold")
+	}
+	if _, warn := w.check(start.Add(20 * time.Second)); !warn {
+		t.Error("no repeat warning after another threshold")
+	}
+
+	// Activity restarts the clock
+	w.active = true
+	if _, warn := w.check(start.Add(21 * time.Second)); warn {
+		t.Error("warned right after activity")
+	}
+	if _, warn := w.check(start.Add(30 * time.Second)); warn {
+		t.Error("warned before a full threshold of new silence")
+	}
+	if _, warn := w.check(start.Add(31 * time.Second)); !warn {
+		t.Error("no warning after a full threshold of new silence")
+	}
+}
+
+func TestIdleWatchDisabled(t *testing.T) {
+	w := newIdleWatch(0, time.Unix(0, 0))
+	if _, warn := w.check(time.Unix(3600, 0)); warn {
+		t.Error("zero threshold must never warn")
+	}
+}
+
+// ─── Event sink ───────────────────────────────────────────────────────────────
+
+func TestSinkReplacesTraceFile(t *testing.T) {
+	shm, sock, _, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+
+	events := make(chan structure.TraceEvent, 4)
+	eng, err := NewTracerEngineWithOptions(1, shm, sock, "", EngineOptions{Sink: structure.ChannelSink(events)})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	if eng.writer != nil {
+		t.Error("empty logPath with a sink should not open a trace file")
+	}
+
+	atomic.StoreUint32(&eng.header.AllocatedCount, 1)
+	eng.stations[0].Header.ProbeID = 9
+	eng.stations[0].Slots[0].Timestamp = 123
+	atomic.StoreUint64(&eng.stations[0].Slots[0].Seq, 2)
+
+	if got := eng.doScan(); got != 1 {
+		t.Fatalf("doScan = %d, want 1", got)
+	}
+	ev := <-events
+	if ev.ProbeID != 9 || ev.TS != 123 {
+		t.Errorf("event = %+v", ev)
+	}
+	eng.flush() // must tolerate the missing writer
+}
+
+func TestSinkRunsAlongsideTraceFile(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+
+	seen := 0
+	eng, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{
+		Sink: structure.SinkFunc(func(structure.TraceEvent) error { seen++; return nil }),
+	})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	t.Cleanup(eng.Close)
+
+	atomic.StoreUint32(&eng.header.AllocatedCount, 1)
+	atomic.StoreUint64(&eng.stations[0].Slots[0].Seq, 2)
+	eng.doScan()
+	eng.flush()
+
+	data, _ := os.ReadFile(log)
+	if seen != 1 || !strings.Contains(string(data), `"seq":2`) {
+		t.Errorf("sink saw %d events, file = %q; want both", seen, data)
+	}
+}
+
+// ─── Station reset policy ─────────────────────────────────────────────────────
+
+// publish writes one committed epoch into slot 0 of station i with the given seq.
+func publish(eng *TracerEngine, i int, seq uint64) {
+	atomic.StoreUint64(&eng.stations[i].Slots[0].Seq, seq)
+}
+
+func TestResetNeverSkipsRestartedSeqs(t *testing.T) {
+	eng, _ := newEngine(t, 1)
+	atomic.StoreUint32(&eng.header.AllocatedCount, 1)
+
+	eng.stations[0].Header.BirthTS = 100
+	publish(eng, 0, 10)
+	eng.doScan()
+
+	// A restarted tracee reuses the station and its counter starts over
+	eng.stations[0].Header.BirthTS = 200
+	publish(eng, 0, 2)
+	if got := eng.doScan(); got != 0 {
+		t.Errorf("doScan = %d, want 0 under ResetNever", got)
+	}
+}
+
+func TestResetOnBirthChangeRearmsRestartedSlots(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	eng, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{StationReset: ResetOnBirthChange})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	atomic.StoreUint32(&eng.header.AllocatedCount, 1)
+
+	eng.stations[0].Header.BirthTS = 100
+	publish(eng, 0, 10)
+	atomic.StoreUint64(&eng.stations[0].Slots[1].Seq, 6)
+	if got := eng.doScan(); got != 2 {
+		t.Fatalf("first doScan = %d, want 2", got)
+	}
+
+	// New owner restarts slot 0; slot 1 still holds the previous owner's epoch
+	eng.stations[0].Header.BirthTS = 200
+	publish(eng, 0, 2)
+	if got := eng.doScan(); got != 1 {
+		t.Errorf("doScan after rebirth = %d, want only the restarted slot", got)
+	}
+	if eng.lastSeen[0][1] != 6 {
+		t.Errorf("untouched slot lastSeen = %d, want 6 kept", eng.lastSeen[0][1])
+	}
+}
+
+func TestParseStationResetPolicy(t *testing.T) {
+	for name, want := range map[string]StationResetPolicy{"": ResetNever, "never": ResetNever, "birth": ResetOnBirthChange} {
+		if got, err := ParseStationResetPolicy(name); err != nil || got != want {
+			t.Errorf("ParseStationResetPolicy(%q) = %v, %v", name, got, err)
+		}
+	}
+	if _, err := ParseStationResetPolicy("always"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+// ─── Cold start policy ────────────────────────────────────────────────────────
+
+func TestColdStartEmitHarvestsHistory(t *testing.T) {
+	eng, _ := newEngine(t, 1)
+	atomic.StoreUint32(&eng.header.AllocatedCount, 1)
+	publish(eng, 0, 10)
+	if got := eng.doScan(); got != 1 {
+		t.Errorf("doScan = %d, want the pre-existing epoch under ColdStartEmit", got)
+	}
+}
+
+func TestColdStartSkipOnlyHarvestsAfterConnect(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	eng, err := NewTracerEngineWithOptions(2, shm, sock, log, EngineOptions{ColdStart: ColdStartSkip})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	atomic.StoreUint32(&eng.header.AllocatedCount, 1)
+
+	publish(eng, 0, 10)
+	// Past AllocatedCount, and a write still in progress
+	atomic.StoreUint64(&eng.stations[1].Slots[0].Seq, 4)
+	atomic.StoreUint64(&eng.stations[0].Slots[1].Seq, 7)
+
+	runDone := make(chan error, 1)
+	go func() { runDone <- eng.Run() }()
+	client, err := net.Dial("unix", eng.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial uds: %v", err)
+	}
+	defer client.Close()
+	// The snapshot is taken before the connection is counted
+	for eng.stats.connections.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The interrupted write commits after the connection, and one new epoch arrives
+	slot := &eng.stations[0].Slots[1]
+	slot.Timestamp = 77
+	atomic.StoreUint64(&slot.Seq, 8)
+	slot = &eng.stations[0].Slots[2]
+	slot.Timestamp = 88
+	atomic.StoreUint64(&slot.Seq, 2)
+	eng.Stop()
+	if err := <-runDone; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	data, _ := os.ReadFile(log)
+	if got := strings.Count(string(data), `"probe_id"`); got != 2 || !strings.Contains(string(data), `"ts":77`) || !strings.Contains(string(data), `"ts":88`) {
+		t.Errorf("trace holds %d events, want only the two after connect:\n%s", got, data)
+	}
+}
+
+func TestParseColdStartPolicy(t *testing.T) {
+	for name, want := range map[string]ColdStartPolicy{"": ColdStartEmit, "emit": ColdStartEmit, "skip": ColdStartSkip} {
+		if got, err := ParseColdStartPolicy(name); err != nil || got != want {
+			t.Errorf("ParseColdStartPolicy(%q) = %v, %v", name, got, err)
+		}
+	}
+	if _, err := ParseColdStartPolicy("snapshot"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+// ─── Metrics ──────────────────────────────────────────────────────────────────
+
+func TestDoScanCountsDroppedEpochs(t *testing.T) {
+	eng, _ := newEngine(t, 1)
+	atomic.StoreUint32(&eng.header.AllocatedCount, 1)
+
+	// Slot 0 was written three times (seq 2, 4, 6) before the first scan: two are gone
+	atomic.StoreUint64(&eng.stations[0].Slots[0].Seq, 6)
+	eng.doScan()
+	if got := eng.Stats().Dropped; got != 2 {
+		t.Errorf("Dropped = %d, want 2", got)
+	}
+
+	// One more write, harvested in time: nothing new is lost
+	atomic.StoreUint64(&eng.stations[0].Slots[0].Seq, 8)
+	eng.doScan()
+	if got := eng.Stats().Dropped; got != 2 {
+		t.Errorf("Dropped = %d after a clean scan, want 2", got)
+	}
+}
+
+func TestMetricsHandlerExposesCounters(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	eng, err := NewTracerEngineWithOptions(2, shm, sock, log, EngineOptions{TrackTIDs: true})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	t.Cleanup(eng.Close)
+
+	atomic.StoreUint32(&eng.header.AllocatedCount, 2)
+	eng.stations[1].Header.IsDead = true
+	eng.stations[0].Slots[0].TID = 42
+	atomic.StoreUint64(&eng.stations[0].Slots[0].Seq, 2)
+	eng.doScan()
+
+	rec := httptest.NewRecorder()
+	eng.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE corotracer_events_total counter\ncorotracer_events_total 1\n",
+		"corotracer_live_coroutines 1\n",
+		"corotracer_stations_allocated 2\n",
+		`corotracer_thread_events_total{tid="42"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %q in:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsCollectorIsConsistent(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	eng, err := NewTracerEngineWithOptions(2, shm, sock, log, EngineOptions{TrackTIDs: true})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	eng.tids.WriteSafeSlot(nil, 0, 2, 42, 0, true, 1)
+
+	// The pedantic registry checks every collected metric against Describe
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(eng.MetricsCollector())
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	if len(families) != 14 {
+		t.Errorf("gathered %d metric families, want all 14", len(families))
+	}
+}
+
+func TestMetricsAfterCloseSkipShmGauges(t *testing.T) {
+	eng, _ := newEngine(t, 2)
+	atomic.StoreUint32(&eng.header.AllocatedCount, 1)
+	eng.Close()
+
+	// Would fault on the unmapped header without the guard
+	rec := httptest.NewRecorder()
+	eng.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, "corotracer_events_total 0\n") {
+		t.Errorf("counters missing after Close:\n%s", body)
+	}
+	if strings.Contains(body, "corotracer_live_coroutines") || strings.Contains(body, "corotracer_stations_allocated") {
+		t.Errorf("shm gauges served after Close:\n%s", body)
+	}
+	if eng.LiveCoroutines() != 0 {
+		t.Errorf("LiveCoroutines after Close = %d, want 0", eng.LiveCoroutines())
+	}
+}
+
+// ─── Periodic flush ───────────────────────────────────────────────────────────
+
+func TestFlushIntervalDefaults(t *testing.T) {
+	if got := (EngineOptions{}).withDefaults().FlushInterval; got != DefaultFlushInterval {
+		t.Errorf("zero FlushInterval = %v, want %v", got, DefaultFlushInterval)
+	}
+	if got := (EngineOptions{FlushInterval: -1}).withDefaults().FlushInterval; got > 0 {
+		t.Errorf("negative FlushInterval = %v, want it left disabled", got)
+	}
+}
+
+func TestFlushTickerRaisesFlag(t *testing.T) {
+	eng, _ := newEngine(t, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go eng.flushTicker(time.Millisecond, stop)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !eng.flushDue.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("flush ticker never requested a flush")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlushUnderSustainedLoad(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	// A huge spin budget keeps the loop from ever reaching the flush before sleeping
+	eng, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{
+		SpinScans:     1 << 30,
+		FlushInterval: 5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	atomic.StoreUint32(&eng.header.AllocatedCount, 1)
+
+	go eng.Run()
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	stopProbe := make(chan struct{})
+	defer close(stopProbe)
+	go func() {
+		for seq := uint64(2); ; seq += 2 {
+			select {
+			case <-stopProbe:
+				return
+			default:
+			}
+			atomic.StoreUint64(&eng.stations[0].Slots[0].Seq, seq)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// At most ~1000 events (<128KB) in a second: they cannot spill the buffer on their own
+	deadline := time.Now().Add(time.Second)
+	for {
+		data, _ := os.ReadFile(log)
+		if strings.Contains(string(data), `"seq":`) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("events never reached the file while the loop was busy")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// ─── DrainOnce / FakeProbe ────────────────────────────────────────────────────
+
+func TestFakeProbeDrainOnce(t *testing.T) {
+	eng, log := newEngine(t, 2)
+
+	a, err := eng.NewFakeProbe(0xA, 1)
+	if err != nil {
+		t.Fatalf("NewFakeProbe: %v", err)
+	}
+	b, _ := eng.NewFakeProbe(0xB, 2)
+	a.Write(1, 0x10, true, 100)
+	a.Write(1, 0x10, false, 200)
+	b.Write(2, 0x20, true, 150)
+
+	if n, err := eng.DrainOnce(); err != nil || n != 3 {
+		t.Fatalf("DrainOnce = %d, %v; want 3", n, err)
+	}
+	if n, _ := eng.DrainOnce(); n != 0 {
+		t.Errorf("second DrainOnce = %d, want 0", n)
+	}
+
+	data, _ := os.ReadFile(log)
+	if got := strings.Count(string(data), `"probe_id":`); got != 3 {
+		t.Errorf("trace has %d events, want 3:\n%s", got, data)
+	}
+
+	if _, err := eng.NewFakeProbe(0xC, 3); err == nil {
+		t.Error("NewFakeProbe beyond capacity should fail")
+	}
+}
+
+func TestFakeProbeWrapsLikeTheSDK(t *testing.T) {
+	eng, _ := newEngine(t, 1)
+	p, _ := eng.NewFakeProbe(1, 1)
+
+	// Ten events into eight slots: the first two are overwritten before the scan
+	for i := uint64(0); i < 10; i++ {
+		p.Write(1, i, i%2 == 0, i)
+	}
+	if n, _ := eng.DrainOnce(); n != 8 {
+		t.Errorf("DrainOnce = %d, want 8", n)
+	}
+	if got := eng.Stats().Dropped; got != 2 {
+		t.Errorf("Dropped = %d, want 2", got)
+	}
+}
+
+func TestFakeProbeHonoursSlotsPerStation(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	eng, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{SlotsPerStation: 2})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	if eng.header.SlotsPerStation != 2 {
+		t.Fatalf("slots_per_station = %d, want 2", eng.header.SlotsPerStation)
+	}
+
+	p, _ := eng.NewFakeProbe(1, 1)
+	for i := uint64(0); i < 5; i++ {
+		p.Write(1, i, true, i)
+	}
+	if n, _ := eng.DrainOnce(); n != 2 {
+		t.Errorf("DrainOnce = %d, want 2", n)
+	}
+	if got := eng.Stats().Dropped; got != 3 {
+		t.Errorf("Dropped = %d, want 3", got)
+	}
+	if seq := eng.stations[0].Slots[2].Seq; seq != 0 {
+		t.Errorf("slot 2 was written (seq %d) with only 2 slots negotiated", seq)
+	}
+}
+
+// ─── Death events ─────────────────────────────────────────────────────────────
+
+func newDeathEngine(t *testing.T, n uint32) (*TracerEngine, string) {
+	t.Helper()
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	eng, err := NewTracerEngineWithOptions(n, shm, sock, log, EngineOptions{DeathEvents: true})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	t.Cleanup(eng.Close)
+	return eng, log
+}
+
+func TestDeathEventFollowsLastEpoch(t *testing.T) {
+	eng, log := newDeathEngine(t, 1)
+	p, _ := eng.NewFakeProbe(0xA, 1)
+	p.Write(1, 0x10, true, 100)
+	p.Write(1, 0x10, false, 200)
+	p.Kill()
+
+	eng.DrainOnce()
+	eng.DrainOnce() // Seen once per owner
+
+	data, _ := os.ReadFile(log)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("trace has %d lines, want meta + 2 events + death:\n%s", len(lines), data)
+	}
+	var death structure.TraceDeath
+	if err := json.Unmarshal([]byte(lines[3]), &death); err != nil || death.Type != "death" || death.ProbeID != 0xA {
+		t.Errorf("last line %q is not the death of probe 0xA (%v)", lines[3], err)
+	}
+	if death.TS == 0 || death.Inferred {
+		t.Errorf("death = %+v, want the probe's DeathTS", death)
+	}
+	if got := eng.Stats().Deaths; got != 1 {
+		t.Errorf("Deaths = %d, want 1", got)
+	}
+}
+
+func TestDeadStationIsRecycled(t *testing.T) {
+	eng, log := newDeathEngine(t, 1)
+	first, _ := eng.NewFakeProbe(1, 1)
+	first.Write(1, 0, true, 10)
+	if _, err := eng.NewFakeProbe(2, 2); err == nil {
+		t.Fatal("second probe got a station while the first was alive")
+	}
+
+	first.Kill()
+	eng.DrainOnce()
+	second, err := eng.NewFakeProbe(2, 2)
+	if err != nil {
+		t.Fatalf("finalized station was not reclaimed: %v", err)
+	}
+	if eng.header.ReclaimableCount != 0 {
+		t.Errorf("reclaimable_count = %d after the claim", eng.header.ReclaimableCount)
+	}
+
+	// The new owner starts at slot 0 again, but its seq keeps counting, so nothing is lost
+	second.Write(2, 0, true, 20)
+	second.Kill()
+	if n, _ := eng.DrainOnce(); n != 1 {
+		t.Errorf("DrainOnce after reuse = %d, want 1", n)
+	}
+	data, _ := os.ReadFile(log)
+	if got := strings.Count(string(data), `"type":"death"`); got != 2 {
+		t.Errorf("trace has %d deaths, want 2:\n%s", got, data)
+	}
+}
+
+func TestStationReusedDuringHarvestIsNotFinalized(t *testing.T) {
+	var eng *TracerEngine
+	reuse := false
+	sink := structure.SinkFunc(func(structure.TraceEvent) error {
+		if reuse {
+			// The SDK claims the reclaimed station for a new coroutine in the middle of the scan
+			reuse = false
+			if _, err := eng.NewFakeProbe(2, 2); err != nil {
+				t.Errorf("reclaimed station not claimable: %v", err)
+			}
+		}
+		return nil
+	})
+	shm, sock, log, cleanup := tempPaths(t)
+	t.Cleanup(cleanup)
+	eng, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{DeathEvents: true, Sink: sink})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	t.Cleanup(eng.Close)
+
+	first, _ := eng.NewFakeProbe(1, 1)
+	first.Write(1, 0, true, 10)
+	first.Kill()
+	eng.DrainOnce()
+
+	// A scan that still sees the old owner's IsDead harvests an epoch, and the reuse happens then
+	first.Write(1, 0, false, 20)
+	reuse = true
+	eng.DrainOnce()
+	if got := eng.Stats().Deaths; got != 1 {
+		t.Errorf("Deaths = %d, want only the first owner's", got)
+	}
+	if eng.stations[0].Header.Reclaimable != 0 || eng.header.ReclaimableCount != 0 {
+		t.Errorf("station in use marked reclaimable again (reclaimable %d, count %d)",
+			eng.stations[0].Header.Reclaimable, eng.header.ReclaimableCount)
+	}
+}
+
+func TestStationTakeOverBetweenDeathReads(t *testing.T) {
+	// The SDK's take-over stores, split at every point around the snapshot taken before
+	// the harvest and the one finalizeIfDead takes after it
+	for from := 0; from <= 4; from++ {
+		for to := from; to <= 4; to++ {
+			eng, _ := newDeathEngine(t, 1)
+			first, _ := eng.NewFakeProbe(1, 1)
+			first.Kill()
+			eng.DrainOnce()
+			station := eng.claimReclaimed()
+			if station == nil {
+				t.Fatal("finalized station not claimable")
+			}
+
+			stores := takeOver(station, 2, 2)
+			for _, store := range stores[:from] {
+				store()
+			}
+			before := readDeath(station)
+			for _, store := range stores[from:to] {
+				store()
+			}
+			eng.finalizeIfDead(0, before)
+			for _, store := range stores[to:] {
+				store()
+			}
+			eng.DrainOnce()
+
+			if got := eng.Stats().Deaths; got != 1 {
+				t.Errorf("stores %d..%d between the reads: Deaths = %d, want only the first owner's", from, to, got)
+			}
+			if station.Header.Reclaimable != 0 || eng.header.ReclaimableCount != 0 {
+				t.Errorf("stores %d..%d between the reads: live station marked reclaimable (reclaimable %d, count %d)",
+					from, to, station.Header.Reclaimable, eng.header.ReclaimableCount)
+			}
+		}
+	}
+}
+
+func TestDeathEventsOffByDefault(t *testing.T) {
+	eng, log := newEngine(t, 1)
+	p, _ := eng.NewFakeProbe(1, 1)
+	p.Kill()
+	eng.DrainOnce()
+	data, _ := os.ReadFile(log)
+	if strings.Contains(string(data), `"death"`) || eng.stations[0].Header.Reclaimable != 0 {
+		t.Errorf("death recorded without DeathEvents:\n%s", data)
+	}
+}
+
+// ─── Station canary ───────────────────────────────────────────────────────────
+
+func TestCanaryFlagsClobberedStationOnce(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	defer cleanup()
+	eng, err := NewTracerEngineWithOptions(3, shm, sock, log, EngineOptions{Canary: true})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	defer eng.Close()
+
+	good, _ := eng.NewFakeProbe(1, 1)
+	bad, _ := eng.NewFakeProbe(2, 2)
+	good.Write(1, 0, true, 10)
+	bad.Write(1, 0, true, 10)
+	eng.DrainOnce()
+	if got := eng.CorruptedProbes(); len(got) != 0 {
+		t.Fatalf("CorruptedProbes = %v before any overrun", got)
+	}
+
+	// A payload write that runs to the end of the station
+	flex := &bad.station.Flexible
+	for i := 0x50; i < len(flex); i++ {
+		flex[i] = 'A'
+	}
+	bad.Write(1, 0, false, 20)
+	if n, _ := eng.DrainOnce(); n != 1 {
+		t.Errorf("DrainOnce = %d, want the clobbered station still harvested", n)
+	}
+	eng.DrainOnce()
+
+	if got := eng.CorruptedProbes(); len(got) != 1 || got[0] != 2 {
+		t.Errorf("CorruptedProbes = %v, want [2]", got)
+	}
+	if got := eng.Stats().Corruptions; got != 1 {
+		t.Errorf("Corruptions = %d, want 1", got)
+	}
+}
+
+func TestCanaryOffByDefault(t *testing.T) {
+	eng, _ := newEngine(t, 1)
+	if eng.stations[0].CanaryIntact() {
+		t.Error("canary armed without EngineOptions.Canary")
+	}
+	eng.DrainOnce()
+	if got := eng.CorruptedProbes(); len(got) != 0 {
+		t.Errorf("CorruptedProbes = %v without EngineOptions.Canary", got)
+	}
+}
+
+// ─── Harvest diagnostics ──────────────────────────────────────────────────────
+
+func TestHarvestAnomaliesAreRecordedAsDiags(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	defer cleanup()
+	eng, err := NewTracerEngineWithOptions(2, shm, sock, log, EngineOptions{Canary: true})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	atomic.StoreUint32(&eng.header.AllocatedCount, 2)
+	eng.stations[0].Header.ProbeID = 7
+	eng.stations[1].Header.ProbeID = 8
+
+	// Station 0 loses two epochs, reported at once, then one more within the same window,
+	// held back until Close
+	atomic.StoreUint64(&eng.stations[0].Slots[0].Seq, 6)
+	eng.doScan()
+	atomic.StoreUint64(&eng.stations[0].Slots[0].Seq, 10)
+	eng.doScan()
+	// Station 1's probe overruns its payload, then the header is overwritten
+	flex := &eng.stations[1].Flexible
+	for i := range flex {
+		flex[i] = 'A'
+	}
+	atomic.StoreUint64(&eng.header.MagicNum, 0)
+	eng.doScan()
+	eng.doScan()
+	eng.Close()
+
+	data, _ := os.ReadFile(log)
+	var diags []structure.TraceDiag
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var diag structure.TraceDiag
+		if json.Unmarshal([]byte(line), &diag) == nil && diag.Type == "diag" {
+			diags = append(diags, diag)
+		}
+	}
+	want := []structure.TraceDiag{
+		{Kind: structure.DiagGap, Station: 0, ProbeID: 7, Count: 2},
+		{Kind: structure.DiagMagic, Station: -1},
+		{Kind: structure.DiagCanary, Station: 1, ProbeID: 8},
+		{Kind: structure.DiagGap, Station: 0, ProbeID: 7, Count: 1},
+	}
+	if len(diags) != len(want) {
+		t.Fatalf("diag records = %+v, want %d", diags, len(want))
+	}
+	for i, diag := range diags {
+		w := want[i]
+		if diag.Kind != w.Kind || diag.Station != w.Station || diag.ProbeID != w.ProbeID || diag.Count != w.Count || diag.TS == 0 {
+			t.Errorf("diag %d = %+v, want %+v", i, diag, w)
+		}
+	}
+}
+
+// ─── Flight recorder ──────────────────────────────────────────────────────────
+
+func TestFlightRecorderKeepsLastEventsEvenWhenSampled(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	defer cleanup()
+	eng, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{FlightRecorder: 3, SampleEvery: 4})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	defer eng.Close()
+
+	probe, _ := eng.NewFakeProbe(5, 1)
+	for ts := uint64(1); ts <= 5; ts++ {
+		probe.Write(1, 0x10, ts%2 == 1, ts*100)
+		eng.DrainOnce()
+	}
+
+	dump := filepath.Join(t.TempDir(), "flight.jsonl")
+	n, err := eng.DumpFlightRecorder(dump)
+	if err != nil || n != 3 {
+		t.Fatalf("DumpFlightRecorder = %d, %v, want the 3 newest", n, err)
+	}
+	data, _ := os.ReadFile(dump)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 || !strings.Contains(lines[0], `"type":"meta"`) {
+		t.Fatalf("dump = %q, want a meta header and 3 events", data)
+	}
+	for i, ts := range []string{`"ts":300`, `"ts":400`, `"ts":500`} {
+		if !strings.Contains(lines[i+1], ts) || !strings.Contains(lines[i+1], `"probe_id":5`) || !strings.Contains(lines[i+1], `"slot":`) {
+			t.Errorf("dump line %d = %s, want %s oldest first", i+1, lines[i+1], ts)
+		}
+	}
+	// Each write went to a fresh slot at seq 2, which one-in-four sampling leaves out
+	trace, _ := os.ReadFile(log)
+	if got := strings.Count(string(trace), `"probe_id"`); got != 0 {
+		t.Errorf("trace holds %d events, want none under SampleEvery 4", got)
+	}
+}
+
+func TestFlightRecorderOff(t *testing.T) {
+	eng, _ := newEngine(t, 1)
+	if _, err := eng.DumpFlightRecorder(filepath.Join(t.TempDir(), "flight.jsonl")); err == nil {
+		t.Error("DumpFlightRecorder succeeded without EngineOptions.FlightRecorder")
+	}
+	shm, sock, log, cleanup := tempPaths(t)
+	defer cleanup()
+	if _, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{FlightRecorder: -1}); err == nil {
+		t.Error("negative FlightRecorder accepted")
+	}
+}
+
+// ─── Pause / Resume ───────────────────────────────────────────────────────────
+
+func TestPauseConsumesWithoutWriting(t *testing.T) {
+	eng, log := newEngine(t, 1)
+	p, _ := eng.NewFakeProbe(1, 1)
+
+	p.Write(1, 0, true, 10)
+	eng.DrainOnce()
+
+	if !eng.Pause() || eng.Pause() {
+		t.Fatal("Pause should report the transition only once")
+	}
+	p.Write(1, 0, false, 20)
+	p.Write(1, 0, true, 30)
+	if n, _ := eng.DrainOnce(); n != 2 {
+		t.Errorf("DrainOnce while paused = %d, want the 2 epochs consumed", n)
+	}
+
+	if !eng.Resume() || eng.Resume() {
+		t.Fatal("Resume should report the transition only once")
+	}
+	// Nothing from the paused window may resurface after Resume
+	if n, _ := eng.DrainOnce(); n != 0 {
+		t.Errorf("DrainOnce right after Resume = %d, want 0", n)
+	}
+	p.Write(1, 0, false, 40)
+	eng.DrainOnce()
+
+	var ts []uint64
+	data, _ := os.ReadFile(log)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n")[1:] {
+		var ev struct{ TS uint64 }
+		json.Unmarshal([]byte(line), &ev)
+		ts = append(ts, ev.TS)
+	}
+	if len(ts) != 2 || ts[0] != 10 || ts[1] != 40 {
+		t.Errorf("written ts = %v, want [10 40]", ts)
+	}
+	if stats := eng.Stats(); stats.Events != 2 || stats.Skipped != 2 {
+		t.Errorf("Events = %d, Skipped = %d, want 2 and 2", stats.Events, stats.Skipped)
+	}
+}
+
+// ─── Write failures ───────────────────────────────────────────────────────────
+
+func TestDrainOnceReportsFullDisk(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("/dev/full not available")
+	}
+	shm, sock, _, cleanup := tempPaths(t)
+	defer cleanup()
+	eng, err := NewTracerEngine(1, shm, sock, "/dev/full")
+	if err != nil {
+		t.Fatalf("NewTracerEngine: %v", err)
+	}
+	defer eng.Close()
+
+	p, _ := eng.NewFakeProbe(1, 1)
+	p.Write(1, 0, true, 10)
+	if _, err := eng.DrainOnce(); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("DrainOnce error = %v, want ENOSPC", err)
+	}
+
+	// Still failing: nothing more is taken out of shared memory
+	p.Write(1, 0, false, 20)
+	if n, err := eng.DrainOnce(); n != 0 || err == nil {
+		t.Errorf("DrainOnce on a full disk = %d, %v, want 0 and an error", n, err)
+	}
+	if eng.lastSeen[0][1] != 0 {
+		t.Error("epoch consumed while the output was failing")
+	}
+	if got := eng.Stats().WriteErrors; got < 2 {
+		t.Errorf("WriteErrors = %d, want at least 2", got)
+	}
+}
+
+// ─── Station pool saturation ──────────────────────────────────────────────────
+
+func TestSaturationRecordedOnce(t *testing.T) {
+	eng, log := newEngine(t, 2)
+	eng.NewFakeProbe(1, 1)
+	eng.NewFakeProbe(2, 2)
+	eng.DrainOnce()
+	if eng.PoolExhaustedAt() != 0 {
+		t.Fatal("pool reported exhausted before any coroutine was refused")
+	}
+
+	if _, err := eng.NewFakeProbe(3, 3); err == nil {
+		t.Fatal("third probe got a station out of two")
+	}
+	eng.DrainOnce()
+	eng.DrainOnce()
+	if eng.PoolExhaustedAt() == 0 {
+		t.Fatal("PoolExhaustedAt = 0 after every station was allocated")
+	}
+
+	data, _ := os.ReadFile(log)
+	if got := strings.Count(string(data), `"type":"saturation"`); got != 1 {
+		t.Errorf("trace has %d saturation records, want 1:\n%s", got, data)
+	}
+}
+
+// ─── Logging ──────────────────────────────────────────────────────────────────
+
+func TestEngineLogsThroughOptionLogger(t *testing.T) {
+	var buf strings.Builder
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	shm, sock, log, cleanup := tempPaths(t)
+	defer cleanup()
+	eng, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{Logger: logger})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	defer eng.Close()
+
+	eng.NewFakeProbe(1, 1)
+	eng.NewFakeProbe(2, 2) // Refused, so the engine warns
+	eng.DrainOnce()
+
+	var found bool
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec struct {
+			Level    string
+			Msg      string
+			Stations uint32
+		}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		if strings.HasPrefix(rec.Msg, "station pool exhausted") {
+			found = rec.Level == "WARN" && rec.Stations == 1
+		}
+	}
+	if !found {
+		t.Errorf("no WARN saturation record in the log:\n%s", buf.String())
+	}
+}
+
+// ─── Sampling ─────────────────────────────────────────────────────────────────
+
+func TestSampleEveryKeepsOneInN(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	defer cleanup()
+	eng, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{SampleEvery: 3, SlotsPerStation: 1})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	defer eng.Close()
+
+	p, _ := eng.NewFakeProbe(1, 1)
+	for ts := uint64(1); ts <= 9; ts++ {
+		p.Write(1, 0, ts%2 == 1, ts)
+		if n, _ := eng.DrainOnce(); n != 1 {
+			t.Fatalf("DrainOnce after write %d = %d: sampled-out epochs must still be consumed", ts, n)
+		}
+	}
+
+	data, _ := os.ReadFile(log)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var meta structure.TraceMeta
+	if err := json.Unmarshal([]byte(lines[0]), &meta); err != nil || meta.SampleEvery != 3 {
+		t.Errorf("meta header %q does not record the sample rate", lines[0])
+	}
+	// Writes 3, 6 and 9 have seq 6, 12 and 18, the multiples of 2*3
+	if len(lines) != 4 || !strings.Contains(lines[1], `"ts":3`) || !strings.Contains(lines[3], `"ts":9`) {
+		t.Errorf("sampled trace:\n%s", data)
+	}
+	if got := eng.Stats().Dropped; got != 0 {
+		t.Errorf("Dropped = %d: sampling must not look like loss", got)
+	}
+}
+
+func TestSampleEveryRejectsNegative(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	defer cleanup()
+	if _, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{SampleEvery: -2}); err == nil {
+		t.Error("negative sample rate accepted")
+	}
+}
+
+func TestThrottleRetunesPerWindow(t *testing.T) {
+	throttle := newThrottleSink(100, 2, discardSink{})
+	start := throttle.windowStart
+
+	throttle.harvested = 50
+	if throttle.retune(start.Add(throttleWindow / 2)) {
+		t.Fatal("retuned before the window was over")
+	}
+	throttle.harvested = 1_000 // 1000/s against a cap of 100/s
+	if !throttle.retune(start.Add(throttleWindow)) || throttle.every != 10 {
+		t.Errorf("every = %d after 1000 epochs/s, want 10", throttle.every)
+	}
+	throttle.harvested = 10 // Quiet again: back to the -sample floor, not below it
+	if !throttle.retune(start.Add(2*throttleWindow)) || throttle.every != 2 {
+		t.Errorf("every = %d after the load dropped, want the floor 2", throttle.every)
+	}
+}
+
+func TestMaxWriteRateSamplesAndRecordsIt(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	defer cleanup()
+	eng, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{MaxWriteRate: 1, SlotsPerStation: 1})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	defer eng.Close()
+
+	// Pretend a second of 4 epochs/s went by, so the next scan samples one in 4
+	eng.throttle.harvested = 4
+	eng.throttle.windowStart = time.Now().Add(-throttleWindow)
+	p, _ := eng.NewFakeProbe(1, 1)
+	for ts := uint64(1); ts <= 8; ts++ {
+		p.Write(1, 0, ts%2 == 1, ts)
+		eng.DrainOnce()
+	}
+	if got := eng.ThrottleSampleEvery(); got != 4 {
+		t.Errorf("ThrottleSampleEvery = %d, want 4", got)
+	}
+
+	data, _ := os.ReadFile(log)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var throttle structure.TraceThrottle
+	if len(lines) != 4 || json.Unmarshal([]byte(lines[1]), &throttle) != nil ||
+		throttle.Type != "throttle" || throttle.SampleEvery != 4 {
+		t.Fatalf("throttled trace:\n%s", data)
+	}
+	// Writes 4 and 8 have seq 8 and 16, the multiples of 2*4
+	if !strings.Contains(lines[2], `"ts":4`) || !strings.Contains(lines[3], `"ts":8`) {
+		t.Errorf("throttled trace:\n%s", data)
+	}
+}
+
+// ─── Wakeup Socket ────────────────────────────────────────────────────────────
+
+// wakeOnce connects to the engine's published SockPath and checks the doorbell byte arrives.
+func wakeOnce(t *testing.T, eng *TracerEngine, network, addr string) {
+	t.Helper()
+	client, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatalf("dial %s %s: %v", network, addr, err)
+	}
+	defer client.Close()
+	server, err := eng.listener.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer server.Close()
+	client.Write([]byte{1})
+	buf := make([]byte, 1)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := server.Read(buf); n != 1 || err != nil {
+		t.Fatalf("doorbell read = %d, %v", n, err)
+	}
+}
+
+func TestWakeupOverTCP(t *testing.T) {
+	shm, _, log, cleanup := tempPaths(t)
+	defer cleanup()
+	eng, err := NewTracerEngine(1, shm, "tcp://127.0.0.1:0", log)
+	if err != nil {
+		t.Fatalf("NewTracerEngine: %v", err)
+	}
+	defer eng.Close()
+
+	addr, ok := strings.CutPrefix(eng.SockPath(), TCPSockPrefix)
+	if !ok || strings.HasSuffix(addr, ":0") {
+		t.Fatalf("SockPath() = %q, want tcp:// with the bound port", eng.SockPath())
+	}
+	wakeOnce(t, eng, "tcp", addr)
+}
+
+func TestWakeupAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are Linux-only")
+	}
+	shm, _, log, cleanup := tempPaths(t)
+	defer cleanup()
+	name := "@corotracer-test-" + strconv.Itoa(os.Getpid())
+	eng, err := NewTracerEngine(1, shm, name, log)
+	if err != nil {
+		t.Fatalf("NewTracerEngine: %v", err)
+	}
+	defer eng.Close()
+
+	if eng.SockPath() != name {
+		t.Errorf("SockPath() = %q, want %q", eng.SockPath(), name)
+	}
+	wakeOnce(t, eng, "unix", name)
+}
+
+func TestRunNoticesStopWithoutListenerClose(t *testing.T) {
+	eng, _ := newEngine(t, 1)
+	if eng.options.WakeupBufferSize != DefaultWakeupBufferSize {
+		t.Errorf("WakeupBufferSize = %d, want the default %d", eng.options.WakeupBufferSize, DefaultWakeupBufferSize)
+	}
+
+	runDone := make(chan error, 1)
+	go func() { runDone <- eng.Run() }()
+	// Only the flag, not Stop: Accept's deadline must bring Run back to check it
+	eng.stopping.Store(true)
+	select {
+	case err := <-runDone:
+		if err != nil {
+			t.Errorf("Run returned %v", err)
+		}
+	case <-time.After(10 * acceptPollInterval):
+		t.Fatal("Run stayed in Accept after stopping was set")
+	}
+}
+
+func TestSmallWakeupBufferStillDrains(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	defer cleanup()
+	eng, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{WakeupBufferSize: 2})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	defer eng.Close()
+
+	server, client := acceptPair(t, eng)
+	client.Write([]byte("1111111"))
+	time.Sleep(10 * time.Millisecond)
+	if drained, closed := drainWakeups(server, make([]byte, eng.options.WakeupBufferSize)); drained != 7 || closed {
+		t.Errorf("drained %d (closed %v) through a 2-byte buffer, want all 7", drained, closed)
+	}
+
+	if _, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{WakeupBufferSize: -1}); err == nil {
+		t.Error("negative wakeup buffer size accepted")
+	}
+}
+
+// ─── Slot index ───────────────────────────────────────────────────────────────
+
+func TestRecordSlotWritesSlotIndex(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	defer cleanup()
+	eng, err := NewTracerEngineWithOptions(1, shm, sock, log, EngineOptions{RecordSlot: true})
+	if err != nil {
+		t.Fatalf("NewTracerEngineWithOptions: %v", err)
+	}
+	defer eng.Close()
+
+	p, _ := eng.NewFakeProbe(1, 1)
+	p.Write(1, 0, true, 1)
+	p.Write(1, 0, false, 2)
+	eng.DrainOnce()
+
+	data, _ := os.ReadFile(log)
+	if !strings.Contains(string(data), `"slot":0,`) || !strings.Contains(string(data), `"slot":1,`) {
+		t.Errorf("trace lacks slot indexes:\n%s", data)
+	}
+}
+
+// ─── Self-test ────────────────────────────────────────────────────────────────
+
+func TestRunSelfTestAccountsForEveryEvent(t *testing.T) {
+	shm, sock, log, cleanup := tempPaths(t)
+	defer cleanup()
+	eng, err := NewTracerEngine(4, shm, sock, log)
+	if err != nil {
+		t.Fatalf("NewTracerEngine: %v", err)
+	}
+	defer eng.Close()
+
+	result, err := eng.RunSelfTest(SelfTestOptions{Probes: 2, Rate: 2000, Duration: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("RunSelfTest: %v", err)
+	}
+	if result.Generated == 0 || result.Harvested == 0 || result.Harvested > result.Generated {
+		t.Fatalf("result = %+v", result)
+	}
+	if result.DropPercent() < 0 || result.DropPercent() > 100 {
+		t.Errorf("DropPercent = %f", result.DropPercent())
+	}
+
+	// Stop drained shared memory, so the trace holds exactly the harvested events. Typed
+	// records (meta, gap diags) are not events, even when they carry a probe_id.
+	data, _ := os.ReadFile(log)
+	events := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.Contains(line, `"probe_id"`) && !strings.Contains(line, `"type"`) {
+			events++
+		}
+	}
+	if uint64(events) != result.Harvested {
+		t.Errorf("trace has %d events, result says %d harvested", events, result.Harvested)
+	}
+}
+
+func TestRunSelfTestNeedsAStationPerProbe(t *testing.T) {
+	eng, _ := newEngine(t, 2)
+	if _, err := eng.RunSelfTest(SelfTestOptions{Probes: 3}); err == nil {
+		t.Error("3 probes on 2 stations accepted")
+	}
+}
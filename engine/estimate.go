@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+// MappingSize is the shm size NewTracerEngine maps for stationCount stations of
+// slotsPerStation slots (0 means the default 8), before any huge page rounding.
+func MappingSize(stationCount uint32, slotsPerStation int) int64 {
+	return HeaderSize + int64(stationCount)*int64(structure.StationSizeFor(slotsPerStation))
+}
+
+// Estimate is a dry-run footprint: nothing is allocated to compute it.
+type Estimate struct {
+	Stations     uint32
+	HeaderBytes  int64
+	StationBytes int64
+	MappingBytes int64
+	EventBytes   int64 // One representative event in the chosen encoding
+	Events       int64
+	TraceBytes   int64 // Events * EventBytes
+}
+
+// EstimateFootprint sizes the shm mapping for stationCount stations and projects the
+// size of the trace at logPath for eventsPerSec sustained over d. The event size comes
+// from encoding a representative epoch (heap-address probe ID and addr, 6-digit TID,
+// days-of-uptime monotonic ts) with the encoder the engine would pick for logPath, so
+// it tracks the real encoders instead of a hardcoded guess.
+func EstimateFootprint(stationCount uint32, logPath string, options EngineOptions, eventsPerSec float64, d time.Duration) Estimate {
+	var s structure.StationData
+	s.Header.ProbeID = 0x7f3a2c001230
+	event := traceEncoder(logPath, options).AppendEvent(nil, &s, 0, 2_000_000, 123456, 0x7f3a2c001240, false, 250_000_000_000_000)
+
+	events := int64(eventsPerSec * d.Seconds())
+	return Estimate{
+		Stations:     stationCount,
+		HeaderBytes:  HeaderSize,
+		StationBytes: int64(structure.StationSizeFor(options.SlotsPerStation)),
+		MappingBytes: MappingSize(stationCount, options.SlotsPerStation),
+		EventBytes:   int64(len(event)),
+		Events:       events,
+		TraceBytes:   events * int64(len(event)),
+	}
+}
@@ -0,0 +1,74 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+// shmMagic is GlobalHeader.MagicNum, "COROTRCR".
+const shmMagic = 0x434F524F54524352
+
+// existingLayout is what an already-initialised shm file says about itself.
+type existingLayout struct {
+	stations uint32
+	slots    int
+	size     int // File size; the whole file is mapped, even past the last station
+}
+
+// readExistingLayout reads the GlobalHeader of a shm file set up by someone else (an init
+// container, or a tracee that creates the mapping itself) and checks that it describes a
+// layout this engine can harvest: the right magic and layout version, slots in range, the
+// station size those slots need, and a file large enough for every station the header
+// announces.
+func readExistingLayout(f *os.File) (existingLayout, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return existingLayout{}, err
+	}
+	var raw [HeaderSize]byte
+	if _, err := f.ReadAt(raw[:], 0); err != nil {
+		if err == io.EOF {
+			return existingLayout{}, fmt.Errorf("existing shm is %d bytes, smaller than the %d-byte header", info.Size(), HeaderSize)
+		}
+		return existingLayout{}, fmt.Errorf("read existing shm header: %w", err)
+	}
+
+	// The mapping is shared with native code, so the header is in host byte order
+	var header structure.GlobalHeader
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&header)), HeaderSize), raw[:])
+	if header.MagicNum != shmMagic {
+		return existingLayout{}, fmt.Errorf("existing shm has magic %#x, want %#x (not initialised?)", header.MagicNum, uint64(shmMagic))
+	}
+	if header.Version != structure.LayoutVersion {
+		return existingLayout{}, fmt.Errorf("existing shm has layout version %d, this tracer uses %d", header.Version, structure.LayoutVersion)
+	}
+	if header.MaxStations == 0 {
+		return existingLayout{}, fmt.Errorf("existing shm header announces no stations")
+	}
+	slots := int(header.SlotsPerStation)
+	if slots < 1 || slots > structure.MaxSlotsPerStation {
+		return existingLayout{}, fmt.Errorf("existing shm header announces %d slots per station, want 1 to %d", slots, structure.MaxSlotsPerStation)
+	}
+	if want := structure.StationSizeFor(slots); int(header.StationSize) != want {
+		return existingLayout{}, fmt.Errorf("existing shm has %d-byte stations, %d slots need %d", header.StationSize, slots, want)
+	}
+	if need := MappingSize(header.MaxStations, slots); info.Size() < need {
+		return existingLayout{}, fmt.Errorf("existing shm is %d bytes, its header announces %d stations needing %d", info.Size(), header.MaxStations, need)
+	}
+
+	return existingLayout{
+		stations: header.MaxStations,
+		slots:    slots,
+		size:     int(info.Size()),
+	}, nil
+}
+
+// MaxStations is the number of stations in the mapping: the count passed to the
+// constructor, or the one read from the header with ExistingShm.
+func (e *TracerEngine) MaxStations() uint32 {
+	return e.maxStations
+}
@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+// flightRecorder keeps the most recent harvested epochs in a ring, independent of the
+// trace writer: it sits in front of pausing, sampling and the writer, so it holds every
+// epoch the harvester read even when the trace file got only some of them. The harvest
+// goroutine appends; DumpFlightRecorder copies from any goroutine, hence the mutex.
+type flightRecorder struct {
+	sink structure.EventSink // The scan's sink, set by scanSink before every scan
+
+	mu     sync.Mutex
+	events []structure.TraceEvent
+	next   int  // Where the next event goes
+	full   bool // The ring has wrapped: events[next] is the oldest
+}
+
+func newFlightRecorder(size int) *flightRecorder {
+	return &flightRecorder{events: make([]structure.TraceEvent, size)}
+}
+
+// WriteSafeSlot passes the epoch on and records it once the sink has taken it. An epoch
+// the sink refused stays in shared memory and comes back on the retry, so recording it
+// now would record it twice.
+func (r *flightRecorder) WriteSafeSlot(station *structure.StationData, slot int, safeSeq, tid, addr uint64, isActive bool, ts uint64) error {
+	if err := r.sink.WriteSafeSlot(station, slot, safeSeq, tid, addr, isActive, ts); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.events[r.next] = structure.TraceEvent{
+		ProbeID:  station.Header.ProbeID,
+		Slot:     slot,
+		TID:      tid,
+		Addr:     addr,
+		Seq:      safeSeq,
+		IsActive: isActive,
+		TS:       ts,
+	}
+	r.next++
+	if r.next == len(r.events) {
+		r.next, r.full = 0, true
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// snapshot copies the recorded events, oldest first.
+func (r *flightRecorder) snapshot() []structure.TraceEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]structure.TraceEvent(nil), r.events[:r.next]...)
+	}
+	events := make([]structure.TraceEvent, 0, len(r.events))
+	events = append(events, r.events[r.next:]...)
+	return append(events, r.events[:r.next]...)
+}
+
+// DumpFlightRecorder writes the events held by the flight recorder (see
+// EngineOptions.FlightRecorder), oldest first, to path: JSONL, or binary for .pb, with a
+// meta header and the slot of every event. The ring is copied under its lock and written
+// from the copy, so it is safe to call from any goroutine while Run is harvesting, e.g.
+// from a signal handler. The file appears under path only once complete, replacing an
+// earlier dump. It returns the number of events written.
+func (e *TracerEngine) DumpFlightRecorder(path string) (int, error) {
+	if e.recorder == nil {
+		return 0, errors.New("the flight recorder is off (EngineOptions.FlightRecorder is 0)")
+	}
+	events := e.recorder.snapshot()
+
+	encoder := structure.EncoderForPath(path)
+	switch enc := encoder.(type) {
+	case structure.JSONLEncoder:
+		encoder = structure.JSONLEncoder{Slot: true}
+	case *structure.BinaryEncoder:
+		enc.Slot = true
+	}
+	writer, err := structure.NewPartialStationWriterWithEncoder(path, encoder)
+	if err != nil {
+		return 0, fmt.Errorf("create flight recorder dump %q: %w", path, err)
+	}
+	monoNS, _ := monotonicNow()
+	meta := structure.NewTraceMeta(monoNS, time.Now().UnixNano())
+	if e.options.SlotsPerStation > structure.BaseSlotsPerStation {
+		meta.SlotsPerStation = uint32(e.options.SlotsPerStation)
+	}
+	if err := writer.WriteMeta(meta); err != nil {
+		writer.Abandon()
+		return 0, fmt.Errorf("write flight recorder dump %q: %w", path, err)
+	}
+	var station structure.StationData
+	for _, ev := range events {
+		station.Header.ProbeID = ev.ProbeID
+		if err := writer.WriteSafeSlot(&station, ev.Slot, ev.Seq, ev.TID, ev.Addr, ev.IsActive, ev.TS); err != nil {
+			writer.Abandon()
+			return 0, fmt.Errorf("write flight recorder dump %q: %w", path, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return 0, fmt.Errorf("finish flight recorder dump %q: %w", path, err)
+	}
+	return len(events), nil
+}
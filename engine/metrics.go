@@ -0,0 +1,165 @@
+package engine
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// tidCounter is an EventSink that counts events per OS thread.
+// The harvest goroutine writes it and metric scrapes read it, hence the mutex.
+type tidCounter struct {
+	mu     sync.Mutex
+	counts map[uint64]uint64
+}
+
+func newTIDCounter() *tidCounter {
+	return &tidCounter{counts: make(map[uint64]uint64)}
+}
+
+func (c *tidCounter) WriteSafeSlot(s *structure.StationData, slot int, safeSeq, tid, addr uint64, isActive bool, ts uint64) error {
+	c.mu.Lock()
+	c.counts[tid]++
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *tidCounter) snapshot() map[uint64]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[uint64]uint64, len(c.counts))
+	for tid, n := range c.counts {
+		out[tid] = n
+	}
+	return out
+}
+
+// TIDEvents returns the harvested event count per TID, or nil unless TrackTIDs is set.
+func (e *TracerEngine) TIDEvents() map[uint64]uint64 {
+	if e.tids == nil {
+		return nil
+	}
+	return e.tids.snapshot()
+}
+
+// LiveCoroutines counts allocated stations whose coroutine has not been destroyed yet.
+// It returns 0 once Close has unmapped the shm.
+func (e *TracerEngine) LiveCoroutines() int {
+	live, _, _ := e.shmGauges()
+	return live
+}
+
+// shmGauges reads the gauges that live in the shm, and reports false once it is unmapped.
+func (e *TracerEngine) shmGauges() (live int, allocated uint32, ok bool) {
+	e.unmapMu.RLock()
+	defer e.unmapMu.RUnlock()
+	if e.unmapped {
+		return 0, 0, false
+	}
+	return e.liveCoroutines(), atomic.LoadUint32(&e.header.AllocatedCount), true
+}
+
+func (e *TracerEngine) liveCoroutines() int {
+	allocated := atomic.LoadUint32(&e.header.AllocatedCount)
+	if allocated > e.maxStations {
+		allocated = e.maxStations
+	}
+	live := 0
+	for i := uint32(0); i < allocated; i++ {
+		if !e.stations[i].Header.IsDead {
+			live++
+		}
+	}
+	return live
+}
+
+// engineCollector exposes Stats, the shm gauges and the per-TID counts as Prometheus
+// metrics. Every scrape reads the engine afresh, so nothing is registered per event.
+type engineCollector struct {
+	e *TracerEngine
+}
+
+func metricDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(name, help, labels, nil)
+}
+
+var (
+	eventsDesc          = metricDesc("corotracer_events_total", "Epochs harvested from shared memory.")
+	droppedDesc         = metricDesc("corotracer_dropped_events_total", "Epochs overwritten by the probe before the tracer read them.")
+	skippedDesc         = metricDesc("corotracer_skipped_events_total", "Epochs harvested while paused and not written.")
+	writeErrorsDesc     = metricDesc("corotracer_write_errors_total", "Failed writes to the trace output, including failed retries.")
+	wakeupsDesc         = metricDesc("corotracer_wakeups_total", "UDS doorbell wakeups.")
+	spuriousWakeupsDesc = metricDesc("corotracer_spurious_wakeups_total", "Wakeups that found no new epoch.")
+	connectionsDesc     = metricDesc("corotracer_connections_total", "Tracee connections accepted; increments past 1 are reconnects.")
+	deathsDesc          = metricDesc("corotracer_coroutine_deaths_total", "Coroutine deaths recorded; only counted with -death-events.")
+	corruptionsDesc     = metricDesc("corotracer_station_corruptions_total", "Stations whose canary was clobbered; only counted with -canary.")
+	liveDesc            = metricDesc("corotracer_live_coroutines", "Allocated stations whose coroutine is still alive.")
+	exhaustedDesc       = metricDesc("corotracer_station_pool_exhausted", "1 once a coroutine was refused a station; the trace may be missing coroutines.")
+	throttleDesc        = metricDesc("corotracer_throttle_sample_every", "One-in-N sampling applied to stay under -max-write-rate; 1 writes every epoch.")
+	allocatedDesc       = metricDesc("corotracer_stations_allocated", "Stations handed out by the probe allocator.")
+	threadEventsDesc    = metricDesc("corotracer_thread_events_total", "Epochs harvested per OS thread.", "tid")
+)
+
+func (c engineCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		eventsDesc, droppedDesc, skippedDesc, writeErrorsDesc, wakeupsDesc, spuriousWakeupsDesc,
+		connectionsDesc, deathsDesc, corruptionsDesc, liveDesc, exhaustedDesc, throttleDesc,
+		allocatedDesc, threadEventsDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (c engineCollector) Collect(ch chan<- prometheus.Metric) {
+	counter := func(desc *prometheus.Desc, value uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), labels...)
+	}
+	gauge := func(desc *prometheus.Desc, value uint64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value))
+	}
+
+	stats := c.e.Stats()
+	counter(eventsDesc, stats.Events)
+	counter(droppedDesc, stats.Dropped)
+	counter(skippedDesc, stats.Skipped)
+	counter(writeErrorsDesc, stats.WriteErrors)
+	counter(wakeupsDesc, stats.Wakeups)
+	counter(spuriousWakeupsDesc, stats.SpuriousWakeups)
+	counter(connectionsDesc, stats.Connections)
+	counter(deathsDesc, stats.Deaths)
+	counter(corruptionsDesc, stats.Corruptions)
+
+	// Scrapes racing Close still get the counters; the shm gauges go with the mapping
+	if live, allocated, mapped := c.e.shmGauges(); mapped {
+		gauge(liveDesc, uint64(live))
+		gauge(allocatedDesc, uint64(allocated))
+	}
+	exhausted := uint64(0)
+	if c.e.PoolExhaustedAt() != 0 {
+		exhausted = 1
+	}
+	gauge(exhaustedDesc, exhausted)
+	gauge(throttleDesc, c.e.ThrottleSampleEvery())
+
+	for tid, n := range c.e.TIDEvents() {
+		counter(threadEventsDesc, n, strconv.FormatUint(tid, 10))
+	}
+}
+
+// MetricsCollector returns the engine's metrics as a prometheus.Collector, for embedders
+// that serve them from their own registry.
+func (e *TracerEngine) MetricsCollector() prometheus.Collector {
+	return engineCollector{e: e}
+}
+
+// MetricsHandler serves the engine's metrics in the Prometheus exposition format.
+func (e *TracerEngine) MetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(e.MetricsCollector())
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,234 @@
+package engine
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+// DefaultBackoffSleep is used when SleepScans is set but BackoffSleep is left at zero.
+const DefaultBackoffSleep = 50 * time.Microsecond
+
+// DefaultFlushInterval bounds how long harvested events may sit in the write buffer.
+const DefaultFlushInterval = 200 * time.Millisecond
+
+// StationResetPolicy decides what happens to the harvester's per-slot lastSeen seqs
+// when a station is taken over by a different coroutine or process.
+type StationResetPolicy int
+
+const (
+	// ResetNever keeps lastSeen for the engine's lifetime. Right when the probes keep
+	// counting across tracee restarts; a restarted counter is skipped until it catches up.
+	ResetNever StationResetPolicy = iota
+	// ResetOnBirthChange rearms a station whose BirthTS changed: every slot whose seq has
+	// gone backwards is harvested again from zero. Slots the new owner has not touched yet
+	// still hold the old seq and are not re-emitted.
+	ResetOnBirthChange
+)
+
+// ParseStationResetPolicy maps the CLI spelling ("never", "birth") to a policy.
+func ParseStationResetPolicy(name string) (StationResetPolicy, error) {
+	switch name {
+	case "", "never":
+		return ResetNever, nil
+	case "birth":
+		return ResetOnBirthChange, nil
+	}
+	return ResetNever, fmt.Errorf("unknown station reset policy %q (want never or birth)", name)
+}
+
+// ColdStartPolicy decides what happens to epochs already sitting in the stations when a
+// tracee connects: history written before the connection, e.g. by a tracee that ran
+// before -attach found it, or on a reused shm.
+type ColdStartPolicy int
+
+const (
+	// ColdStartEmit harvests whatever the stations hold on connect, once, like any new
+	// epoch: each slot's latest pre-existing write lands at the start of the trace.
+	ColdStartEmit ColdStartPolicy = iota
+	// ColdStartSkip snapshots every slot's seq on each connect and starts harvesting after
+	// it, so the trace holds only events written once the tracee is connected.
+	ColdStartSkip
+)
+
+// ParseColdStartPolicy maps the CLI spelling ("emit", "skip") to a policy.
+func ParseColdStartPolicy(name string) (ColdStartPolicy, error) {
+	switch name {
+	case "", "emit":
+		return ColdStartEmit, nil
+	case "skip":
+		return ColdStartSkip, nil
+	}
+	return ColdStartEmit, fmt.Errorf("unknown cold start policy %q (want emit or skip)", name)
+}
+
+// CleanupPolicy decides which of the engine's files Close removes. The wakeup socket file
+// is always removed on Close, and a stale one left by a killed tracer on the next start.
+type CleanupPolicy int
+
+const (
+	// CleanupKeepShm leaves the shm file in place, so the stations as the tracee last wrote
+	// them can be inspected post mortem. The next start recreates it.
+	CleanupKeepShm CleanupPolicy = iota
+	// CleanupRemove removes the shm file too, leaving nothing behind. A shm mapped with
+	// ExistingShm belongs to the tracee's side and is never removed.
+	CleanupRemove
+)
+
+// ParseCleanupPolicy maps the CLI spelling ("keep", "remove") to a policy.
+func ParseCleanupPolicy(name string) (CleanupPolicy, error) {
+	switch name {
+	case "", "keep":
+		return CleanupKeepShm, nil
+	case "remove":
+		return CleanupRemove, nil
+	}
+	return CleanupKeepShm, fmt.Errorf("unknown cleanup policy %q (want keep or remove)", name)
+}
+
+// EngineOptions tunes the harvester. The zero value keeps the classic behaviour
+// (plus a periodic flush), so callers only set what they need.
+type EngineOptions struct {
+	// Adaptive backoff: after the last productive scan the loop busy-spins for SpinScans
+	// empty scans, then yields with runtime.Gosched for YieldScans, then sleeps BackoffSleep
+	// for SleepScans, and only then arms the UDS wait. All zero = arm immediately.
+	SpinScans    int
+	YieldScans   int
+	SleepScans   int
+	BackoffSleep time.Duration
+
+	// StrictShmFS refuses to start when the shm file is not on tmpfs/ramfs/hugetlbfs
+	// instead of only printing a warning.
+	StrictShmFS bool
+
+	// ExistingShm maps a shm file that is already initialised, e.g. by an init container or
+	// by a tracee that creates the mapping itself, instead of recreating it. The file is not
+	// truncated and the header is left as found: MaxStations and SlotsPerStation come from
+	// it, overriding the station count and SlotsPerStation passed in.
+	ExistingShm bool
+
+	// Cleanup picks whether Close removes the shm file. Zero is CleanupKeepShm.
+	Cleanup CleanupPolicy
+
+	// HugePages backs the mapping with 2MB pages: explicitly when the shm file is on
+	// hugetlbfs, otherwise via MADV_HUGEPAGE. The path actually taken is logged.
+	HugePages bool
+
+	// Mlock pins the mapping in RAM so the kernel cannot swap stations out under memory
+	// pressure. Failure (usually RLIMIT_MEMLOCK) is logged and the engine runs unlocked.
+	Mlock bool
+
+	// IdleWarning logs a warning whenever the connected tracee has produced no events and
+	// rung no doorbell for this long, and again every IdleWarning after that. It is only a
+	// hint that the target may be wedged: a quiet process is never disconnected. Zero disables it.
+	IdleWarning time.Duration
+
+	// StationReset picks how lastSeen is handled when a station changes owner,
+	// e.g. a restarted tracee reusing the same shm. Zero is ResetNever.
+	StationReset StationResetPolicy
+
+	// ColdStart picks whether epochs written before a tracee connects are harvested.
+	// Zero is ColdStartEmit.
+	ColdStart ColdStartPolicy
+
+	// Sink additionally receives every harvested epoch, for embedding the engine as a library
+	// (see structure.SinkFunc and structure.ChannelSink). With an empty logPath it replaces
+	// the trace file instead of running alongside it. It is called on the harvest goroutine.
+	Sink structure.EventSink
+
+	// PartialOutput writes the trace to <logPath>.partial and renames it on Close,
+	// so a killed tracer never leaves a truncated file under the final name.
+	PartialOutput bool
+
+	// MinimalHex writes JSONL addresses without leading zeros, which noticeably shrinks
+	// traces. Binary output is unaffected.
+	MinimalHex bool
+
+	// RecordSlot adds the index of the station slot each epoch was read from to every
+	// event ("slot" in JSONL, field 9 in binary). Off by default to keep traces small.
+	RecordSlot bool
+
+	// TrackTIDs keeps a per-thread event count for TIDEvents and the metrics endpoint.
+	// It costs a mutex per event, so it is off by default.
+	TrackTIDs bool
+
+	// FlushInterval forces a flush of the trace file at least this often, even when the
+	// event rate is so high that the loop never reaches the flush before sleeping.
+	// Zero means DefaultFlushInterval; a negative value disables the ticker.
+	FlushInterval time.Duration
+
+	// Index writes a sidecar <logPath>.idx mapping each ProbeID to the byte offsets of its
+	// events (see structure.StationWriter.EnableIndex and export.LoadTraceIndex).
+	Index bool
+
+	// DeathEvents watches each station's IsDead flag. Once a dead coroutine's last epochs
+	// are harvested, a structure.TraceDeath record goes to the sink and the station is
+	// marked reclaimable so the SDK allocator can hand it to a new coroutine.
+	DeathEvents bool
+
+	// Canary writes structure.StationCanary into the last bytes of every station and checks
+	// it on each scan, so a probe writing past its payload area is reported (and listed by
+	// CorruptedProbes) instead of silently corrupting its neighbour. Probes must leave those
+	// bytes alone; the bundled SDKs never write the Flexible region.
+	Canary bool
+
+	// WriteErrorTimeout gives up once the trace output has been failing (e.g. a full
+	// disk) for this long: Run returns the error instead of retrying forever. While the
+	// output fails, harvesting is suspended and the write retried with backoff. Zero
+	// retries until the output recovers or the engine is stopped.
+	WriteErrorTimeout time.Duration
+
+	// SampleEvery keeps one epoch in every SampleEvery per slot, picked by seq, and
+	// consumes the rest without writing them. The rate goes into the trace's meta header.
+	// 0 or 1 writes every epoch.
+	SampleEvery int
+
+	// MaxWriteRate caps the epochs written per second. Once a second the harvest rate is
+	// compared with it, and while it is over the engine samples like SampleEvery with the
+	// smallest one-in-N that fits, never below SampleEvery itself. Every change of rate
+	// goes into the trace as a structure.TraceThrottle record. It trades completeness for
+	// keeping up: a harvester stalled on disk I/O lets the probes overrun their slots,
+	// which loses events unseen. Zero writes everything.
+	MaxWriteRate float64
+
+	// FlightRecorder keeps the last FlightRecorder harvested epochs in memory, whether or
+	// not they reached the trace (paused, sampled out), for DumpFlightRecorder. It costs a
+	// mutex per event. Zero disables it.
+	FlightRecorder int
+
+	// WakeupBufferSize is the read buffer for doorbell bytes on the wakeup connection. One
+	// read drains up to this many rings; a larger backlog takes more reads, nothing is lost.
+	// Zero means DefaultWakeupBufferSize.
+	WakeupBufferSize int
+
+	// Logger receives the engine's own messages (connections, warnings, write failures).
+	// Nil means slog.Default().
+	Logger *slog.Logger
+
+	// SlotsPerStation sizes each station's Epoch ring, 1 to structure.MaxSlotsPerStation;
+	// it is published in the GlobalHeader, with the station size it implies, so the probes
+	// cycle through the same count. Fewer slots drop more events under bursts, more widen
+	// every station past 1024 bytes. Zero means structure.BaseSlotsPerStation.
+	SlotsPerStation int
+}
+
+func (o EngineOptions) withDefaults() EngineOptions {
+	if o.SleepScans > 0 && o.BackoffSleep <= 0 {
+		o.BackoffSleep = DefaultBackoffSleep
+	}
+	if o.FlushInterval == 0 {
+		o.FlushInterval = DefaultFlushInterval
+	}
+	if o.WakeupBufferSize == 0 {
+		o.WakeupBufferSize = DefaultWakeupBufferSize
+	}
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+	if o.SlotsPerStation == 0 {
+		o.SlotsPerStation = structure.BaseSlotsPerStation
+	}
+	return o
+}
@@ -0,0 +1,46 @@
+package engine
+
+import "github.com/lixiasky-back/coroTracer/structure"
+
+// discardSink stands in for the real sink while the engine is paused.
+type discardSink struct{}
+
+func (discardSink) WriteSafeSlot(s *structure.StationData, slot int, safeSeq, tid, addr uint64, isActive bool, ts uint64) error {
+	return nil
+}
+
+// Pause keeps harvesting but stops handing epochs to the sink, so no backlog builds up
+// in the stations and the tracee stays connected. It reports whether the engine was
+// running before. Safe to call from any goroutine, e.g. a signal handler.
+func (e *TracerEngine) Pause() bool {
+	return !e.paused.Swap(true)
+}
+
+// Resume undoes Pause; epochs written from the next scan on reach the sink again.
+// It reports whether the engine was paused before.
+func (e *TracerEngine) Resume() bool {
+	return e.paused.Swap(false)
+}
+
+// Paused reports whether epochs are currently being discarded.
+func (e *TracerEngine) Paused() bool {
+	return e.paused.Load()
+}
+
+// scanSink is the sink for the current scan: discardSink while paused, otherwise the
+// real one, behind the sampling filter if there is one. The flight recorder, when on,
+// goes in front of either.
+func (e *TracerEngine) scanSink() (structure.EventSink, bool) {
+	sink, paused := e.sink, e.paused.Load()
+	switch {
+	case paused:
+		sink = discardSink{}
+	case e.sampled != nil:
+		sink = e.sampled
+	}
+	if e.recorder != nil {
+		e.recorder.sink = sink
+		return e.recorder, paused
+	}
+	return sink, paused
+}
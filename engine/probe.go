@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+// DrainOnce harvests everything currently published in shared memory and flushes it,
+// without a socket or a tracee. It is Run's inner step, exposed for tests and for
+// embedders that drive the engine on their own schedule. It must not race with Run.
+// While the output is failing, each call retries it once and harvests nothing until
+// that succeeds.
+func (e *TracerEngine) DrainOnce() (int, error) {
+	if e.failure.err != nil {
+		if e.writer != nil {
+			if err := e.writer.Retry(); err != nil {
+				e.noteWriteError(err)
+				return 0, e.failure.err
+			}
+		}
+		e.failure = writeFailure{}
+	}
+	harvested := e.doScan()
+	e.flush()
+	return harvested, e.failure.err
+}
+
+// FakeProbe writes epochs into a station exactly like the C++/Rust SDKs do, so the
+// harvesting path can be exercised from Go without a real tracee.
+type FakeProbe struct {
+	station *structure.StationData
+	slots   uint64 // Slots the engine harvests; a header 0 (all of them) is already resolved
+	events  uint64
+}
+
+// NewFakeProbe allocates the next station the way an SDK coroutine would.
+func (e *TracerEngine) NewFakeProbe(probeID, birthTS uint64) (*FakeProbe, error) {
+	var station *structure.StationData
+	if idx := atomic.AddUint32(&e.header.AllocatedCount, 1) - 1; idx < e.maxStations {
+		station = e.stations[idx]
+	} else if station = e.claimReclaimed(); station == nil {
+		return nil, fmt.Errorf("all %d stations are allocated", e.maxStations)
+	}
+	for _, store := range takeOver(station, probeID, birthTS) {
+		store()
+	}
+	return &FakeProbe{station: station, slots: uint64(e.options.SlotsPerStation)}, nil
+}
+
+// takeOver lists, in order, the stores an SDK makes to hand a station to a new owner.
+// The previous owner's death is cleared before the owner changes: a tracer that reads
+// the new owner must not also read the old IsDead, or it would finalize a live coroutine
+// and hand its station out a second time.
+func takeOver(station *structure.StationData, probeID, birthTS uint64) []func() {
+	return []func(){
+		func() { storeDead(station, false) },
+		func() { atomic.StoreUint64(&station.Header.DeathTS, 0) },
+		func() { atomic.StoreUint64(&station.Header.ProbeID, probeID) },
+		func() { atomic.StoreUint64(&station.Header.BirthTS, birthTS) },
+	}
+}
+
+// Write publishes one epoch with the SDK's SeqLock protocol: odd seq, payload, even seq.
+func (p *FakeProbe) Write(tid, addr uint64, isActive bool, ts uint64) {
+	slot := p.station.Slot(int(p.events % p.slots))
+	old := atomic.LoadUint64(&slot.Seq)
+	atomic.StoreUint64(&slot.Seq, old+1)
+	slot.TID = tid
+	slot.Addr = addr
+	slot.Timestamp = ts
+	slot.IsActive = isActive
+	atomic.StoreUint64(&slot.Seq, old+2)
+	p.events++
+}
+
+// Kill marks the coroutine as destroyed, as the SDK's destructor does: DeathTS first, then IsDead.
+func (p *FakeProbe) Kill() {
+	ts, _ := monotonicNow()
+	atomic.StoreUint64(&p.station.Header.DeathTS, ts)
+	storeDead(p.station, true)
+}
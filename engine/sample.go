@@ -0,0 +1,18 @@
+package engine
+
+import "github.com/lixiasky-back/coroTracer/structure"
+
+// sampleSink passes on one epoch in every `every` per slot. Every committed write adds 2
+// to a slot's seq, so seq/2 numbers the slot's writes and the choice needs no state: it
+// survives drops and reconnects, and lastSeen still advances past the epochs left out.
+type sampleSink struct {
+	every uint64
+	sink  structure.EventSink
+}
+
+func (s sampleSink) WriteSafeSlot(station *structure.StationData, slot int, safeSeq, tid, addr uint64, isActive bool, ts uint64) error {
+	if (safeSeq/2)%s.every != 0 {
+		return nil
+	}
+	return s.sink.WriteSafeSlot(station, slot, safeSeq, tid, addr, isActive, ts)
+}
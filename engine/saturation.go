@@ -0,0 +1,34 @@
+package engine
+
+import (
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+// checkSaturation notices the first scan after a coroutine was refused a station and
+// records it in the trace: that coroutine, and any later one, may be invisible. allocated
+// is the raw AllocatedCount, which only overshoots MaxStations once the pool is exhausted.
+func (e *TracerEngine) checkSaturation(allocated uint32) {
+	if allocated <= e.maxStations || e.exhaustedAt.Load() != 0 {
+		return
+	}
+	ts, _ := monotonicNow()
+	e.exhaustedAt.Store(ts)
+
+	msg := "station pool exhausted: a coroutine got no station, it and later ones are missing from the trace; raise -n"
+	if e.options.DeathEvents {
+		msg = "station pool exhausted: new coroutines only get a station once a dead one is reclaimed; raise -n if the trace has gaps"
+	}
+	e.log.Warn(msg, "stations", e.maxStations)
+
+	if e.writer != nil {
+		if err := e.writer.WriteSaturation(structure.NewTraceSaturation(ts, e.maxStations)); err != nil {
+			e.log.Warn("failed to record the station pool exhaustion", "error", err)
+		}
+	}
+}
+
+// PoolExhaustedAt returns the monotonic ns at which a coroutine was first found refused a
+// station, or 0 while none was. It is safe to call from any goroutine.
+func (e *TracerEngine) PoolExhaustedAt() uint64 {
+	return e.exhaustedAt.Load()
+}
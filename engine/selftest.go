@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SelfTestOptions configures RunSelfTest. Zero values mean the defaults.
+type SelfTestOptions struct {
+	// Probes is the number of generator goroutines, one station each (default 4).
+	Probes int
+	// Rate is the events per second each probe aims for; 0 writes as fast as possible.
+	Rate float64
+	// Duration is how long the probes write (default 5s).
+	Duration time.Duration
+}
+
+// SelfTestResult compares what the generators wrote with what the engine harvested.
+type SelfTestResult struct {
+	Generated uint64 // Epochs the probes published
+	Harvested uint64 // Epochs handed to the sink (Stats.Events)
+	Dropped   uint64 // Epochs overwritten before a scan reached them (Stats.Dropped)
+	Elapsed   time.Duration
+}
+
+// DropPercent is the share of generated epochs that never reached the sink.
+func (r SelfTestResult) DropPercent() float64 {
+	if r.Generated == 0 {
+		return 0
+	}
+	return 100 * float64(r.Generated-min(r.Harvested, r.Generated)) / float64(r.Generated)
+}
+
+// RunSelfTest is a built-in load generator for measuring the harvester without a C++ or
+// Rust tracee. It connects to the engine's own wakeup socket like an SDK, starts Run, and
+// has each probe goroutine publish epochs through FakeProbe, ringing the doorbell whenever
+// the tracer sleeps. Once Duration is up the engine is stopped, which drains and flushes
+// everything still in shared memory, so the result is final. The engine must be fresh:
+// neither running nor driven by DrainOnce.
+func (e *TracerEngine) RunSelfTest(options SelfTestOptions) (SelfTestResult, error) {
+	if options.Probes <= 0 {
+		options.Probes = 4
+	}
+	if options.Duration <= 0 {
+		options.Duration = 5 * time.Second
+	}
+	if options.Probes > int(e.maxStations) {
+		return SelfTestResult{}, fmt.Errorf("selftest: %d probes need as many stations, the engine has %d", options.Probes, e.maxStations)
+	}
+
+	probes := make([]*FakeProbe, options.Probes)
+	for i := range probes {
+		probe, err := e.NewFakeProbe(uint64(i+1), 0)
+		if err != nil {
+			return SelfTestResult{}, fmt.Errorf("selftest: %w", err)
+		}
+		probes[i] = probe
+	}
+
+	runErr := make(chan error, 1)
+	go func() { runErr <- e.Run() }()
+
+	address := e.SockPath()
+	network := "unix"
+	if tcp, ok := strings.CutPrefix(address, TCPSockPrefix); ok {
+		network, address = "tcp", tcp
+	}
+	doorbell, err := net.Dial(network, address)
+	if err != nil {
+		e.Stop()
+		return SelfTestResult{}, fmt.Errorf("selftest: connect to the wakeup socket: %w", err)
+	}
+	defer doorbell.Close()
+
+	// Probe timestamps come from Go's clock, anchored to CLOCK_MONOTONIC like the SDKs'
+	base, _ := monotonicNow()
+	start := time.Now()
+	deadline := start.Add(options.Duration)
+
+	// Unthrottled probes check the clock once per batch. Paced ones check it every event:
+	// a batch written back to back would overrun the slots no matter the average rate.
+	batch := 256
+	if options.Rate > 0 {
+		batch = 1
+	}
+
+	var generated atomic.Uint64
+	var wg sync.WaitGroup
+	for i, probe := range probes {
+		wg.Add(1)
+		go func(tid uint64, probe *FakeProbe) {
+			defer wg.Done()
+			wake := []byte{'1'}
+			var written uint64
+			for {
+				for range batch {
+					probe.Write(tid, written, written%2 == 0, base+uint64(time.Since(start)))
+					written++
+					if atomic.LoadUint32(&e.header.TracerSleeping) == 1 {
+						doorbell.Write(wake)
+					}
+				}
+				now := time.Now()
+				if !now.Before(deadline) {
+					break
+				}
+				if options.Rate > 0 {
+					due := start.Add(time.Duration(float64(written) / options.Rate * float64(time.Second)))
+					if wait := due.Sub(now); wait > 0 {
+						time.Sleep(min(wait, deadline.Sub(now)))
+					}
+				}
+			}
+			generated.Add(written)
+		}(uint64(i+1), probe)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	e.Stop()
+	if err := <-runErr; err != nil {
+		return SelfTestResult{}, fmt.Errorf("selftest: engine stopped: %w", err)
+	}
+
+	stats := e.Stats()
+	return SelfTestResult{
+		Generated: generated.Load(),
+		Harvested: stats.Events,
+		Dropped:   stats.Dropped,
+		Elapsed:   elapsed,
+	}, nil
+}
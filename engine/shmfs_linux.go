@@ -0,0 +1,59 @@
+//go:build linux
+
+package engine
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Filesystem magic numbers from linux/magic.h
+const (
+	tmpfsMagic     = 0x01021994 // tmpfs and /dev/shm
+	ramfsMagic     = 0x858458f6
+	hugetlbfsMagic = 0x958458f6
+)
+
+// shmFilesystem reports which filesystem backs f and whether it is memory-backed.
+// A disk-backed shm file turns every probe write into page-cache writeback traffic.
+func shmFilesystem(f *os.File) (name string, inMemory bool, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Fstatfs(int(f.Fd()), &st); err != nil {
+		return "", false, err
+	}
+	switch uint32(st.Type) {
+	case tmpfsMagic:
+		return "tmpfs", true, nil
+	case ramfsMagic:
+		return "ramfs", true, nil
+	case hugetlbfsMagic:
+		return "hugetlbfs", true, nil
+	}
+	return "disk-backed", false, nil
+}
+
+// hugePageSize is the x86-64/arm64 default huge page size; hugetlbfs files must be a multiple of it.
+const hugePageSize = 2 << 20
+
+// hugePageMapSize returns how many bytes to truncate and map for a layout of memSize bytes.
+// Only hugetlbfs needs rounding; the stations still start at the same offsets.
+func hugePageMapSize(fsName string, memSize int) int {
+	if fsName != "hugetlbfs" {
+		return memSize
+	}
+	return (memSize + hugePageSize - 1) / hugePageSize * hugePageSize
+}
+
+// adviseHugePages asks for huge-page backing and reports which path was taken.
+// On hugetlbfs the mapping already uses huge pages; on tmpfs we fall back to
+// transparent huge pages, which the kernel may still decline (shmem_enabled).
+func adviseHugePages(mmapData []byte, fsName string) string {
+	if fsName == "hugetlbfs" {
+		return "hugetlbfs (explicit 2MB pages)"
+	}
+	if err := syscall.Madvise(mmapData, syscall.MADV_HUGEPAGE); err != nil {
+		return fmt.Sprintf("normal pages (MADV_HUGEPAGE failed: %v)", err)
+	}
+	return "transparent huge pages requested (subject to /sys/kernel/mm/transparent_hugepage/shmem_enabled)"
+}
@@ -0,0 +1,15 @@
+//go:build linux
+
+package engine
+
+import "testing"
+
+func TestHugePageMapSize(t *testing.T) {
+	memSize := HeaderSize + 10*StationSize
+	if got := hugePageMapSize("tmpfs", memSize); got != memSize {
+		t.Errorf("tmpfs map size = %d, want %d", got, memSize)
+	}
+	if got := hugePageMapSize("hugetlbfs", memSize); got != 2<<20 {
+		t.Errorf("hugetlbfs map size = %d, want %d", got, 2<<20)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package engine
+
+import "os"
+
+// shmFilesystem cannot tell memory-backed filesystems apart outside Linux,
+// so it never warns there.
+func shmFilesystem(f *os.File) (name string, inMemory bool, err error) {
+	return "unknown", true, nil
+}
+
+func hugePageMapSize(fsName string, memSize int) int {
+	return memSize
+}
+
+func adviseHugePages(mmapData []byte, fsName string) string {
+	return "normal pages (huge pages are only supported on Linux)"
+}
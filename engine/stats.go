@@ -0,0 +1,49 @@
+package engine
+
+import "sync/atomic"
+
+// Stats is a point-in-time snapshot of the engine counters.
+// It is safe to take from any goroutine while Run is active.
+type Stats struct {
+	Events          uint64 // Epochs harvested and handed to the sink
+	Wakeups         uint64 // UDS doorbell wakeups (timeouts are not counted)
+	SpuriousWakeups uint64 // Wakeups after which the first scan found nothing
+	WakeupBytes     uint64 // Doorbell bytes consumed, including the drained backlog
+	Dropped         uint64 // Epochs overwritten by the probe before a scan reached them (seq jumped)
+	Connections     uint64 // Tracee connections accepted; more than one means reconnects
+	Deaths          uint64 // Coroutine deaths recorded (EngineOptions.DeathEvents)
+	Corruptions     uint64 // Stations whose canary was clobbered (EngineOptions.Canary)
+	Skipped         uint64 // Epochs harvested while paused and not handed to the sink
+	WriteErrors     uint64 // Failed writes to the trace output, including failed retries
+}
+
+// engineStats holds the live counters. Only the harvest goroutine writes them,
+// but readers may come from anywhere, so every access goes through atomics.
+type engineStats struct {
+	events          atomic.Uint64
+	wakeups         atomic.Uint64
+	spuriousWakeups atomic.Uint64
+	wakeupBytes     atomic.Uint64
+	dropped         atomic.Uint64
+	connections     atomic.Uint64
+	deaths          atomic.Uint64
+	corruptions     atomic.Uint64
+	skipped         atomic.Uint64
+	writeErrors     atomic.Uint64
+}
+
+// Stats returns a snapshot of the engine counters.
+func (e *TracerEngine) Stats() Stats {
+	return Stats{
+		Events:          e.stats.events.Load(),
+		Wakeups:         e.stats.wakeups.Load(),
+		SpuriousWakeups: e.stats.spuriousWakeups.Load(),
+		WakeupBytes:     e.stats.wakeupBytes.Load(),
+		Dropped:         e.stats.dropped.Load(),
+		Connections:     e.stats.connections.Load(),
+		Deaths:          e.stats.deaths.Load(),
+		Corruptions:     e.stats.corruptions.Load(),
+		Skipped:         e.stats.skipped.Load(),
+		WriteErrors:     e.stats.writeErrors.Load(),
+	}
+}
@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"math"
+	"time"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+// throttleWindow is how often the harvest rate is compared with MaxWriteRate.
+const throttleWindow = time.Second
+
+// throttleSink is sampleSink with a rate that follows the load. It counts every epoch
+// harvested, and once per throttleWindow picks the smallest one-in-N that keeps the epochs
+// written under MaxWriteRate, never going below the configured SampleEvery. Only the
+// harvest goroutine touches it.
+type throttleSink struct {
+	maxRate float64
+	base    uint64 // Floor for every: SampleEvery, or 1
+	every   uint64 // Current rate; the seq rule is sampleSink's
+	sink    structure.EventSink
+
+	windowStart time.Time
+	harvested   uint64 // Epochs offered since windowStart, written or not
+}
+
+func newThrottleSink(maxRate float64, base uint64, sink structure.EventSink) *throttleSink {
+	return &throttleSink{maxRate: maxRate, base: base, every: base, sink: sink, windowStart: time.Now()}
+}
+
+func (t *throttleSink) WriteSafeSlot(station *structure.StationData, slot int, safeSeq, tid, addr uint64, isActive bool, ts uint64) error {
+	t.harvested++
+	if (safeSeq/2)%t.every != 0 {
+		return nil
+	}
+	return t.sink.WriteSafeSlot(station, slot, safeSeq, tid, addr, isActive, ts)
+}
+
+// retune closes the window once it has run its length and reports whether the rate
+// changed. A window spanning an idle stretch sees a low rate and lifts the sampling.
+func (t *throttleSink) retune(now time.Time) bool {
+	elapsed := now.Sub(t.windowStart)
+	if elapsed < throttleWindow {
+		return false
+	}
+	rate := float64(t.harvested) / elapsed.Seconds()
+	t.windowStart, t.harvested = now, 0
+
+	every := max(t.base, uint64(math.Ceil(rate/t.maxRate)))
+	if every == t.every {
+		return false
+	}
+	t.every = every
+	return true
+}
+
+// checkThrottle retunes the write-rate throttle before a scan and records every change in
+// the trace, so readers know which stretches are sampled and at what rate.
+func (e *TracerEngine) checkThrottle() {
+	if e.throttle == nil || !e.throttle.retune(time.Now()) {
+		return
+	}
+	every := e.throttle.every
+	if every > e.throttle.base {
+		e.log.Warn("harvest rate over -max-write-rate, sampling to keep up", "sample_every", every, "max_rate", e.throttle.maxRate)
+	} else {
+		e.log.Info("harvest rate back under -max-write-rate", "sample_every", every)
+	}
+	e.throttleEvery.Store(every)
+
+	if e.writer != nil {
+		ts, _ := monotonicNow()
+		if err := e.writer.WriteThrottle(structure.NewTraceThrottle(ts, uint32(min(every, math.MaxUint32)))); err != nil {
+			e.log.Warn("failed to record the sampling change", "error", err)
+		}
+	}
+}
+
+// ThrottleSampleEvery is the one-in-N rate currently applied under MaxWriteRate, never
+// below SampleEvery; 1 when MaxWriteRate is unset. It is safe to call from any goroutine.
+func (e *TracerEngine) ThrottleSampleEvery() uint64 {
+	return max(e.throttleEvery.Load(), 1)
+}
@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// TCPSockPrefix marks a -sock value as a TCP address for the wakeup channel. The SDKs only
+// write single doorbell bytes to it, so TCP works wherever the UDS path is not shared, e.g.
+// between containers.
+const TCPSockPrefix = "tcp://"
+
+// DefaultWakeupBufferSize is the default for EngineOptions.WakeupBufferSize. Each doorbell
+// ring is a single byte, so one read of 1KB soaks up a long backlog of rings at once.
+const DefaultWakeupBufferSize = 1024
+
+// acceptPollInterval bounds how long Run waits in Accept before it rechecks for shutdown,
+// so stopping never depends on the listener being closed under it.
+const acceptPollInterval = 100 * time.Millisecond
+
+// listenWakeup opens the wakeup listener named by sockPath:
+//   - "tcp://host:port" listens on TCP
+//   - "@name" is a Linux abstract-namespace socket, which needs no shared filesystem path
+//   - anything else is a filesystem UDS path, replacing a stale socket file if present and
+//     removing it again when the listener is closed
+func listenWakeup(sockPath string) (net.Listener, error) {
+	if addr, ok := strings.CutPrefix(sockPath, TCPSockPrefix); ok {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("listen tcp failed: %w", err)
+		}
+		return listener, nil
+	}
+	if !strings.HasPrefix(sockPath, "@") {
+		os.Remove(sockPath)
+	}
+	listener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return nil, fmt.Errorf("listen uds failed: %w", err)
+	}
+	if unix, ok := listener.(*net.UnixListener); ok && !strings.HasPrefix(sockPath, "@") {
+		// Closing the listener removes the socket file, which is what Close relies on
+		unix.SetUnlinkOnClose(true)
+	}
+	return listener, nil
+}
+
+// SockPath is the wakeup address to hand the tracee in CTP_SOCK_PATH. It differs from the
+// configured one only for TCP, where port 0 has been resolved to the port actually bound.
+func (e *TracerEngine) SockPath() string {
+	if _, ok := e.listener.(*net.TCPListener); ok {
+		return TCPSockPrefix + e.listener.Addr().String()
+	}
+	return e.listener.Addr().String()
+}
+
+// acceptWakeup waits up to acceptPollInterval for a tracee to connect. A nil conn with a
+// nil error means the wait timed out and the caller should check for shutdown and retry.
+func (e *TracerEngine) acceptWakeup() (net.Conn, error) {
+	if listener, ok := e.listener.(interface{ SetDeadline(time.Time) error }); ok {
+		listener.SetDeadline(time.Now().Add(acceptPollInterval))
+	}
+	conn, err := e.listener.Accept()
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return nil, nil
+	}
+	return conn, err
+}
@@ -0,0 +1,55 @@
+package engine
+
+import "time"
+
+// Retry backoff for a failing trace output: doubles from writeRetryMin up to writeRetryMax.
+const (
+	writeRetryMin = 10 * time.Millisecond
+	writeRetryMax = time.Second
+)
+
+// writeFailure is the harvest goroutine's record of a sink that stopped accepting events.
+type writeFailure struct {
+	err      error
+	since    time.Time
+	attempts int
+}
+
+// noteWriteError records a sink error. Only the start of a failure streak is logged.
+func (e *TracerEngine) noteWriteError(err error) {
+	e.stats.writeErrors.Add(1)
+	if e.failure.err != nil {
+		e.failure.err = err
+		return
+	}
+	e.failure = writeFailure{err: err, since: time.Now()}
+	e.log.Error("writing the trace failed; harvesting is suspended and the write retried with backoff, epochs the probes overwrite meanwhile are counted as dropped", "error", err)
+}
+
+// retryWrites waits out the current backoff step and retries the trace file. It reports
+// whether the output works again; an embedder's sink is simply offered events again.
+func (e *TracerEngine) retryWrites() bool {
+	delay := writeRetryMin << min(e.failure.attempts, 7)
+	if delay > writeRetryMax {
+		delay = writeRetryMax
+	}
+	time.Sleep(delay)
+
+	if e.writer != nil {
+		if err := e.writer.Retry(); err != nil {
+			e.failure.attempts++
+			e.noteWriteError(err)
+			return false
+		}
+	}
+	e.log.Info("trace writes recovered", "after", time.Since(e.failure.since).Round(time.Millisecond))
+	e.failure = writeFailure{}
+	return true
+}
+
+// writeFailureExpired reports whether the output has been failing longer than
+// EngineOptions.WriteErrorTimeout allows.
+func (e *TracerEngine) writeFailureExpired() bool {
+	timeout := e.options.WriteErrorTimeout
+	return timeout > 0 && e.failure.err != nil && time.Since(e.failure.since) > timeout
+}
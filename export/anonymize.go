@@ -0,0 +1,178 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+// anonPage is the page size addresses are rebased by, so offsets within a page survive.
+const anonPage = 0x1000
+
+// AnonymizeKey undoes AnonymizeTrace. It stays with whoever made the shareable copy.
+type AnonymizeKey struct {
+	// AddrBase was subtracted from every non-null address
+	AddrBase string `json:"addr_base"`
+	// Probes maps each anonymized ProbeID back to the original
+	Probes map[uint64]uint64 `json:"probes"`
+	// Clock anchor of the first run, removed from every meta header (see structure.TraceMeta)
+	MonoNS uint64 `json:"mono_ns,omitempty"`
+	UnixNS int64  `json:"unix_ns,omitempty"`
+}
+
+// AnonymizeResult summarizes an anonymized copy.
+type AnonymizeResult struct {
+	Records int
+	Probes  int
+}
+
+// AnonymizeTrace writes a copy of a trace that is safe to share: it does not reveal the
+// binary's layout, coroutine names or when it ran.
+//   - Non-null addresses are rebased so the lowest lands in the second page. Distances
+//     between addresses and offsets within a page are kept, so stacks stay comparable.
+//   - ProbeIDs, and the ParentIDs that point at them, are renumbered 1..N in order of
+//     first appearance.
+//   - Coroutine names and the meta header's clock anchor are removed.
+//
+// Timestamps, TIDs, seqs and the other typed records are copied as they are. When keyPath
+// is set, the AnonymizeKey needed to map the copy back is written there. The output
+// encoding follows outPath's extension, and it is written as <outPath>.partial until complete.
+// maxLineBytes bounds the input's lines as in StreamJSONL.
+func AnonymizeTrace(inPath, outPath, keyPath string, maxLineBytes int) (AnonymizeResult, error) {
+	var result AnonymizeResult
+	if outPath == inPath || (keyPath != "" && (keyPath == inPath || keyPath == outPath)) {
+		return result, fmt.Errorf("anonymize %q: the output and key must be new files", inPath)
+	}
+	if err := ensureParentDir(outPath); err != nil {
+		return result, fmt.Errorf("create parent directory for anonymized output: %w", err)
+	}
+
+	// Pass 1: the lowest address and the ProbeIDs in order of appearance
+	probes := make(map[uint64]uint64)
+	key := AnonymizeKey{Probes: make(map[uint64]uint64)}
+	renumber := func(probeID uint64) uint64 {
+		if probeID == 0 {
+			return 0
+		}
+		if id, ok := probes[probeID]; ok {
+			return id
+		}
+		id := uint64(len(probes) + 1)
+		probes[probeID] = id
+		key.Probes[id] = probeID
+		return id
+	}
+	lowest := uint64(0)
+	err := streamTrace(inPath, maxLineBytes, func(record TraceRecord) error {
+		addr, err := ParseAddr(record.Addr)
+		if err != nil {
+			return err
+		}
+		if addr != 0 && (lowest == 0 || addr < lowest) {
+			lowest = addr
+		}
+		renumber(record.ProbeID)
+		renumber(record.ParentID)
+		return nil
+	}, func(payload []byte) error {
+		var death structure.TraceDeath
+		if json.Unmarshal(payload, &death) == nil && death.Type == "death" {
+			renumber(death.ProbeID)
+		}
+		var diag structure.TraceDiag
+		if decodeDiag(payload, &diag) {
+			renumber(diag.ProbeID)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	base := uint64(0)
+	if page := lowest &^ (anonPage - 1); page > anonPage {
+		base = page - anonPage
+	}
+	key.AddrBase = fmt.Sprintf("0x%016x", base)
+
+	// Pass 2: write the copy
+	encoder := structure.EncoderForPath(outPath)
+	switch e := encoder.(type) {
+	case structure.JSONLEncoder:
+		encoder = structure.JSONLEncoder{Slot: true}
+	case *structure.BinaryEncoder:
+		e.Slot = true
+	}
+	writer, err := structure.NewPartialStationWriterWithEncoder(outPath, encoder)
+	if err != nil {
+		return result, fmt.Errorf("create anonymized output %q: %w", outPath, err)
+	}
+
+	var station structure.StationData
+	streamErr := streamTrace(inPath, maxLineBytes, func(record TraceRecord) error {
+		addr, err := ParseAddr(record.Addr)
+		if err != nil {
+			return err
+		}
+		if addr != 0 {
+			addr -= base
+		}
+		station.Header.ProbeID = probes[record.ProbeID]
+		payload := station.Payload()
+		*payload = structure.FlexPayload{}
+		if record.ParentID != 0 {
+			payload.Version = structure.FlexPayloadVersion
+			payload.ParentID = probes[record.ParentID]
+		}
+		slot := -1
+		if record.Slot != nil {
+			slot = *record.Slot
+		}
+		if err := writer.WriteSafeSlot(&station, slot, record.Seq, record.TID, addr, record.IsActive, record.TS); err != nil {
+			return fmt.Errorf("write anonymized record: %w", err)
+		}
+		result.Records++
+		return nil
+	}, func(payload []byte) error {
+		var meta structure.TraceMeta
+		if json.Unmarshal(payload, &meta) == nil && meta.Type == "meta" {
+			if key.MonoNS == 0 {
+				key.MonoNS, key.UnixNS = meta.MonoNS, meta.UnixNS
+			}
+			meta.MonoNS, meta.UnixNS = 0, 0
+			return writer.WriteMeta(meta)
+		}
+		var death structure.TraceDeath
+		if json.Unmarshal(payload, &death) == nil && death.Type == "death" {
+			death.ProbeID = probes[death.ProbeID]
+			return writer.WriteDeath(death)
+		}
+		var diag structure.TraceDiag
+		if decodeDiag(payload, &diag) {
+			diag.ProbeID = probes[diag.ProbeID]
+			return writer.WriteDiag(diag)
+		}
+		return writeTypedRecord(writer, payload)
+	})
+	if streamErr != nil {
+		writer.Abandon()
+		return result, streamErr
+	}
+	if err := writer.Close(); err != nil {
+		return result, fmt.Errorf("finish anonymized output %q: %w", outPath, err)
+	}
+	result.Probes = len(probes)
+
+	if keyPath != "" {
+		data, err := json.MarshalIndent(key, "", "  ")
+		if err != nil {
+			return result, err
+		}
+		// The key re-identifies the trace, so it is private to its owner
+		if err := os.WriteFile(keyPath, append(data, '\n'), 0o600); err != nil {
+			return result, fmt.Errorf("write anonymization key %q: %w", keyPath, err)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,172 @@
+package export
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+// maxBinaryRecordSize mirrors the JSONL scanner limit; a TraceEvent is < 160 bytes,
+// so anything larger means the length prefix itself is garbage.
+const maxBinaryRecordSize = 1024 * 1024
+
+// StreamTrace walks a trace file in whichever encoding its extension implies
+// (see structure.EncoderForPath), so every exporter accepts both formats, gzipped or not.
+// maxLineBytes bounds JSONL lines as in StreamJSONL; binary traces ignore it.
+func StreamTrace(tracePath string, maxLineBytes int, fn func(record TraceRecord) error) error {
+	return streamTrace(tracePath, maxLineBytes, fn, nil)
+}
+
+// streamTrace is StreamTrace that also hands typed records to typed, in trace order.
+func streamTrace(tracePath string, maxLineBytes int, fn func(record TraceRecord) error, typed func(payload []byte) error) error {
+	if isBinaryTrace(tracePath) {
+		return streamBinary(tracePath, fn, typed)
+	}
+	return streamJSONL(tracePath, maxLineBytes, fn, typed)
+}
+
+// StreamBinary walks a length-prefixed protobuf trace written by
+// structure.BinaryEncoder, one record at a time.
+func StreamBinary(binPath string, fn func(record TraceRecord) error) error {
+	return streamBinary(binPath, fn, nil)
+}
+
+// streamBinary is StreamBinary that also hands the JSON payload of typed records
+// (meta headers, deaths) to typed, when it is set.
+func streamBinary(binPath string, fn func(record TraceRecord) error, typed func(payload []byte) error) error {
+	file, err := openTrace(binPath)
+	if err != nil {
+		return fmt.Errorf("open binary trace %q: %w", binPath, err)
+	}
+	defer file.Close()
+	return readBinary(file, fn, typed)
+}
+
+// readBinary is streamBinary's loop over an already opened, decompressed trace.
+func readBinary(r io.Reader, fn func(record TraceRecord) error, typed func(payload []byte) error) error {
+	reader := bufio.NewReaderSize(r, 128*1024)
+	body := make([]byte, 0, 64)
+
+	for recordNo := 1; ; recordNo++ {
+		size, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read binary record %d length: %w", recordNo, err)
+		}
+		if size > maxBinaryRecordSize {
+			return fmt.Errorf("read binary record %d: length %d exceeds %d bytes", recordNo, size, maxBinaryRecordSize)
+		}
+
+		if uint64(cap(body)) < size {
+			body = make([]byte, size)
+		}
+		body = body[:size]
+		if _, err := io.ReadFull(reader, body); err != nil {
+			if err == io.EOF {
+				// The length prefix was there, so the record is cut short, not absent
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("read binary record %d body: %w", recordNo, err)
+		}
+
+		if payload, meta := binaryMetaPayload(body); meta {
+			if typed != nil {
+				if err := typed(payload); err != nil {
+					return fmt.Errorf("process binary record %d: %w", recordNo, err)
+				}
+			}
+			continue
+		}
+
+		record, err := decodeBinaryRecord(body)
+		if err != nil {
+			return fmt.Errorf("decode binary record %d: %w", recordNo, err)
+		}
+
+		if err := fn(record); err != nil {
+			return fmt.Errorf("process binary record %d: %w", recordNo, err)
+		}
+	}
+}
+
+var errMalformedVarint = errors.New("malformed varint")
+
+// decodeBinaryRecord parses one TraceEvent message body. Unknown fields are
+// skipped so newer writers stay readable.
+func decodeBinaryRecord(body []byte) (TraceRecord, error) {
+	var record TraceRecord
+	var addr uint64
+
+	for len(body) > 0 {
+		tag, n := binary.Uvarint(body)
+		if n <= 0 {
+			return record, errMalformedVarint
+		}
+		body = body[n:]
+
+		field, wireType := tag>>3, tag&0x7
+		switch wireType {
+		case 0:
+			v, n := binary.Uvarint(body)
+			if n <= 0 {
+				return record, errMalformedVarint
+			}
+			body = body[n:]
+
+			switch field {
+			case structure.PBFieldProbeID:
+				record.ProbeID = v
+			case structure.PBFieldTID:
+				record.TID = v
+			case structure.PBFieldAddr:
+				addr = v
+			case structure.PBFieldSeq:
+				record.Seq = v
+			case structure.PBFieldIsActive:
+				record.IsActive = v != 0
+			case structure.PBFieldTS:
+				record.TS = v
+			case structure.PBFieldParentID:
+				record.ParentID = v
+			case structure.PBFieldSlot:
+				slot := int(v)
+				record.Slot = &slot
+			}
+		case 1:
+			if len(body) < 8 {
+				return record, io.ErrUnexpectedEOF
+			}
+			body = body[8:]
+		case 2:
+			size, n := binary.Uvarint(body)
+			if n <= 0 {
+				return record, errMalformedVarint
+			}
+			body = body[n:]
+			if uint64(len(body)) < size {
+				return record, io.ErrUnexpectedEOF
+			}
+			if field == structure.PBFieldName {
+				record.Name = string(body[:size])
+			}
+			body = body[size:]
+		case 5:
+			if len(body) < 4 {
+				return record, io.ErrUnexpectedEOF
+			}
+			body = body[4:]
+		default:
+			return record, fmt.Errorf("field %d: unsupported wire type %d", field, wireType)
+		}
+	}
+
+	// Keep the same fixed-width representation the JSONL writer uses
+	record.Addr = fmt.Sprintf("0x%016x", addr)
+	return record, nil
+}
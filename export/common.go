@@ -3,15 +3,22 @@ package export
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 const (
 	DefaultDatabaseName = "coro_tracer"
 	DefaultTableName    = "coro_trace_events"
+
+	// DefaultMaxLineBytes is the longest JSONL line the readers accept when they are
+	// given a limit of 0. A longer line is reported as an error, never silently dropped.
+	DefaultMaxLineBytes = 1024 * 1024
 )
 
 type TraceRecord struct {
@@ -21,19 +28,49 @@ type TraceRecord struct {
 	Seq      uint64 `json:"seq"`
 	IsActive bool   `json:"is_active"`
 	TS       uint64 `json:"ts"`
+
+	// Set only when the probe filled the station's FlexPayload
+	Name     string `json:"name,omitempty"`
+	ParentID uint64 `json:"parent_id,omitempty"`
+
+	// Station slot the epoch was read from; nil unless the tracer ran with -record-slot
+	Slot *int `json:"slot,omitempty"`
+}
+
+// ParseAddr reads an addr field back into a number. It accepts both the fixed 16-digit
+// form and the minimal form written with -min-hex, so compare addresses through it
+// (e.g. a null pointer is ParseAddr(addr) == 0), never by string length.
+func ParseAddr(addr string) (uint64, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(addr, "0x"), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse addr %q: %w", addr, err)
+	}
+	return v, nil
 }
 
 // StreamJSONL walks the trace JSONL file line by line so large traces can be
-// exported without loading the whole file into memory.
-func StreamJSONL(jsonlPath string, fn func(record TraceRecord) error) error {
-	file, err := os.Open(jsonlPath)
+// exported without loading the whole file into memory. Lines longer than
+// maxLineBytes (0 means DefaultMaxLineBytes) are reported as errors.
+func StreamJSONL(jsonlPath string, maxLineBytes int, fn func(record TraceRecord) error) error {
+	return streamJSONL(jsonlPath, maxLineBytes, fn, nil)
+}
+
+// streamJSONL is StreamJSONL that also hands typed lines (meta headers, deaths) to typed,
+// when it is set, in their place among the events.
+func streamJSONL(jsonlPath string, maxLineBytes int, fn func(record TraceRecord) error, typed func(payload []byte) error) error {
+	file, err := openTrace(jsonlPath)
 	if err != nil {
 		return fmt.Errorf("open jsonl %q: %w", jsonlPath, err)
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	maxLine := maxLineBytes
+	if maxLine <= 0 {
+		maxLine = DefaultMaxLineBytes
+	}
+	tail := &tailReader{Reader: file}
+	scanner := bufio.NewScanner(tail)
+	scanner.Buffer(make([]byte, 0, min(64*1024, maxLine)), maxLine)
 
 	lineNo := 0
 	for scanner.Scan() {
@@ -44,8 +81,21 @@ func StreamJSONL(jsonlPath string, fn func(record TraceRecord) error) error {
 			continue
 		}
 
+		if isMetaLine([]byte(line)) {
+			if typed != nil {
+				if err := typed([]byte(line)); err != nil {
+					return fmt.Errorf("process jsonl line %d: %w", lineNo, err)
+				}
+			}
+			continue
+		}
+
 		var record TraceRecord
 		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			// An unterminated last line is a write cut short, not corruption: say so
+			if !scanner.Scan() && scanner.Err() == nil && tail.endsMidLine() {
+				return fmt.Errorf("decode jsonl line %d: the trace ends mid-line (tracer killed?); -validate counts the damage: %w", lineNo, io.ErrUnexpectedEOF)
+			}
 			return fmt.Errorf("decode jsonl line %d: %w", lineNo, err)
 		}
 
@@ -55,6 +105,9 @@ func StreamJSONL(jsonlPath string, fn func(record TraceRecord) error) error {
 	}
 
 	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return fmt.Errorf("scan jsonl %q: line %d is longer than %d bytes (raise the max line size): %w", jsonlPath, lineNo+1, maxLine, err)
+		}
 		return fmt.Errorf("scan jsonl %q: %w", jsonlPath, err)
 	}
 
@@ -0,0 +1,125 @@
+package export
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+// ConvertResult summarizes a binary-to-JSONL conversion.
+type ConvertResult struct {
+	Records int
+	// Truncated is set when the binary trace ended mid-record, as it does when the tracer
+	// was killed. Every complete record before the cut is still converted.
+	Truncated bool
+}
+
+// ConvertBinaryToJSONL re-emits a binary (.pb/.bin) trace as canonical JSONL, byte for
+// byte what the tracer would have written with a .jsonl -out, including the meta header.
+// The output is written as <jsonlPath>.partial and renamed when complete.
+func ConvertBinaryToJSONL(binPath, jsonlPath string) (ConvertResult, error) {
+	var result ConvertResult
+	if !isBinaryTrace(binPath) {
+		return result, fmt.Errorf("%q is not a binary trace (.pb or .bin)", binPath)
+	}
+	if structure.IsBinaryTracePath(jsonlPath) {
+		return result, fmt.Errorf("output %q must not have a binary extension", jsonlPath)
+	}
+
+	if err := ensureParentDir(jsonlPath); err != nil {
+		return result, fmt.Errorf("create parent directory for jsonl output: %w", err)
+	}
+	// Slot is only written for records that carry one, so slot-less traces convert unchanged
+	writer, err := structure.NewPartialStationWriterWithEncoder(jsonlPath, structure.JSONLEncoder{Slot: true})
+	if err != nil {
+		return result, fmt.Errorf("create jsonl output %q: %w", jsonlPath, err)
+	}
+
+	var station structure.StationData
+	streamErr := streamBinary(binPath, func(record TraceRecord) error {
+		addr, err := ParseAddr(record.Addr)
+		if err != nil {
+			return err
+		}
+		station.Header.ProbeID = record.ProbeID
+		payload := station.Payload()
+		*payload = structure.FlexPayload{}
+		if record.Name != "" || record.ParentID != 0 {
+			payload.Version = structure.FlexPayloadVersion
+			payload.ParentID = record.ParentID
+			payload.SetName(record.Name)
+		}
+		slot := -1
+		if record.Slot != nil {
+			slot = *record.Slot
+		}
+		if err := writer.WriteSafeSlot(&station, slot, record.Seq, record.TID, addr, record.IsActive, record.TS); err != nil {
+			return fmt.Errorf("write jsonl record: %w", err)
+		}
+		result.Records++
+		return nil
+	}, func(payload []byte) error {
+		return writeTypedRecord(writer, payload)
+	})
+	if errors.Is(streamErr, io.ErrUnexpectedEOF) {
+		result.Truncated = true
+		streamErr = nil
+	}
+
+	if streamErr != nil {
+		writer.Abandon()
+		return result, streamErr
+	}
+	if closeErr := writer.Close(); closeErr != nil {
+		return result, fmt.Errorf("finish jsonl output %q: %w", jsonlPath, closeErr)
+	}
+	return result, nil
+}
+
+// writeTypedRecord re-emits a typed record in place, so the JSONL keeps the headers of
+// every appended run, the coroutine deaths, and the saturation, throttle and diag notes.
+func writeTypedRecord(writer *structure.StationWriter, payload []byte) error {
+	var probe struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(payload, &probe); err != nil {
+		return fmt.Errorf("decode typed record: %w", err)
+	}
+	switch probe.Type {
+	case "meta":
+		var meta structure.TraceMeta
+		if err := json.Unmarshal(payload, &meta); err != nil {
+			return fmt.Errorf("decode trace meta: %w", err)
+		}
+		return writer.WriteMeta(meta)
+	case "death":
+		var death structure.TraceDeath
+		if err := json.Unmarshal(payload, &death); err != nil {
+			return fmt.Errorf("decode death record: %w", err)
+		}
+		return writer.WriteDeath(death)
+	case "saturation":
+		var saturation structure.TraceSaturation
+		if err := json.Unmarshal(payload, &saturation); err != nil {
+			return fmt.Errorf("decode saturation record: %w", err)
+		}
+		return writer.WriteSaturation(saturation)
+	case "throttle":
+		var throttle structure.TraceThrottle
+		if err := json.Unmarshal(payload, &throttle); err != nil {
+			return fmt.Errorf("decode throttle record: %w", err)
+		}
+		return writer.WriteThrottle(throttle)
+	case "diag":
+		var diag structure.TraceDiag
+		if err := json.Unmarshal(payload, &diag); err != nil {
+			return fmt.Errorf("decode diag record: %w", err)
+		}
+		return writer.WriteDiag(diag)
+	}
+	// Unknown types come from newer tracers; they carry nothing this version can re-emit
+	return nil
+}
@@ -5,11 +5,37 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"time"
+
+	"github.com/lixiasky-back/coroTracer/structure"
 )
 
+// DataFrameExportOptions tunes the CSV export. The zero value reproduces ExportJSONLToDataFrameCSV.
+type DataFrameExportOptions struct {
+	// WallTime appends a wall_time column (RFC 3339, ns precision) computed from the
+	// trace's clock anchor. Traces without an anchor get an empty column.
+	WallTime bool
+
+	// MaxLineBytes is the longest trace line accepted; 0 means DefaultMaxLineBytes.
+	MaxLineBytes int
+}
+
 // ExportJSONLToDataFrameCSV converts the trace JSONL into CSV, which is a
 // zero-dependency DataFrame-friendly format for pandas, polars, DuckDB, and R.
 func ExportJSONLToDataFrameCSV(jsonlPath, csvPath string) error {
+	return ExportJSONLToDataFrameCSVWithOptions(jsonlPath, csvPath, DataFrameExportOptions{})
+}
+
+// ExportJSONLToDataFrameCSVWithOptions is ExportJSONLToDataFrameCSV with extra columns.
+func ExportJSONLToDataFrameCSVWithOptions(jsonlPath, csvPath string, options DataFrameExportOptions) error {
+	var meta structure.TraceMeta
+	if options.WallTime {
+		var err error
+		if meta, _, err = ReadTraceMeta(jsonlPath); err != nil {
+			return err
+		}
+	}
+
 	if err := ensureParentDir(csvPath); err != nil {
 		return fmt.Errorf("create parent directory for csv output: %w", err)
 	}
@@ -22,19 +48,31 @@ func ExportJSONLToDataFrameCSV(jsonlPath, csvPath string) error {
 
 	writer := csv.NewWriter(file)
 
-	if err := writer.Write([]string{"probe_id", "tid", "addr", "seq", "is_active", "ts"}); err != nil {
+	header := []string{"probe_id", "tid", "addr", "seq", "is_active", "ts"}
+	if options.WallTime {
+		header = append(header, "wall_time")
+	}
+	if err := writer.Write(header); err != nil {
 		return fmt.Errorf("write csv header: %w", err)
 	}
 
-	if err := StreamJSONL(jsonlPath, func(record TraceRecord) error {
-		return writer.Write([]string{
+	if err := StreamTrace(jsonlPath, options.MaxLineBytes, func(record TraceRecord) error {
+		row := []string{
 			strconv.FormatUint(record.ProbeID, 10),
 			strconv.FormatUint(record.TID, 10),
 			record.Addr,
 			strconv.FormatUint(record.Seq, 10),
 			strconv.FormatBool(record.IsActive),
 			strconv.FormatUint(record.TS, 10),
-		})
+		}
+		if options.WallTime {
+			wall := ""
+			if meta.HasClockAnchor() {
+				wall = meta.WallTime(record.TS).UTC().Format(time.RFC3339Nano)
+			}
+			row = append(row, wall)
+		}
+		return writer.Write(row)
 	}); err != nil {
 		return err
 	}
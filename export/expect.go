@@ -0,0 +1,245 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+// Expectation kinds. Durations are measured between a coroutine's consecutive events.
+const (
+	ExpectMaxSuspend    = "max-suspend"    // No suspend->resume gap longer than the duration
+	ExpectMaxActive     = "max-active"     // No resume->suspend run longer than the duration
+	ExpectMaxMigrations = "max-migrations" // No coroutine changes TID more often than this
+	ExpectMaxCoroutines = "max-coroutines" // At most this many ProbeIDs in the trace
+	ExpectMinEvents     = "min-events"     // At least this many events in the trace
+)
+
+// Expectation is one rule of an expectations file: a kind and its limit, one per line.
+//
+//	# parked coroutines must come back within half a second
+//	max-suspend 500ms
+//	max-migrations 2
+type Expectation struct {
+	Line  int
+	Kind  string
+	Limit uint64 // ns for max-suspend and max-active, a count otherwise
+	Text  string // The line as written, for messages
+}
+
+// durationRule reports whether the rule measures time between events, which sampling skews.
+func (x Expectation) durationRule() bool {
+	return x.Kind == ExpectMaxSuspend || x.Kind == ExpectMaxActive
+}
+
+// ExpectationViolation is a rule broken by one coroutine, or by the whole trace when
+// ProbeID is 0. Value is what was observed: the worst duration in ns, or the count.
+type ExpectationViolation struct {
+	Rule    Expectation
+	ProbeID uint64
+	Value   uint64
+	TS      uint64 // Where the worst duration started; 0 for counts
+}
+
+// ExpectationResult lists what CheckExpectations found.
+type ExpectationResult struct {
+	Rules      int
+	Violations int                    // Coroutines (or traces) breaking a rule, counted once per rule
+	Samples    []ExpectationViolation // The first few violations
+	// Skipped lists duration rules not checked because the trace is sampled: the gaps
+	// between kept events are not the gaps the coroutine saw.
+	Skipped []Expectation
+}
+
+// OK reports whether every checked rule held.
+func (r ExpectationResult) OK() bool {
+	return r.Violations == 0
+}
+
+// ParseExpectations reads rules, one per line; blank lines and # comments are ignored.
+func ParseExpectations(r io.Reader) ([]Expectation, error) {
+	var rules []Expectation
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want \"<kind> <limit>\", got %q", lineNo, strings.TrimSpace(text))
+		}
+		rule := Expectation{Line: lineNo, Kind: fields[0], Text: strings.Join(fields, " ")}
+		switch rule.Kind {
+		case ExpectMaxSuspend, ExpectMaxActive:
+			d, err := time.ParseDuration(fields[1])
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("line %d: %s needs a duration like 500ms, got %q", lineNo, rule.Kind, fields[1])
+			}
+			rule.Limit = uint64(d)
+		case ExpectMaxMigrations, ExpectMaxCoroutines, ExpectMinEvents:
+			n, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s needs a count, got %q", lineNo, rule.Kind, fields[1])
+			}
+			rule.Limit = n
+		default:
+			return nil, fmt.Errorf("line %d: unknown rule %q (want %s, %s, %s, %s or %s)", lineNo, rule.Kind,
+				ExpectMaxSuspend, ExpectMaxActive, ExpectMaxMigrations, ExpectMaxCoroutines, ExpectMinEvents)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// coroutineWalk is what the per-coroutine rules need from one ProbeID's events in order.
+type coroutineWalk struct {
+	maxSuspend, maxSuspendTS uint64
+	maxActive, maxActiveTS   uint64
+	migrations               uint64
+}
+
+// walkCoroutine sorts one coroutine's events like findActiveOverlaps and measures them.
+// Suspend and active spans need a matching pair of edges; a lost edge ends the span unmeasured.
+func walkCoroutine(edges []activeEdge) coroutineWalk {
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].ts != edges[j].ts {
+			return edges[i].ts < edges[j].ts
+		}
+		return edges[i].seq < edges[j].seq
+	})
+	var walk coroutineWalk
+	for i := 0; i+1 < len(edges); i++ {
+		prev, next := edges[i], edges[i+1]
+		span := next.ts - prev.ts
+		switch {
+		case !prev.active && next.active && span > walk.maxSuspend:
+			walk.maxSuspend, walk.maxSuspendTS = span, prev.ts
+		case prev.active && !next.active && span > walk.maxActive:
+			walk.maxActive, walk.maxActiveTS = span, prev.ts
+		}
+		if prev.tid != next.tid && prev.tid != 0 && next.tid != 0 {
+			walk.migrations++
+		}
+	}
+	return walk
+}
+
+// ReadExpectations parses the rules file at rulesPath (see ParseExpectations).
+func ReadExpectations(rulesPath string) ([]Expectation, error) {
+	file, err := os.Open(rulesPath)
+	if err != nil {
+		return nil, fmt.Errorf("open expectations: %w", err)
+	}
+	defer file.Close()
+	rules, err := ParseExpectations(file)
+	if err != nil {
+		return nil, fmt.Errorf("expectations %q: %w", rulesPath, err)
+	}
+	return rules, nil
+}
+
+// CheckExpectations evaluates the rules in rulesPath against a trace, turning it into a
+// test oracle for CI. Each coroutine breaking a per-coroutine rule counts once, with its
+// worst value. maxLineBytes bounds the trace's lines as in StreamJSONL.
+func CheckExpectations(tracePath, rulesPath string, maxLineBytes int) (ExpectationResult, error) {
+	rules, err := ReadExpectations(rulesPath)
+	if err != nil {
+		return ExpectationResult{}, err
+	}
+	return CheckExpectationRules(tracePath, rules, maxLineBytes)
+}
+
+// CheckExpectationRules is CheckExpectations with the rules already parsed.
+func CheckExpectationRules(tracePath string, rules []Expectation, maxLineBytes int) (ExpectationResult, error) {
+	pass := newExpectationPass()
+	if err := streamTrace(tracePath, maxLineBytes, pass.add, pass.typed); err != nil {
+		return ExpectationResult{Rules: len(rules)}, err
+	}
+	return pass.check(rules), nil
+}
+
+// expectationPass collects what the rules need in one walk over the trace, so a trace
+// that can only be read once is checked alongside its validation (see ValidateStream).
+type expectationPass struct {
+	edges   map[uint64][]activeEdge
+	events  uint64
+	sampled bool
+}
+
+func newExpectationPass() *expectationPass {
+	return &expectationPass{edges: make(map[uint64][]activeEdge)}
+}
+
+func (p *expectationPass) add(record TraceRecord) error {
+	p.events++
+	p.edges[record.ProbeID] = append(p.edges[record.ProbeID], activeEdge{record.TID, record.TS, record.Seq, record.IsActive})
+	return nil
+}
+
+func (p *expectationPass) typed(payload []byte) error {
+	var meta structure.TraceMeta
+	var throttle structure.TraceThrottle
+	if (json.Unmarshal(payload, &meta) == nil && meta.Type == "meta" && meta.SampleEvery > 1) ||
+		decodeThrottle(payload, &throttle) {
+		p.sampled = true
+	}
+	return nil
+}
+
+func (p *expectationPass) check(rules []Expectation) ExpectationResult {
+	result := ExpectationResult{Rules: len(rules)}
+	probeIDs := make([]uint64, 0, len(p.edges))
+	for probeID := range p.edges {
+		probeIDs = append(probeIDs, probeID)
+	}
+	sort.Slice(probeIDs, func(i, j int) bool { return probeIDs[i] < probeIDs[j] })
+	walks := make(map[uint64]coroutineWalk, len(p.edges))
+	for _, probeID := range probeIDs {
+		walks[probeID] = walkCoroutine(p.edges[probeID])
+	}
+
+	violate := func(rule Expectation, probeID, value, ts uint64) {
+		result.Violations++
+		if len(result.Samples) < maxReportedLines {
+			result.Samples = append(result.Samples, ExpectationViolation{Rule: rule, ProbeID: probeID, Value: value, TS: ts})
+		}
+	}
+	for _, rule := range rules {
+		if p.sampled && rule.durationRule() {
+			result.Skipped = append(result.Skipped, rule)
+			continue
+		}
+		switch rule.Kind {
+		case ExpectMinEvents:
+			if p.events < rule.Limit {
+				violate(rule, 0, p.events, 0)
+			}
+		case ExpectMaxCoroutines:
+			if n := uint64(len(probeIDs)); n > rule.Limit {
+				violate(rule, 0, n, 0)
+			}
+		default:
+			for _, probeID := range probeIDs {
+				walk := walks[probeID]
+				switch {
+				case rule.Kind == ExpectMaxSuspend && walk.maxSuspend > rule.Limit:
+					violate(rule, probeID, walk.maxSuspend, walk.maxSuspendTS)
+				case rule.Kind == ExpectMaxActive && walk.maxActive > rule.Limit:
+					violate(rule, probeID, walk.maxActive, walk.maxActiveTS)
+				case rule.Kind == ExpectMaxMigrations && walk.migrations > rule.Limit:
+					violate(rule, probeID, walk.migrations, 0)
+				}
+			}
+		}
+	}
+	return result
+}
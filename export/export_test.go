@@ -1,12 +1,34 @@
 package export
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
 )
 
 // ─── Fixtures ─────────────────────────────────────────────────────────────────
@@ -34,6 +56,33 @@ func writeTempJSONL(t *testing.T, records []TraceRecord) string {
 	return f.Name()
 }
 
+// writeTempBinary encodes records with the engine's binary encoder into a .pb file.
+func writeTempBinary(t *testing.T, records []TraceRecord) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "trace.pb")
+	enc := &structure.BinaryEncoder{}
+	var buf []byte
+	for _, r := range records {
+		var s structure.StationData
+		s.Header.ProbeID = r.ProbeID
+		if r.Name != "" || r.ParentID != 0 {
+			payload := s.Payload()
+			payload.Version = structure.FlexPayloadVersion
+			payload.ParentID = r.ParentID
+			payload.SetName(r.Name)
+		}
+		addr, err := strconv.ParseUint(strings.TrimPrefix(r.Addr, "0x"), 16, 64)
+		if err != nil {
+			t.Fatalf("parse addr %q: %v", r.Addr, err)
+		}
+		buf = enc.AppendEvent(buf, &s, 0, r.Seq, r.TID, addr, r.IsActive, r.TS)
+	}
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
 func hasBinary(name string) bool {
 	_, err := exec.LookPath(name)
 	return err == nil
@@ -46,7 +95,7 @@ func TestStreamJSONLReadsAllRecords(t *testing.T) {
 	defer os.Remove(name)
 
 	var got []TraceRecord
-	if err := StreamJSONL(name, func(r TraceRecord) error {
+	if err := StreamJSONL(name, 0, func(r TraceRecord) error {
 		got = append(got, r)
 		return nil
 	}); err != nil {
@@ -67,7 +116,7 @@ func TestStreamJSONLEmptyFile(t *testing.T) {
 	defer os.Remove(name)
 
 	var count int
-	if err := StreamJSONL(name, func(TraceRecord) error { count++; return nil }); err != nil {
+	if err := StreamJSONL(name, 0, func(TraceRecord) error { count++; return nil }); err != nil {
 		t.Fatalf("StreamJSONL empty: %v", err)
 	}
 	if count != 0 {
@@ -88,7 +137,7 @@ func TestStreamJSONLSkipsBlankLines(t *testing.T) {
 	f.Close()
 
 	var count int
-	if err := StreamJSONL(name, func(TraceRecord) error { count++; return nil }); err != nil {
+	if err := StreamJSONL(name, 0, func(TraceRecord) error { count++; return nil }); err != nil {
 		t.Fatalf("StreamJSONL blanks: %v", err)
 	}
 	if count != 1 {
@@ -97,7 +146,7 @@ func TestStreamJSONLSkipsBlankLines(t *testing.T) {
 }
 
 func TestStreamJSONLMissingFile(t *testing.T) {
-	err := StreamJSONL("/nonexistent_xyz/test.jsonl", func(TraceRecord) error { return nil })
+	err := StreamJSONL("/nonexistent_xyz/test.jsonl", 0, func(TraceRecord) error { return nil })
 	if err == nil {
 		t.Error("expected error for missing file, got nil")
 	}
@@ -110,7 +159,7 @@ func TestStreamJSONLMalformedLine(t *testing.T) {
 	f.WriteString("{not valid json}\n")
 	f.Close()
 
-	err := StreamJSONL(name, func(TraceRecord) error { return nil })
+	err := StreamJSONL(name, 0, func(TraceRecord) error { return nil })
 	if err == nil {
 		t.Error("expected error for malformed JSON, got nil")
 	}
@@ -133,7 +182,7 @@ func TestStreamJSONLLargeFile(t *testing.T) {
 	defer os.Remove(name)
 
 	var count int
-	if err := StreamJSONL(name, func(TraceRecord) error { count++; return nil }); err != nil {
+	if err := StreamJSONL(name, 0, func(TraceRecord) error { count++; return nil }); err != nil {
 		t.Fatalf("StreamJSONL large: %v", err)
 	}
 	if count != n {
@@ -306,7 +355,7 @@ func TestExportJSONLToSQLite(t *testing.T) {
 	dbPath := name + ".sqlite"
 	defer os.Remove(dbPath)
 
-	if err := ExportJSONLToSQLite(name, dbPath); err != nil {
+	if err := ExportJSONLToSQLite(name, dbPath, 0); err != nil {
 		t.Fatalf("ExportJSONLToSQLite: %v", err)
 	}
 	info, err := os.Stat(dbPath)
@@ -327,7 +376,7 @@ func TestExportJSONLToSQLiteEmpty(t *testing.T) {
 	dbPath := name + ".sqlite"
 	defer os.Remove(dbPath)
 
-	if err := ExportJSONLToSQLite(name, dbPath); err != nil {
+	if err := ExportJSONLToSQLite(name, dbPath, 0); err != nil {
 		t.Fatalf("ExportJSONLToSQLite empty: %v", err)
 	}
 }
@@ -342,7 +391,7 @@ func TestExportJSONLToSQLiteRowCount(t *testing.T) {
 	dbPath := name + ".sqlite"
 	defer os.Remove(dbPath)
 
-	ExportJSONLToSQLite(name, dbPath)
+	ExportJSONLToSQLite(name, dbPath, 0)
 
 	out, err := exec.Command("sqlite3", dbPath,
 		"SELECT COUNT(*) FROM "+DefaultTableName+";").Output()
@@ -564,3 +613,1288 @@ func TestDefaultNames(t *testing.T) {
 		t.Error("DefaultTableName is empty")
 	}
 }
+
+// ─── Binary traces ────────────────────────────────────────────────────────────
+
+func TestStreamTraceBinaryRoundTrip(t *testing.T) {
+	path := writeTempBinary(t, sampleRecords)
+
+	var got []TraceRecord
+	if err := StreamTrace(path, 0, func(r TraceRecord) error {
+		got = append(got, r)
+		return nil
+	}); err != nil {
+		t.Fatalf("StreamTrace: %v", err)
+	}
+	if len(got) != len(sampleRecords) {
+		t.Fatalf("got %d records, want %d", len(got), len(sampleRecords))
+	}
+	for i := range got {
+		if got[i] != sampleRecords[i] {
+			t.Errorf("record %d = %+v, want %+v", i, got[i], sampleRecords[i])
+		}
+	}
+}
+
+func TestStreamTraceBinaryTruncated(t *testing.T) {
+	path := writeTempBinary(t, sampleRecords)
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, data[:len(data)-3], 0o644)
+
+	err := StreamTrace(path, 0, func(TraceRecord) error { return nil })
+	if err == nil {
+		t.Fatal("expected error for truncated binary trace")
+	}
+}
+
+func TestDecodeBinaryRecordSkipsUnknownFields(t *testing.T) {
+	body := []byte{
+		0x08, 7, // probe_id = 7
+		0x7a, 2, 'h', 'i', // field 15, length-delimited
+		0x30, 5, // ts = 5
+	}
+	record, err := decodeBinaryRecord(body)
+	if err != nil {
+		t.Fatalf("decodeBinaryRecord: %v", err)
+	}
+	if record.ProbeID != 7 || record.TS != 5 || record.Addr != "0x0000000000000000" {
+		t.Errorf("record = %+v", record)
+	}
+}
+
+func TestExportDataFrameCSVFromBinary(t *testing.T) {
+	in := writeTempBinary(t, sampleRecords)
+	out := filepath.Join(t.TempDir(), "out.csv")
+
+	if err := ExportJSONLToDataFrameCSV(in, out); err != nil {
+		t.Fatalf("ExportJSONLToDataFrameCSV: %v", err)
+	}
+	f, _ := os.Open(out)
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("read csv: %v", err)
+	}
+	if len(rows) != len(sampleRecords)+1 {
+		t.Errorf("csv rows = %d, want %d", len(rows), len(sampleRecords)+1)
+	}
+}
+
+// ─── ValidateTrace ────────────────────────────────────────────────────────────
+
+func TestValidateTraceClean(t *testing.T) {
+	name := writeTempJSONL(t, sampleRecords)
+	defer os.Remove(name)
+
+	report, err := ValidateTrace(name, 0)
+	if err != nil {
+		t.Fatalf("ValidateTrace: %v", err)
+	}
+	if !report.OK() || report.Records != len(sampleRecords) {
+		t.Errorf("clean trace: %+v", report)
+	}
+}
+
+func TestValidateTraceFindsProblems(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.jsonl")
+	var b strings.Builder
+	b.WriteString(`{"probe_id":1,"tid":1,"addr":"0x1","seq":2,"is_active":true,"ts":1}` + "\n")
+	b.WriteString(`{"probe_id":1,"tid":1,"addr":"0x1","seq":2,"is_active":true,"ts":1}` + "\n") // duplicate
+	b.WriteString(`{"probe_id":1,"tid":1,"addr":"0x1","seq":3,"is_active":true,"ts":2}` + "\n") // odd seq
+	b.WriteString("not json\n")
+	b.WriteString(`{"probe_id":1,"addr":"` + strings.Repeat("f", 100) + `"}` + "\n") // too long for a 64-byte buffer
+	// ProbeID 9 reaches seq 2 nine times: more than the 8 slots allow
+	for i := 0; i < 9; i++ {
+		b.WriteString(`{"probe_id":9,"tid":1,"addr":"0x1","seq":2,"is_active":false,"ts":` + strconv.Itoa(10+i) + "}\n")
+	}
+	os.WriteFile(path, []byte(b.String()), 0o644)
+
+	report, err := ValidateTrace(path, 80)
+	if err != nil {
+		t.Fatalf("ValidateTrace: %v", err)
+	}
+	if report.OK() {
+		t.Fatal("expected problems")
+	}
+	if report.DuplicateRecords != 1 {
+		t.Errorf("DuplicateRecords = %d, want 1", report.DuplicateRecords)
+	}
+	if report.OddSeqs != 1 {
+		t.Errorf("OddSeqs = %d, want 1", report.OddSeqs)
+	}
+	if report.Malformed != 1 || len(report.MalformedLines) != 1 || report.MalformedLines[0] != 4 {
+		t.Errorf("Malformed = %d at %v, want 1 at [4]", report.Malformed, report.MalformedLines)
+	}
+	if report.TooLong != 1 || report.TooLongLines[0] != 5 {
+		t.Errorf("TooLong = %d at %v, want 1 at [5]", report.TooLong, report.TooLongLines)
+	}
+	if len(report.DuplicateProbes) != 1 || report.DuplicateProbes[0] != 9 {
+		t.Errorf("DuplicateProbes = %v, want [9]", report.DuplicateProbes)
+	}
+}
+
+func TestValidateTraceSeqOrderPerSlot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slots.jsonl")
+	lines := []string{
+		`{"probe_id":3,"tid":1,"addr":"0x1","slot":0,"seq":2,"is_active":true,"ts":1}`,
+		`{"probe_id":3,"tid":1,"addr":"0x1","slot":1,"seq":2,"is_active":false,"ts":2}`,
+		`{"probe_id":3,"tid":1,"addr":"0x1","slot":0,"seq":4,"is_active":true,"ts":3}`,
+		`{"probe_id":3,"tid":1,"addr":"0x1","slot":1,"seq":4,"is_active":false,"ts":4}`,
+	}
+	os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644)
+	if report, err := ValidateTrace(path, 0); err != nil || !report.OK() {
+		t.Fatalf("in-order slots: %+v, %v", report, err)
+	}
+
+	// Slot 0 goes back to seq 2 after reaching 4
+	lines = append(lines, `{"probe_id":3,"tid":1,"addr":"0x1","slot":0,"seq":2,"is_active":false,"ts":5}`)
+	os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644)
+	report, err := ValidateTrace(path, 0)
+	if err != nil {
+		t.Fatalf("ValidateTrace: %v", err)
+	}
+	if report.OK() || report.SeqRegressions != 1 || len(report.DuplicateProbes) != 0 {
+		t.Errorf("regressed slot: %+v", report)
+	}
+}
+
+func TestValidateTraceWideStationsRepeatSeqs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wide.jsonl")
+	lines := []string{`{"type":"meta","version":2,"mono_ns":0,"unix_ns":0,"slots_per_station":12}`}
+	// Each of 12 slots reaches seq 2 once: one coroutine, not twelve
+	for i := 0; i < 12; i++ {
+		lines = append(lines, fmt.Sprintf(`{"probe_id":3,"tid":1,"addr":"0x1","seq":2,"is_active":%t,"ts":%d}`, i%2 == 0, i+1))
+	}
+	os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644)
+	report, err := ValidateTrace(path, 0)
+	if err != nil {
+		t.Fatalf("ValidateTrace: %v", err)
+	}
+	if len(report.DuplicateProbes) != 0 {
+		t.Errorf("DuplicateProbes = %v on a 12-slot trace, want none", report.DuplicateProbes)
+	}
+}
+
+func TestValidateTraceBinaryTruncated(t *testing.T) {
+	path := writeTempBinary(t, sampleRecords)
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, data[:len(data)-2], 0o644)
+
+	report, err := ValidateTrace(path, 0)
+	if err != nil {
+		t.Fatalf("ValidateTrace: %v", err)
+	}
+	if report.ReadError == "" || !report.TornTail || report.Records != len(sampleRecords)-1 {
+		t.Errorf("truncated binary: %+v", report)
+	}
+}
+
+func TestTornJSONLTailIsReported(t *testing.T) {
+	dir := t.TempDir()
+	line, _ := json.Marshal(sampleRecords[0])
+	torn := filepath.Join(dir, "torn.jsonl")
+	os.WriteFile(torn, append(append(line, '\n'), line[:len(line)/2]...), 0o644)
+	corrupt := filepath.Join(dir, "corrupt.jsonl")
+	os.WriteFile(corrupt, append([]byte("not json\n"), append(line, '\n')...), 0o644)
+
+	err := StreamJSONL(torn, 0, func(TraceRecord) error { return nil })
+	if !errors.Is(err, io.ErrUnexpectedEOF) || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("torn tail: error = %v, want ErrUnexpectedEOF naming line 2", err)
+	}
+	err = StreamJSONL(corrupt, 0, func(TraceRecord) error { return nil })
+	if err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("corrupt line: error = %v, want a plain decode error", err)
+	}
+
+	report, err := ValidateTrace(torn, 0)
+	if err != nil {
+		t.Fatalf("ValidateTrace: %v", err)
+	}
+	if !report.TornTail || report.Malformed != 1 || report.Records != 1 {
+		t.Errorf("torn tail: %+v", report)
+	}
+	report, err = ValidateTrace(corrupt, 0)
+	if err != nil {
+		t.Fatalf("ValidateTrace: %v", err)
+	}
+	if report.TornTail || report.Malformed != 1 {
+		t.Errorf("corrupt line: %+v", report)
+	}
+}
+
+func TestValidateTraceActiveOverlap(t *testing.T) {
+	records := []TraceRecord{
+		// Probes 1 and 2 both run on TID 7 during 15..20
+		{ProbeID: 1, TID: 7, Seq: 2, IsActive: true, TS: 10},
+		{ProbeID: 1, TID: 7, Seq: 4, IsActive: false, TS: 20},
+		{ProbeID: 2, TID: 7, Seq: 2, IsActive: true, TS: 15},
+		{ProbeID: 2, TID: 7, Seq: 4, IsActive: false, TS: 30},
+		// Probe 3 starts as probe 2 suspends: touching, not overlapping
+		{ProbeID: 3, TID: 7, Seq: 2, IsActive: true, TS: 30},
+		{ProbeID: 3, TID: 7, Seq: 4, IsActive: false, TS: 40},
+		// Probe 4 overlaps in time but on another thread
+		{ProbeID: 4, TID: 8, Seq: 2, IsActive: true, TS: 12},
+		{ProbeID: 4, TID: 8, Seq: 4, IsActive: false, TS: 35},
+		// Probe 5 lost its suspend: the window is dropped instead of running to ts 50
+		{ProbeID: 5, TID: 7, Seq: 2, IsActive: true, TS: 5},
+		{ProbeID: 5, TID: 7, Seq: 4, IsActive: true, TS: 50},
+	}
+	path := writeTempJSONL(t, records)
+	defer os.Remove(path)
+
+	report, err := ValidateTrace(path, 0)
+	if err != nil {
+		t.Fatalf("ValidateTrace: %v", err)
+	}
+	want := ActiveOverlap{TID: 7, ProbeA: 1, ProbeB: 2, FromTS: 15, ToTS: 20}
+	if report.OK() || report.ActiveOverlaps != 1 || len(report.OverlapSamples) != 1 || report.OverlapSamples[0] != want {
+		t.Errorf("overlaps = %d %+v, want 1 %+v", report.ActiveOverlaps, report.OverlapSamples, want)
+	}
+
+	// A sampled trace is missing edges by design, so the check is skipped
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, append([]byte(`{"type":"meta","version":2,"mono_ns":0,"unix_ns":0,"sample_every":4}`+"\n"), data...), 0o644)
+	if report, _ := ValidateTrace(path, 0); !report.OK() {
+		t.Errorf("sampled trace: %+v", report)
+	}
+	// So is a trace the write-rate throttle sampled part of
+	os.WriteFile(path, append([]byte(`{"type":"throttle","ts":1,"sample_every":2}`+"\n"), data...), 0o644)
+	if report, _ := ValidateTrace(path, 0); !report.OK() {
+		t.Errorf("throttled trace: %+v", report)
+	}
+}
+
+func TestValidateTraceSkipsOverlapsAcrossGaps(t *testing.T) {
+	lines := []string{
+		`{"probe_id":1,"tid":7,"addr":"0x0","seq":2,"is_active":true,"ts":10}`,
+		// Probe 1's suspend at seq 4 and resume at seq 6 were lapped before the harvest
+		`{"type":"diag","kind":"gap","ts":25,"station":0,"probe_id":1,"count":2}`,
+		`{"probe_id":2,"tid":7,"addr":"0x0","seq":2,"is_active":true,"ts":20}`,
+		`{"probe_id":2,"tid":7,"addr":"0x0","seq":4,"is_active":false,"ts":30}`,
+		`{"probe_id":1,"tid":7,"addr":"0x0","seq":8,"is_active":false,"ts":40}`,
+	}
+	path := filepath.Join(t.TempDir(), "gapped.jsonl")
+	os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644)
+	report, err := ValidateTrace(path, 0)
+	if err != nil {
+		t.Fatalf("ValidateTrace: %v", err)
+	}
+	if !report.OK() || report.ActiveOverlaps != 0 || report.LostEpochs != 2 {
+		t.Errorf("gapped trace: %+v", report)
+	}
+
+	// Without the gap record, probe 1's window pairs resume 10 with suspend 40
+	os.WriteFile(path, []byte(strings.Join(append(lines[:1:1], lines[2:]...), "\n")+"\n"), 0o644)
+	if report, _ := ValidateTrace(path, 0); report.ActiveOverlaps != 1 {
+		t.Errorf("ungapped trace: overlaps = %d, want 1", report.ActiveOverlaps)
+	}
+}
+
+func TestValidateTraceMissingFile(t *testing.T) {
+	if _, err := ValidateTrace("/nonexistent/trace.jsonl", 0); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+// ─── Compressed input ─────────────────────────────────────────────────────────
+
+// gzipCopy writes a gzip-compressed copy of src to dst.
+func gzipCopy(t *testing.T, src, dst string) {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	gz.Close()
+	if err := os.WriteFile(dst, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+func TestReadersAcceptGzip(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct{ src, gz string }{
+		{writeTraceWithMeta(t, "trace.jsonl"), "trace.jsonl.gz"},
+		{writeTraceWithMeta(t, "trace.pb"), "trace.pb.gz"},
+		// Magic bytes are enough without the suffix
+		{writeTraceWithMeta(t, "trace.jsonl"), "renamed.jsonl"},
+	} {
+		path := filepath.Join(dir, tc.gz)
+		gzipCopy(t, tc.src, path)
+
+		var records int
+		if err := StreamTrace(path, 0, func(TraceRecord) error { records++; return nil }); err != nil || records != 1 {
+			t.Errorf("StreamTrace(%s) = %d records, %v", tc.gz, records, err)
+		}
+		if _, ok, err := ReadTraceMeta(path); !ok || err != nil {
+			t.Errorf("ReadTraceMeta(%s) = %v, %v", tc.gz, ok, err)
+		}
+		if report, err := ValidateTrace(path, 0); err != nil || !report.OK() || report.Records != 1 {
+			t.Errorf("ValidateTrace(%s) = %+v, %v", tc.gz, report, err)
+		}
+	}
+
+	out := filepath.Join(dir, "converted.jsonl")
+	if result, err := ConvertBinaryToJSONL(filepath.Join(dir, "trace.pb.gz"), out); err != nil || result.Records != 1 {
+		t.Errorf("ConvertBinaryToJSONL(.pb.gz) = %+v, %v", result, err)
+	}
+}
+
+func TestReadersRejectZstdAndFakeGzip(t *testing.T) {
+	dir := t.TempDir()
+	zst := filepath.Join(dir, "trace.jsonl.zst")
+	os.WriteFile(zst, []byte{0x28, 0xb5, 0x2f, 0xfd, 0, 0}, 0o644)
+	if err := StreamTrace(zst, 0, func(TraceRecord) error { return nil }); !errors.Is(err, ErrZstdUnsupported) {
+		t.Errorf("zstd trace: %v, want ErrZstdUnsupported", err)
+	}
+
+	fake := filepath.Join(dir, "trace.jsonl.gz")
+	os.WriteFile(fake, []byte(`{"probe_id":1}`+"\n"), 0o644)
+	if err := StreamTrace(fake, 0, func(TraceRecord) error { return nil }); err == nil {
+		t.Error("plain data behind a .gz suffix was accepted")
+	}
+	if _, err := RebuildTraceIndex(fake); err == nil {
+		t.Error("compressed trace was indexed")
+	}
+}
+
+// ─── SpoolTrace ───────────────────────────────────────────────────────────────
+
+func TestSpoolTraceSniffsEncoding(t *testing.T) {
+	for _, path := range []string{writeTempJSONL(t, sampleRecords), writeTempBinary(t, sampleRecords)} {
+		data, _ := os.ReadFile(path)
+		spooled, err := SpoolTrace(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("SpoolTrace: %v", err)
+		}
+		defer os.Remove(spooled)
+
+		if filepath.Ext(spooled) != filepath.Ext(path) {
+			t.Errorf("%s spooled as %s", filepath.Ext(path), spooled)
+		}
+		report, err := ValidateTrace(spooled, 0)
+		if err != nil || !report.OK() || report.Records != len(sampleRecords) {
+			t.Errorf("spooled %s: %+v, %v", filepath.Ext(path), report, err)
+		}
+	}
+
+	gz := filepath.Join(t.TempDir(), "trace.pb.gz")
+	gzipCopy(t, writeTempBinary(t, sampleRecords), gz)
+	data, _ := os.ReadFile(gz)
+	spooled, err := SpoolTrace(bytes.NewReader(data))
+	if err != nil || filepath.Ext(spooled) != ".pb" {
+		t.Fatalf("SpoolTrace(gzip) = %q, %v", spooled, err)
+	}
+	os.Remove(spooled)
+}
+
+func TestSpoolInputReadsNamedPipe(t *testing.T) {
+	fifo := filepath.Join(t.TempDir(), "trace.fifo")
+	if err := syscall.Mkfifo(fifo, 0o600); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	if !IsNamedPipe(fifo) || IsNamedPipe(writeTempJSONL(t, sampleRecords)) {
+		t.Fatal("IsNamedPipe does not tell a FIFO from a file")
+	}
+
+	// The writer arrives after the reader and sends the trace in two chunks
+	data, _ := os.ReadFile(writeTempBinary(t, sampleRecords))
+	go func() {
+		pipe, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		pipe.Write(data[:len(data)/2])
+		time.Sleep(20 * time.Millisecond)
+		pipe.Write(data[len(data)/2:])
+		pipe.Close()
+	}()
+	spooled, ok, err := SpoolInput(fifo)
+	if err != nil || !ok {
+		t.Fatalf("SpoolInput(fifo) = %q, %v, %v", spooled, ok, err)
+	}
+	defer os.Remove(spooled)
+	if report, err := ValidateTrace(spooled, 0); err != nil || !report.OK() || report.Records != len(sampleRecords) {
+		t.Errorf("spooled FIFO: %+v, %v", report, err)
+	}
+
+	path := writeTempJSONL(t, sampleRecords)
+	if got, ok, err := SpoolInput(path); got != path || ok || err != nil {
+		t.Errorf("SpoolInput(file) = %q, %v, %v", got, ok, err)
+	}
+}
+
+func TestValidateStreamReadsNamedPipeWithoutSpooling(t *testing.T) {
+	data, _ := os.ReadFile(writeTempJSONL(t, sampleRecords))
+	fifo := filepath.Join(t.TempDir(), "trace.fifo")
+	if err := syscall.Mkfifo(fifo, 0o600); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	spool := t.TempDir()
+	t.Setenv("TMPDIR", spool)
+
+	go func() {
+		pipe, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		pipe.Write(data[:len(data)/2])
+		time.Sleep(20 * time.Millisecond)
+		pipe.Write(data[len(data)/2:])
+		pipe.Close()
+	}()
+	stream, err := OpenStream(fifo)
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	defer stream.Close()
+	rules, _ := ParseExpectations(strings.NewReader("min-events 1\nmax-coroutines 0\n"))
+	report, expectations, err := ValidateStream(stream, "trace.fifo", 0, rules)
+	if err != nil || !report.OK() || report.Records != len(sampleRecords) {
+		t.Fatalf("ValidateStream(fifo) = %+v, %v", report, err)
+	}
+	// Both rules were checked in the same pass: the coroutine count breaks the second
+	if expectations.Rules != 2 || expectations.Violations != 1 || expectations.Samples[0].Rule.Kind != ExpectMaxCoroutines {
+		t.Errorf("expectations = %+v", expectations)
+	}
+	if entries, _ := os.ReadDir(spool); len(entries) != 0 {
+		t.Errorf("the stream was copied to disk: %v", entries)
+	}
+}
+
+func TestValidateStreamSniffsEncoding(t *testing.T) {
+	gz := filepath.Join(t.TempDir(), "trace.pb.gz")
+	gzipCopy(t, writeTempBinary(t, sampleRecords), gz)
+	for _, path := range []string{writeTempJSONL(t, sampleRecords), writeTempBinary(t, sampleRecords), gz} {
+		data, _ := os.ReadFile(path)
+		report, _, err := ValidateStream(bytes.NewReader(data), "stdin", 0, nil)
+		if err != nil || !report.OK() || report.Records != len(sampleRecords) {
+			t.Errorf("%s: %+v, %v", filepath.Base(path), report, err)
+		}
+	}
+}
+
+// ─── Line length limit ────────────────────────────────────────────────────────
+
+func TestStreamJSONLReportsTooLongLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "long.jsonl")
+	line, _ := json.Marshal(sampleRecords[0])
+	content := string(line) + "\n" + `{"probe_id":1,"addr":"` + strings.Repeat("a", 200) + `"}` + "\n"
+	os.WriteFile(path, []byte(content), 0o644)
+
+	err := StreamJSONL(path, 128, func(TraceRecord) error { return nil })
+	if err == nil {
+		t.Fatal("expected an error for a line over maxLineBytes")
+	}
+	if !errors.Is(err, bufio.ErrTooLong) || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("error = %v, want ErrTooLong naming line 2", err)
+	}
+}
+
+// ─── Trace meta header ────────────────────────────────────────────────────────
+
+// writeTraceWithMeta writes a meta header and one event through the engine's writer.
+func writeTraceWithMeta(t *testing.T, name string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	sw, err := structure.NewStationWriter(path)
+	if err != nil {
+		t.Fatalf("NewStationWriter: %v", err)
+	}
+	if err := sw.WriteMeta(structure.NewTraceMeta(1_000, 1_700_000_000_000_000_000)); err != nil {
+		t.Fatalf("WriteMeta: %v", err)
+	}
+	var s structure.StationData
+	s.Header.ProbeID = 7
+	if err := sw.WriteSafeSlot(&s, 0, 2, 1, 0x10, true, 3_000); err != nil {
+		t.Fatalf("WriteSafeSlot: %v", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return path
+}
+
+func TestStreamTraceSkipsMeta(t *testing.T) {
+	for _, name := range []string{"trace.jsonl", "trace.pb"} {
+		path := writeTraceWithMeta(t, name)
+
+		var got []TraceRecord
+		if err := StreamTrace(path, 0, func(r TraceRecord) error {
+			got = append(got, r)
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: StreamTrace: %v", name, err)
+		}
+		if len(got) != 1 || got[0].ProbeID != 7 {
+			t.Errorf("%s: records = %+v, want the single event", name, got)
+		}
+
+		report, err := ValidateTrace(path, 0)
+		if err != nil || !report.OK() || report.Records != 1 {
+			t.Errorf("%s: ValidateTrace = %+v, %v", name, report, err)
+		}
+	}
+}
+
+func TestReadTraceMeta(t *testing.T) {
+	for _, name := range []string{"trace.jsonl", "trace.pb"} {
+		meta, ok, err := ReadTraceMeta(writeTraceWithMeta(t, name))
+		if err != nil || !ok {
+			t.Fatalf("%s: ReadTraceMeta ok=%v err=%v", name, ok, err)
+		}
+		if meta.MonoNS != 1_000 || meta.UnixNS != 1_700_000_000_000_000_000 {
+			t.Errorf("%s: meta = %+v", name, meta)
+		}
+	}
+
+	// Traces from before the header existed simply have none
+	_, ok, err := ReadTraceMeta(writeTempJSONL(t, sampleRecords))
+	if err != nil || ok {
+		t.Errorf("legacy trace: ok=%v err=%v, want no meta", ok, err)
+	}
+}
+
+func TestExportDataFrameCSVWallTime(t *testing.T) {
+	csvPath := filepath.Join(t.TempDir(), "out.csv")
+	if err := ExportJSONLToDataFrameCSVWithOptions(writeTraceWithMeta(t, "trace.jsonl"), csvPath,
+		DataFrameExportOptions{WallTime: true}); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+
+	data, _ := os.ReadFile(csvPath)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], ",wall_time") {
+		t.Fatalf("csv = %q", data)
+	}
+	if !strings.HasSuffix(lines[1], ",2023-11-14T22:13:20.000002Z") {
+		t.Errorf("row = %q, want wall time 2µs after the anchor", lines[1])
+	}
+}
+
+// ─── OTLP export ──────────────────────────────────────────────────────────────
+
+// fakeCollector is an OTLP/gRPC trace service that keeps every span it receives.
+type fakeCollector struct {
+	coltracepb.UnimplementedTraceServiceServer
+	mu     sync.Mutex
+	spans  []*tracepb.Span
+	reject int64 // Spans to report as rejected in each response
+}
+
+func (c *fakeCollector) Export(_ context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	resp := &coltracepb.ExportTraceServiceResponse{}
+	if c.reject > 0 {
+		resp.PartialSuccess = &coltracepb.ExportTracePartialSuccess{RejectedSpans: c.reject, ErrorMessage: "over quota"}
+	}
+	return resp, nil
+}
+
+func (c *fakeCollector) received() []*tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*tracepb.Span(nil), c.spans...)
+}
+
+// collectOTLP starts a fake OTLP/gRPC collector and returns its host:port.
+func collectOTLP(t *testing.T) (string, *fakeCollector) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := &fakeCollector{}
+	srv := grpc.NewServer()
+	coltracepb.RegisterTraceServiceServer(srv, collector)
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+	return ln.Addr().String(), collector
+}
+
+func TestExportOTLPActiveWindowsBecomeSpans(t *testing.T) {
+	endpoint, collector := collectOTLP(t)
+	path := writeTempJSONL(t, []TraceRecord{
+		// Harvested in slot order: the suspension is emitted before its activation
+		{ProbeID: 1, TID: 7, Addr: "0x00000000000000aa", Seq: 2, IsActive: false, TS: 20},
+		{ProbeID: 1, TID: 7, Addr: "0x00000000000000bb", Seq: 2, IsActive: true, TS: 10},
+		{ProbeID: 1, TID: 8, Addr: "0x00000000000000cc", Seq: 2, IsActive: true, TS: 30},
+	})
+
+	if err := ExportJSONLToOTLP(path, OTLPExportOptions{Endpoint: endpoint, BatchSize: 1}); err != nil {
+		t.Fatalf("ExportJSONLToOTLP: %v", err)
+	}
+
+	got := collector.received()
+	if len(got) != 2 {
+		t.Fatalf("spans = %+v, want 2", got)
+	}
+	first := got[0]
+	if hex.EncodeToString(first.TraceId) != "00000000000000000000000000000001" || hex.EncodeToString(first.SpanId) != "0000000000000001" {
+		t.Errorf("ids = %x/%x", first.TraceId, first.SpanId)
+	}
+	if first.StartTimeUnixNano != 10 || first.EndTimeUnixNano != 20 {
+		t.Errorf("window = %d..%d, want 10..20", first.StartTimeUnixNano, first.EndTimeUnixNano)
+	}
+	if addr := first.Attributes[2].Value.GetStringValue(); addr != "0x00000000000000bb" {
+		t.Errorf("addr attribute = %q, want the activation's addr", addr)
+	}
+	// Still running at the end of the trace
+	if last := got[1].Attributes[len(got[1].Attributes)-1]; last.Key != "coro.unfinished" {
+		t.Errorf("open window not marked unfinished: %+v", got[1].Attributes)
+	}
+}
+
+func TestGenerateOTLPReportsRejectedSpans(t *testing.T) {
+	endpoint, collector := collectOTLP(t)
+	collector.reject = 1
+
+	err := GenerateOTLP(writeTempJSONL(t, sampleRecords), endpoint)
+	if err == nil || !strings.Contains(err.Error(), "over quota") {
+		t.Errorf("err = %v, want the collector's partial success", err)
+	}
+}
+
+func TestExportOTLPOverHTTP(t *testing.T) {
+	var got []*tracepb.Span
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req coltracepb.ExportTraceServiceRequest
+		if r.Header.Get("Content-Type") != "application/x-protobuf" || proto.Unmarshal(body, &req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		got = append(got, req.ResourceSpans[0].ScopeSpans[0].Spans...)
+	}))
+	defer srv.Close()
+
+	err := ExportJSONLToOTLP(writeTempJSONL(t, sampleRecords), OTLPExportOptions{Protocol: OTLPProtocolHTTP, Endpoint: srv.URL})
+	if err != nil {
+		t.Fatalf("ExportJSONLToOTLP: %v", err)
+	}
+	if len(got) == 0 {
+		t.Error("collector received no spans")
+	}
+}
+
+func TestExportOTLPReportsCollectorError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	err := ExportJSONLToOTLP(writeTempJSONL(t, sampleRecords), OTLPExportOptions{Protocol: OTLPProtocolHTTP, Endpoint: srv.URL})
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("err = %v, want the collector's 503", err)
+	}
+}
+
+// ─── Replay ───────────────────────────────────────────────────────────────────
+
+func TestReplayTraceKeepsSpacing(t *testing.T) {
+	path := writeTempJSONL(t, []TraceRecord{
+		{ProbeID: 1, Seq: 2, TS: 1_000_000_000},
+		{ProbeID: 1, Seq: 4, TS: 1_040_000_000}, // 40ms later
+		{ProbeID: 1, Seq: 6, TS: 1_080_000_000},
+	})
+
+	var got []TraceRecord
+	start := time.Now()
+	if err := ReplayTrace(path, 2, 0, func(r TraceRecord) error {
+		got = append(got, r)
+		return nil
+	}); err != nil {
+		t.Fatalf("ReplayTrace: %v", err)
+	}
+
+	// 80ms of trace at 2x speed takes about 40ms
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond || elapsed > time.Second {
+		t.Errorf("replay took %v, want ~40ms", elapsed)
+	}
+	if len(got) != 3 || got[2].Seq != 6 {
+		t.Errorf("replayed %+v", got)
+	}
+}
+
+func TestReplayTraceUnthrottled(t *testing.T) {
+	path := writeTempJSONL(t, []TraceRecord{
+		{ProbeID: 1, Seq: 2, TS: 0},
+		{ProbeID: 1, Seq: 4, TS: uint64(time.Hour)},
+	})
+
+	n := 0
+	start := time.Now()
+	if err := ReplayTrace(path, 0, 0, func(TraceRecord) error { n++; return nil }); err != nil {
+		t.Fatalf("ReplayTrace: %v", err)
+	}
+	if n != 2 || time.Since(start) > time.Second {
+		t.Errorf("speed 0 replayed %d events in %v, want 2 without delay", n, time.Since(start))
+	}
+}
+
+// ─── Binary → JSONL conversion ────────────────────────────────────────────────
+
+func TestConvertBinaryToJSONLMatchesWriter(t *testing.T) {
+	dir := t.TempDir()
+	binPath := writeTraceWithMeta(t, "trace.pb")
+	wantPath := writeTraceWithMeta(t, "trace.jsonl")
+	outPath := filepath.Join(dir, "out.jsonl")
+
+	result, err := ConvertBinaryToJSONL(binPath, outPath)
+	if err != nil || result.Records != 1 || result.Truncated {
+		t.Fatalf("ConvertBinaryToJSONL = %+v, %v", result, err)
+	}
+
+	got, _ := os.ReadFile(outPath)
+	want, _ := os.ReadFile(wantPath)
+	if string(got) != string(want) {
+		t.Errorf("converted trace differs from a JSONL run:\ngot  %q\nwant %q", got, want)
+	}
+}
+
+func TestConvertBinaryToJSONLKeepsSlot(t *testing.T) {
+	var s structure.StationData
+	s.Header.ProbeID = 4
+	enc := &structure.BinaryEncoder{Slot: true}
+	buf := enc.AppendEvent(nil, &s, 0, 2, 1, 0x10, true, 5)
+	buf = enc.AppendEvent(buf, &s, 7, 2, 1, 0x10, false, 6)
+	binPath := filepath.Join(t.TempDir(), "slots.pb")
+	os.WriteFile(binPath, buf, 0o644)
+
+	outPath := filepath.Join(t.TempDir(), "slots.jsonl")
+	if _, err := ConvertBinaryToJSONL(binPath, outPath); err != nil {
+		t.Fatalf("ConvertBinaryToJSONL: %v", err)
+	}
+	var slots []int
+	StreamJSONL(outPath, 0, func(r TraceRecord) error {
+		if r.Slot != nil {
+			slots = append(slots, *r.Slot)
+		}
+		return nil
+	})
+	if len(slots) != 2 || slots[0] != 0 || slots[1] != 7 {
+		t.Errorf("slots after conversion = %v, want [0 7]", slots)
+	}
+
+	// Identical records apart from the slot pointer are still duplicates
+	data, _ := os.ReadFile(outPath)
+	os.WriteFile(outPath, append(data, data[:bytes.IndexByte(data, '\n')+1]...), 0o644)
+	if report, _ := ValidateTrace(outPath, 0); report.DuplicateRecords != 1 {
+		t.Errorf("DuplicateRecords = %d, want 1", report.DuplicateRecords)
+	}
+}
+
+func TestConvertBinaryToJSONLKeepsCompleteRecordsOfTruncatedTrace(t *testing.T) {
+	binPath := writeTempBinary(t, sampleRecords)
+	data, _ := os.ReadFile(binPath)
+	os.WriteFile(binPath, data[:len(data)-3], 0o644)
+	outPath := filepath.Join(t.TempDir(), "out.jsonl")
+
+	result, err := ConvertBinaryToJSONL(binPath, outPath)
+	if err != nil {
+		t.Fatalf("ConvertBinaryToJSONL on truncated input: %v", err)
+	}
+	if !result.Truncated || result.Records != len(sampleRecords)-1 {
+		t.Errorf("result = %+v, want %d records and Truncated", result, len(sampleRecords)-1)
+	}
+
+	var got []TraceRecord
+	if err := StreamJSONL(outPath, 0, func(r TraceRecord) error { got = append(got, r); return nil }); err != nil {
+		t.Fatalf("StreamJSONL: %v", err)
+	}
+	if len(got) != len(sampleRecords)-1 || got[0] != sampleRecords[0] {
+		t.Errorf("converted records = %+v", got)
+	}
+}
+
+func TestConvertBinaryToJSONLRejectsWrongExtensions(t *testing.T) {
+	if _, err := ConvertBinaryToJSONL("trace.jsonl", "out.jsonl"); err == nil {
+		t.Error("JSONL input accepted")
+	}
+	if _, err := ConvertBinaryToJSONL("trace.pb", "out.bin"); err == nil {
+		t.Error("binary output accepted")
+	}
+}
+
+func TestConvertBinaryToJSONLKeepsPayload(t *testing.T) {
+	records := []TraceRecord{{ProbeID: 7, TID: 1, Addr: "0x0000000000000010", Seq: 2, IsActive: true, TS: 5, Name: `rpc "get"`, ParentID: 3}}
+	binPath := writeTempBinary(t, records)
+
+	var streamed []TraceRecord
+	if err := StreamBinary(binPath, func(r TraceRecord) error { streamed = append(streamed, r); return nil }); err != nil {
+		t.Fatalf("StreamBinary: %v", err)
+	}
+	if len(streamed) != 1 || streamed[0] != records[0] {
+		t.Fatalf("binary records = %+v, want %+v", streamed, records)
+	}
+
+	outPath := filepath.Join(t.TempDir(), "out.jsonl")
+	if _, err := ConvertBinaryToJSONL(binPath, outPath); err != nil {
+		t.Fatalf("ConvertBinaryToJSONL: %v", err)
+	}
+	var converted []TraceRecord
+	if err := StreamJSONL(outPath, 0, func(r TraceRecord) error { converted = append(converted, r); return nil }); err != nil {
+		t.Fatalf("StreamJSONL: %v", err)
+	}
+	if len(converted) != 1 || converted[0] != records[0] {
+		t.Errorf("converted records = %+v, want %+v", converted, records)
+	}
+}
+
+// ─── Death records ────────────────────────────────────────────────────────────
+
+// writeTraceWithDeath is writeTraceWithMeta followed by the death of the probe.
+func writeTraceWithDeath(t *testing.T, name string) string {
+	t.Helper()
+	path := writeTraceWithMeta(t, name)
+	sw, err := structure.NewStationWriter(path)
+	if err != nil {
+		t.Fatalf("NewStationWriter: %v", err)
+	}
+	if err := sw.WriteDeath(structure.NewTraceDeath(7, 4_000, false)); err != nil {
+		t.Fatalf("WriteDeath: %v", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return path
+}
+
+func TestStreamDeaths(t *testing.T) {
+	for _, name := range []string{"trace.jsonl", "trace.pb"} {
+		path := writeTraceWithDeath(t, name)
+
+		var deaths []structure.TraceDeath
+		if err := StreamDeaths(path, func(d structure.TraceDeath) error {
+			deaths = append(deaths, d)
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: StreamDeaths: %v", name, err)
+		}
+		if len(deaths) != 1 || deaths[0].ProbeID != 7 || deaths[0].TS != 4_000 {
+			t.Errorf("%s: deaths = %+v", name, deaths)
+		}
+
+		// Event readers skip the record like any other typed line
+		records := 0
+		if err := StreamTrace(path, 0, func(TraceRecord) error { records++; return nil }); err != nil || records != 1 {
+			t.Errorf("%s: StreamTrace saw %d records, %v", name, records, err)
+		}
+	}
+}
+
+func TestConvertBinaryToJSONLKeepsDeaths(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "out.jsonl")
+	if _, err := ConvertBinaryToJSONL(writeTraceWithDeath(t, "trace.pb"), outPath); err != nil {
+		t.Fatalf("ConvertBinaryToJSONL: %v", err)
+	}
+
+	got, _ := os.ReadFile(outPath)
+	want, _ := os.ReadFile(writeTraceWithDeath(t, "trace.jsonl"))
+	if string(got) != string(want) {
+		t.Errorf("converted trace differs from a JSONL run:\ngot  %q\nwant %q", got, want)
+	}
+}
+
+// ─── Anonymization ────────────────────────────────────────────────────────────
+
+func TestAnonymizeTrace(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "trace.jsonl")
+	meta := `{"type":"meta","version":2,"mono_ns":5,"unix_ns":1700000000000000000}`
+	events := []TraceRecord{
+		{ProbeID: 900, TID: 7, Addr: "0x0000000000401abc", Seq: 2, IsActive: true, TS: 10, Name: "secret_handler"},
+		{ProbeID: 42, TID: 7, Addr: "0x0000000000402000", Seq: 2, IsActive: true, TS: 11, ParentID: 900},
+		{ProbeID: 900, TID: 7, Addr: "0x0000000000000000", Seq: 4, IsActive: false, TS: 12},
+	}
+	content := meta + "\n"
+	for _, r := range events {
+		line, _ := json.Marshal(r)
+		content += string(line) + "\n"
+	}
+	content += `{"type":"death","probe_id":42,"ts":13}` + "\n"
+	os.WriteFile(in, []byte(content), 0o644)
+
+	out, keyPath := filepath.Join(dir, "shared.jsonl"), filepath.Join(dir, "shared.key.json")
+	result, err := AnonymizeTrace(in, out, keyPath, 0)
+	if err != nil {
+		t.Fatalf("AnonymizeTrace: %v", err)
+	}
+	if result.Records != 3 || result.Probes != 2 {
+		t.Errorf("result = %+v, want 3 records of 2 coroutines", result)
+	}
+
+	data, _ := os.ReadFile(out)
+	for _, leak := range []string{"secret_handler", "900", "1700000000000000000", "401abc"} {
+		if strings.Contains(string(data), leak) {
+			t.Errorf("anonymized trace leaks %q:\n%s", leak, data)
+		}
+	}
+	var got []TraceRecord
+	if err := StreamJSONL(out, 0, func(r TraceRecord) error { got = append(got, r); return nil }); err != nil {
+		t.Fatalf("StreamJSONL: %v", err)
+	}
+	want := []struct {
+		probe, parent uint64
+		addr          string
+	}{{1, 0, "0x0000000000001abc"}, {2, 1, "0x0000000000002000"}, {1, 0, "0x0000000000000000"}}
+	for i, w := range want {
+		if got[i].ProbeID != w.probe || got[i].ParentID != w.parent || got[i].Addr != w.addr || got[i].Name != "" {
+			t.Errorf("record %d = %+v, want probe %d parent %d addr %s", i, got[i], w.probe, w.parent, w.addr)
+		}
+	}
+	if !strings.Contains(string(data), `{"type":"death","probe_id":2,"ts":13}`) {
+		t.Errorf("death record not renumbered:\n%s", data)
+	}
+
+	var key AnonymizeKey
+	raw, _ := os.ReadFile(keyPath)
+	if err := json.Unmarshal(raw, &key); err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	if key.AddrBase != "0x0000000000400000" || key.Probes[1] != 900 || key.Probes[2] != 42 || key.UnixNS != 1700000000000000000 {
+		t.Errorf("key = %+v", key)
+	}
+	if info, _ := os.Stat(keyPath); info.Mode().Perm() != 0o600 {
+		t.Errorf("key mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	// Binary output, and no key for a one-way copy
+	binOut := filepath.Join(dir, "shared.pb")
+	if result, err := AnonymizeTrace(in, binOut, "", 0); err != nil || result.Records != 3 {
+		t.Errorf("binary AnonymizeTrace = %+v, %v", result, err)
+	}
+	if _, err := AnonymizeTrace(in, in, "", 0); err == nil {
+		t.Error("anonymizing a trace onto itself was accepted")
+	}
+}
+
+// ─── Station pool saturation ──────────────────────────────────────────────────
+
+func TestSaturationIsReported(t *testing.T) {
+	for _, name := range []string{"trace.jsonl", "trace.pb"} {
+		path := writeTraceWithMeta(t, name)
+		if _, ok, err := ReadSaturation(path); ok || err != nil {
+			t.Errorf("%s: saturation reported before it was recorded (%v)", name, err)
+		}
+
+		sw, err := structure.NewStationWriter(path)
+		if err != nil {
+			t.Fatalf("NewStationWriter: %v", err)
+		}
+		sw.WriteSaturation(structure.NewTraceSaturation(5_000, 128))
+		if err := sw.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		saturation, ok, err := ReadSaturation(path)
+		if err != nil || !ok || saturation.TS != 5_000 || saturation.Stations != 128 {
+			t.Errorf("%s: ReadSaturation = %+v, %v, %v", name, saturation, ok, err)
+		}
+		report, err := ValidateTrace(path, 0)
+		if err != nil || !report.OK() || report.PoolExhaustedTS != 5_000 || report.Records != 1 {
+			t.Errorf("%s: ValidateTrace = %+v, %v", name, report, err)
+		}
+	}
+}
+
+// ─── Write-rate throttle ──────────────────────────────────────────────────────
+
+func TestThrottleIsReported(t *testing.T) {
+	for _, name := range []string{"trace.jsonl", "trace.pb"} {
+		path := writeTraceWithMeta(t, name)
+		sw, err := structure.NewStationWriter(path)
+		if err != nil {
+			t.Fatalf("NewStationWriter: %v", err)
+		}
+		// A record lifting the sampling does not count as throttling
+		sw.WriteThrottle(structure.NewTraceThrottle(4_000, 1))
+		if err := sw.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		if _, ok, err := ReadThrottle(path); ok || err != nil {
+			t.Errorf("%s: throttle reported for a record that lifts it (%v)", name, err)
+		}
+
+		sw, err = structure.NewStationWriter(path)
+		if err != nil {
+			t.Fatalf("NewStationWriter: %v", err)
+		}
+		sw.WriteThrottle(structure.NewTraceThrottle(6_000, 8))
+		if err := sw.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		throttle, ok, err := ReadThrottle(path)
+		if err != nil || !ok || throttle.TS != 6_000 || throttle.SampleEvery != 8 {
+			t.Errorf("%s: ReadThrottle = %+v, %v, %v", name, throttle, ok, err)
+		}
+		if report, err := ValidateTrace(path, 0); err != nil || !report.OK() || report.Records != 1 {
+			t.Errorf("%s: ValidateTrace = %+v, %v", name, report, err)
+		}
+	}
+}
+
+// ─── Expectations ─────────────────────────────────────────────────────────────
+
+func TestParseExpectationsRejectsBadRules(t *testing.T) {
+	for _, rules := range []string{
+		"max-suspend\n",
+		"max-suspend soon\n",
+		"max-migrations -1\n",
+		"min-latency 5ms\n",
+	} {
+		if _, err := ParseExpectations(strings.NewReader(rules)); err == nil {
+			t.Errorf("ParseExpectations(%q) accepted a bad rule", rules)
+		}
+	}
+	rules, err := ParseExpectations(strings.NewReader("# header\n\nmax-active 2ms # inline\nmin-events 3\n"))
+	if err != nil || len(rules) != 2 || rules[0].Line != 3 || rules[0].Limit != 2_000_000 || rules[1].Text != "min-events 3" {
+		t.Fatalf("ParseExpectations = %+v, %v", rules, err)
+	}
+}
+
+func TestCheckExpectations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	sw, err := structure.NewStationWriter(path)
+	if err != nil {
+		t.Fatalf("NewStationWriter: %v", err)
+	}
+	var s structure.StationData
+	// Probe 1 parks for 5ms and then resumes on another thread; probe 2 runs for 1ms.
+	// Written out of order, as slots are harvested.
+	s.Header.ProbeID = 1
+	sw.WriteSafeSlot(&s, 1, 4, 11, 0x10, true, 6_000_000)
+	sw.WriteSafeSlot(&s, 0, 2, 10, 0x10, false, 1_000_000)
+	s.Header.ProbeID = 2
+	sw.WriteSafeSlot(&s, 0, 2, 10, 0x20, true, 1_000_000)
+	sw.WriteSafeSlot(&s, 1, 4, 10, 0x20, false, 2_000_000)
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	check := func(rules string) ExpectationResult {
+		t.Helper()
+		rulesPath := filepath.Join(t.TempDir(), "rules.txt")
+		if err := os.WriteFile(rulesPath, []byte(rules), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		result, err := CheckExpectations(path, rulesPath, 0)
+		if err != nil {
+			t.Fatalf("CheckExpectations(%q): %v", rules, err)
+		}
+		return result
+	}
+
+	if result := check("max-suspend 10ms\nmax-active 1ms\nmax-migrations 1\nmax-coroutines 2\nmin-events 4\n"); !result.OK() || result.Rules != 5 {
+		t.Errorf("rules that hold: %+v", result)
+	}
+	result := check("max-suspend 1ms\nmax-active 500us\nmax-migrations 0\nmax-coroutines 1\nmin-events 5\n")
+	if result.Violations != 5 || len(result.Samples) != 5 {
+		t.Fatalf("rules that break: %+v", result)
+	}
+	if v := result.Samples[0]; v.ProbeID != 1 || v.Value != 5_000_000 || v.TS != 1_000_000 {
+		t.Errorf("max-suspend violation = %+v", v)
+	}
+	if v := result.Samples[1]; v.ProbeID != 2 || v.Value != 1_000_000 {
+		t.Errorf("max-active violation = %+v", v)
+	}
+	if v := result.Samples[2]; v.ProbeID != 1 || v.Value != 1 {
+		t.Errorf("max-migrations violation = %+v", v)
+	}
+	if v := result.Samples[3]; v.ProbeID != 0 || v.Value != 2 {
+		t.Errorf("max-coroutines violation = %+v", v)
+	}
+
+	// Once sampled, the gaps between kept events say nothing about suspend times
+	sw, err = structure.NewStationWriter(path)
+	if err != nil {
+		t.Fatalf("NewStationWriter: %v", err)
+	}
+	sw.WriteThrottle(structure.NewTraceThrottle(7_000_000, 4))
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	result = check("max-suspend 1ms\nmax-migrations 0\n")
+	if result.Violations != 1 || len(result.Skipped) != 1 || result.Skipped[0].Kind != ExpectMaxSuspend {
+		t.Errorf("sampled trace: %+v", result)
+	}
+}
+
+// ─── Harvest diagnostics ──────────────────────────────────────────────────────
+
+func TestDiagsAreReported(t *testing.T) {
+	for _, name := range []string{"trace.jsonl", "trace.pb"} {
+		path := writeTraceWithMeta(t, name)
+		sw, err := structure.NewStationWriter(path)
+		if err != nil {
+			t.Fatalf("NewStationWriter: %v", err)
+		}
+		sw.WriteDiag(structure.NewTraceDiag(structure.DiagGap, 4_000, 0, 7, 5))
+		sw.WriteDiag(structure.NewTraceDiag(structure.DiagCanary, 5_000, 0, 7, 0))
+		sw.WriteDiag(structure.NewTraceDiag(structure.DiagGap, 6_000, 0, 7, 2))
+		if err := sw.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		var kinds []string
+		if err := StreamDiags(path, func(diag structure.TraceDiag) error {
+			kinds = append(kinds, diag.Kind)
+			return nil
+		}); err != nil || strings.Join(kinds, ",") != "gap,canary,gap" {
+			t.Errorf("%s: StreamDiags = %v, %v", name, kinds, err)
+		}
+		report, err := ValidateTrace(path, 0)
+		if err != nil || !report.OK() || report.Records != 1 || report.Diags[structure.DiagGap] != 2 ||
+			report.Diags[structure.DiagCanary] != 1 || report.LostEpochs != 7 {
+			t.Errorf("%s: ValidateTrace = %+v, %v", name, report, err)
+		}
+
+		// Copies keep the records; the anonymized one points them at the renumbered probe
+		anon := filepath.Join(t.TempDir(), "anon.jsonl")
+		if _, err := AnonymizeTrace(path, anon, "", 0); err != nil {
+			t.Fatalf("%s: AnonymizeTrace: %v", name, err)
+		}
+		var probes []uint64
+		StreamDiags(anon, func(diag structure.TraceDiag) error {
+			probes = append(probes, diag.ProbeID)
+			return nil
+		})
+		if len(probes) != 3 || probes[0] != 1 {
+			t.Errorf("%s: anonymized diag probes = %v, want 1", name, probes)
+		}
+		if name == "trace.pb" {
+			converted := filepath.Join(t.TempDir(), "converted.jsonl")
+			if _, err := ConvertBinaryToJSONL(path, converted); err != nil {
+				t.Fatalf("ConvertBinaryToJSONL: %v", err)
+			}
+			if report, err := ValidateTrace(converted, 0); err != nil || report.LostEpochs != 7 {
+				t.Errorf("converted: ValidateTrace = %+v, %v", report, err)
+			}
+		}
+	}
+}
+
+// ─── Address parsing ──────────────────────────────────────────────────────────
+
+func TestParseAddrAcceptsBothForms(t *testing.T) {
+	for in, want := range map[string]uint64{
+		"0x0000000000000000": 0,
+		"0x0":                0,
+		"0x0000000000401abc": 0x401abc,
+		"0x401abc":           0x401abc,
+	} {
+		if got, err := ParseAddr(in); err != nil || got != want {
+			t.Errorf("ParseAddr(%q) = %#x, %v; want %#x", in, got, err, want)
+		}
+	}
+	if _, err := ParseAddr("0xnope"); err == nil {
+		t.Error("ParseAddr accepted garbage")
+	}
+}
+
+// ─── Sidecar index ────────────────────────────────────────────────────────────
+
+// writeIndexedTrace writes sampleRecords through a StationWriter with the index enabled.
+func writeIndexedTrace(t *testing.T, name string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	sw, err := structure.NewStationWriter(path)
+	if err != nil {
+		t.Fatalf("NewStationWriter: %v", err)
+	}
+	if err := sw.EnableIndex(); err != nil {
+		t.Fatalf("EnableIndex: %v", err)
+	}
+	sw.WriteMeta(structure.NewTraceMeta(1, 2))
+	for _, r := range sampleRecords {
+		var s structure.StationData
+		s.Header.ProbeID = r.ProbeID
+		addr, _ := ParseAddr(r.Addr)
+		sw.WriteSafeSlot(&s, 0, r.Seq, r.TID, addr, r.IsActive, r.TS)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return path
+}
+
+func probeRecords(t *testing.T, path string, index TraceIndex, probeID uint64) []TraceRecord {
+	t.Helper()
+	var got []TraceRecord
+	if err := StreamProbe(path, index, probeID, func(r TraceRecord) error { got = append(got, r); return nil }); err != nil {
+		t.Fatalf("StreamProbe: %v", err)
+	}
+	return got
+}
+
+func TestStreamProbeThroughWriterIndex(t *testing.T) {
+	for _, name := range []string{"trace.jsonl", "trace.pb"} {
+		path := writeIndexedTrace(t, name)
+		if _, err := readTraceIndex(path); err != nil {
+			t.Fatalf("%s: writer index rejected: %v", name, err)
+		}
+		index, err := LoadTraceIndex(path)
+		if err != nil {
+			t.Fatalf("%s: LoadTraceIndex: %v", name, err)
+		}
+		got := probeRecords(t, path, index, 2)
+		if len(got) != 2 || got[0] != sampleRecords[2] || got[1] != sampleRecords[3] {
+			t.Errorf("%s: probe 2 events = %+v", name, got)
+		}
+	}
+}
+
+func TestLoadTraceIndexRebuildsMissingIndex(t *testing.T) {
+	path := writeTempJSONL(t, sampleRecords)
+	defer os.Remove(path)
+	defer os.Remove(structure.IndexPath(path))
+
+	index, err := LoadTraceIndex(path)
+	if err != nil {
+		t.Fatalf("LoadTraceIndex: %v", err)
+	}
+	if len(index) != 3 || len(index[1]) != 2 {
+		t.Errorf("rebuilt index = %v", index)
+	}
+	if _, err := readTraceIndex(path); err != nil {
+		t.Errorf("rebuilt index not written back: %v", err)
+	}
+}
+
+func TestLoadTraceIndexRebuildsStaleIndex(t *testing.T) {
+	path := writeIndexedTrace(t, "trace.jsonl")
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"probe_id":3,"tid":300,"addr":"0x0","seq":4,"is_active":true,"ts":4000000}` + "\n")
+	f.Close()
+
+	if _, err := readTraceIndex(path); err == nil {
+		t.Fatal("index missing the appended event was accepted")
+	}
+	index, err := LoadTraceIndex(path)
+	if err != nil {
+		t.Fatalf("LoadTraceIndex: %v", err)
+	}
+	if got := probeRecords(t, path, index, 3); len(got) != 2 || got[1].TS != 4_000_000 {
+		t.Errorf("probe 3 events after rebuild = %+v", got)
+	}
+}
+
+func TestTraceIndexToleratesTornTail(t *testing.T) {
+	path := writeIndexedTrace(t, "trace.jsonl")
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"probe_id":3,"tid":3`)
+	f.Close()
+
+	if _, err := readTraceIndex(path); err != nil {
+		t.Errorf("torn last line invalidated the index: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+// TraceIndex maps each ProbeID to the byte offsets of its events, in file order.
+type TraceIndex map[uint64][]int64
+
+// LoadTraceIndex reads the sidecar index written with the tracer's -index flag. When the
+// index is missing, torn, covers only the latest of several appended runs, or the trace
+// holds events past its last entry, it is rebuilt from the trace and rewritten.
+func LoadTraceIndex(tracePath string) (TraceIndex, error) {
+	index, err := readTraceIndex(tracePath)
+	if err == nil {
+		return index, nil
+	}
+	return RebuildTraceIndex(tracePath)
+}
+
+// RebuildTraceIndex scans the whole trace and atomically replaces its sidecar index.
+// Lines that do not decode are left out, as are meta headers.
+func RebuildTraceIndex(tracePath string) (TraceIndex, error) {
+	if compressionSuffix(tracePath) != "" {
+		return nil, fmt.Errorf("index trace %q: compressed traces cannot be indexed, offsets need the plain file", tracePath)
+	}
+	file, err := os.Open(tracePath)
+	if err != nil {
+		return nil, fmt.Errorf("open trace %q: %w", tracePath, err)
+	}
+	defer file.Close()
+
+	index := make(TraceIndex)
+	buf := structure.AppendIndexHeader(nil, 0)
+	reader := newRecordReader(file, structure.IsBinaryTracePath(tracePath), 0)
+	for {
+		record, offset, event, err := reader.next()
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			// A record cut short by a crash is not indexed, just like a torn JSONL line
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("index trace %q at offset %d: %w", tracePath, offset, err)
+		}
+		if event {
+			index[record.ProbeID] = append(index[record.ProbeID], offset)
+			buf = structure.AppendIndexEntry(buf, record.ProbeID, offset)
+		}
+	}
+
+	indexPath := structure.IndexPath(tracePath)
+	tmpPath := indexPath + structure.PartialSuffix
+	if err := os.WriteFile(tmpPath, buf, 0o644); err != nil {
+		return nil, fmt.Errorf("write index %q: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, indexPath); err != nil {
+		return nil, fmt.Errorf("replace index %q: %w", indexPath, err)
+	}
+	return index, nil
+}
+
+var errStaleIndex = errors.New("index does not cover the trace")
+
+// readTraceIndex loads the sidecar index and checks it against the trace.
+func readTraceIndex(tracePath string) (TraceIndex, error) {
+	data, err := os.ReadFile(structure.IndexPath(tracePath))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < structure.IndexHeaderSize || string(data[:8]) != structure.IndexMagic {
+		return nil, errStaleIndex
+	}
+	if base := binary.LittleEndian.Uint64(data[8:16]); base != 0 {
+		return nil, errStaleIndex
+	}
+	entries := data[structure.IndexHeaderSize:]
+	if len(entries) == 0 || len(entries)%structure.IndexEntrySize != 0 {
+		return nil, errStaleIndex
+	}
+
+	index := make(TraceIndex)
+	var lastProbe uint64
+	lastOffset := int64(-1)
+	for ; len(entries) > 0; entries = entries[structure.IndexEntrySize:] {
+		probeID := binary.LittleEndian.Uint64(entries[0:8])
+		offset := int64(binary.LittleEndian.Uint64(entries[8:16]))
+		if offset <= lastOffset {
+			return nil, errStaleIndex
+		}
+		index[probeID] = append(index[probeID], offset)
+		lastProbe, lastOffset = probeID, offset
+	}
+
+	// The last entry must point at an event of that probe, with no event after it
+	file, err := os.Open(tracePath)
+	if err != nil {
+		return nil, fmt.Errorf("open trace %q: %w", tracePath, err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(lastOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader := newRecordReader(file, structure.IsBinaryTracePath(tracePath), lastOffset)
+	record, _, event, err := reader.next()
+	if err != nil || !event || record.ProbeID != lastProbe {
+		return nil, errStaleIndex
+	}
+	for {
+		_, _, event, err := reader.next()
+		if err != nil {
+			// EOF, or a torn tail the rebuild would skip too
+			return index, nil
+		}
+		if event {
+			return nil, errStaleIndex
+		}
+	}
+}
+
+// StreamProbe calls fn for every event of probeID, seeking through index instead of
+// scanning the trace. Get index from LoadTraceIndex.
+func StreamProbe(tracePath string, index TraceIndex, probeID uint64, fn func(record TraceRecord) error) error {
+	offsets := index[probeID]
+	if len(offsets) == 0 {
+		return nil
+	}
+	file, err := os.Open(tracePath)
+	if err != nil {
+		return fmt.Errorf("open trace %q: %w", tracePath, err)
+	}
+	defer file.Close()
+
+	binaryTrace := structure.IsBinaryTracePath(tracePath)
+	for _, offset := range offsets {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("seek trace %q to %d: %w", tracePath, offset, err)
+		}
+		record, _, event, err := newRecordReader(file, binaryTrace, offset).next()
+		if err == nil && (!event || record.ProbeID != probeID) {
+			err = errStaleIndex
+		}
+		if err != nil {
+			return fmt.Errorf("read probe %d event at offset %d: %w", probeID, offset, err)
+		}
+		if err := fn(record); err != nil {
+			return fmt.Errorf("process probe %d event at offset %d: %w", probeID, offset, err)
+		}
+	}
+	return nil
+}
+
+// recordReader walks a trace one record at a time while tracking byte offsets.
+type recordReader struct {
+	reader      *bufio.Reader
+	binaryTrace bool
+	offset      int64
+	body        []byte
+}
+
+func newRecordReader(r io.Reader, binaryTrace bool, offset int64) *recordReader {
+	return &recordReader{reader: bufio.NewReaderSize(r, 64*1024), binaryTrace: binaryTrace, offset: offset}
+}
+
+// next returns the record starting at the current offset. event is false for meta
+// headers, blank lines and JSONL lines that do not decode.
+func (rr *recordReader) next() (record TraceRecord, offset int64, event bool, err error) {
+	offset = rr.offset
+	if rr.binaryTrace {
+		return rr.nextBinary(offset)
+	}
+
+	line, err := rr.reader.ReadBytes('\n')
+	rr.offset += int64(len(line))
+	if len(line) == 0 && err != nil {
+		return record, offset, false, err
+	}
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || isMetaLine(line) || json.Unmarshal(line, &record) != nil {
+		return record, offset, false, nil
+	}
+	return record, offset, true, nil
+}
+
+func (rr *recordReader) nextBinary(offset int64) (record TraceRecord, _ int64, event bool, err error) {
+	size, err := binary.ReadUvarint(rr.reader)
+	if err != nil {
+		return record, offset, false, err
+	}
+	if size > maxBinaryRecordSize {
+		return record, offset, false, fmt.Errorf("record length %d exceeds %d bytes", size, maxBinaryRecordSize)
+	}
+	if uint64(cap(rr.body)) < size {
+		rr.body = make([]byte, size)
+	}
+	rr.body = rr.body[:size]
+	if _, err := io.ReadFull(rr.reader, rr.body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return record, offset, false, err
+	}
+	rr.offset += int64(len(structure.AppendVarint(nil, size))) + int64(size)
+
+	if _, meta := binaryMetaPayload(rr.body); meta {
+		return record, offset, false, nil
+	}
+	record, err = decodeBinaryRecord(rr.body)
+	return record, offset, err == nil, err
+}
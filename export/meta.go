@@ -0,0 +1,176 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+// isMetaLine reports whether a JSONL line is a header record (e.g. structure.TraceMeta)
+// rather than an event. Events never carry a "type" key, so the cheap check settles most lines.
+func isMetaLine(line []byte) bool {
+	if !bytes.Contains(line, []byte(`"type"`)) {
+		return false
+	}
+	var probe struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(line, &probe) == nil && probe.Type != ""
+}
+
+// binaryMetaPayload returns the embedded JSON if body is a metadata record.
+func binaryMetaPayload(body []byte) ([]byte, bool) {
+	tag, n := binary.Uvarint(body)
+	if n <= 0 || tag != structure.PBFieldMetaJSON<<3|2 {
+		return nil, false
+	}
+	size, m := binary.Uvarint(body[n:])
+	if m <= 0 || uint64(len(body[n+m:])) < size {
+		return nil, false
+	}
+	return body[n+m : n+m+int(size)], true
+}
+
+// ReadTraceMeta returns the header the tracer wrote at the top of the trace.
+// Traces from older versions have none; ok is false for them.
+func ReadTraceMeta(tracePath string) (meta structure.TraceMeta, ok bool, err error) {
+	file, err := openTrace(tracePath)
+	if err != nil {
+		return meta, false, fmt.Errorf("open trace %q: %w", tracePath, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var payload []byte
+
+	if isBinaryTrace(tracePath) {
+		size, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			return meta, false, nil
+		}
+		if err != nil {
+			return meta, false, fmt.Errorf("read binary trace %q: %w", tracePath, err)
+		}
+		if size > maxBinaryRecordSize {
+			return meta, false, fmt.Errorf("read binary trace %q: first record length %d exceeds %d bytes", tracePath, size, maxBinaryRecordSize)
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return meta, false, fmt.Errorf("read binary trace %q: %w", tracePath, err)
+		}
+		if payload, ok = binaryMetaPayload(body); !ok {
+			return meta, false, nil
+		}
+	} else {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return meta, false, fmt.Errorf("read jsonl %q: %w", tracePath, err)
+		}
+		if !isMetaLine(line) {
+			return meta, false, nil
+		}
+		payload = line
+	}
+
+	if err := json.Unmarshal(payload, &meta); err != nil {
+		return meta, false, fmt.Errorf("decode trace meta in %q: %w", tracePath, err)
+	}
+	return meta, meta.Type == "meta", nil
+}
+
+// StreamDeaths calls fn for every coroutine death recorded in the trace (see the tracer's
+// -death-events). Events and meta headers are skipped.
+func StreamDeaths(tracePath string, fn func(death structure.TraceDeath) error) error {
+	return streamTypedRecords(tracePath, func(payload []byte) error {
+		var death structure.TraceDeath
+		if err := json.Unmarshal(payload, &death); err != nil || death.Type != "death" {
+			return nil
+		}
+		return fn(death)
+	})
+}
+
+// ReadSaturation reports whether the tracer ran out of stations while recording the
+// trace, and when. If so, coroutines created after saturation.TS may be missing.
+func ReadSaturation(tracePath string) (saturation structure.TraceSaturation, ok bool, err error) {
+	err = streamTypedRecords(tracePath, func(payload []byte) error {
+		if ok {
+			return nil
+		}
+		ok = decodeSaturation(payload, &saturation)
+		return nil
+	})
+	return saturation, ok, err
+}
+
+func decodeSaturation(payload []byte, saturation *structure.TraceSaturation) bool {
+	return json.Unmarshal(payload, saturation) == nil && saturation.Type == "saturation"
+}
+
+// ReadThrottle reports whether the tracer sampled the trace to stay under -max-write-rate,
+// returning the first throttle record that switched sampling on.
+func ReadThrottle(tracePath string) (throttle structure.TraceThrottle, ok bool, err error) {
+	err = streamTypedRecords(tracePath, func(payload []byte) error {
+		if ok {
+			return nil
+		}
+		ok = decodeThrottle(payload, &throttle)
+		return nil
+	})
+	return throttle, ok, err
+}
+
+// decodeThrottle matches a throttle record that turned sampling on, not one lifting it.
+func decodeThrottle(payload []byte, throttle *structure.TraceThrottle) bool {
+	return json.Unmarshal(payload, throttle) == nil && throttle.Type == "throttle" && throttle.SampleEvery > 1
+}
+
+// StreamDiags calls fn for every harvest anomaly the tracer recorded in the trace: gaps,
+// clobbered canaries and a rewritten shm header (see structure.TraceDiag).
+func StreamDiags(tracePath string, fn func(diag structure.TraceDiag) error) error {
+	return streamTypedRecords(tracePath, func(payload []byte) error {
+		var diag structure.TraceDiag
+		if !decodeDiag(payload, &diag) {
+			return nil
+		}
+		return fn(diag)
+	})
+}
+
+func decodeDiag(payload []byte, diag *structure.TraceDiag) bool {
+	return json.Unmarshal(payload, diag) == nil && diag.Type == "diag"
+}
+
+// streamTypedRecords hands the JSON of every typed record (meta, death, saturation, throttle, diag) to fn.
+func streamTypedRecords(tracePath string, handle func(payload []byte) error) error {
+	if isBinaryTrace(tracePath) {
+		return streamBinary(tracePath, func(TraceRecord) error { return nil }, handle)
+	}
+
+	file, err := openTrace(tracePath)
+	if err != nil {
+		return fmt.Errorf("open jsonl %q: %w", tracePath, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && isMetaLine(line) {
+			if err := handle(line); err != nil {
+				return fmt.Errorf("process jsonl line %d: %w", lineNo, err)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read jsonl %q: %w", tracePath, err)
+		}
+	}
+}
@@ -18,6 +18,8 @@ type MySQLExportOptions struct {
 	Socket   string
 	Database string
 	Table    string
+
+	MaxLineBytes int // Longest trace line accepted; 0 means DefaultMaxLineBytes
 }
 
 // ExportJSONLToMySQL converts a trace JSONL file directly into a MySQL table by
@@ -86,7 +88,7 @@ func ExportJSONLToMySQL(jsonlPath string, options MySQLExportOptions) error {
 	}
 
 	insertSQL := "INSERT INTO " + quoteMySQLIdentifier(tableName) + " (probe_id, tid, addr, seq, is_active, ts) VALUES (%d, %d, '%s', %d, %t, %d);\n"
-	if err := StreamJSONL(jsonlPath, func(record TraceRecord) error {
+	if err := StreamTrace(jsonlPath, options.MaxLineBytes, func(record TraceRecord) error {
 		_, err := fmt.Fprintf(
 			writer,
 			insertSQL,
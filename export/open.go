@@ -0,0 +1,128 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ErrZstdUnsupported is returned for zstd-compressed traces: the standard library has no
+// zstd decoder. Decompress first (zstd -d) or recompress with gzip.
+var ErrZstdUnsupported = errors.New("zstd-compressed traces are not supported; decompress with zstd -d or use gzip")
+
+// compressionSuffix returns ".gz" or ".zst" when path carries one, "" otherwise.
+func compressionSuffix(path string) string {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".gz", ".zst":
+		return ext
+	}
+	return ""
+}
+
+// isBinaryTrace is structure.IsBinaryTracePath looking past a compression suffix, so
+// trace.pb.gz is binary and trace.jsonl.gz is JSONL.
+func isBinaryTrace(path string) bool {
+	return structure.IsBinaryTracePath(strings.TrimSuffix(path, compressionSuffix(path)))
+}
+
+// openTrace opens a trace for sequential reading and decompresses gzip transparently.
+// Compression is recognised by magic bytes, so a compressed file without the suffix
+// works too; a .gz suffix on data that is not gzip is an error. Every streaming reader
+// goes through here. The index readers seek to byte offsets and open files directly.
+func openTrace(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReader(file)
+	head, _ := buffered.Peek(len(zstdMagic))
+
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%q: %w", path, err)
+		}
+		return gzipTrace{gz, file}, nil
+	case bytes.HasPrefix(head, zstdMagic) || compressionSuffix(path) == ".zst":
+		file.Close()
+		return nil, fmt.Errorf("%q: %w", path, ErrZstdUnsupported)
+	case compressionSuffix(path) == ".gz" && len(head) > 0:
+		file.Close()
+		return nil, fmt.Errorf("%q has a .gz suffix but is not gzip data", path)
+	}
+	return plainTrace{buffered, file}, nil
+}
+
+// sniffTrace prepares a trace arriving on r (stdin, a named pipe) for sequential reading.
+// A stream has no file extension, so gzip is recognised by its magic bytes and the
+// encoding from the content: JSONL starts with `{"` (or whitespace), a binary trace with
+// a record length.
+func sniffTrace(r io.Reader) (reader *bufio.Reader, binary bool, err error) {
+	reader = bufio.NewReader(r)
+	if head, _ := reader.Peek(len(zstdMagic)); bytes.HasPrefix(head, gzipMagic) {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, false, err
+		}
+		reader = bufio.NewReader(gz)
+	} else if bytes.HasPrefix(head, zstdMagic) {
+		return nil, false, ErrZstdUnsupported
+	}
+	head, _ := reader.Peek(2)
+	jsonl := len(head) == 0 || bytes.HasPrefix(head, []byte(`{"`)) || bytes.ContainsAny(head[:1], " \t\r\n")
+	return reader, !jsonl, nil
+}
+
+type plainTrace struct {
+	io.Reader
+	file *os.File
+}
+
+func (t plainTrace) Close() error {
+	return t.file.Close()
+}
+
+type gzipTrace struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (t gzipTrace) Close() error {
+	t.Reader.Close()
+	return t.file.Close()
+}
+
+// tailReader remembers the last byte read, so a reader that hit EOF can tell whether the
+// trace ended with a newline or mid-line, as a tracer killed during a write leaves it.
+type tailReader struct {
+	io.Reader
+	last byte
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	n, err := t.Reader.Read(p)
+	if n > 0 {
+		t.last = p[n-1]
+	}
+	return n, err
+}
+
+// endsMidLine reports whether the data read so far stops after an unterminated line.
+func (t *tailReader) endsMidLine() bool {
+	return t.last != 0 && t.last != '\n'
+}
@@ -0,0 +1,343 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	OTLPProtocolGRPC = "grpc"
+	OTLPProtocolHTTP = "http"
+
+	DefaultOTLPEndpoint     = "127.0.0.1:4317"
+	DefaultOTLPHTTPEndpoint = "http://127.0.0.1:4318/v1/traces"
+	DefaultOTLPServiceName  = "coroTracer"
+	defaultOTLPBatchSize    = 512
+)
+
+type OTLPExportOptions struct {
+	Protocol    string        // OTLPProtocolGRPC (default) or OTLPProtocolHTTP
+	Endpoint    string        // gRPC host:port, or the OTLP/HTTP traces URL; defaults per protocol
+	ServiceName string        // service.name resource attribute; defaults to DefaultOTLPServiceName
+	BatchSize   int           // Spans per request; defaults to 512
+	Timeout     time.Duration // Per-request timeout; defaults to 10s
+
+	MaxLineBytes int // Longest trace line accepted; 0 means DefaultMaxLineBytes
+}
+
+// GenerateOTLP ships the trace at jsonlPath to the collector listening on endpoint
+// (host:port) over OTLP/gRPC, with the default service name and batching.
+func GenerateOTLP(jsonlPath, endpoint string) error {
+	return ExportJSONLToOTLP(jsonlPath, OTLPExportOptions{Endpoint: endpoint})
+}
+
+// ExportJSONLToOTLP turns every coroutine into a trace and each of its active windows
+// (is_active=true until the next is_active=false) into a span, then ships the spans to
+// an OpenTelemetry collector. OTLP/gRPC (port 4317) is the default; OTLP/HTTP with the
+// protobuf encoding (port 4318) is there for collectors behind an HTTP-only proxy.
+//
+// Span times are converted to Unix time with the trace's clock anchor when it has one;
+// older traces keep the raw monotonic ns.
+func ExportJSONLToOTLP(jsonlPath string, options OTLPExportOptions) error {
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultOTLPBatchSize
+	}
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	var send otlpSender
+	switch protocol := defaultString(options.Protocol, OTLPProtocolGRPC); protocol {
+	case OTLPProtocolGRPC:
+		endpoint := defaultString(options.Endpoint, DefaultOTLPEndpoint)
+		conn, err := grpc.NewClient(endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return fmt.Errorf("dial otlp collector %s: %w", endpoint, err)
+		}
+		defer conn.Close()
+		send = grpcSender(endpoint, coltracepb.NewTraceServiceClient(conn), timeout)
+	case OTLPProtocolHTTP:
+		send = httpSender(defaultString(options.Endpoint, DefaultOTLPHTTPEndpoint), &http.Client{Timeout: timeout})
+	default:
+		return fmt.Errorf("unknown otlp protocol %q: want %s or %s", protocol, OTLPProtocolGRPC, OTLPProtocolHTTP)
+	}
+
+	meta, _, err := ReadTraceMeta(jsonlPath)
+	if err != nil {
+		return err
+	}
+	toUnixNano := func(ts uint64) uint64 { return ts }
+	if meta.HasClockAnchor() {
+		toUnixNano = func(ts uint64) uint64 { return uint64(meta.WallTime(ts).UnixNano()) }
+	}
+
+	exporter := &otlpExporter{
+		send:        send,
+		serviceName: defaultString(options.ServiceName, DefaultOTLPServiceName),
+		batchSize:   batchSize,
+		toUnixNano:  toUnixNano,
+	}
+	builder := newSpanBuilder(max(int(meta.SlotsPerStation), slotsPerStation), exporter.add)
+
+	if err := StreamTrace(jsonlPath, options.MaxLineBytes, builder.push); err != nil {
+		return err
+	}
+	if err := builder.finish(); err != nil {
+		return err
+	}
+	return exporter.flush()
+}
+
+// activeWindow is one stretch during which a coroutine was running.
+type activeWindow struct {
+	probeID    uint64
+	index      uint64 // 1-based position among the probe's windows, makes the span ID
+	start, end TraceRecord
+	unfinished bool // Still active when the trace ended
+}
+
+// probeWindows pairs one probe's events into windows.
+type probeWindows struct {
+	pending  []TraceRecord // Reorder buffer, see spanBuilder
+	open     *TraceRecord
+	windows  uint64
+	lastSeen TraceRecord
+}
+
+// spanBuilder pairs activations with suspensions per probe. The harvester emits a station's
+// new epochs in slot order, not event order, but never more than one scan's worth (one per
+// slot) at a time, so a reorder buffer of that many records per probe restores timestamp
+// order in bounded memory.
+type spanBuilder struct {
+	probes  map[uint64]*probeWindows
+	reorder int // Slots per station
+	emit    func(activeWindow) error
+}
+
+func newSpanBuilder(reorder int, emit func(activeWindow) error) *spanBuilder {
+	return &spanBuilder{probes: make(map[uint64]*probeWindows), reorder: reorder, emit: emit}
+}
+
+func (b *spanBuilder) push(record TraceRecord) error {
+	p := b.probes[record.ProbeID]
+	if p == nil {
+		p = &probeWindows{}
+		b.probes[record.ProbeID] = p
+	}
+	p.pending = append(p.pending, record)
+	if len(p.pending) <= b.reorder {
+		return nil
+	}
+	return b.apply(record.ProbeID, p, popEarliest(p))
+}
+
+func popEarliest(p *probeWindows) TraceRecord {
+	earliest := 0
+	for i := range p.pending {
+		if p.pending[i].TS < p.pending[earliest].TS {
+			earliest = i
+		}
+	}
+	record := p.pending[earliest]
+	p.pending = append(p.pending[:earliest], p.pending[earliest+1:]...)
+	return record
+}
+
+func (b *spanBuilder) apply(probeID uint64, p *probeWindows, record TraceRecord) error {
+	p.lastSeen = record
+	if record.IsActive {
+		if p.open != nil {
+			// Two activations in a row: the suspension was lost, end the window here
+			if err := b.close(probeID, p, record, false); err != nil {
+				return err
+			}
+		}
+		start := record
+		p.open = &start
+		return nil
+	}
+	if p.open == nil {
+		return nil
+	}
+	return b.close(probeID, p, record, false)
+}
+
+func (b *spanBuilder) close(probeID uint64, p *probeWindows, end TraceRecord, unfinished bool) error {
+	p.windows++
+	window := activeWindow{probeID: probeID, index: p.windows, start: *p.open, end: end, unfinished: unfinished}
+	p.open = nil
+	return b.emit(window)
+}
+
+// finish drains every reorder buffer and closes windows still open at the end of the trace.
+func (b *spanBuilder) finish() error {
+	probeIDs := make([]uint64, 0, len(b.probes))
+	for probeID := range b.probes {
+		probeIDs = append(probeIDs, probeID)
+	}
+	sort.Slice(probeIDs, func(i, j int) bool { return probeIDs[i] < probeIDs[j] })
+
+	for _, probeID := range probeIDs {
+		p := b.probes[probeID]
+		for len(p.pending) > 0 {
+			if err := b.apply(probeID, p, popEarliest(p)); err != nil {
+				return err
+			}
+		}
+		if p.open != nil {
+			if err := b.close(probeID, p, p.lastSeen, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func stringAttr(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func intAttr(key string, value uint64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(value)}}}
+}
+
+func boolAttr(key string, value bool) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: value}}}
+}
+
+// otlpSender delivers one batch to the collector, whatever the transport.
+type otlpSender func(request *coltracepb.ExportTraceServiceRequest) error
+
+func grpcSender(endpoint string, client coltracepb.TraceServiceClient, timeout time.Duration) otlpSender {
+	return func(request *coltracepb.ExportTraceServiceRequest) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		resp, err := client.Export(ctx, request)
+		if err != nil {
+			return fmt.Errorf("send %d spans to %s: %w", countSpans(request), endpoint, err)
+		}
+		return checkPartialSuccess(endpoint, resp)
+	}
+}
+
+func httpSender(endpoint string, client *http.Client) otlpSender {
+	return func(request *coltracepb.ExportTraceServiceRequest) error {
+		body, err := proto.Marshal(request)
+		if err != nil {
+			return fmt.Errorf("encode otlp request: %w", err)
+		}
+
+		resp, err := client.Post(endpoint, "application/x-protobuf", bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("send %d spans to %s: %w", countSpans(request), endpoint, err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode/100 != 2 {
+			detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("otlp collector %s rejected %d spans: %s: %s", endpoint, countSpans(request), resp.Status, bytes.TrimSpace(detail))
+		}
+		reply, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("read otlp response from %s: %w", endpoint, err)
+		}
+		var decoded coltracepb.ExportTraceServiceResponse
+		if err := proto.Unmarshal(reply, &decoded); err != nil {
+			// A 2xx with an unreadable body still means the batch was taken
+			return nil
+		}
+		return checkPartialSuccess(endpoint, &decoded)
+	}
+}
+
+// checkPartialSuccess turns spans the collector accepted the request for but then dropped
+// into an error; OTLP reports them in an otherwise successful response.
+func checkPartialSuccess(endpoint string, resp *coltracepb.ExportTraceServiceResponse) error {
+	partial := resp.GetPartialSuccess()
+	if partial.GetRejectedSpans() == 0 {
+		return nil
+	}
+	return fmt.Errorf("otlp collector %s rejected %d spans: %s", endpoint, partial.GetRejectedSpans(), partial.GetErrorMessage())
+}
+
+func countSpans(request *coltracepb.ExportTraceServiceRequest) int {
+	n := 0
+	for _, rs := range request.GetResourceSpans() {
+		for _, ss := range rs.GetScopeSpans() {
+			n += len(ss.GetSpans())
+		}
+	}
+	return n
+}
+
+type otlpExporter struct {
+	send        otlpSender
+	serviceName string
+	batchSize   int
+	toUnixNano  func(ts uint64) uint64
+	spans       []*tracepb.Span
+}
+
+func (x *otlpExporter) add(window activeWindow) error {
+	attributes := []*commonpb.KeyValue{
+		stringAttr("coro.probe_id", fmt.Sprintf("0x%016x", window.probeID)),
+		intAttr("thread.id", window.start.TID),
+		stringAttr("coro.addr", window.start.Addr),
+	}
+	if window.unfinished {
+		attributes = append(attributes, boolAttr("coro.unfinished", true))
+	}
+
+	// Coroutine = trace: the probe ID fills the low half of the 128-bit trace ID
+	traceID := make([]byte, 16)
+	binary.BigEndian.PutUint64(traceID[8:], window.probeID)
+	spanID := make([]byte, 8)
+	binary.BigEndian.PutUint64(spanID, window.index)
+
+	x.spans = append(x.spans, &tracepb.Span{
+		TraceId:           traceID,
+		SpanId:            spanID,
+		Name:              "coroutine active",
+		Kind:              tracepb.Span_SPAN_KIND_INTERNAL,
+		StartTimeUnixNano: x.toUnixNano(window.start.TS),
+		EndTimeUnixNano:   x.toUnixNano(window.end.TS),
+		Attributes:        attributes,
+	})
+	if len(x.spans) >= x.batchSize {
+		return x.flush()
+	}
+	return nil
+}
+
+func (x *otlpExporter) flush() error {
+	if len(x.spans) == 0 {
+		return nil
+	}
+
+	request := &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{
+		Resource:   &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringAttr("service.name", x.serviceName)}},
+		ScopeSpans: []*tracepb.ScopeSpans{{Scope: &commonpb.InstrumentationScope{Name: "coroTracer"}, Spans: x.spans}},
+	}}}
+	if err := x.send(request); err != nil {
+		return err
+	}
+
+	x.spans = nil
+	return nil
+}
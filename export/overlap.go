@@ -0,0 +1,82 @@
+package export
+
+import "sort"
+
+// ActiveOverlap is two coroutines claiming to run on the same OS thread at the same time.
+// A thread runs one coroutine at a time, so each one points at a probe bug, a stale TID,
+// or ProbeID reuse.
+type ActiveOverlap struct {
+	TID    uint64 `json:"tid"`
+	ProbeA uint64 `json:"probe_a"` // Window that started first
+	ProbeB uint64 `json:"probe_b"`
+	FromTS uint64 `json:"from_ts"` // Overlapping range, monotonic ns
+	ToTS   uint64 `json:"to_ts"`
+}
+
+type activeEdge struct {
+	tid    uint64
+	ts     uint64
+	seq    uint64
+	active bool
+}
+
+type threadWindow struct {
+	probeID    uint64
+	start, end uint64
+}
+
+// findActiveOverlaps turns each probe's events into active windows per TID and reports the
+// windows that overlap on the same TID. A window is an is_active=true event closed by the
+// same probe's next event; if that next event is not a suspend, an edge was lost and the
+// window is dropped rather than guessed. Windows that merely touch do not overlap.
+func findActiveOverlaps(edges map[uint64][]activeEdge, keep int) (count int, samples []ActiveOverlap) {
+	byTID := make(map[uint64][]threadWindow)
+	for probeID, probeEdges := range edges {
+		sort.Slice(probeEdges, func(i, j int) bool {
+			if probeEdges[i].ts != probeEdges[j].ts {
+				return probeEdges[i].ts < probeEdges[j].ts
+			}
+			return probeEdges[i].seq < probeEdges[j].seq
+		})
+		for i := 0; i+1 < len(probeEdges); i++ {
+			open, next := probeEdges[i], probeEdges[i+1]
+			if !open.active || next.active {
+				continue
+			}
+			byTID[open.tid] = append(byTID[open.tid], threadWindow{probeID, open.ts, next.ts})
+		}
+	}
+
+	tids := make([]uint64, 0, len(byTID))
+	for tid := range byTID {
+		tids = append(tids, tid)
+	}
+	sort.Slice(tids, func(i, j int) bool { return tids[i] < tids[j] })
+
+	for _, tid := range tids {
+		windows := byTID[tid]
+		sort.Slice(windows, func(i, j int) bool {
+			if windows[i].start != windows[j].start {
+				return windows[i].start < windows[j].start
+			}
+			return windows[i].probeID < windows[j].probeID
+		})
+		// Compare each window with the one reaching furthest so far
+		reach := windows[0]
+		for _, w := range windows[1:] {
+			if w.start < reach.end {
+				count++
+				if len(samples) < keep {
+					samples = append(samples, ActiveOverlap{
+						TID: tid, ProbeA: reach.probeID, ProbeB: w.probeID,
+						FromTS: w.start, ToTS: min(w.end, reach.end),
+					})
+				}
+			}
+			if w.end > reach.end {
+				reach = w
+			}
+		}
+	}
+	return count, samples
+}
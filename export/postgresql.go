@@ -19,6 +19,8 @@ type PostgreSQLExportOptions struct {
 	Table         string
 	MaintenanceDB string
 	SSLMode       string
+
+	MaxLineBytes int // Longest trace line accepted; 0 means DefaultMaxLineBytes
 }
 
 // ExportJSONLToPostgreSQL converts a trace JSONL file directly into a
@@ -76,7 +78,7 @@ func ExportJSONLToPostgreSQL(jsonlPath string, options PostgreSQLExportOptions)
 	}
 
 	insertSQL := "INSERT INTO public." + quotePostgresIdentifier(tableName) + " (probe_id, tid, addr, seq, is_active, ts) VALUES (%d, %d, '%s', %d, %t, %d);\n"
-	if err := StreamJSONL(jsonlPath, func(record TraceRecord) error {
+	if err := StreamTrace(jsonlPath, options.MaxLineBytes, func(record TraceRecord) error {
 		_, err := fmt.Fprintf(
 			writer,
 			insertSQL,
@@ -0,0 +1,28 @@
+package export
+
+import "time"
+
+// ReplayTrace re-emits a recorded trace through fn, sleeping so that events arrive with
+// their original spacing divided by speed (2 = twice as fast). A speed <= 0 replays
+// without any delay. It lets downstream consumers be exercised without a live tracee.
+//
+// Deadlines are computed from the first event, so sleep overshoot does not accumulate.
+// Events harvested slightly out of timestamp order are delivered immediately.
+func ReplayTrace(tracePath string, speed float64, maxLineBytes int, fn func(record TraceRecord) error) error {
+	var start time.Time
+	var firstTS uint64
+
+	return StreamTrace(tracePath, maxLineBytes, func(record TraceRecord) error {
+		if speed > 0 {
+			if start.IsZero() {
+				start, firstTS = time.Now(), record.TS
+			} else if record.TS > firstTS {
+				offset := time.Duration(float64(record.TS-firstTS) / speed)
+				if wait := time.Until(start.Add(offset)); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+		}
+		return fn(record)
+	})
+}
@@ -12,8 +12,8 @@ import (
 // ExportJSONLToSQLite converts a trace JSONL file into a SQLite database file.
 //
 // Runtime note: this exporter uses the local sqlite3 CLI so the project keeps
-// its Go dependency set minimal.
-func ExportJSONLToSQLite(jsonlPath, sqlitePath string) error {
+// its Go dependency set minimal. maxLineBytes bounds the trace's lines as in StreamJSONL.
+func ExportJSONLToSQLite(jsonlPath, sqlitePath string, maxLineBytes int) error {
 	if _, err := exec.LookPath("sqlite3"); err != nil {
 		return fmt.Errorf("sqlite3 binary not found in PATH: %w", err)
 	}
@@ -64,7 +64,7 @@ func ExportJSONLToSQLite(jsonlPath, sqlitePath string) error {
 	}
 
 	insertSQL := "INSERT INTO " + DefaultTableName + " (probe_id, tid, addr, seq, is_active, ts) VALUES ('%d', %d, '%s', %d, %d, %d);\n"
-	if err := StreamJSONL(jsonlPath, func(record TraceRecord) error {
+	if err := StreamTrace(jsonlPath, maxLineBytes, func(record TraceRecord) error {
 		_, err := fmt.Fprintf(
 			writer,
 			insertSQL,
@@ -0,0 +1,84 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// StdinPath is the -in value that reads the trace from standard input.
+const StdinPath = "-"
+
+// SpoolTrace copies a trace arriving on r (usually stdin) into a temporary file and returns
+// its path; the caller removes it. It is for consumers that read a trace more than once,
+// which a pipe cannot do: the exporters look at the meta header and typed records before
+// they walk the events, and the index readers seek. Single-pass readers take the stream
+// directly (see ValidateStream). gzip input is decompressed on the way, and the file gets
+// a .jsonl or .pb extension from the content.
+func SpoolTrace(r io.Reader) (string, error) {
+	reader, binary, err := sniffTrace(r)
+	if err != nil {
+		return "", fmt.Errorf("spool trace: %w", err)
+	}
+	ext := ".jsonl"
+	if binary {
+		ext = ".pb"
+	}
+
+	file, err := os.CreateTemp("", "corotracer-stdin-*"+ext)
+	if err != nil {
+		return "", fmt.Errorf("spool trace: %w", err)
+	}
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", fmt.Errorf("spool trace: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("spool trace: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// IsNamedPipe reports whether path is a FIFO, which like stdin can only be read once.
+func IsNamedPipe(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// IsStream reports whether path names a trace that can only be read once: stdin (-) or
+// a named pipe.
+func IsStream(path string) bool {
+	return path == StdinPath || IsNamedPipe(path)
+}
+
+// OpenStream opens stdin (-) or a named pipe for a single-pass reader. Opening a FIFO
+// waits for a writer, and reading ends only when the last writer closes it, so events
+// are consumed as the producer writes them. Closing the stdin stream leaves stdin open.
+func OpenStream(path string) (io.ReadCloser, error) {
+	if path == StdinPath {
+		return io.NopCloser(os.Stdin), nil
+	}
+	pipe, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open named pipe: %w", err)
+	}
+	return pipe, nil
+}
+
+// SpoolInput returns a regular file to read the trace at path from, for consumers that
+// need one (see SpoolTrace). stdin (-) and named pipes are spooled, and spooled reports
+// that the caller must remove the copy; a FIFO is copied once its last writer closes it.
+func SpoolInput(path string) (file string, spooled bool, err error) {
+	if !IsStream(path) {
+		return path, false, nil
+	}
+	stream, err := OpenStream(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer stream.Close()
+	file, err = SpoolTrace(stream)
+	return file, err == nil, err
+}
@@ -0,0 +1,329 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/lixiasky-back/coroTracer/structure"
+)
+
+const (
+	// slotsPerStation bounds how often one (probe_id, seq) pair can legitimately appear
+	// in a trace without slot indexes: seq is per slot, so each of the 8 slots may reach
+	// the same value once. A meta record's SlotsPerStation raises it for wider stations.
+	slotsPerStation = structure.BaseSlotsPerStation
+	// maxReportedLines caps the line numbers kept for each problem kind.
+	maxReportedLines = 20
+)
+
+// ValidationReport lists everything ValidateTrace found wrong with a trace.
+type ValidationReport struct {
+	Lines   int // Non-blank lines (JSONL) or records (binary) read
+	Records int // Lines that decoded into a TraceRecord
+
+	Malformed      int   // Lines that failed to unmarshal
+	MalformedLines []int // First few offending line numbers
+	TooLong        int   // Lines longer than the reader buffer, skipped unread
+	TooLongLines   []int
+
+	OddSeqs          int      // Records with an odd seq, i.e. a torn write that slipped through
+	DuplicateRecords int      // Records identical to an earlier one
+	DuplicateProbes  []uint64 // ProbeIDs whose seq repeats more often than there are slots: two coroutines share the ID
+	SeqRegressions   int      // Records whose seq is below an earlier one from the same (probe_id, slot)
+
+	ReadError string // Set when a binary trace could not be read to the end
+
+	// TornTail is set when the trace ends in a partial record, as a tracer killed mid-write
+	// leaves it. The record is already counted in Malformed (JSONL) or ReadError (binary);
+	// this tells a cut-short tail apart from corruption further in.
+	TornTail bool
+
+	// ActiveOverlaps counts active windows that overlap another coroutine's on the same
+	// TID; the first few are in OverlapSamples. Not checked for sampled traces or traces
+	// with gap records, whose missing edges would pair up the wrong events.
+	ActiveOverlaps int
+	OverlapSamples []ActiveOverlap
+
+	// PoolExhaustedTS is the monotonic ns at which the tracer found every station taken,
+	// 0 if it never did. It does not fail OK, but the trace may be missing coroutines.
+	PoolExhaustedTS uint64
+
+	// Diags counts the harvest anomalies the tracer recorded, by kind (structure.DiagGap,
+	// ...), and LostEpochs sums the epochs its gap records say were overwritten unread.
+	// They describe the tracee and the tracer's run, not the file, so they do not fail OK.
+	Diags      map[string]int
+	LostEpochs uint64
+
+	// SampleEvery is the -sample rate from the meta header, 0 for a full trace, and
+	// Throttle the first record of -max-write-rate sampling (SampleEvery 0 when none), so
+	// a trace read once need not be read again for them.
+	SampleEvery uint32
+	Throttle    structure.TraceThrottle
+}
+
+// OK reports whether the trace is clean enough to hand to downstream tooling.
+func (r ValidationReport) OK() bool {
+	return r.Malformed == 0 && r.TooLong == 0 && r.OddSeqs == 0 &&
+		r.DuplicateRecords == 0 && len(r.DuplicateProbes) == 0 && r.SeqRegressions == 0 && r.ReadError == "" &&
+		r.ActiveOverlaps == 0
+}
+
+type probeSeq struct {
+	probeID uint64
+	seq     uint64
+}
+
+type probeSlot struct {
+	probeID uint64
+	slot    int
+}
+
+// recordKey compares records by value: TraceRecord.Slot is a pointer.
+type recordKey struct {
+	TraceRecord
+	slot int
+}
+
+func newRecordKey(record TraceRecord) recordKey {
+	key := recordKey{TraceRecord: record, slot: -1}
+	if record.Slot != nil {
+		key.slot = *record.Slot
+		key.Slot = nil
+	}
+	return key
+}
+
+type traceValidator struct {
+	report    ValidationReport
+	seqCounts map[probeSeq]int
+	lastSeqs  map[probeSlot]uint64
+	seen      map[recordKey]struct{}
+	dupProbes map[uint64]struct{}
+	edges     map[uint64][]activeEdge
+	sampled   bool
+	gapped    bool
+	slots     int              // Widest SlotsPerStation announced by a meta record
+	expect    *expectationPass // Set when rules are checked in the same pass
+}
+
+func newTraceValidator() *traceValidator {
+	return &traceValidator{
+		seqCounts: make(map[probeSeq]int),
+		lastSeqs:  make(map[probeSlot]uint64),
+		seen:      make(map[recordKey]struct{}),
+		dupProbes: make(map[uint64]struct{}),
+		edges:     make(map[uint64][]activeEdge),
+	}
+}
+
+func (v *traceValidator) add(record TraceRecord) {
+	v.report.Records++
+	if v.expect != nil {
+		v.expect.add(record)
+	}
+
+	if record.Seq%2 != 0 {
+		v.report.OddSeqs++
+	}
+
+	key := newRecordKey(record)
+	if _, dup := v.seen[key]; dup {
+		v.report.DuplicateRecords++
+		return
+	}
+	v.seen[key] = struct{}{}
+	v.edges[record.ProbeID] = append(v.edges[record.ProbeID], activeEdge{record.TID, record.TS, record.Seq, record.IsActive})
+
+	if record.Slot != nil {
+		ps := probeSlot{record.ProbeID, *record.Slot}
+		if last, ok := v.lastSeqs[ps]; ok && record.Seq < last {
+			v.report.SeqRegressions++
+			return
+		}
+		v.lastSeqs[ps] = record.Seq
+		return
+	}
+	ps := probeSeq{record.ProbeID, record.Seq}
+	v.seqCounts[ps]++
+	if v.seqCounts[ps] > max(v.slots, slotsPerStation) {
+		v.dupProbes[record.ProbeID] = struct{}{}
+	}
+}
+
+// typed notes the typed records the report cares about.
+func (v *traceValidator) typed(payload []byte) error {
+	if v.expect != nil {
+		v.expect.typed(payload)
+	}
+	var saturation structure.TraceSaturation
+	if v.report.PoolExhaustedTS == 0 && decodeSaturation(payload, &saturation) {
+		v.report.PoolExhaustedTS = saturation.TS
+	}
+	var meta structure.TraceMeta
+	if json.Unmarshal(payload, &meta) == nil && meta.Type == "meta" {
+		v.slots = max(v.slots, int(meta.SlotsPerStation))
+		if meta.SampleEvery > 1 {
+			v.sampled = true
+			v.report.SampleEvery = meta.SampleEvery
+		}
+	}
+	var throttle structure.TraceThrottle
+	if decodeThrottle(payload, &throttle) {
+		v.sampled = true
+		if v.report.Throttle.SampleEvery == 0 {
+			v.report.Throttle = throttle
+		}
+	}
+	var diag structure.TraceDiag
+	if decodeDiag(payload, &diag) {
+		if v.report.Diags == nil {
+			v.report.Diags = make(map[string]int)
+		}
+		v.report.Diags[diag.Kind]++
+		if diag.Kind == structure.DiagGap {
+			v.report.LostEpochs += diag.Count
+			v.gapped = true
+		}
+	}
+	return nil
+}
+
+// ValidateTrace scans a JSONL or binary trace and reports structural problems.
+// Unlike StreamJSONL it never stops at the first bad line, so the report covers the whole file.
+// Records that carry a slot index must have a non-decreasing seq per (probe_id, slot).
+// Without one, per-slot ordering is checked indirectly: a (probe_id, seq) pair may
+// appear at most once per slot.
+func ValidateTrace(tracePath string, maxLineBytes int) (ValidationReport, error) {
+	v := newTraceValidator()
+	binary := isBinaryTrace(tracePath)
+	file, err := openTrace(tracePath)
+	if err != nil {
+		if binary {
+			return v.report, fmt.Errorf("open binary trace %q: %w", tracePath, err)
+		}
+		return v.report, fmt.Errorf("open jsonl %q: %w", tracePath, err)
+	}
+	defer file.Close()
+	if err := v.read(tracePath, file, binary, maxLineBytes); err != nil {
+		return v.report, err
+	}
+	return v.finish(), nil
+}
+
+// ValidateStream is ValidateTrace for a trace that can only be read once, such as stdin
+// or a named pipe (see OpenStream). r is read to EOF in a single pass, with nothing
+// written to disk; the encoding is detected from the content and name labels errors.
+// rules, if any, are checked in the same pass, as CheckExpectations would.
+func ValidateStream(r io.Reader, name string, maxLineBytes int, rules []Expectation) (ValidationReport, ExpectationResult, error) {
+	v := newTraceValidator()
+	if len(rules) > 0 {
+		v.expect = newExpectationPass()
+	}
+	reader, binary, err := sniffTrace(r)
+	if err != nil {
+		return v.report, ExpectationResult{}, fmt.Errorf("read %s: %w", name, err)
+	}
+	if err := v.read(name, reader, binary, maxLineBytes); err != nil {
+		return v.report, ExpectationResult{}, err
+	}
+	var expectations ExpectationResult
+	if v.expect != nil {
+		expectations = v.expect.check(rules)
+	}
+	return v.finish(), expectations, nil
+}
+
+// read feeds one decompressed trace through the validator.
+func (v *traceValidator) read(name string, r io.Reader, binary bool, maxLineBytes int) error {
+	if !binary {
+		return v.readJSONL(name, r, maxLineBytes)
+	}
+	if err := readBinary(r, func(record TraceRecord) error {
+		v.report.Lines++
+		v.add(record)
+		return nil
+	}, v.typed); err != nil {
+		v.report.ReadError = err.Error()
+		v.report.TornTail = errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// finish runs the checks that need the whole trace and returns the report.
+func (v *traceValidator) finish() ValidationReport {
+	for probeID := range v.dupProbes {
+		v.report.DuplicateProbes = append(v.report.DuplicateProbes, probeID)
+	}
+	sort.Slice(v.report.DuplicateProbes, func(i, j int) bool {
+		return v.report.DuplicateProbes[i] < v.report.DuplicateProbes[j]
+	})
+
+	if !v.sampled && !v.gapped {
+		v.report.ActiveOverlaps, v.report.OverlapSamples = findActiveOverlaps(v.edges, maxReportedLines)
+	}
+	return v.report
+}
+
+func (v *traceValidator) readJSONL(jsonlPath string, r io.Reader, maxLineBytes int) error {
+	if maxLineBytes <= 0 {
+		maxLineBytes = DefaultMaxLineBytes
+	}
+
+	// ReadLine instead of bufio.Scanner: an over-long line is reported and skipped, not fatal
+	tail := &tailReader{Reader: r}
+	reader := bufio.NewReaderSize(tail, maxLineBytes)
+
+	lineNo, lastMalformed := 0, false
+	for {
+		line, isPrefix, err := reader.ReadLine()
+		if err == io.EOF {
+			v.report.TornTail = lastMalformed && tail.endsMidLine()
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read jsonl %q: %w", jsonlPath, err)
+		}
+		lineNo++
+
+		if isPrefix {
+			for isPrefix && err == nil {
+				_, isPrefix, err = reader.ReadLine()
+			}
+			v.report.Lines++
+			v.report.TooLong++
+			v.report.TooLongLines = appendCapped(v.report.TooLongLines, lineNo)
+			continue
+		}
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		lastMalformed = false
+		if isMetaLine(line) {
+			v.typed(line)
+			continue
+		}
+		v.report.Lines++
+
+		var record TraceRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			v.report.Malformed++
+			v.report.MalformedLines = appendCapped(v.report.MalformedLines, lineNo)
+			lastMalformed = true
+			continue
+		}
+		v.add(record)
+	}
+}
+
+func appendCapped(lines []int, lineNo int) []int {
+	if len(lines) >= maxReportedLines {
+		return lines
+	}
+	return append(lines, lineNo)
+}
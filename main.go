@@ -4,28 +4,82 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/lixiasky-back/coroTracer/engine"
 	exporter "github.com/lixiasky-back/coroTracer/export"
+	"github.com/lixiasky-back/coroTracer/structure"
 )
 
 func main() {
 	// 1. Define command-line arguments
 	n := flag.Uint("n", 128, "Number of stations (coroutines) to allocate")
 	cmdStr := flag.String("cmd", "", "Target command to execute and trace (e.g., './my_cpp_coro')")
+	stopTimeout := flag.Duration("stop-timeout", 5*time.Second, "How long to wait for the target to exit after forwarding a shutdown signal before killing it")
+	duration := flag.Duration("duration", 0, "Stop tracing automatically after this long (e.g. 30s); the target gets SIGTERM and the trace is flushed")
+	estimate := flag.Bool("estimate", false, "Print the shm mapping size for -n and the projected trace size for -estimate-rate over -duration (1m if unset), then exit without allocating")
+	estimateRate := flag.Float64("estimate-rate", 100000, "Events per second assumed by -estimate")
+	selftest := flag.Bool("selftest", false, "Benchmark the harvester: built-in Go probes write epochs for -duration (default 5s), then report generated vs harvested events")
+	selftestProbes := flag.Int("selftest-probes", 4, "Generator goroutines for -selftest, one station each")
+	selftestRate := flag.Float64("selftest-rate", 0, "Events per second per -selftest probe; 0 writes as fast as possible")
+	attach := flag.Bool("attach", false, "Do not launch a target; wait for an already-running tracee to connect using the CTP_* environment")
+	maxWriteRate := flag.Float64("max-write-rate", 0, "Cap on epochs written per second; above it the tracer samples automatically and records each change in the trace. 0 writes everything")
+	flightRecorder := flag.Int("flight-recorder", 0, "Keep the last N harvested events in memory, written to -out or not; SIGQUIT dumps them to -flight-recorder-out and tracing goes on. 0 disables")
+	flightRecorderOut := flag.String("flight-recorder-out", "", "Where SIGQUIT dumps the -flight-recorder ring; .jsonl or .pb. Defaults to <out>.flight.jsonl")
+	sample := flag.Int("sample", 1, "Write only one epoch in N per slot to shrink the trace; the rate is recorded in the meta header")
+	slots := flag.Int("slots", 8, "Epoch slots per station (1-64), negotiated with the SDK; fewer slots drop more events under bursts")
 	shmPath := flag.String("shm", "/tmp/corotracer.shm", "Path to shared memory file")
-	sockPath := flag.String("sock", "/tmp/corotracer.sock", "Path to Unix Domain Socket")
-	logPath := flag.String("out", "trace_output.jsonl", "Output JSONL file path")
-	exportKind := flag.String("export", "", "Optional export target: sqlite | mysql | postgres | postgresql | dataframe | csv")
-	inputPath := flag.String("in", "", "Input JSONL file for export-only mode. Defaults to -out.")
+	shmStrict := flag.Bool("shm-strict", false, "Refuse to start if -shm is not on tmpfs/ramfs/hugetlbfs (default: warn only)")
+	mlock := flag.Bool("mlock", false, "Lock the shm mapping in RAM so it cannot be swapped out (needs ulimit -l or CAP_IPC_LOCK)")
+	shmExisting := flag.Bool("shm-existing", false, "Map -shm as already created and initialised by the tracee's side, without truncating it; -n and -slots are read from its header")
+	cleanup := flag.String("cleanup", "keep", "What to remove on exit: keep (leave -shm for post-mortem inspection) | remove (delete -shm too); the -sock file is always removed")
+	hugePages := flag.Bool("hugepages", false, "Back the shm mapping with 2MB huge pages (hugetlbfs path or MADV_HUGEPAGE), falling back to normal pages")
+	sockPath := flag.String("sock", "/tmp/corotracer.sock", "Wakeup socket: a Unix Domain Socket path, @name for the Linux abstract namespace, or tcp://host:port")
+	logPath := flag.String("out", "trace_output.jsonl", "Output JSONL file path; {cmd}, {timestamp} and {pid} are expanded when tracing")
+	outDir := flag.String("out-dir", "", "Directory for relative -out paths, created if missing; also where -export/-validate look when -in is empty")
+	recordSlot := flag.Bool("record-slot", false, "Record the station slot index (0-7) of every event, for per-slot analyses")
+	minHex := flag.Bool("min-hex", false, "Write JSONL addresses without leading zeros (0x0, 0x401abc) to shrink the trace")
+	index := flag.Bool("index", false, "Maintain <out>.idx mapping each ProbeID to the byte offsets of its events; rebuilt from the trace when missing or stale")
+	atomicOut := flag.Bool("atomic-out", false, "Write -out as <out>.partial and rename it on clean shutdown, so readers never see a truncated trace")
+	logFormat := flag.String("log-format", "text", "Format of the tracer's runtime log on stdout: text | json")
+	pprofAddr := flag.String("pprof", "", "Serve the tracer's own net/http/pprof profiles on this address at /debug/pprof/ (e.g. :6060); empty disables")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics on this address at /metrics (e.g. :9464); empty disables")
+	writeErrorTimeout := flag.Duration("write-error-timeout", 0, "Stop tracing once writes to -out have failed (e.g. disk full) for this long; 0 retries until they recover")
+	flushInterval := flag.Duration("flush-interval", engine.DefaultFlushInterval, "Flush the trace file at least this often under sustained load; negative disables")
+	idleWarn := flag.Duration("idle-warn", 0, "Warn when the connected tracee has been silent this long (e.g. 30s); 0 disables")
+	deathEvents := flag.Bool("death-events", false, "Record a death line when a coroutine's station is marked dead and let the SDK reuse the station")
+	canary := flag.Bool("canary", false, "Guard the end of every station with a canary and report probes that write past their payload area")
+	coldStart := flag.String("cold-start", "emit", "Epochs already in the stations when the tracee connects: emit (harvest them once) | skip (trace only what is written after connect)")
+	stationReset := flag.String("station-reset", "never", "lastSeen handling when a station changes owner (restarted tracee on reused shm): never | birth")
+	backoffSpin := flag.Int("backoff-spin", 0, "Empty scans to busy-spin before backing off")
+	backoffYield := flag.Int("backoff-yield", 0, "Empty scans to yield (runtime.Gosched) after spinning")
+	backoffSleepScans := flag.Int("backoff-sleep-scans", 0, "Empty scans to sleep for -backoff-sleep before arming the UDS wait")
+	backoffSleep := flag.Duration("backoff-sleep", engine.DefaultBackoffSleep, "Sleep per empty scan during the sleep phase of the backoff")
+	exportKind := flag.String("export", "", "Optional export target: sqlite | mysql | postgres | postgresql | dataframe | csv | otlp | jsonl | anonymize")
+	inputPath := flag.String("in", "", "Input JSONL file for export-only mode, - for stdin. Defaults to -out.")
+	maxLineBytes := flag.Int("max-line-bytes", exporter.DefaultMaxLineBytes, "Longest JSONL line accepted by -export/-validate; longer lines are reported, never silently dropped")
+	validate := flag.Bool("validate", false, "Check the -in trace for malformed lines, torn seqs and duplicate ProbeIDs; exits non-zero on problems")
+	expectPath := flag.String("expect", "", "Rules file checked against the -in trace (max-suspend 500ms, max-migrations 2, ...); implies -validate and exits non-zero when a rule is broken")
 	sqlitePath := flag.String("sqlite-out", "", "Output SQLite database path. Defaults to <input>.sqlite")
 	csvPath := flag.String("csv-out", "", "Output DataFrame-friendly CSV path. Defaults to <input>.csv")
+	csvWallTime := flag.Bool("csv-wall-time", false, "Add a wall_time column to the CSV export, computed from the trace's clock anchor")
+	anonOut := flag.String("anon-out", "", "Output path for anonymize export; .jsonl or .pb. Defaults to <input>.anon.jsonl")
+	anonKey := flag.String("anon-key", "", "Where anonymize export writes the key that maps the copy back. Defaults to <anon-out>.key.json")
+	jsonlOut := flag.String("jsonl-out", "", "Output JSONL path for jsonl export (binary trace conversion). Defaults to <input>.jsonl")
+	otlpProtocol := flag.String("otlp-protocol", exporter.OTLPProtocolGRPC, "Transport for otlp export: grpc | http")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "Collector for otlp export. Defaults to "+exporter.DefaultOTLPEndpoint+" for grpc, "+exporter.DefaultOTLPHTTPEndpoint+" for http")
+	otlpService := flag.String("otlp-service", exporter.DefaultOTLPServiceName, "service.name reported to the collector for otlp export")
 	dbCLI := flag.String("db-cli", "", "Optional database CLI override. mysql export defaults to mysql; postgres export defaults to psql")
 	dbHost := flag.String("db-host", "127.0.0.1", "Database host for mysql/postgres export")
 	dbPort := flag.Int("db-port", 0, "Database port for mysql/postgres export. Defaults to 3306 for mysql and 5432 for postgres")
@@ -38,22 +92,108 @@ func main() {
 	pgSSLMode := flag.String("pg-sslmode", "", "Optional PostgreSQL SSL mode passed via PGSSLMODE")
 	flag.Parse()
 
-	traceMode := strings.TrimSpace(*cmdStr) != ""
+	if *estimate {
+		window := *duration
+		if window <= 0 {
+			window = time.Minute
+		}
+		est := engine.EstimateFootprint(uint32(*n), *logPath, engine.EngineOptions{MinimalHex: *minHex, RecordSlot: *recordSlot}, *estimateRate, window)
+		printEstimate(est, *estimateRate, window, *logPath)
+		return
+	}
+
+	if *expectPath != "" {
+		*validate = true
+	}
+
+	launchMode := strings.TrimSpace(*cmdStr) != ""
+	traceMode := launchMode || *attach
 	exportMode := strings.TrimSpace(*exportKind) != ""
 
-	if !traceMode && !exportMode {
-		log.Fatal("Error: either -cmd or -export is required. Example: ./coroTracer -cmd './redis-test' or ./coroTracer -export sqlite -in trace_output.jsonl")
+	if !traceMode && !exportMode && !*validate && !*selftest {
+		log.Fatal("Error: either -cmd, -attach, -export, -validate or -selftest is required. Example: ./coroTracer -cmd './redis-test' or ./coroTracer -export sqlite -in trace_output.jsonl")
+	}
+
+	if *selftest && (traceMode || exportMode || *validate) {
+		log.Fatal("Error: -selftest generates its own load and cannot be combined with -cmd, -attach, -export or -validate.")
+	}
+
+	if *validate && (traceMode || exportMode) {
+		log.Fatal("Error: -validate cannot be combined with -cmd, -attach or -export.")
+	}
+
+	if launchMode && *attach {
+		log.Fatal("Error: -cmd and -attach cannot be used together. Use -cmd to launch the target, or -attach to wait for one that is already running.")
 	}
 
 	if traceMode && exportMode {
-		log.Fatal("Error: -cmd and -export cannot be used together. Use -cmd only to collect JSONL, or use -export only to convert an existing JSONL file.")
+		log.Fatal("Error: -cmd/-attach and -export cannot be used together. Use -cmd or -attach only to collect JSONL, or use -export only to convert an existing JSONL file.")
+	}
+
+	outLabel := cmdLabel(*cmdStr)
+	if *selftest {
+		// From here on the self-test runs the trace path, with built-in probes as the tracee
+		traceMode = true
+		outLabel = "selftest"
+	}
+
+	if traceMode {
+		*logPath = expandOutPath(*logPath, *outDir, outLabel, time.Now(), os.Getpid())
+		if err := os.MkdirAll(filepath.Dir(*logPath), 0o755); err != nil {
+			log.Fatalf("Error: cannot create the output directory: %v", err)
+		}
+	} else if strings.TrimSpace(*inputPath) == "" {
+		if strings.ContainsAny(*logPath, "{}") {
+			log.Fatal("Error: -out is a file name template; pass the trace to read with -in.")
+		}
+		*logPath = expandOutPath(*logPath, *outDir, "", time.Time{}, 0)
+	}
+
+	if *validate {
+		validateInput := resolveExportInput(*inputPath, *logPath)
+		source := validateInput
+		if source == exporter.StdinPath {
+			source = "stdin"
+		}
+		var rules []exporter.Expectation
+		if *expectPath != "" {
+			var err error
+			if rules, err = exporter.ReadExpectations(*expectPath); err != nil {
+				log.Fatalf("Validation failed: %v", err)
+			}
+		}
+		report, expectations, err := validateInputTrace(validateInput, source, rules, *maxLineBytes)
+		if err != nil {
+			log.Fatalf("Validation failed: %v", err)
+		}
+		printValidationReport(report)
+		printSampling(source, report.SampleEvery, report.Throttle)
+		if *expectPath != "" {
+			printExpectationResult(expectations)
+		}
+		if !report.OK() || !expectations.OK() {
+			os.Exit(1)
+		}
+		fmt.Println("✅ Trace is well-formed.")
+		if *expectPath != "" {
+			fmt.Println("✅ Every expectation holds.")
+		}
+		return
 	}
 
 	if exportMode {
 		exportInput := resolveExportInput(*inputPath, *logPath)
 		if err := runExport(strings.TrimSpace(*exportKind), exportInput, exportConfig{
+			maxLineBytes:    *maxLineBytes,
 			sqlitePath:      *sqlitePath,
 			csvPath:         *csvPath,
+			csvWallTime:     *csvWallTime,
+			jsonlPath:       *jsonlOut,
+			anonPath:        *anonOut,
+			anonKeyPath:     *anonKey,
+			otlpProtocol:    *otlpProtocol,
+			otlpEndpoint:    *otlpEndpoint,
+			otlpService:     *otlpService,
 			dbCLI:           *dbCLI,
 			dbHost:          *dbHost,
 			dbPort:          *dbPort,
@@ -71,23 +211,139 @@ func main() {
 		return
 	}
 
+	resetPolicy, err := engine.ParseStationResetPolicy(*stationReset)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	coldStartPolicy, err := engine.ParseColdStartPolicy(*coldStart)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	cleanupPolicy, err := engine.ParseCleanupPolicy(*cleanup)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	logger, err := newLogger(*logFormat)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	// Route the log package through the same handler, so every runtime message is structured
+	slog.SetDefault(logger)
+
 	fmt.Printf("🚀 coroTracer Launcher Started\n")
-	fmt.Printf("📦 Allocating %d Stations (Memory: %d Bytes)\n", *n, 64+(*n*1024))
+	if *shmExisting {
+		fmt.Printf("📦 Mapping existing shm %s\n", *shmPath)
+	} else {
+		fmt.Printf("📦 Allocating %d Stations (Memory: %d Bytes)\n", *n, engine.MappingSize(uint32(*n), *slots))
+	}
+	fmt.Printf("📝 Writing trace to %s\n", *logPath)
 
 	// 2. Initialize the harvester engine
-	tracer, err := engine.NewTracerEngine(uint32(*n), *shmPath, *sockPath, *logPath)
+	tracer, err := engine.NewTracerEngineWithOptions(uint32(*n), *shmPath, *sockPath, *logPath, engine.EngineOptions{
+		SpinScans:         *backoffSpin,
+		YieldScans:        *backoffYield,
+		SleepScans:        *backoffSleepScans,
+		BackoffSleep:      *backoffSleep,
+		StrictShmFS:       *shmStrict,
+		ExistingShm:       *shmExisting,
+		Cleanup:           cleanupPolicy,
+		HugePages:         *hugePages,
+		Mlock:             *mlock,
+		PartialOutput:     *atomicOut,
+		MinimalHex:        *minHex,
+		RecordSlot:        *recordSlot,
+		IdleWarning:       *idleWarn,
+		StationReset:      resetPolicy,
+		ColdStart:         coldStartPolicy,
+		TrackTIDs:         *metricsAddr != "",
+		FlushInterval:     *flushInterval,
+		SlotsPerStation:   *slots,
+		Index:             *index,
+		DeathEvents:       *deathEvents,
+		Canary:            *canary,
+		WriteErrorTimeout: *writeErrorTimeout,
+		Logger:            logger,
+		SampleEvery:       *sample,
+		MaxWriteRate:      *maxWriteRate,
+		FlightRecorder:    *flightRecorder,
+	})
 	if err != nil {
 		log.Fatalf("Failed to initialize Tracer Engine: %v", err)
 	}
 	defer tracer.Close()
+	if *shmExisting {
+		fmt.Printf("📦 %d Stations found in the shm header\n", tracer.MaxStations())
+	}
+
+	if *metricsAddr != "" {
+		if err := serveMetrics(*metricsAddr, tracer); err != nil {
+			tracer.Close() // log.Fatalf skips the deferred Close, which removes the socket file
+			log.Fatalf("Failed to start metrics endpoint: %v", err)
+		}
+	}
+
+	if *pprofAddr != "" {
+		if err := servePprof(*pprofAddr); err != nil {
+			tracer.Close()
+			log.Fatalf("Failed to start pprof endpoint: %v", err)
+		}
+	}
+
+	if *selftest {
+		fmt.Printf("🏋️  Self-test: %d probe(s), %s each, for %v\n", *selftestProbes, formatRate(*selftestRate), selftestWindow(*duration))
+		result, err := tracer.RunSelfTest(engine.SelfTestOptions{
+			Probes:   *selftestProbes,
+			Rate:     *selftestRate,
+			Duration: *duration,
+		})
+		if err != nil {
+			tracer.Close()
+			log.Fatalf("Self-test failed: %v", err)
+		}
+		printSelfTest(result)
+		return
+	}
 
 	// 3. Start the harvesting event loop in a background Goroutine
+	handlePauseSignals(tracer)
+	if *flightRecorder > 0 {
+		dumpPath := *flightRecorderOut
+		if strings.TrimSpace(dumpPath) == "" {
+			dumpPath = deriveOutputPath(*logPath, ".flight.jsonl")
+		}
+		handleFlightRecorderSignal(tracer, dumpPath)
+		fmt.Printf("🛩️  Flight recorder on: the last %d events go to %s on SIGQUIT (kill -QUIT %d)\n", *flightRecorder, dumpPath, os.Getpid())
+	}
+
+	// Run only returns an error when tracing cannot go on, e.g. -write-error-timeout expired
+	engineFailed := make(chan error, 1)
 	go func() {
 		if err := tracer.Run(); err != nil {
-			log.Printf("Tracer engine exited: %v\n", err)
+			engineFailed <- err
 		}
 	}()
 
+	if *attach {
+		// Attach mode: the tracee is not our child, so we only publish the connection
+		// details and harvest until interrupted. Nothing is killed on the way out.
+		fmt.Println("🔗 Attach mode: start (or restart) the tracee with:")
+		fmt.Printf("   CTP_SHM_PATH=%s CTP_SOCK_PATH=%s CTP_MAX_STATIONS=%d\n", *shmPath, tracer.SockPath(), tracer.MaxStations())
+
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-sigChan:
+			fmt.Println("\n🛑 Received interrupt signal, shutting down...")
+		case <-afterDuration(*duration):
+			fmt.Printf("\n⏱️  -duration %v elapsed, shutting down...\n", *duration)
+		case err := <-engineFailed:
+			tracer.Close()
+			log.Fatalf("Tracer engine stopped: %v", err)
+		}
+		tracer.Close()
+		os.Exit(0)
+	}
+
 	// 4. Prepare the target command (Tracee)
 	// Using sh -c enables support for commands with arguments, e.g., -cmd "./my_prog --threads 4"
 	cmd := exec.Command("sh", "-c", *cmdStr)
@@ -95,40 +351,263 @@ func main() {
 	// 🔴 Core: Inject connection information of the cTP protocol into the child process via environment variables
 	cmd.Env = append(os.Environ(),
 		fmt.Sprintf("CTP_SHM_PATH=%s", *shmPath),
-		fmt.Sprintf("CTP_SOCK_PATH=%s", *sockPath),
+		fmt.Sprintf("CTP_SOCK_PATH=%s", tracer.SockPath()),
 		// We can even pass the value of n to let the tested program know its concurrency limit
-		fmt.Sprintf("CTP_MAX_STATIONS=%d", *n),
+		fmt.Sprintf("CTP_MAX_STATIONS=%d", tracer.MaxStations()),
 	)
 
 	// Redirect the output of the child process to the main console for easy debugging
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	// 5. Listen for system interrupt signals (Ctrl+C) for graceful exit
+	// 5. Listen for signals before launching so nothing slips through between Start and Notify
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-sigChan
-		fmt.Println("\n🛑 Received interrupt signal, shutting down...")
-		if cmd.Process != nil {
+	signal.Notify(sigChan, launchSignals(*flightRecorder > 0)...)
+
+	// 6. Officially launch the tested child process
+	fmt.Printf("🏃 Executing target: %s\n", *cmdStr)
+	if err := cmd.Start(); err != nil {
+		tracer.Close()
+		log.Fatalf("Failed to start target command: %v", err)
+	}
+	childDone := make(chan error, 1)
+	go func() { childDone <- cmd.Wait() }()
+
+	// Unmapping the shm under a still-running probe would SIGBUS it, so always wait first
+	waitChild := func() {
+		select {
+		case <-childDone:
+		case <-time.After(*stopTimeout):
+			fmt.Printf("⚠️  Target still running after %v, killing it\n", *stopTimeout)
+			cmd.Process.Kill()
+			<-childDone
+		}
+	}
+
+	deadline := afterDuration(*duration)
+	for {
+		select {
+		case err := <-childDone:
+			tracer.Close()
+			if err != nil {
+				log.Fatalf("Target command exited with error: %v", err)
+			}
+			fmt.Println("✅ Target command finished successfully. coroTracer exiting.")
+			return
+		case sig := <-sigChan:
+			// Forward the signal we actually got; the child decides what it means
+			cmd.Process.Signal(sig)
+			if !isShutdownSignal(sig) {
+				fmt.Printf("↪️  Forwarded %v to target\n", sig)
+				continue
+			}
+
+			fmt.Printf("\n🛑 Received %v, waiting for the target to exit...\n", sig)
+			waitChild()
+			tracer.Close()
+			os.Exit(0)
+		case err := <-engineFailed:
+			fmt.Printf("\n🛑 Tracer engine stopped: %v. Stopping the target...\n", err)
 			cmd.Process.Signal(syscall.SIGTERM)
+			waitChild()
+			tracer.Close()
+			os.Exit(1)
+		case <-deadline:
+			fmt.Printf("\n⏱️  -duration %v elapsed, stopping the target...\n", *duration)
+			cmd.Process.Signal(syscall.SIGTERM)
+			waitChild()
+			// Close drains the engine: a last scan and flush happen before the unmap
+			tracer.Close()
+			fmt.Println("✅ Trace window finished. coroTracer exiting.")
+			return
+		}
+	}
+}
+
+// afterDuration fires once d has elapsed; a zero or negative d never fires.
+func afterDuration(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	return time.After(d)
+}
+
+// forwardedSignals are relayed to the traced child. SIGHUP and SIGWINCH are passed
+// through without stopping the tracer (config reload, terminal resize).
+var forwardedSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP, syscall.SIGWINCH}
+
+// launchSignals are the signals relayed to a launched child. With the flight recorder on,
+// SIGQUIT belongs to the tracer: it dumps the ring instead of stopping the target.
+func launchSignals(flightRecorder bool) []os.Signal {
+	if !flightRecorder {
+		return forwardedSignals
+	}
+	var signals []os.Signal
+	for _, sig := range forwardedSignals {
+		if sig != syscall.SIGQUIT {
+			signals = append(signals, sig)
+		}
+	}
+	return signals
+}
+
+// handleFlightRecorderSignal dumps the flight recorder on every SIGQUIT. The dump runs on
+// the signal goroutine while harvesting goes on, and each one replaces the previous file.
+func handleFlightRecorderSignal(tracer *engine.TracerEngine, path string) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGQUIT)
+	go func() {
+		for range sigChan {
+			n, err := tracer.DumpFlightRecorder(path)
+			if err != nil {
+				log.Printf("Flight recorder dump failed: %v\n", err)
+				continue
+			}
+			fmt.Printf("🛩️  Flight recorder: dumped the last %d events to %s (SIGQUIT)\n", n, path)
 		}
-		tracer.Close()
-		os.Exit(0)
 	}()
+}
 
-	// 6. Officially launch the tested child process
-	fmt.Printf("🏃 Executing target: %s\n", *cmdStr)
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("Target command exited with error: %v", err)
+// handlePauseSignals lets the operator cut a window out of a live trace without touching
+// the tracee: SIGUSR1 pauses writing, SIGUSR2 resumes it. They are not forwarded.
+func handlePauseSignals(tracer *engine.TracerEngine) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigChan {
+			switch {
+			case sig == syscall.SIGUSR1 && tracer.Pause():
+				fmt.Println("⏸️  Trace paused (SIGUSR1): epochs are consumed but not written")
+			case sig == syscall.SIGUSR2 && tracer.Resume():
+				fmt.Println("▶️  Trace resumed (SIGUSR2)")
+			}
+		}
+	}()
+}
+
+// serveMetrics exposes the live engine counters for Prometheus scraping.
+// The listener is opened synchronously so a busy port fails the launch instead of going unnoticed.
+func serveMetrics(addr string, tracer *engine.TracerEngine) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", tracer.MetricsHandler())
+	fmt.Printf("📈 Metrics on http://%s/metrics\n", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Metrics endpoint stopped: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// newLogger builds the runtime logger for -log-format. Both formats write to stdout,
+// where the launcher's other output goes.
+func newLogger(format string) (*slog.Logger, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(os.Stdout, nil)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, nil)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q (want text or json)", format)
+}
+
+// servePprof profiles coroTracer itself (the scan loop, encoding, disk I/O), not the target.
+// Like serveMetrics it listens synchronously, on its own mux so nothing leaks onto
+// http.DefaultServeMux.
+func servePprof(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("🔬 pprof on http://%s/debug/pprof/\n", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, pprofMux()); err != nil {
+			log.Printf("pprof endpoint stopped: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+func pprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+func printEstimate(est engine.Estimate, rate float64, window time.Duration, outPath string) {
+	fmt.Printf("📐 Footprint for -n %d (nothing allocated)\n", est.Stations)
+	fmt.Printf("   header:  %d B\n", est.HeaderBytes)
+	fmt.Printf("   station: %d B x %d\n", est.StationBytes, est.Stations)
+	fmt.Printf("   mapping: %d B (%s); -hugepages rounds it up to whole 2MB pages\n", est.MappingBytes, formatBytes(est.MappingBytes))
+	fmt.Printf("   trace:   ~%d B (%s) for %d events at %.0f/s over %s, ~%d B/event in %s\n",
+		est.TraceBytes, formatBytes(est.TraceBytes), est.Events, rate, window, est.EventBytes, outPath)
+}
+
+// selftestWindow is the run length RunSelfTest will use for -duration.
+func selftestWindow(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 5 * time.Second
+	}
+	return d
+}
+
+func formatRate(perProbe float64) string {
+	if perProbe <= 0 {
+		return "unthrottled"
+	}
+	return fmt.Sprintf("%.0f events/s", perProbe)
+}
+
+func printSelfTest(result engine.SelfTestResult) {
+	seconds := result.Elapsed.Seconds()
+	fmt.Printf("📊 Self-test over %v\n", result.Elapsed.Round(time.Millisecond))
+	fmt.Printf("   generated: %d events (%.0f/s)\n", result.Generated, float64(result.Generated)/seconds)
+	fmt.Printf("   harvested: %d events (%.0f/s)\n", result.Harvested, float64(result.Harvested)/seconds)
+	fmt.Printf("   dropped:   %d events detected, %.2f%% of generated never reached the trace\n", result.Dropped, result.DropPercent())
+}
+
+// formatBytes renders n with a binary unit for quick reading next to the exact count.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, suffix := float64(n), "KMGTPE"
+	i := -1
+	for value >= unit && i < len(suffix)-1 {
+		value /= unit
+		i++
 	}
+	return fmt.Sprintf("%.1f %ciB", value, suffix[i])
+}
 
-	fmt.Println("✅ Target command finished successfully. coroTracer exiting.")
+func isShutdownSignal(sig os.Signal) bool {
+	switch sig {
+	case os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT:
+		return true
+	}
+	return false
 }
 
 type exportConfig struct {
+	maxLineBytes    int
 	sqlitePath      string
 	csvPath         string
+	csvWallTime     bool
+	jsonlPath       string
+	anonPath        string
+	anonKeyPath     string
+	otlpProtocol    string
+	otlpEndpoint    string
+	otlpService     string
 	dbCLI           string
 	dbHost          string
 	dbPort          int
@@ -144,35 +623,105 @@ type exportConfig struct {
 func runExport(kind, inputPath string, cfg exportConfig) error {
 	exportType := strings.ToLower(strings.TrimSpace(kind))
 
+	// source names the input in messages and derived output paths; stdin and named pipes
+	// are spooled first
+	source := inputPath
+	if source == exporter.StdinPath {
+		source = "stdin"
+	}
+	noteNamedPipe(inputPath)
+	inputPath, spooled, err := exporter.SpoolInput(inputPath)
+	if err != nil {
+		return err
+	}
+	if spooled {
+		defer os.Remove(inputPath)
+	}
+
+	noteSampled(inputPath, source)
+	// Warn before exporting: a saturated run silently lacks every coroutine that got no station
+	if saturation, ok, err := exporter.ReadSaturation(inputPath); err == nil && ok {
+		fmt.Printf("⚠️  trace may be incomplete: station pool (%d stations) exhausted at ts %d\n", saturation.Stations, saturation.TS)
+	}
+
 	switch exportType {
 	case "sqlite":
 		output := cfg.sqlitePath
 		if strings.TrimSpace(output) == "" {
-			output = deriveOutputPath(inputPath, ".sqlite")
+			output = deriveOutputPath(source, ".sqlite")
 		}
-		fmt.Printf("📤 Exporting %s -> SQLite %s\n", inputPath, output)
-		return exporter.ExportJSONLToSQLite(inputPath, output)
+		fmt.Printf("📤 Exporting %s -> SQLite %s\n", source, output)
+		return exporter.ExportJSONLToSQLite(inputPath, output, cfg.maxLineBytes)
 	case "dataframe", "csv":
 		output := cfg.csvPath
 		if strings.TrimSpace(output) == "" {
-			output = deriveOutputPath(inputPath, ".csv")
+			output = deriveOutputPath(source, ".csv")
 		}
-		fmt.Printf("📤 Exporting %s -> CSV %s\n", inputPath, output)
-		return exporter.ExportJSONLToDataFrameCSV(inputPath, output)
+		fmt.Printf("📤 Exporting %s -> CSV %s\n", source, output)
+		return exporter.ExportJSONLToDataFrameCSVWithOptions(inputPath, output, exporter.DataFrameExportOptions{
+			WallTime:     cfg.csvWallTime,
+			MaxLineBytes: cfg.maxLineBytes,
+		})
+	case "jsonl":
+		output := cfg.jsonlPath
+		if strings.TrimSpace(output) == "" {
+			output = deriveOutputPath(source, ".jsonl")
+		}
+		fmt.Printf("📤 Converting %s -> JSONL %s\n", source, output)
+		result, err := exporter.ConvertBinaryToJSONL(inputPath, output)
+		if err != nil {
+			return err
+		}
+		if result.Truncated {
+			fmt.Printf("⚠️  %s ends mid-record (tracer killed?); converted the %d complete records before the cut\n", source, result.Records)
+		}
+		return nil
+	case "anonymize":
+		output := cfg.anonPath
+		if strings.TrimSpace(output) == "" {
+			output = deriveOutputPath(source, ".anon.jsonl")
+		}
+		keyPath := cfg.anonKeyPath
+		if strings.TrimSpace(keyPath) == "" {
+			keyPath = output + ".key.json"
+		}
+		fmt.Printf("📤 Anonymizing %s -> %s (key: %s)\n", source, output, keyPath)
+		result, err := exporter.AnonymizeTrace(inputPath, output, keyPath, cfg.maxLineBytes)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("   %d records, %d coroutines renumbered; keep %s private, it re-identifies the copy\n", result.Records, result.Probes, keyPath)
+		return nil
+	case "otlp":
+		endpoint := cfg.otlpEndpoint
+		if endpoint == "" {
+			endpoint = exporter.DefaultOTLPEndpoint
+			if cfg.otlpProtocol == exporter.OTLPProtocolHTTP {
+				endpoint = exporter.DefaultOTLPHTTPEndpoint
+			}
+		}
+		fmt.Printf("📤 Exporting %s -> OTLP/%s %s\n", source, cfg.otlpProtocol, endpoint)
+		return exporter.ExportJSONLToOTLP(inputPath, exporter.OTLPExportOptions{
+			Protocol:     cfg.otlpProtocol,
+			Endpoint:     endpoint,
+			ServiceName:  cfg.otlpService,
+			MaxLineBytes: cfg.maxLineBytes,
+		})
 	case "mysql":
-		fmt.Printf("📤 Exporting %s -> MySQL %s.%s\n", inputPath, cfg.dbName, cfg.dbTable)
+		fmt.Printf("📤 Exporting %s -> MySQL %s.%s\n", source, cfg.dbName, cfg.dbTable)
 		return exporter.ExportJSONLToMySQL(inputPath, exporter.MySQLExportOptions{
-			Command:  cfg.dbCLI,
-			Host:     cfg.dbHost,
-			Port:     cfg.dbPort,
-			User:     cfg.dbUser,
-			Password: cfg.dbPassword,
-			Socket:   cfg.mysqlSocket,
-			Database: cfg.dbName,
-			Table:    cfg.dbTable,
+			Command:      cfg.dbCLI,
+			Host:         cfg.dbHost,
+			Port:         cfg.dbPort,
+			User:         cfg.dbUser,
+			Password:     cfg.dbPassword,
+			Socket:       cfg.mysqlSocket,
+			Database:     cfg.dbName,
+			Table:        cfg.dbTable,
+			MaxLineBytes: cfg.maxLineBytes,
 		})
 	case "postgres", "postgresql":
-		fmt.Printf("📤 Exporting %s -> PostgreSQL %s.%s\n", inputPath, cfg.dbName, cfg.dbTable)
+		fmt.Printf("📤 Exporting %s -> PostgreSQL %s.%s\n", source, cfg.dbName, cfg.dbTable)
 		return exporter.ExportJSONLToPostgreSQL(inputPath, exporter.PostgreSQLExportOptions{
 			Command:       cfg.dbCLI,
 			Host:          cfg.dbHost,
@@ -183,12 +732,75 @@ func runExport(kind, inputPath string, cfg exportConfig) error {
 			Table:         cfg.dbTable,
 			MaintenanceDB: cfg.pgMaintenanceDB,
 			SSLMode:       cfg.pgSSLMode,
+			MaxLineBytes:  cfg.maxLineBytes,
 		})
 	default:
 		return fmt.Errorf("unsupported export target %q", kind)
 	}
 }
 
+// cmdLabel names the run for the {cmd} placeholder: the base name of the traced program,
+// made filename-safe, or "attach" without -cmd.
+func cmdLabel(cmdStr string) string {
+	fields := strings.Fields(cmdStr)
+	if len(fields) == 0 {
+		return "attach"
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' {
+			return r
+		}
+		return '_'
+	}, filepath.Base(fields[0]))
+}
+
+// expandOutPath fills the -out template and places relative results under dir, so repeated
+// runs can write uniquely named traces side by side:
+//   - {cmd}: label, see cmdLabel ("selftest" for -selftest)
+//   - {timestamp}: local start time as 20060102-150405
+//   - {pid}: the tracer's own PID (the tracee is started after the file is opened)
+func expandOutPath(out, dir, label string, now time.Time, pid int) string {
+	out = strings.NewReplacer(
+		"{cmd}", label,
+		"{timestamp}", now.Format("20060102-150405"),
+		"{pid}", fmt.Sprint(pid),
+	).Replace(out)
+	if dir != "" && !filepath.IsAbs(out) {
+		out = filepath.Join(dir, out)
+	}
+	return out
+}
+
+// validateInputTrace validates the -in trace and checks rules against it. stdin and named
+// pipes are validated as they stream in, in a single pass with no copy on disk.
+func validateInputTrace(path, source string, rules []exporter.Expectation, maxLineBytes int) (exporter.ValidationReport, exporter.ExpectationResult, error) {
+	if exporter.IsStream(path) {
+		noteNamedPipe(path)
+		stream, err := exporter.OpenStream(path)
+		if err != nil {
+			return exporter.ValidationReport{}, exporter.ExpectationResult{}, err
+		}
+		defer stream.Close()
+		fmt.Printf("🔎 Validating %s\n", source)
+		return exporter.ValidateStream(stream, source, maxLineBytes, rules)
+	}
+
+	fmt.Printf("🔎 Validating %s\n", source)
+	report, err := exporter.ValidateTrace(path, maxLineBytes)
+	if err != nil {
+		return report, exporter.ExpectationResult{}, err
+	}
+	expectations, err := exporter.CheckExpectationRules(path, rules, maxLineBytes)
+	return report, expectations, err
+}
+
+// noteNamedPipe says why the tracer seems to hang on a FIFO -in: it reads until the writer closes.
+func noteNamedPipe(path string) {
+	if exporter.IsNamedPipe(path) {
+		fmt.Printf("⏳ %s is a named pipe; reading it until its writer closes\n", path)
+	}
+}
+
 func resolveExportInput(inputPath, defaultLogPath string) string {
 	if strings.TrimSpace(inputPath) != "" {
 		return inputPath
@@ -197,9 +809,116 @@ func resolveExportInput(inputPath, defaultLogPath string) string {
 }
 
 func deriveOutputPath(inputPath, ext string) string {
+	// trace.jsonl.gz names its outputs like trace.jsonl
+	switch strings.ToLower(filepath.Ext(inputPath)) {
+	case ".gz", ".zst":
+		inputPath = strings.TrimSuffix(inputPath, filepath.Ext(inputPath))
+	}
 	base := strings.TrimSuffix(inputPath, filepath.Ext(inputPath))
 	if strings.TrimSpace(base) == "" || base == "." {
 		return "trace_output" + ext
 	}
 	return base + ext
 }
+
+// noteSampled says so when the trace at path was recorded with -sample or throttled by
+// -max-write-rate, since its gaps are intended. source is the name shown for it, which
+// differs for spooled stdin.
+func noteSampled(path, source string) {
+	var sampleEvery uint32
+	if meta, ok, err := exporter.ReadTraceMeta(path); err == nil && ok {
+		sampleEvery = meta.SampleEvery
+	}
+	throttle, _, _ := exporter.ReadThrottle(path)
+	printSampling(source, sampleEvery, throttle)
+}
+
+// printSampling is noteSampled for what a validation pass already found.
+func printSampling(source string, sampleEvery uint32, throttle structure.TraceThrottle) {
+	if sampleEvery > 1 {
+		fmt.Printf("ℹ️  %s is sampled: it holds one epoch in %d per slot\n", source, sampleEvery)
+	}
+	if throttle.SampleEvery > 1 {
+		fmt.Printf("ℹ️  %s is partly sampled: the tracer hit -max-write-rate at ts %d and switched to one epoch in %d per slot\n", source, throttle.TS, throttle.SampleEvery)
+	}
+}
+
+func printValidationReport(report exporter.ValidationReport) {
+	fmt.Printf("   lines: %d, records: %d\n", report.Lines, report.Records)
+	if report.Malformed > 0 {
+		fmt.Printf("❌ %d malformed line(s), first at: %v\n", report.Malformed, report.MalformedLines)
+	}
+	if report.TooLong > 0 {
+		fmt.Printf("❌ %d line(s) longer than the reader buffer, first at: %v\n", report.TooLong, report.TooLongLines)
+	}
+	if report.OddSeqs > 0 {
+		fmt.Printf("❌ %d record(s) with an odd (torn) seq\n", report.OddSeqs)
+	}
+	if report.DuplicateRecords > 0 {
+		fmt.Printf("❌ %d duplicate record(s)\n", report.DuplicateRecords)
+	}
+	if len(report.DuplicateProbes) > 0 {
+		fmt.Printf("❌ %d ProbeID(s) shared by more than one coroutine: %v\n", len(report.DuplicateProbes), report.DuplicateProbes)
+	}
+	if report.SeqRegressions > 0 {
+		fmt.Printf("❌ %d record(s) whose seq goes backwards within their slot\n", report.SeqRegressions)
+	}
+	if report.ReadError != "" {
+		fmt.Printf("❌ trace could not be read to the end: %s\n", report.ReadError)
+	}
+	if report.TornTail {
+		fmt.Println("⚠️  the last record is cut short (tracer killed mid-write?); everything before it is intact")
+	}
+	if report.ActiveOverlaps > 0 {
+		fmt.Printf("❌ %d active window(s) overlapping another coroutine on the same thread\n", report.ActiveOverlaps)
+		for _, o := range report.OverlapSamples {
+			fmt.Printf("   tid %d: probes %d and %d both active during ts %d..%d\n", o.TID, o.ProbeA, o.ProbeB, o.FromTS, o.ToTS)
+		}
+	}
+	if report.PoolExhaustedTS != 0 {
+		fmt.Printf("⚠️  trace may be incomplete: station pool exhausted at ts %d\n", report.PoolExhaustedTS)
+	}
+	if len(report.Diags) > 0 {
+		fmt.Printf("⚠️  the tracer recorded harvest anomalies: %s\n", describeDiags(report.Diags, report.LostEpochs))
+	}
+}
+
+// describeDiags summarizes diag records by kind, e.g. "canary 1, gap 3 (120 epochs overwritten unread)".
+func describeDiags(diags map[string]int, lostEpochs uint64) string {
+	kinds := make([]string, 0, len(diags))
+	for kind := range diags {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	parts := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		part := fmt.Sprintf("%s %d", kind, diags[kind])
+		if kind == structure.DiagGap {
+			part += fmt.Sprintf(" (%d epochs overwritten unread)", lostEpochs)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func printExpectationResult(result exporter.ExpectationResult) {
+	fmt.Printf("   expectations: %d rule(s)\n", result.Rules)
+	for _, rule := range result.Skipped {
+		fmt.Printf("⚠️  line %d (%s) skipped: the trace is sampled, so gaps between its events are not the coroutines' own\n", rule.Line, rule.Text)
+	}
+	if result.OK() {
+		return
+	}
+	fmt.Printf("❌ %d expectation violation(s)\n", result.Violations)
+	for _, v := range result.Samples {
+		where := "trace"
+		if v.ProbeID != 0 {
+			where = fmt.Sprintf("probe %d", v.ProbeID)
+		}
+		observed := fmt.Sprintf("%d against a limit of %d", v.Value, v.Rule.Limit)
+		if v.Rule.Kind == exporter.ExpectMaxSuspend || v.Rule.Kind == exporter.ExpectMaxActive {
+			observed = fmt.Sprintf("%v from ts %d", time.Duration(v.Value), v.TS)
+		}
+		fmt.Printf("   line %d (%s): %s has %s\n", v.Rule.Line, v.Rule.Text, where, observed)
+	}
+}
@@ -1,6 +1,13 @@
 package main
 
-import "testing"
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
 
 // ─── deriveOutputPath ─────────────────────────────────────────────────────────
 
@@ -15,6 +22,7 @@ func TestDeriveOutputPath(t *testing.T) {
 		{"/tmp/run.jsonl", ".sqlite", "/tmp/run.sqlite"},
 		{"noext", ".csv", "noext.csv"},
 		{"a.b.c.jsonl", ".sqlite", "a.b.c.sqlite"},
+		{"/tmp/run.pb.gz", ".csv", "/tmp/run.csv"},
 		// empty / dot cases fall back to "trace_output<ext>"
 		{"", ".csv", "trace_output.csv"},
 		{".", ".csv", "trace_output.csv"},
@@ -63,3 +71,119 @@ func TestResolveExportInputNonEmptyIgnoresDefault(t *testing.T) {
 		t.Errorf("custom input: got %q, want custom.jsonl", got)
 	}
 }
+
+// ─── expandOutPath ────────────────────────────────────────────────────────────
+
+func TestExpandOutPath(t *testing.T) {
+	now := time.Date(2024, 3, 5, 14, 7, 9, 0, time.Local)
+	cases := []struct {
+		out, dir, cmd string
+		want          string
+	}{
+		{"trace_output.jsonl", "", "./app", "trace_output.jsonl"},
+		{"trace_output.jsonl", "runs", "./app", "runs/trace_output.jsonl"},
+		{"{cmd}-{timestamp}-{pid}.jsonl", "runs", "./bin/redis-test --threads 4", "runs/redis-test-20240305-140709-42.jsonl"},
+		{"{cmd}.pb", "", "sh -c 'x'", "sh.pb"},
+		{"{cmd}.jsonl", "", "./svc:v2", "svc_v2.jsonl"},
+		{"{cmd}.jsonl", "runs", "", "runs/attach.jsonl"},
+		{"/abs/{pid}.jsonl", "runs", "./app", "/abs/42.jsonl"},
+	}
+	for _, tc := range cases {
+		if got := expandOutPath(tc.out, tc.dir, cmdLabel(tc.cmd), now, 42); got != tc.want {
+			t.Errorf("expandOutPath(%q, %q, %q) = %q, want %q", tc.out, tc.dir, tc.cmd, got, tc.want)
+		}
+	}
+	if got := expandOutPath("{cmd}.jsonl", "", "selftest", now, 42); got != "selftest.jsonl" {
+		t.Errorf("expandOutPath with the selftest label = %q", got)
+	}
+}
+
+// ─── Signal forwarding ────────────────────────────────────────────────────────
+
+func TestIsShutdownSignal(t *testing.T) {
+	cases := []struct {
+		sig  os.Signal
+		want bool
+	}{
+		{os.Interrupt, true},
+		{syscall.SIGTERM, true},
+		{syscall.SIGQUIT, true},
+		{syscall.SIGHUP, false},
+		{syscall.SIGWINCH, false},
+	}
+	for _, c := range cases {
+		if got := isShutdownSignal(c.sig); got != c.want {
+			t.Errorf("isShutdownSignal(%v) = %v, want %v", c.sig, got, c.want)
+		}
+	}
+}
+
+func TestForwardedSignalsIncludeShutdownSignals(t *testing.T) {
+	forwarded := make(map[os.Signal]bool)
+	for _, sig := range forwardedSignals {
+		forwarded[sig] = true
+	}
+	for _, sig := range []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP} {
+		if !forwarded[sig] {
+			t.Errorf("%v is not forwarded to the child", sig)
+		}
+	}
+}
+
+func TestFlightRecorderKeepsSIGQUIT(t *testing.T) {
+	if got := launchSignals(false); len(got) != len(forwardedSignals) {
+		t.Errorf("launchSignals(false) = %v, want every forwarded signal", got)
+	}
+	got := launchSignals(true)
+	if len(got) != len(forwardedSignals)-1 {
+		t.Errorf("launchSignals(true) = %v, want all but SIGQUIT", got)
+	}
+	for _, sig := range got {
+		if sig == syscall.SIGQUIT {
+			t.Error("SIGQUIT is forwarded although the flight recorder handles it")
+		}
+	}
+}
+
+func TestAfterDurationZeroNeverFires(t *testing.T) {
+	if afterDuration(0) != nil || afterDuration(-time.Second) != nil {
+		t.Error("afterDuration(<=0) should return a nil channel")
+	}
+	select {
+	case <-afterDuration(time.Millisecond):
+	case <-time.After(time.Second):
+		t.Error("afterDuration(1ms) did not fire")
+	}
+}
+
+// ─── pprof ────────────────────────────────────────────────────────────────────
+
+func TestPprofMuxServesProfiles(t *testing.T) {
+	mux := pprofMux()
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/cmdline"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != 200 {
+			t.Errorf("GET %s = %d", path, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=1", nil))
+	if !strings.Contains(rec.Body.String(), "goroutine") {
+		t.Error("goroutine profile is empty")
+	}
+}
+
+// ─── Logging ──────────────────────────────────────────────────────────────────
+
+func TestNewLoggerFormats(t *testing.T) {
+	for _, format := range []string{"", "text", "JSON"} {
+		if logger, err := newLogger(format); err != nil || logger == nil {
+			t.Errorf("newLogger(%q) = %v, %v", format, logger, err)
+		}
+	}
+	if _, err := newLogger("xml"); err == nil {
+		t.Error("newLogger accepted an unknown format")
+	}
+}
@@ -0,0 +1,131 @@
+package structure
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// EventEncoder serializes one validated epoch by appending it to dst. slot is the index of
+// the station slot it was read from, negative when unknown (e.g. re-encoding a trace).
+// Implementations may keep scratch state: like StationWriter, they are driven by a single goroutine.
+type EventEncoder interface {
+	AppendEvent(dst []byte, s *StationData, slot int, safeSeq, tid, addr uint64, isActive bool, ts uint64) []byte
+}
+
+// JSONLEncoder is the default text encoder: one JSON object per line.
+type JSONLEncoder struct {
+	// MinimalHex writes addresses without leading zeros ("0x0", "0x401abc") instead of
+	// the fixed 16-digit form. Readers should compare addresses numerically (see export.ParseAddr).
+	MinimalHex bool
+	// Slot adds a "slot" field with the index of the station slot each epoch came from.
+	Slot bool
+}
+
+func (e JSONLEncoder) AppendEvent(dst []byte, s *StationData, slot int, safeSeq, tid, addr uint64, isActive bool, ts uint64) []byte {
+	if !e.Slot {
+		slot = -1
+	}
+	return s.marshalSlotJSONL(dst, slot, safeSeq, tid, addr, isActive, ts, e.MinimalHex)
+}
+
+// Protobuf field numbers of the binary TraceEvent message:
+//
+//	message TraceEvent {
+//	  uint64 probe_id  = 1;
+//	  uint64 tid       = 2;
+//	  uint64 addr      = 3;
+//	  uint64 seq       = 4;
+//	  bool   is_active = 5;
+//	  uint64 ts        = 6;
+//	  uint64 parent_id = 7; // FlexPayload, when the probe filled it
+//	  string name      = 8;
+//	  optional uint32 slot = 9; // only with BinaryEncoder.Slot
+//	}
+//
+// Every record is written varint-length-prefixed (protobuf "delimited" framing),
+// so any protobuf runtime can read the stream with parseDelimitedFrom.
+const (
+	PBFieldProbeID  = 1
+	PBFieldTID      = 2
+	PBFieldAddr     = 3
+	PBFieldSeq      = 4
+	PBFieldIsActive = 5
+	PBFieldTS       = 6
+	PBFieldParentID = 7
+	PBFieldName     = 8
+	PBFieldSlot     = 9
+)
+
+// BinaryEncoder writes length-prefixed protobuf TraceEvent messages.
+// It skips the text formatting entirely, which matters at extreme event rates.
+type BinaryEncoder struct {
+	// Slot adds the slot index each epoch came from. Slot 0 is written too, so readers can
+	// tell it from an encoder that does not record slots.
+	Slot bool
+
+	body []byte
+}
+
+func (b *BinaryEncoder) AppendEvent(dst []byte, s *StationData, slot int, safeSeq, tid, addr uint64, isActive bool, ts uint64) []byte {
+	body := b.body[:0]
+	body = appendPBUint(body, PBFieldProbeID, s.Header.ProbeID)
+	body = appendPBUint(body, PBFieldTID, tid)
+	body = appendPBUint(body, PBFieldAddr, addr)
+	body = appendPBUint(body, PBFieldSeq, safeSeq)
+	if isActive {
+		body = appendPBUint(body, PBFieldIsActive, 1)
+	}
+	body = appendPBUint(body, PBFieldTS, ts)
+	if b.Slot && slot >= 0 {
+		body = AppendVarint(body, PBFieldSlot<<3)
+		body = AppendVarint(body, uint64(slot))
+	}
+	if payload := s.Payload(); payload.Valid() {
+		body = appendPBUint(body, PBFieldParentID, payload.ParentID)
+		if name := payload.NameBytes(); len(name) > 0 {
+			body = AppendVarint(body, PBFieldName<<3|2) // wire type 2 = length-delimited
+			body = AppendVarint(body, uint64(len(name)))
+			body = append(body, name...)
+		}
+	}
+	b.body = body
+
+	dst = AppendVarint(dst, uint64(len(body)))
+	return append(dst, body...)
+}
+
+// appendPBUint appends a varint field. Zero values are omitted, as proto3 does.
+func appendPBUint(dst []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return dst
+	}
+	dst = AppendVarint(dst, uint64(field)<<3) // wire type 0 = varint
+	return AppendVarint(dst, v)
+}
+
+// AppendVarint appends v in protobuf base-128 varint form.
+func AppendVarint(dst []byte, v uint64) []byte {
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+// IsBinaryTracePath reports whether path names a binary (protobuf) trace.
+func IsBinaryTracePath(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".pb", ".bin":
+		return true
+	}
+	return false
+}
+
+// EncoderForPath picks the encoder from the output file extension:
+// .pb/.bin get the binary encoder, everything else stays JSONL.
+func EncoderForPath(path string) EventEncoder {
+	if IsBinaryTracePath(path) {
+		return &BinaryEncoder{body: make([]byte, 0, 64)}
+	}
+	return JSONLEncoder{}
+}
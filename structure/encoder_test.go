@@ -0,0 +1,201 @@
+package structure
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+	"unsafe"
+)
+
+func TestJSONLEncoderMatchesMarshal(t *testing.T) {
+	var s StationData
+	s.Header.ProbeID = 9
+
+	got := JSONLEncoder{}.AppendEvent(nil, &s, 0, 4, 1, 0x10, true, 77)
+	want := []byte(`{"probe_id":9,"tid":1,"addr":"0x0000000000000010","seq":4,"is_active":true,"ts":77}` + "\n")
+	if !bytes.Equal(got, want) {
+		t.Errorf("JSONLEncoder = %q, want %q", got, want)
+	}
+}
+
+func TestBinaryEncoderWireFormat(t *testing.T) {
+	var s StationData
+	s.Header.ProbeID = 1
+
+	enc := &BinaryEncoder{}
+	got := enc.AppendEvent(nil, &s, 0, 2, 3, 0, true, 300)
+
+	// len=11 | probe_id=1 | tid=3 | seq=2 | is_active=1 | ts=300 (varint 0xac 0x02); addr=0 is omitted
+	want := []byte{11, 0x08, 1, 0x10, 3, 0x20, 2, 0x28, 1, 0x30, 0xac, 0x02}
+	if !bytes.Equal(got, want) {
+		t.Errorf("BinaryEncoder = % x, want % x", got, want)
+	}
+}
+
+func TestEncodersRecordSlot(t *testing.T) {
+	var s StationData
+	s.Header.ProbeID = 1
+
+	if got := string(JSONLEncoder{Slot: true}.AppendEvent(nil, &s, 5, 2, 1, 0, true, 3)); !strings.Contains(got, `"seq":2,"slot":5,`) {
+		t.Errorf("JSONL with slot = %s", got)
+	}
+	if got := string(JSONLEncoder{Slot: true}.AppendEvent(nil, &s, -1, 2, 1, 0, true, 3)); strings.Contains(got, "slot") {
+		t.Errorf("unknown slot written: %s", got)
+	}
+	if got := string(JSONLEncoder{}.AppendEvent(nil, &s, 5, 2, 1, 0, true, 3)); strings.Contains(got, "slot") {
+		t.Errorf("slot written without Slot: %s", got)
+	}
+
+	// Slot 0 is written explicitly (tag 0x48 = field 9, varint), unlike other zero fields
+	got := (&BinaryEncoder{Slot: true}).AppendEvent(nil, &s, 0, 2, 0, 0, false, 0)
+	want := []byte{6, 0x08, 1, 0x20, 2, 0x48, 0}
+	if !bytes.Equal(got, want) {
+		t.Errorf("BinaryEncoder with slot = % x, want % x", got, want)
+	}
+}
+
+func TestBinaryEncoderAppendsAfterDst(t *testing.T) {
+	var s StationData
+	enc := &BinaryEncoder{}
+	first := enc.AppendEvent(nil, &s, 0, 2, 0, 0, false, 0)
+	both := enc.AppendEvent(first, &s, 0, 4, 0, 0, false, 0)
+	if !bytes.HasPrefix(both, first) || len(both) != 2*len(first) {
+		t.Errorf("second record clobbered the first: % x", both)
+	}
+}
+
+func TestAppendVarint(t *testing.T) {
+	cases := []struct {
+		v    uint64
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{^uint64(0), []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+	}
+	for _, c := range cases {
+		if got := AppendVarint(nil, c.v); !bytes.Equal(got, c.want) {
+			t.Errorf("AppendVarint(%d) = % x, want % x", c.v, got, c.want)
+		}
+	}
+}
+
+func TestEncoderForPath(t *testing.T) {
+	cases := map[string]bool{
+		"trace.jsonl":   false,
+		"trace":         false,
+		"trace.pb":      true,
+		"/tmp/run.BIN":  true,
+		"trace.pb.json": false,
+	}
+	for path, wantBinary := range cases {
+		_, isBinary := EncoderForPath(path).(*BinaryEncoder)
+		if isBinary != wantBinary {
+			t.Errorf("EncoderForPath(%q) binary = %v, want %v", path, isBinary, wantBinary)
+		}
+	}
+}
+
+func TestTraceMetaWallTime(t *testing.T) {
+	meta := NewTraceMeta(1_000, 1_700_000_000_000_000_000)
+	if !meta.HasClockAnchor() {
+		t.Fatal("anchored meta reports no anchor")
+	}
+	if got := meta.WallTime(1_500).UnixNano(); got != 1_700_000_000_000_000_500 {
+		t.Errorf("WallTime(1500) = %d", got)
+	}
+	// Events recorded before the anchor was taken land before it
+	if got := meta.WallTime(400).UnixNano(); got != 1_699_999_999_999_999_400 {
+		t.Errorf("WallTime(400) = %d", got)
+	}
+	if NewTraceMeta(0, 1).HasClockAnchor() {
+		t.Error("mono_ns 0 must mean no anchor")
+	}
+}
+
+func TestJSONLEncoderMinimalHex(t *testing.T) {
+	var s StationData
+	for addr, want := range map[uint64]string{0: `"addr":"0x0"`, 0x401abc: `"addr":"0x401abc"`, ^uint64(0): `"addr":"0xffffffffffffffff"`} {
+		got := string(JSONLEncoder{MinimalHex: true}.AppendEvent(nil, &s, 0, 2, 1, addr, true, 3))
+		if !bytes.Contains([]byte(got), []byte(want)) {
+			t.Errorf("addr %#x: line %q missing %s", addr, got, want)
+		}
+	}
+}
+
+func TestFlexPayloadLayout(t *testing.T) {
+	var s StationData
+	p := s.Payload()
+	if size := unsafe.Sizeof(*p); size != unsafe.Sizeof(s.Flexible) {
+		t.Fatalf("FlexPayload is %d bytes, Flexible is %d", size, unsafe.Sizeof(s.Flexible))
+	}
+	base := uintptr(unsafe.Pointer(&s))
+	for name, got := range map[string]uintptr{
+		"Version":  uintptr(unsafe.Pointer(&p.Version)) - base,
+		"NameLen":  uintptr(unsafe.Pointer(&p.NameLen)) - base,
+		"ParentID": uintptr(unsafe.Pointer(&p.ParentID)) - base,
+		"Name":     uintptr(unsafe.Pointer(&p.Name)) - base,
+		"Canary":   uintptr(unsafe.Pointer(&p.Canary)) - base,
+	} {
+		want := map[string]uintptr{"Version": 0x240, "NameLen": 0x244, "ParentID": 0x248, "Name": 0x250, "Canary": 0x3F8}[name]
+		if got != want {
+			t.Errorf("%s at station offset %#x, want %#x", name, got, want)
+		}
+	}
+}
+
+func TestStationCanary(t *testing.T) {
+	var s StationData
+	if s.CanaryIntact() {
+		t.Error("zeroed station reports an intact canary")
+	}
+	s.ArmCanary()
+	if !s.CanaryIntact() {
+		t.Fatal("canary not intact right after ArmCanary")
+	}
+	// An overrun of the payload area reaches the canary before the next station
+	s.Flexible[len(s.Flexible)-1] ^= 0xFF
+	if s.CanaryIntact() {
+		t.Error("clobbered canary reported intact")
+	}
+}
+
+func TestJSONLEncoderPayload(t *testing.T) {
+	var s StationData
+	plain := string(JSONLEncoder{}.AppendEvent(nil, &s, 0, 2, 1, 0, true, 3))
+
+	p := s.Payload()
+	p.ParentID = 42
+	p.SetName("worker \"a\"\n")
+	if got := string(JSONLEncoder{}.AppendEvent(nil, &s, 0, 2, 1, 0, true, 3)); got != plain {
+		t.Errorf("version 0 payload leaked into the line: %q", got)
+	}
+
+	p.Version = FlexPayloadVersion
+	got := JSONLEncoder{}.AppendEvent(nil, &s, 0, 2, 1, 0, true, 3)
+	var decoded struct {
+		Name     string `json:"name"`
+		ParentID uint64 `json:"parent_id"`
+	}
+	if err := json.Unmarshal(got, &decoded); err != nil {
+		t.Fatalf("line %q is not valid JSON: %v", got, err)
+	}
+	if decoded.Name != "worker \"a\"\n" || decoded.ParentID != 42 {
+		t.Errorf("decoded payload = %+v from %q", decoded, got)
+	}
+}
+
+func TestFlexPayloadNameClamped(t *testing.T) {
+	var p FlexPayload
+	p.SetName(strings.Repeat("€", 30)) // 90 bytes of 3-byte runes, cut on a rune boundary
+	if n := len(p.NameBytes()); n != 63 || !utf8.Valid(p.NameBytes()) {
+		t.Errorf("name kept %d bytes, valid UTF-8 %v", n, utf8.Valid(p.NameBytes()))
+	}
+	p.NameLen = 1000 // Garbage from a misbehaving probe
+	if n := len(p.NameBytes()); n != len(p.Name) {
+		t.Errorf("NameLen past the field returned %d bytes", n)
+	}
+}
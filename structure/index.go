@@ -0,0 +1,78 @@
+package structure
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+)
+
+// IndexSuffix names the sidecar index next to a trace: trace.jsonl -> trace.jsonl.idx.
+const IndexSuffix = ".idx"
+
+// Sidecar index layout: a 16-byte header (IndexMagic, then the little-endian trace
+// offset the index starts covering), followed by fixed 16-byte entries (ProbeID,
+// byte offset of the event's line or record). Fixed-size entries make a torn tail
+// after a crash easy to spot.
+const (
+	IndexMagic      = "CTRIDX\x00\x01"
+	IndexHeaderSize = 16
+	IndexEntrySize  = 16
+)
+
+// IndexPath returns where the sidecar index of tracePath lives.
+func IndexPath(tracePath string) string {
+	return tracePath + IndexSuffix
+}
+
+// AppendIndexHeader appends the index header for an index starting at trace offset base.
+func AppendIndexHeader(dst []byte, base int64) []byte {
+	dst = append(dst, IndexMagic...)
+	return binary.LittleEndian.AppendUint64(dst, uint64(base))
+}
+
+// AppendIndexEntry appends one ProbeID -> offset entry.
+func AppendIndexEntry(dst []byte, probeID uint64, offset int64) []byte {
+	dst = binary.LittleEndian.AppendUint64(dst, probeID)
+	return binary.LittleEndian.AppendUint64(dst, uint64(offset))
+}
+
+// indexWriter buffers entries like the trace writer does. Its buffer is smaller than the
+// trace's, so the StationWriter flushes the trace before an entry could spill it (see
+// reserveIndexEntry): a crash leaves the index behind the trace, never pointing past it.
+type indexWriter struct {
+	file   *os.File
+	writer *bufio.Writer
+	entry  []byte
+}
+
+func createIndex(path string, base int64) (*indexWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	iw := &indexWriter{file: f, writer: bufio.NewWriterSize(f, 32*1024), entry: make([]byte, 0, IndexEntrySize)}
+	if _, err := iw.writer.Write(AppendIndexHeader(nil, base)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return iw, nil
+}
+
+func (iw *indexWriter) add(probeID uint64, offset int64) error {
+	iw.entry = AppendIndexEntry(iw.entry[:0], probeID, offset)
+	_, err := iw.writer.Write(iw.entry)
+	return err
+}
+
+// full reports whether the next entry would flush the buffer to the file.
+func (iw *indexWriter) full() bool {
+	return iw.writer.Available() < IndexEntrySize
+}
+
+func (iw *indexWriter) close() error {
+	flushErr := iw.writer.Flush()
+	if err := iw.file.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
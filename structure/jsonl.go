@@ -16,10 +16,14 @@ func appendHex(dst []byte, v uint64) []byte {
 	return dst
 }
 
-// MarshalSlotJSONL
-// Change 1: Modify the receiver to StationData
-// Change 2: Force pass observedSeq to completely eliminate dirty reads caused by secondary reads
-func (s *StationData) marshalSafeSlotJSONL(buf []byte, safeSeq, tid, addr uint64, isActive bool, ts uint64) []byte {
+// appendMinimalHex writes v without leading zeros: 0x0, 0x401abc.
+func appendMinimalHex(dst []byte, v uint64) []byte {
+	dst = append(dst, '0', 'x')
+	return strconv.AppendUint(dst, v, 16)
+}
+
+// marshalSlotJSONL writes the "slot" field only for slot >= 0.
+func (s *StationData) marshalSlotJSONL(buf []byte, slot int, safeSeq, tid, addr uint64, isActive bool, ts uint64, minimalHex bool) []byte {
 	buf = append(buf, `{"probe_id":`...)
 	buf = strconv.AppendUint(buf, s.Header.ProbeID, 10)
 
@@ -27,11 +31,20 @@ func (s *StationData) marshalSafeSlotJSONL(buf []byte, safeSeq, tid, addr uint64
 	buf = strconv.AppendUint(buf, tid, 10)
 
 	buf = append(buf, `,"addr":"`...)
-	buf = appendHex(buf, addr)
+	if minimalHex {
+		buf = appendMinimalHex(buf, addr)
+	} else {
+		buf = appendHex(buf, addr)
+	}
 
 	buf = append(buf, `","seq":`...)
 	buf = strconv.AppendUint(buf, safeSeq, 10)
 
+	if slot >= 0 {
+		buf = append(buf, `,"slot":`...)
+		buf = strconv.AppendInt(buf, int64(slot), 10)
+	}
+
 	buf = append(buf, `,"is_active":`...)
 	if isActive {
 		buf = append(buf, "true"...)
@@ -42,6 +55,17 @@ func (s *StationData) marshalSafeSlotJSONL(buf []byte, safeSeq, tid, addr uint64
 	buf = append(buf, `,"ts":`...)
 	buf = strconv.AppendUint(buf, ts, 10)
 
+	if payload := s.Payload(); payload.Valid() {
+		if name := payload.NameBytes(); len(name) > 0 {
+			buf = append(buf, `,"name":`...)
+			buf = appendJSONString(buf, name)
+		}
+		if payload.ParentID != 0 {
+			buf = append(buf, `,"parent_id":`...)
+			buf = strconv.AppendUint(buf, payload.ParentID, 10)
+		}
+	}
+
 	buf = append(buf, "}\n"...)
 
 	return buf
@@ -50,37 +74,264 @@ func (s *StationData) marshalSafeSlotJSONL(buf []byte, safeSeq, tid, addr uint64
 // StationWriter no longer needs to be locked!
 // Under the cTP protocol, there will only be one global listening Goroutine operating it in the entire system.
 type StationWriter struct {
-	file   *os.File
-	writer *bufio.Writer
-	line   []byte
+	file      *os.File
+	out       *spillWriter
+	writer    *bufio.Writer
+	encoder   EventEncoder
+	line      []byte
+	finalPath string // Set for partial writers: Close renames file to it
+
+	index    *indexWriter // nil unless EnableIndex was called, or after the index failed
+	indexErr error        // Why the index was dropped, returned by Close
+	offset   int64        // File offset of the next byte written, tracked for the index
 }
 
+// NewStationWriter picks the encoder from the file extension (see EncoderForPath).
 func NewStationWriter(filename string) (*StationWriter, error) {
+	return NewStationWriterWithEncoder(filename, EncoderForPath(filename))
+}
+
+func NewStationWriterWithEncoder(filename string, encoder EventEncoder) (*StationWriter, error) {
 	// O_APPEND combined with 128KB buffering can squeeze disk I/O to the limit
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	return openStationWriter(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, encoder)
+}
+
+// PartialSuffix is appended to the output name while a partial writer is still open.
+const PartialSuffix = ".partial"
+
+// NewPartialStationWriter writes to filename+".partial" and renames it to filename only
+// on Close, so consumers never see a half-written trace. After a crash the .partial file
+// stays behind for recovery. Unlike NewStationWriter it starts a fresh file instead of appending.
+func NewPartialStationWriter(filename string) (*StationWriter, error) {
+	return NewPartialStationWriterWithEncoder(filename, EncoderForPath(filename))
+}
+
+func NewPartialStationWriterWithEncoder(filename string, encoder EventEncoder) (*StationWriter, error) {
+	sw, err := openStationWriter(filename+PartialSuffix, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, encoder)
+	if err != nil {
+		return nil, err
+	}
+	sw.finalPath = filename
+	return sw, nil
+}
+
+func openStationWriter(path string, flag int, encoder EventEncoder) (*StationWriter, error) {
+	f, err := os.OpenFile(path, flag, 0644)
 	if err != nil {
 		return nil, err
 	}
+	out := &spillWriter{file: f}
 	return &StationWriter{
-		file:   f,
-		writer: bufio.NewWriterSize(f, 128*1024),
-		line:   make([]byte, 0, 2048),
+		file:    f,
+		out:     out,
+		writer:  bufio.NewWriterSize(out, 128*1024),
+		encoder: encoder,
+		line:    make([]byte, 0, 2048),
 	}, nil
 }
 
+// EnableIndex maintains a sidecar index (see IndexPath) mapping every event to its
+// ProbeID and byte offset, so readers can seek straight to one coroutine. A partial
+// writer indexes under the final name. The index is only a cache: readers rebuild it
+// from the trace when it is missing, partial or stale (see export.LoadTraceIndex).
+func (sw *StationWriter) EnableIndex() error {
+	info, err := sw.file.Stat()
+	if err != nil {
+		return err
+	}
+	sw.offset = info.Size() + int64(sw.writer.Buffered())
+
+	tracePath := sw.finalPath
+	if tracePath == "" {
+		tracePath = sw.file.Name()
+	}
+	// Appending to an existing trace starts the index at the old end; readers see the
+	// non-zero base and rebuild it to cover the earlier runs too
+	index, err := createIndex(IndexPath(tracePath), sw.offset)
+	if err != nil {
+		return err
+	}
+	sw.index = index
+	return nil
+}
+
 // WriteSlot
 // Change 3: Receive StationData and observedSeq
-func (sw *StationWriter) WriteSafeSlot(s *StationData, safeSeq, tid, addr uint64, isActive bool, ts uint64) error {
-	sw.line = s.marshalSafeSlotJSONL(sw.line[:0], safeSeq, tid, addr, isActive, ts)
-	_, err := sw.writer.Write(sw.line)
+// Once the file has failed (see Retry), it rejects the event instead of buffering it.
+func (sw *StationWriter) WriteSafeSlot(s *StationData, slot int, safeSeq, tid, addr uint64, isActive bool, ts uint64) error {
+	if err := sw.out.err; err != nil {
+		return err
+	}
+	if err := sw.reserveIndexEntry(); err != nil {
+		return err
+	}
+	sw.line = sw.encoder.AppendEvent(sw.line[:0], s, slot, safeSeq, tid, addr, isActive, ts)
+	n, err := sw.writer.Write(sw.line)
+	if sw.index != nil && err == nil {
+		// The event is accepted now; failing it here would get it harvested and written twice
+		if indexErr := sw.index.add(s.Header.ProbeID, sw.offset); indexErr != nil {
+			sw.dropIndex(indexErr)
+		}
+	}
+	sw.offset += int64(n)
+	return err
+}
+
+// reserveIndexEntry runs before an event is accepted. When its entry would spill the
+// index buffer, the trace goes out first, so the index never points past it; if that
+// fails, the event is rejected like any other write to a failed file.
+func (sw *StationWriter) reserveIndexEntry() error {
+	if sw.index == nil || !sw.index.full() {
+		return nil
+	}
+	if err := sw.writer.Flush(); err != nil {
+		return err
+	}
+	return sw.out.err
+}
+
+// dropIndex stops indexing after the index file failed. The trace is unaffected: readers
+// find the index stale and rebuild it. Close reports err.
+func (sw *StationWriter) dropIndex(err error) {
+	sw.index.close()
+	sw.index = nil
+	sw.indexErr = err
+}
+
+// WriteMeta records a TraceMeta header in the writer's encoding.
+func (sw *StationWriter) WriteMeta(meta TraceMeta) error {
+	return sw.writeTyped(meta)
+}
+
+// WriteDeath records a coroutine death (see TraceDeath) in the writer's encoding.
+func (sw *StationWriter) WriteDeath(death TraceDeath) error {
+	return sw.writeTyped(death)
+}
+
+// WriteSaturation records that the station pool ran out (see TraceSaturation).
+func (sw *StationWriter) WriteSaturation(saturation TraceSaturation) error {
+	return sw.writeTyped(saturation)
+}
+
+// WriteThrottle records a change of the load-driven sampling rate (see TraceThrottle).
+func (sw *StationWriter) WriteThrottle(throttle TraceThrottle) error {
+	return sw.writeTyped(throttle)
+}
+
+// WriteDiag records a harvest anomaly (see TraceDiag).
+func (sw *StationWriter) WriteDiag(diag TraceDiag) error {
+	return sw.writeTyped(diag)
+}
+
+func (sw *StationWriter) writeTyped(record any) error {
+	if err := sw.out.err; err != nil {
+		return err
+	}
+	line, err := appendTypedRecord(sw.line[:0], sw.encoder, record)
+	if err != nil {
+		return err
+	}
+	sw.line = line
+	n, err := sw.writer.Write(sw.line)
+	sw.offset += int64(n)
 	return err
 }
 
 func (sw *StationWriter) Flush() error {
-	return sw.writer.Flush()
+	if err := sw.writer.Flush(); err != nil {
+		return err
+	}
+	if err := sw.out.err; err != nil {
+		return err
+	}
+	if sw.index != nil {
+		// Only after the trace: the index must never reference bytes not yet written
+		if err := sw.index.writer.Flush(); err != nil {
+			sw.dropIndex(err)
+		}
+	}
+	return nil
+}
+
+// Retry writes out what a failed write (a full disk, an I/O error) left pending and
+// then flushes. Nothing is lost or duplicated in between: the trace continues byte for
+// byte where it stopped, and the writer accepts events again once Retry succeeds.
+func (sw *StationWriter) Retry() error {
+	if err := sw.out.retry(); err != nil {
+		return err
+	}
+	return sw.Flush()
+}
+
+// spillWriter sits under the bufio.Writer. bufio errors are sticky and can only be
+// cleared by discarding the buffer, so a failed or short write is kept here instead and
+// reported through err; bufio always sees success. At most one buffer's worth piles up,
+// since the StationWriter stops accepting records while err is set.
+type spillWriter struct {
+	file    *os.File
+	pending []byte
+	err     error
+}
+
+func (w *spillWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		n, err := w.file.Write(p)
+		if err == nil {
+			return n, nil
+		}
+		w.err = err
+		w.pending = append(w.pending, p[n:]...)
+		return len(p), nil
+	}
+	w.pending = append(w.pending, p...)
+	return len(p), nil
+}
+
+func (w *spillWriter) retry() error {
+	if w.err == nil {
+		return nil
+	}
+	n, err := w.file.Write(w.pending)
+	w.pending = w.pending[:copy(w.pending, w.pending[n:])]
+	if err != nil {
+		w.err = err
+		return err
+	}
+	w.err = nil
+	return nil
+}
+
+// Abandon flushes and closes a partial writer without renaming it, leaving the
+// .partial file for inspection. On a regular writer it is the same as Close.
+func (sw *StationWriter) Abandon() error {
+	sw.finalPath = ""
+	return sw.Close()
 }
 
 func (sw *StationWriter) Close() error {
-	sw.Flush()
-	return sw.file.Close()
+	flushErr := sw.Flush()
+	if flushErr != nil {
+		// One last attempt: the failure may have been transient
+		flushErr = sw.Retry()
+	}
+	if sw.index != nil {
+		if err := sw.index.close(); err != nil && flushErr == nil {
+			flushErr = err
+		}
+		sw.index = nil
+	}
+	if flushErr == nil {
+		flushErr = sw.indexErr
+	}
+	if err := sw.file.Close(); err != nil {
+		return err
+	}
+	if sw.finalPath == "" {
+		return flushErr
+	}
+	if flushErr != nil {
+		// Keep the .partial name: the tail is missing, so the file is not complete
+		return flushErr
+	}
+	return os.Rename(sw.file.Name(), sw.finalPath)
 }
@@ -2,7 +2,9 @@ package structure
 
 import (
 	"bufio"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"os"
 	"strings"
 	"testing"
@@ -75,7 +77,7 @@ func TestWriteSafeSlotProducesValidJSON(t *testing.T) {
 	var s StationData
 	s.Header.ProbeID = 42
 
-	if err := sw.WriteSafeSlot(&s, 4, 1001, 0xDEADBEEF, true, 123456789); err != nil {
+	if err := sw.WriteSafeSlot(&s, 0, 4, 1001, 0xDEADBEEF, true, 123456789); err != nil {
 		t.Fatalf("WriteSafeSlot: %v", err)
 	}
 	sw.Close()
@@ -111,7 +113,7 @@ func TestWriteSafeSlotInactive(t *testing.T) {
 
 	sw, _ := NewStationWriter(name)
 	var s StationData
-	sw.WriteSafeSlot(&s, 2, 0, 0xBEEF, false, 0)
+	sw.WriteSafeSlot(&s, 0, 2, 0, 0xBEEF, false, 0)
 	sw.Close()
 
 	rec := readSingleRecord(t, name)
@@ -130,7 +132,7 @@ func TestAddrHex16Digits(t *testing.T) {
 
 	sw, _ := NewStationWriter(name)
 	var s StationData
-	sw.WriteSafeSlot(&s, 2, 0, 0xCAFEBABE00001234, true, 0)
+	sw.WriteSafeSlot(&s, 0, 2, 0, 0xCAFEBABE00001234, true, 0)
 	sw.Close()
 
 	rec := readSingleRecord(t, name)
@@ -151,7 +153,7 @@ func TestAddrZeroValue(t *testing.T) {
 
 	sw, _ := NewStationWriter(name)
 	var s StationData
-	sw.WriteSafeSlot(&s, 2, 0, 0, true, 0)
+	sw.WriteSafeSlot(&s, 0, 2, 0, 0, true, 0)
 	sw.Close()
 
 	rec := readSingleRecord(t, name)
@@ -169,7 +171,7 @@ func TestAddrMaxValue(t *testing.T) {
 
 	sw, _ := NewStationWriter(name)
 	var s StationData
-	sw.WriteSafeSlot(&s, 2, 0, ^uint64(0), true, 0) // 0xffffffffffffffff
+	sw.WriteSafeSlot(&s, 0, 2, 0, ^uint64(0), true, 0) // 0xffffffffffffffff
 	sw.Close()
 
 	rec := readSingleRecord(t, name)
@@ -191,7 +193,7 @@ func TestWriteMultipleLines(t *testing.T) {
 	var s StationData
 	const n = 25
 	for i := 0; i < n; i++ {
-		sw.WriteSafeSlot(&s, uint64(i*2+2), uint64(i), uint64(i*8), i%2 == 0, uint64(i*100))
+		sw.WriteSafeSlot(&s, 0, uint64(i*2+2), uint64(i), uint64(i*8), i%2 == 0, uint64(i*100))
 	}
 	sw.Close()
 
@@ -219,7 +221,7 @@ func TestEachLineIsValidJSON(t *testing.T) {
 	var s StationData
 	const n = 10
 	for i := 0; i < n; i++ {
-		sw.WriteSafeSlot(&s, uint64(i*2+2), uint64(i), uint64(i), i%3 == 0, uint64(i))
+		sw.WriteSafeSlot(&s, 0, uint64(i*2+2), uint64(i), uint64(i), i%3 == 0, uint64(i))
 	}
 	sw.Close()
 
@@ -258,7 +260,7 @@ func TestFlushWritesToDisk(t *testing.T) {
 
 	sw, _ := NewStationWriter(name)
 	var s StationData
-	sw.WriteSafeSlot(&s, 2, 1, 2, true, 3)
+	sw.WriteSafeSlot(&s, 0, 2, 1, 2, true, 3)
 
 	if err := sw.Flush(); err != nil {
 		t.Fatalf("Flush: %v", err)
@@ -287,6 +289,65 @@ func TestFlushOnEmptyWriterDoesNotError(t *testing.T) {
 	}
 }
 
+// ─── Write failures ───────────────────────────────────────────────────────────
+
+func TestStationWriterRetryResumesFailedTrace(t *testing.T) {
+	path := t.TempDir() + "/trace.jsonl"
+	sw, err := NewStationWriter(path)
+	if err != nil {
+		t.Fatalf("NewStationWriter: %v", err)
+	}
+	var s StationData
+	s.Header.ProbeID = 1
+	sw.WriteSafeSlot(&s, 0, 2, 1, 0, true, 10)
+	if err := sw.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	// The file goes away under the writer, as a full or failing disk would
+	sw.file.Close()
+	sw.WriteSafeSlot(&s, 0, 4, 1, 0, false, 20)
+	if err := sw.Flush(); err == nil {
+		t.Fatal("Flush succeeded on a closed file")
+	}
+	if err := sw.WriteSafeSlot(&s, 0, 6, 1, 0, true, 30); err == nil {
+		t.Error("failed writer accepted another event")
+	}
+	if err := sw.Retry(); err == nil {
+		t.Error("Retry succeeded while the file is still closed")
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	sw.file, sw.out.file = f, f
+	if err := sw.Retry(); err != nil {
+		t.Fatalf("Retry after the disk recovered: %v", err)
+	}
+	if err := sw.WriteSafeSlot(&s, 0, 8, 1, 0, false, 40); err != nil {
+		t.Fatalf("WriteSafeSlot after Retry: %v", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The event buffered when the write failed survives; the rejected one never got in
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var ts []float64
+	for _, line := range lines {
+		var rec map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		ts = append(ts, rec["ts"].(float64))
+	}
+	if fmt.Sprint(ts) != "[10 20 40]" {
+		t.Errorf("ts = %v, want [10 20 40]", ts)
+	}
+}
+
 // ─── ProbeID propagated from station ─────────────────────────────────────────
 
 func TestProbeIDFromStationHeader(t *testing.T) {
@@ -298,7 +359,7 @@ func TestProbeIDFromStationHeader(t *testing.T) {
 	sw, _ := NewStationWriter(name)
 	var s StationData
 	s.Header.ProbeID = 99999
-	sw.WriteSafeSlot(&s, 2, 0, 0, false, 0)
+	sw.WriteSafeSlot(&s, 0, 2, 0, 0, false, 0)
 	sw.Close()
 
 	rec := readSingleRecord(t, name)
@@ -306,3 +367,210 @@ func TestProbeIDFromStationHeader(t *testing.T) {
 		t.Errorf("probe_id = %v, want 99999", rec["probe_id"])
 	}
 }
+
+// ─── Partial writer ───────────────────────────────────────────────────────────
+
+func TestPartialWriterRenamesOnClose(t *testing.T) {
+	name := t.TempDir() + "/trace.jsonl"
+
+	sw, err := NewPartialStationWriter(name)
+	if err != nil {
+		t.Fatalf("NewPartialStationWriter: %v", err)
+	}
+	var s StationData
+	sw.WriteSafeSlot(&s, 0, 2, 1, 0, true, 5)
+	sw.Flush()
+
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("final name exists before Close: %v", err)
+	}
+	if _, err := os.Stat(name + PartialSuffix); err != nil {
+		t.Errorf("partial file missing while open: %v", err)
+	}
+
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := os.Stat(name + PartialSuffix); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind after Close: %v", err)
+	}
+	if rec := readSingleRecord(t, name); rec["seq"] != float64(2) {
+		t.Errorf("renamed file holds %v", rec)
+	}
+}
+
+func TestPartialWriterReplacesOldTrace(t *testing.T) {
+	name := t.TempDir() + "/trace.jsonl"
+	os.WriteFile(name, []byte("{\"stale\":true}\n"), 0o644)
+
+	sw, err := NewPartialStationWriter(name)
+	if err != nil {
+		t.Fatalf("NewPartialStationWriter: %v", err)
+	}
+	var s StationData
+	sw.WriteSafeSlot(&s, 0, 4, 1, 0, false, 5)
+	sw.Close()
+
+	if rec := readSingleRecord(t, name); rec["seq"] != float64(4) {
+		t.Errorf("trace = %v, want only the new run", rec)
+	}
+}
+
+func TestPartialWriterAbandonKeepsPartial(t *testing.T) {
+	name := t.TempDir() + "/trace.jsonl"
+	sw, err := NewPartialStationWriter(name)
+	if err != nil {
+		t.Fatalf("NewPartialStationWriter: %v", err)
+	}
+	sw.Abandon()
+
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("abandoned output was renamed: %v", err)
+	}
+	if _, err := os.Stat(name + PartialSuffix); err != nil {
+		t.Errorf("abandoned .partial missing: %v", err)
+	}
+}
+
+// ─── Sidecar index ────────────────────────────────────────────────────────────
+
+func TestIndexRecordsEventOffsets(t *testing.T) {
+	name := t.TempDir() + "/trace.jsonl"
+	os.WriteFile(name, []byte("{\"probe_id\":1}\n"), 0o644) // An earlier run
+
+	sw, err := NewStationWriter(name)
+	if err != nil {
+		t.Fatalf("NewStationWriter: %v", err)
+	}
+	if err := sw.EnableIndex(); err != nil {
+		t.Fatalf("EnableIndex: %v", err)
+	}
+	sw.WriteMeta(NewTraceMeta(1, 2))
+	var a, b StationData
+	a.Header.ProbeID, b.Header.ProbeID = 7, 8
+	sw.WriteSafeSlot(&a, 0, 2, 1, 0, true, 5)
+	sw.WriteSafeSlot(&b, 0, 2, 1, 0, true, 6)
+	sw.WriteSafeSlot(&a, 0, 4, 1, 0, false, 7)
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	trace, _ := os.ReadFile(name)
+	idx, err := os.ReadFile(IndexPath(name))
+	if err != nil {
+		t.Fatalf("index not written: %v", err)
+	}
+	if string(idx[:8]) != IndexMagic || len(idx) != IndexHeaderSize+3*IndexEntrySize {
+		t.Fatalf("index is %d bytes: % x", len(idx), idx)
+	}
+	if base := binary.LittleEndian.Uint64(idx[8:16]); base != 15 {
+		t.Errorf("index base = %d, want 15 (size of the earlier run)", base)
+	}
+	for i, want := range []uint64{7, 8, 7} {
+		entry := idx[IndexHeaderSize+i*IndexEntrySize:]
+		probeID, offset := binary.LittleEndian.Uint64(entry), binary.LittleEndian.Uint64(entry[8:])
+		prefix := fmt.Sprintf(`{"probe_id":%d,`, want)
+		if probeID != want || !strings.HasPrefix(string(trace[offset:]), prefix) {
+			t.Errorf("entry %d = probe %d at %d, trace there: %.30q", i, probeID, offset, trace[offset:])
+		}
+	}
+}
+
+func TestPartialWriterIndexesUnderFinalName(t *testing.T) {
+	name := t.TempDir() + "/trace.pb"
+	sw, _ := NewPartialStationWriter(name)
+	if err := sw.EnableIndex(); err != nil {
+		t.Fatalf("EnableIndex: %v", err)
+	}
+	sw.Close()
+	if _, err := os.Stat(IndexPath(name)); err != nil {
+		t.Errorf("index not under the final name: %v", err)
+	}
+}
+
+func TestIndexNeverFlushedAheadOfTrace(t *testing.T) {
+	name := t.TempDir() + "/trace.jsonl"
+	sw, err := NewStationWriter(name)
+	if err != nil {
+		t.Fatalf("NewStationWriter: %v", err)
+	}
+	if err := sw.EnableIndex(); err != nil {
+		t.Fatalf("EnableIndex: %v", err)
+	}
+	var s StationData
+	s.Header.ProbeID = 7
+	// Enough events to spill the index buffer several times while the trace's still holds data
+	for i := uint64(1); i <= 10_000; i++ {
+		sw.WriteSafeSlot(&s, 0, 2*i, 1, 0, true, i)
+		trace, _ := os.Stat(name)
+		idx, _ := os.Stat(IndexPath(name))
+		entries := (idx.Size() - IndexHeaderSize) / IndexEntrySize
+		if entries <= 0 {
+			continue
+		}
+		// The last entry on disk must point at a line already on disk
+		data, _ := os.ReadFile(IndexPath(name))
+		last := binary.LittleEndian.Uint64(data[IndexHeaderSize+(entries-1)*IndexEntrySize+8:])
+		if int64(last) >= trace.Size() {
+			t.Fatalf("after %d events the index points at %d, the trace has %d bytes", i, last, trace.Size())
+		}
+	}
+	sw.Close()
+}
+
+func TestIndexedWriterRetryWritesEventOnce(t *testing.T) {
+	name := t.TempDir() + "/trace.jsonl"
+	sw, err := NewStationWriter(name)
+	if err != nil {
+		t.Fatalf("NewStationWriter: %v", err)
+	}
+	if err := sw.EnableIndex(); err != nil {
+		t.Fatalf("EnableIndex: %v", err)
+	}
+	var s StationData
+	s.Header.ProbeID = 7
+	seq := uint64(2)
+	for ; !sw.index.full(); seq += 2 {
+		if err := sw.WriteSafeSlot(&s, 0, seq, 1, 0, true, seq); err != nil {
+			t.Fatalf("WriteSafeSlot: %v", err)
+		}
+	}
+
+	// The disk fails just as the next entry needs the trace flushed ahead of the index
+	sw.file.Close()
+	if err := sw.WriteSafeSlot(&s, 0, seq, 1, 0, true, seq); err == nil {
+		t.Fatal("event accepted although the trace could not be flushed")
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	sw.file, sw.out.file = f, f
+	if err := sw.Retry(); err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	// The harvester offers the rejected event again
+	if err := sw.WriteSafeSlot(&s, 0, seq, 1, 0, true, seq); err != nil {
+		t.Fatalf("WriteSafeSlot after Retry: %v", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	trace, _ := os.ReadFile(name)
+	lines := strings.Split(strings.TrimSpace(string(trace)), "\n")
+	seen := make(map[string]bool, len(lines))
+	for _, line := range lines {
+		if seen[line] {
+			t.Fatalf("line written twice: %s", line)
+		}
+		seen[line] = true
+	}
+	if want := int(seq / 2); len(lines) != want {
+		t.Errorf("trace has %d lines, want %d", len(lines), want)
+	}
+	idx, _ := os.ReadFile(IndexPath(name))
+	if entries := (len(idx) - IndexHeaderSize) / IndexEntrySize; entries != len(lines) {
+		t.Errorf("index has %d entries for %d lines", entries, len(lines))
+	}
+}
@@ -0,0 +1,52 @@
+package structure
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// layoutField is one size or offset the cTP ABI pins down (see docs/cTP.md §3).
+type layoutField struct {
+	name      string
+	got, want uintptr
+}
+
+func layoutFields() []layoutField {
+	var h GlobalHeader
+	var s StationData
+	var e Epoch
+	return []layoutField{
+		{"sizeof(GlobalHeader)", unsafe.Sizeof(h), 1024},
+		{"sizeof(Epoch)", unsafe.Sizeof(e), 64},
+		{"sizeof(StationData)", unsafe.Sizeof(s), 1024},
+		{"sizeof(FlexPayload)", unsafe.Sizeof(FlexPayload{}), unsafe.Sizeof(s.Flexible)},
+
+		{"GlobalHeader.MaxStations", unsafe.Offsetof(h.MaxStations), 0x0C},
+		{"GlobalHeader.AllocatedCount", unsafe.Offsetof(h.AllocatedCount), 0x10},
+		{"GlobalHeader.TracerSleeping", unsafe.Offsetof(h.TracerSleeping), 0x14},
+		{"GlobalHeader.StationSize", unsafe.Offsetof(h.StationSize), 0x18},
+		{"GlobalHeader.SlotsPerStation", unsafe.Offsetof(h.SlotsPerStation), 0x1C},
+		{"GlobalHeader.ReclaimableCount", unsafe.Offsetof(h.ReclaimableCount), 0x20},
+
+		{"Epoch.Seq", unsafe.Offsetof(e.Seq), 0x18},
+		{"Epoch.IsActive", unsafe.Offsetof(e.IsActive), 0x3F},
+
+		{"StationData.Header.IsDead", unsafe.Offsetof(s.Header.IsDead), 0x10},
+		{"StationData.Header.DeathTS", unsafe.Offsetof(s.Header.DeathTS), 0x18},
+		{"StationData.Header.Reclaimable", unsafe.Offsetof(s.Header.Reclaimable), 0x20},
+		{"StationData.Slots", unsafe.Offsetof(s.Slots), 0x40},
+		{"StationData.Flexible", unsafe.Offsetof(s.Flexible), 0x240},
+	}
+}
+
+// CheckLayout verifies that the Go structs match the byte layout the C++ and Rust probes
+// write. A mismatch would make every read of shared memory silently wrong, so the engine
+// refuses to start on one; it can only happen if the structs or the compiler change.
+func CheckLayout() error {
+	for _, f := range layoutFields() {
+		if f.got != f.want {
+			return fmt.Errorf("cTP layout mismatch: %s is %#x, the protocol requires %#x", f.name, f.got, f.want)
+		}
+	}
+	return nil
+}
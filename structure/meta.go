@@ -0,0 +1,136 @@
+package structure
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// MetaVersion is bumped whenever TraceMeta gains a field readers must understand.
+const MetaVersion = 2
+
+// TraceMeta is the self-describing record written at the start of every writer session.
+// Readers tell it apart from events by Type == "meta".
+type TraceMeta struct {
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+
+	// Clock anchor: MonoNS is CLOCK_MONOTONIC (the probes' "ts" clock) and UnixNS the
+	// wall clock, both captured at the same instant. MonoNS == 0 means no anchor.
+	MonoNS uint64 `json:"mono_ns"`
+	UnixNS int64  `json:"unix_ns"`
+
+	// SampleEvery is N when the tracer kept only one epoch in N per slot (version 2).
+	// Counts and durations derived from such a trace are estimates; 0 means unsampled.
+	SampleEvery uint32 `json:"sample_every,omitempty"`
+
+	// SlotsPerStation is set when the stations had more than 8 slots. Readers use it to
+	// bound how often a seq may repeat per probe and how far one scan reorders a probe's
+	// events; 0 means at most 8.
+	SlotsPerStation uint32 `json:"slots_per_station,omitempty"`
+}
+
+// NewTraceMeta builds the session header for a tracer started at the given clock readings.
+func NewTraceMeta(monoNS uint64, unixNS int64) TraceMeta {
+	return TraceMeta{Type: "meta", Version: MetaVersion, MonoNS: monoNS, UnixNS: unixNS}
+}
+
+// HasClockAnchor reports whether WallTime can convert timestamps.
+func (m TraceMeta) HasClockAnchor() bool {
+	return m.MonoNS != 0
+}
+
+// WallTime converts a probe "ts" (monotonic ns) into an absolute time using the anchor.
+func (m TraceMeta) WallTime(ts uint64) time.Time {
+	return time.Unix(0, m.UnixNS+int64(ts-m.MonoNS))
+}
+
+// TraceDeath records that a coroutine finished: the probe set IsDead on its station and
+// every epoch it wrote before that was harvested. Like TraceMeta it carries a Type, so
+// readers that only want events skip it.
+type TraceDeath struct {
+	Type    string `json:"type"`
+	ProbeID uint64 `json:"probe_id"`
+	TS      uint64 `json:"ts"`
+
+	// Inferred is set when the probe recorded no DeathTS (an older SDK) and TS is the
+	// tracer's monotonic clock when it noticed the death instead.
+	Inferred bool `json:"inferred,omitempty"`
+}
+
+// NewTraceDeath builds the death record for probeID.
+func NewTraceDeath(probeID, ts uint64, inferred bool) TraceDeath {
+	return TraceDeath{Type: "death", ProbeID: probeID, TS: ts, Inferred: inferred}
+}
+
+// TraceSaturation records that every station was handed out: coroutines created after
+// TS may have found no station and be missing from the trace. The engine writes it once.
+type TraceSaturation struct {
+	Type     string `json:"type"`
+	TS       uint64 `json:"ts"`
+	Stations uint32 `json:"stations"`
+}
+
+// NewTraceSaturation builds the saturation record for a pool of stations.
+func NewTraceSaturation(ts uint64, stations uint32) TraceSaturation {
+	return TraceSaturation{Type: "saturation", TS: ts, Stations: stations}
+}
+
+// TraceThrottle records that the tracer changed how many epochs it writes because the
+// harvest rate crossed its write-rate limit: from TS on it kept one epoch in SampleEvery
+// per slot, until the next throttle record. SampleEvery 1 means everything is written again.
+type TraceThrottle struct {
+	Type        string `json:"type"`
+	TS          uint64 `json:"ts"`
+	SampleEvery uint32 `json:"sample_every"`
+}
+
+// NewTraceThrottle builds the record for a switch to one epoch in sampleEvery.
+func NewTraceThrottle(ts uint64, sampleEvery uint32) TraceThrottle {
+	return TraceThrottle{Type: "throttle", TS: ts, SampleEvery: sampleEvery}
+}
+
+// Kinds of TraceDiag.
+const (
+	DiagGap    = "gap"    // A probe overwrote epochs before the harvester read them
+	DiagCanary = "canary" // A probe wrote past its payload area into the station canary
+	DiagMagic  = "magic"  // The GlobalHeader's magic number changed under the tracer
+)
+
+// TraceDiag records an anomaly the tracer noticed while harvesting, so the trace tells
+// tracer-side trouble apart from program behaviour. Station is -1 for the GlobalHeader.
+// For DiagGap, Count is the number of epochs lost on the station since its last gap record.
+type TraceDiag struct {
+	Type    string `json:"type"`
+	Kind    string `json:"kind"`
+	TS      uint64 `json:"ts"`
+	Station int64  `json:"station"`
+	ProbeID uint64 `json:"probe_id,omitempty"`
+	Count   uint64 `json:"count,omitempty"`
+}
+
+// NewTraceDiag builds a diagnostic record of the given kind.
+func NewTraceDiag(kind string, ts uint64, station int64, probeID, count uint64) TraceDiag {
+	return TraceDiag{Type: "diag", Kind: kind, TS: ts, Station: station, ProbeID: probeID, Count: count}
+}
+
+// PBFieldMetaJSON carries a JSON-encoded typed record (TraceMeta, TraceDeath) inside a
+// binary record. A record with this field set is metadata, not an event.
+const PBFieldMetaJSON = 15
+
+// appendTypedRecord serializes a non-event record as a JSON line, or as a PBFieldMetaJSON
+// record for the binary encoder.
+func appendTypedRecord(dst []byte, encoder EventEncoder, record any) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return dst, err
+	}
+	if _, binary := encoder.(*BinaryEncoder); binary {
+		body := AppendVarint(nil, PBFieldMetaJSON<<3|2) // wire type 2 = length-delimited
+		body = AppendVarint(body, uint64(len(payload)))
+		body = append(body, payload...)
+		dst = AppendVarint(dst, uint64(len(body)))
+		return append(dst, body...), nil
+	}
+	dst = append(dst, payload...)
+	return append(dst, '\n'), nil
+}
@@ -0,0 +1,87 @@
+package structure
+
+import (
+	"sync/atomic"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// FlexPayloadVersion marks a Flexible region that follows the FlexPayload layout.
+const FlexPayloadVersion = 1
+
+// FlexPayload is the optional layout of StationData.Flexible (station offset 0x240).
+// The probe fills it once, before the coroutine's first event, and never changes it,
+// so the harvester can read it without a SeqLock. Offsets are relative to Flexible.
+type FlexPayload struct {
+	Version  uint32    // 0x00: 0 = region unused, FlexPayloadVersion = this layout
+	NameLen  uint32    // 0x04: valid bytes in Name
+	ParentID uint64    // 0x08: ProbeID of the coroutine that spawned this one, 0 = none
+	Name     [64]byte  // 0x10: UTF-8 coroutine name, not NUL-terminated
+	_        [360]byte // 0x50: free for future fields
+	Canary   uint64    // 0x1B8: StationCanary when the engine guards the station, never written by probes
+}
+
+// StationCanary fills the last 8 bytes of every station when canary checking is on.
+// A probe that overruns the station before it corrupts the next one's header.
+const StationCanary uint64 = 0xC0DEC0A1CA4A2157
+
+// ArmCanary writes StationCanary into the station's last 8 bytes.
+func (s *StationData) ArmCanary() {
+	atomic.StoreUint64(&s.Payload().Canary, StationCanary)
+}
+
+// CanaryIntact reports whether the canary written by ArmCanary is still in place.
+func (s *StationData) CanaryIntact() bool {
+	return atomic.LoadUint64(&s.Payload().Canary) == StationCanary
+}
+
+// Payload overlays the Flexible region. Check Version before trusting the fields.
+func (s *StationData) Payload() *FlexPayload {
+	return (*FlexPayload)(unsafe.Pointer(&s.Flexible))
+}
+
+// Valid reports whether the probe filled the region with this layout.
+func (p *FlexPayload) Valid() bool {
+	return p.Version == FlexPayloadVersion
+}
+
+// NameBytes returns the coroutine name, clamped to the Name field.
+func (p *FlexPayload) NameBytes() []byte {
+	n := p.NameLen
+	if n > uint32(len(p.Name)) {
+		n = uint32(len(p.Name))
+	}
+	return p.Name[:n]
+}
+
+// SetName stores name, truncated to the field size on a UTF-8 boundary.
+func (p *FlexPayload) SetName(name string) {
+	if len(name) > len(p.Name) {
+		name = name[:len(p.Name)]
+		for len(name) > 0 && !utf8.ValidString(name) {
+			name = name[:len(name)-1]
+		}
+	}
+	p.NameLen = uint32(copy(p.Name[:], name))
+}
+
+// appendJSONString appends b as a JSON string literal. Probe-supplied bytes are not
+// trusted: control characters, quotes and invalid UTF-8 are escaped.
+func appendJSONString(dst, b []byte) []byte {
+	dst = append(dst, '"')
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		switch {
+		case r == utf8.RuneError && size == 1:
+			dst = append(dst, `�`...)
+		case r == '"' || r == '\\':
+			dst = append(dst, '\\', byte(r))
+		case r < 0x20:
+			dst = append(dst, '\\', 'u', '0', '0', hexChars[r>>4], hexChars[r&0xf])
+		default:
+			dst = append(dst, b[:size]...)
+		}
+		b = b[size:]
+	}
+	return append(dst, '"')
+}
@@ -0,0 +1,82 @@
+package structure
+
+// EventSink receives every epoch that passed SeqLock validation.
+// StationWriter is the default sink; embedders can plug in their own to process events in-process.
+// Like StationWriter, a sink is driven by the single harvest goroutine.
+type EventSink interface {
+	WriteSafeSlot(s *StationData, slot int, safeSeq, tid, addr uint64, isActive bool, ts uint64) error
+}
+
+// DeathSink is implemented by sinks that also want coroutine deaths. The engine only
+// produces them with EngineOptions.DeathEvents.
+type DeathSink interface {
+	WriteDeath(death TraceDeath) error
+}
+
+// TraceEvent is one harvested epoch, decoupled from the shared-memory station it came from.
+type TraceEvent struct {
+	ProbeID  uint64
+	Slot     int // Index of the station slot the epoch was read from
+	TID      uint64
+	Addr     uint64
+	Seq      uint64
+	IsActive bool
+	TS       uint64
+}
+
+// SinkFunc adapts a plain callback to EventSink.
+type SinkFunc func(ev TraceEvent) error
+
+func (f SinkFunc) WriteSafeSlot(s *StationData, slot int, safeSeq, tid, addr uint64, isActive bool, ts uint64) error {
+	return f(TraceEvent{
+		ProbeID:  s.Header.ProbeID,
+		Slot:     slot,
+		TID:      tid,
+		Addr:     addr,
+		Seq:      safeSeq,
+		IsActive: isActive,
+		TS:       ts,
+	})
+}
+
+// ChannelSink delivers every event on ch. The send blocks, so a slow consumer stalls
+// harvesting and the probes start overwriting slots; give ch enough buffer.
+func ChannelSink(ch chan<- TraceEvent) SinkFunc {
+	return func(ev TraceEvent) error {
+		ch <- ev
+		return nil
+	}
+}
+
+type multiSink []EventSink
+
+// MultiSink fans each event out to all sinks in order. Every sink sees the event even if
+// an earlier one fails; the first error is returned.
+func MultiSink(sinks ...EventSink) EventSink {
+	return multiSink(sinks)
+}
+
+func (m multiSink) WriteSafeSlot(s *StationData, slot int, safeSeq, tid, addr uint64, isActive bool, ts uint64) error {
+	var first error
+	for _, sink := range m {
+		if err := sink.WriteSafeSlot(s, slot, safeSeq, tid, addr, isActive, ts); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// WriteDeath forwards the death to every sink that implements DeathSink.
+func (m multiSink) WriteDeath(death TraceDeath) error {
+	var first error
+	for _, sink := range m {
+		ds, ok := sink.(DeathSink)
+		if !ok {
+			continue
+		}
+		if err := ds.WriteDeath(death); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,118 @@
+package structure
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestChannelSinkDeliversEvent(t *testing.T) {
+	var s StationData
+	s.Header.ProbeID = 5
+
+	ch := make(chan TraceEvent, 1)
+	if err := ChannelSink(ch).WriteSafeSlot(&s, 0, 2, 7, 0x40, true, 99); err != nil {
+		t.Fatalf("WriteSafeSlot: %v", err)
+	}
+	want := TraceEvent{ProbeID: 5, TID: 7, Addr: 0x40, Seq: 2, IsActive: true, TS: 99}
+	if got := <-ch; got != want {
+		t.Errorf("event = %+v, want %+v", got, want)
+	}
+}
+
+func TestMultiSinkReachesEverySink(t *testing.T) {
+	var s StationData
+	boom := errors.New("boom")
+
+	calls := 0
+	failing := SinkFunc(func(TraceEvent) error { calls++; return boom })
+	counting := SinkFunc(func(TraceEvent) error { calls++; return nil })
+
+	err := MultiSink(failing, counting).WriteSafeSlot(&s, 0, 2, 0, 0, false, 0)
+	if !errors.Is(err, boom) {
+		t.Errorf("err = %v, want the first sink's error", err)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2: a failing sink must not starve the next", calls)
+	}
+}
+
+func TestHarvestIntoSink(t *testing.T) {
+	var s StationData
+	s.Header.ProbeID = 3
+	s.Slots[0].Seq = 2
+	s.Slots[0].TID = 11
+
+	var got []TraceEvent
+	var lastSeen [8]uint64
+	n, _ := s.Harvest(&lastSeen, SinkFunc(func(ev TraceEvent) error {
+		got = append(got, ev)
+		return nil
+	}))
+	if n != 1 || len(got) != 1 || got[0].ProbeID != 3 || got[0].TID != 11 {
+		t.Errorf("Harvest = %d, events %+v", n, got)
+	}
+}
+
+func TestHarvestPassesSlotIndex(t *testing.T) {
+	var s StationData
+	s.Slots[3].Seq = 2
+	s.Slots[6].Seq = 4
+
+	var slots []int
+	var lastSeen [8]uint64
+	s.Harvest(&lastSeen, SinkFunc(func(ev TraceEvent) error {
+		slots = append(slots, ev.Slot)
+		return nil
+	}))
+	if len(slots) != 2 || slots[0] != 3 || slots[1] != 6 {
+		t.Errorf("slots = %v, want [3 6]", slots)
+	}
+}
+
+func TestHarvestStopsAtSinkError(t *testing.T) {
+	var s StationData
+	s.Slots[0].Seq = 2
+	s.Slots[1].Seq = 2
+
+	full := errors.New("disk full")
+	var lastSeen [8]uint64
+	n, err := s.Harvest(&lastSeen, SinkFunc(func(TraceEvent) error { return full }))
+	if n != 0 || err != full {
+		t.Fatalf("Harvest = %d, %v, want 0 and the sink error", n, err)
+	}
+	if lastSeen[0] != 0 {
+		t.Errorf("lastSeen[0] = %d: a rejected epoch must be offered again", lastSeen[0])
+	}
+
+	n, err = s.Harvest(&lastSeen, SinkFunc(func(TraceEvent) error { return nil }))
+	if n != 2 || err != nil {
+		t.Errorf("Harvest after recovery = %d, %v, want both epochs", n, err)
+	}
+}
+
+type deathRecorder struct {
+	SinkFunc
+	deaths []TraceDeath
+}
+
+func (d *deathRecorder) WriteDeath(death TraceDeath) error {
+	d.deaths = append(d.deaths, death)
+	return nil
+}
+
+func TestMultiSinkForwardsDeathsToDeathSinks(t *testing.T) {
+	recorder := &deathRecorder{SinkFunc: func(TraceEvent) error { return nil }}
+	plain := SinkFunc(func(TraceEvent) error { return nil })
+	sink := MultiSink(plain, recorder)
+
+	deaths, ok := sink.(DeathSink)
+	if !ok {
+		t.Fatal("MultiSink does not implement DeathSink")
+	}
+	if err := deaths.WriteDeath(NewTraceDeath(7, 99, false)); err != nil {
+		t.Fatalf("WriteDeath: %v", err)
+	}
+	if len(recorder.deaths) != 1 || recorder.deaths[0].ProbeID != 7 || recorder.deaths[0].Type != "death" {
+		t.Errorf("recorded deaths = %+v", recorder.deaths)
+	}
+}
@@ -2,17 +2,41 @@ package structure
 
 import (
 	"sync/atomic"
+	"unsafe"
 )
 
+// LayoutVersion is GlobalHeader.Version for this layout. Version 2 added StationSize,
+// SlotsPerStation and ReclaimableCount to the header, DeathTS and Reclaimable to the
+// station header, and slots past the eighth; probes refuse any other version.
+const LayoutVersion = 2
+
 // GlobalHeader forcibly occupies a full 1024 bytes (1KB)
 // This ensures that the StationData immediately following it is absolutely 1024-byte aligned
 type GlobalHeader struct {
-	MagicNum       uint64     // 0x00
-	Version        uint32     // 0x08
-	MaxStations    uint32     // 0x0C
-	AllocatedCount uint32     // 0x10
-	TracerSleeping uint32     // 0x14
-	_              [1000]byte // 🔴 1024 - 24 = 1000. Hard padding, matches C++ _reserved[1000] and Rust [u8;1000]
+	MagicNum         uint64    // 0x00
+	Version          uint32    // 0x08
+	MaxStations      uint32    // 0x0C
+	AllocatedCount   uint32    // 0x10
+	TracerSleeping   uint32    // 0x14
+	StationSize      uint32    // 0x18 - Bytes from one station to the next, StationSizeFor(SlotsPerStation)
+	SlotsPerStation  uint32    // 0x1C - Epoch slots the probe cycles through
+	ReclaimableCount uint32    // 0x20 - Stations with Reclaimable set; SDKs only scan for one when this is non-zero
+	_                [988]byte // 🔴 1024 - 36 = 988. Hard padding, matches C++ _reserved[988] and Rust [u8;988]
+}
+
+const (
+	// BaseSlotsPerStation is the size of the Slots array inside StationData.
+	BaseSlotsPerStation = 8
+	// MaxSlotsPerStation caps GlobalHeader.SlotsPerStation. Slots past the eighth live
+	// right after the 1024-byte StationData, see Slot.
+	MaxSlotsPerStation = 64
+)
+
+// StationSizeFor is the station stride for a slot count: 1024 bytes for up to 8 slots,
+// plus 64 bytes for each slot past the eighth.
+func StationSizeFor(slots int) int {
+	extra := max(slots-BaseSlotsPerStation, 0)
+	return int(unsafe.Sizeof(StationData{})) + extra*int(unsafe.Sizeof(Epoch{}))
 }
 
 // Epoch strictly occupies 64 bytes, matching the CPU Cache Line
@@ -28,10 +52,13 @@ type Epoch struct {
 // StationData strictly occupies 1024 bytes
 type StationData struct {
 	Header struct {
-		ProbeID uint64   // 0x00
-		BirthTS uint64   // 0x08
-		IsDead  bool     // 0x10
-		_       [47]byte // 0x11 - Pad to fill up to 64 bytes
+		ProbeID     uint64   // 0x00
+		BirthTS     uint64   // 0x08
+		IsDead      bool     // 0x10
+		_           [7]byte  // 0x11
+		DeathTS     uint64   // 0x18 - Monotonic ns the probe died at, written before IsDead; 0 from SDKs that predate the field
+		Reclaimable uint32   // 0x20 - Set to 1 by the tracer once a dead station is finalized; an SDK claims it with CAS 1 -> 0
+		_           [28]byte // 0x24 - Pad to fill up to 64 bytes
 	} // Occupy 64 Bytes
 
 	Slots [8]Epoch // Occupy 512 Bytes (8 * 64)
@@ -39,11 +66,31 @@ type StationData struct {
 	Flexible [448]byte
 }
 
-// Harvest implements strict SeqLock for tear-free lock-free scanning
-func (s *StationData) Harvest(lastSeenSeqs *[8]uint64, sw *StationWriter) int {
+// Slot returns Epoch i of the station. The first 8 are the Slots array; the rest follow
+// the StationData, so i >= 8 is only valid inside a mapping whose station stride is
+// StationSizeFor(i+1) or more.
+func (s *StationData) Slot(i int) *Epoch {
+	if i < len(s.Slots) {
+		return &s.Slots[i]
+	}
+	extra := uintptr(i-len(s.Slots)) * unsafe.Sizeof(Epoch{})
+	return (*Epoch)(unsafe.Add(unsafe.Pointer(s), unsafe.Sizeof(*s)+extra))
+}
+
+// Harvest implements strict SeqLock for tear-free lock-free scanning.
+// It stops at the first epoch the sink rejects and returns the error; that slot's
+// lastSeen is left alone, so the epoch is offered again by the next scan if the
+// probe has not overwritten it by then.
+func (s *StationData) Harvest(lastSeenSeqs *[8]uint64, sw EventSink) (int, error) {
+	return s.HarvestSlots(lastSeenSeqs[:], sw)
+}
+
+// HarvestSlots is Harvest over len(lastSeenSeqs) slots, as negotiated in
+// GlobalHeader.SlotsPerStation; see Slot for where slots past the eighth live.
+func (s *StationData) HarvestSlots(lastSeenSeqs []uint64, sw EventSink) (int, error) {
 	harvestedCount := 0
-	for i := 0; i < 8; i++ {
-		slot := &s.Slots[i]
+	for i := range lastSeenSeqs {
+		slot := s.Slot(i)
 
 		// 🔵 Lean: go_scan (Step 1: Read pre-snapshot)
 		// Use LoadUint64 to guarantee memory barrier semantics
@@ -78,10 +125,12 @@ func (s *StationData) Harvest(lastSeenSeqs *[8]uint64, sw *StationWriter) int {
 
 		// 🟢 Validation passed! Corresponding to go_validate_pass in Lean
 		// At this point, variables such as localTID are 100% from a complete, clean C++ write
-		sw.WriteSafeSlot(s, seq1, localTID, localAddr, localIsActive, localTS)
+		if err := sw.WriteSafeSlot(s, i, seq1, localTID, localAddr, localIsActive, localTS); err != nil {
+			return harvestedCount, err
+		}
 
 		lastSeenSeqs[i] = seq1
 		harvestedCount++
 	}
-	return harvestedCount
+	return harvestedCount, nil
 }
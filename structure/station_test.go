@@ -41,6 +41,9 @@ func TestGlobalHeaderFieldOffsets(t *testing.T) {
 		{"MaxStations", uintptr(unsafe.Pointer(&h.MaxStations)) - base, 0x0C},
 		{"AllocatedCount", uintptr(unsafe.Pointer(&h.AllocatedCount)) - base, 0x10},
 		{"TracerSleeping", uintptr(unsafe.Pointer(&h.TracerSleeping)) - base, 0x14},
+		{"StationSize", uintptr(unsafe.Pointer(&h.StationSize)) - base, 0x18},
+		{"SlotsPerStation", uintptr(unsafe.Pointer(&h.SlotsPerStation)) - base, 0x1C},
+		{"ReclaimableCount", uintptr(unsafe.Pointer(&h.ReclaimableCount)) - base, 0x20},
 	}
 	for _, c := range cases {
 		if c.got != c.wantOff {
@@ -70,6 +73,28 @@ func TestEpochFieldOffsets(t *testing.T) {
 	}
 }
 
+func TestStationHeaderFieldOffsets(t *testing.T) {
+	var s StationData
+	base := uintptr(unsafe.Pointer(&s))
+	cases := []struct {
+		name    string
+		got     uintptr
+		wantOff uintptr
+	}{
+		{"ProbeID", uintptr(unsafe.Pointer(&s.Header.ProbeID)) - base, 0x00},
+		{"BirthTS", uintptr(unsafe.Pointer(&s.Header.BirthTS)) - base, 0x08},
+		{"IsDead", uintptr(unsafe.Pointer(&s.Header.IsDead)) - base, 0x10},
+		{"DeathTS", uintptr(unsafe.Pointer(&s.Header.DeathTS)) - base, 0x18},
+		{"Reclaimable", uintptr(unsafe.Pointer(&s.Header.Reclaimable)) - base, 0x20},
+		{"Slots", uintptr(unsafe.Pointer(&s.Slots)) - base, 0x40},
+	}
+	for _, c := range cases {
+		if c.got != c.wantOff {
+			t.Errorf("StationData.%s offset = 0x%02x, want 0x%02x", c.name, c.got, c.wantOff)
+		}
+	}
+}
+
 func TestStationDataSlotCount(t *testing.T) {
 	var s StationData
 	if len(s.Slots) != 8 {
@@ -115,7 +140,7 @@ func TestHarvestEmptyStation(t *testing.T) {
 
 	var s StationData
 	var lastSeen [8]uint64
-	if got := s.Harvest(&lastSeen, sw); got != 0 {
+	if got, _ := s.Harvest(&lastSeen, sw); got != 0 {
 		t.Errorf("empty station: Harvest = %d, want 0", got)
 	}
 }
@@ -130,7 +155,7 @@ func TestHarvestSingleWrite(t *testing.T) {
 
 	simulateSeqLockWrite(&s.Slots[0], 1001, 0xDEADBEEF, true, 999)
 
-	if got := s.Harvest(&lastSeen, sw); got != 1 {
+	if got, _ := s.Harvest(&lastSeen, sw); got != 1 {
 		t.Errorf("single write: Harvest = %d, want 1", got)
 	}
 	if lastSeen[0] == 0 {
@@ -147,7 +172,7 @@ func TestHarvestDoesNotRepeatSameSeq(t *testing.T) {
 	simulateSeqLockWrite(&s.Slots[0], 1001, 0xABCD, false, 100)
 	s.Harvest(&lastSeen, sw)
 
-	if got := s.Harvest(&lastSeen, sw); got != 0 {
+	if got, _ := s.Harvest(&lastSeen, sw); got != 0 {
 		t.Errorf("repeat harvest: got %d, want 0", got)
 	}
 }
@@ -161,7 +186,7 @@ func TestHarvestSkipsOddSeq(t *testing.T) {
 	// Force odd seq (C++ is mid-write)
 	atomic.StoreUint64(&s.Slots[0].Seq, 3)
 
-	if got := s.Harvest(&lastSeen, sw); got != 0 {
+	if got, _ := s.Harvest(&lastSeen, sw); got != 0 {
 		t.Errorf("odd seq: Harvest = %d, want 0", got)
 	}
 }
@@ -178,7 +203,7 @@ func TestHarvestAllEightSlots(t *testing.T) {
 		simulateSeqLockWrite(&s.Slots[i], uint64(100+i), uint64(i*16), i%2 == 0, uint64(i*1000))
 	}
 
-	if got := s.Harvest(&lastSeen, sw); got != 8 {
+	if got, _ := s.Harvest(&lastSeen, sw); got != 8 {
 		t.Errorf("all slots: Harvest = %d, want 8", got)
 	}
 	for i := 0; i < 8; i++ {
@@ -199,11 +224,59 @@ func TestHarvestPartialSlots(t *testing.T) {
 	simulateSeqLockWrite(&s.Slots[3], 103, 0x33, false, 3)
 	simulateSeqLockWrite(&s.Slots[5], 105, 0x55, true, 5)
 
-	if got := s.Harvest(&lastSeen, sw); got != 3 {
+	if got, _ := s.Harvest(&lastSeen, sw); got != 3 {
 		t.Errorf("partial slots: Harvest = %d, want 3", got)
 	}
 }
 
+func TestHarvestSlotsStopsAtNegotiatedCount(t *testing.T) {
+	sw, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	var s StationData
+	var lastSeen [8]uint64
+	for i := 0; i < 8; i++ {
+		simulateSeqLockWrite(&s.Slots[i], uint64(100+i), 0, true, uint64(i))
+	}
+
+	if got, _ := s.HarvestSlots(lastSeen[:3], sw); got != 3 {
+		t.Errorf("HarvestSlots(3) = %d, want 3", got)
+	}
+	if lastSeen[3] != 0 {
+		t.Errorf("slot 3 harvested past the negotiated count")
+	}
+	if got, _ := s.HarvestSlots(lastSeen[:], sw); got != 5 {
+		t.Errorf("HarvestSlots(8) = %d, want the remaining 5", got)
+	}
+}
+
+func TestHarvestSlotsPastTheEighth(t *testing.T) {
+	sw, cleanup := newTestWriter(t)
+	defer cleanup()
+
+	const slots = 12
+	if size := StationSizeFor(slots); size != 1024+4*64 {
+		t.Fatalf("StationSizeFor(%d) = %d, want %d", slots, size, 1024+4*64)
+	}
+	// Slots past the eighth live right after the StationData, inside the station stride
+	mem := make([]Epoch, StationSizeFor(slots)/int(unsafe.Sizeof(Epoch{})))
+	s := (*StationData)(unsafe.Pointer(&mem[0]))
+	if s.Slot(8) != &mem[16] {
+		t.Fatalf("slot 8 at %p, want right after the StationData at %p", s.Slot(8), &mem[16])
+	}
+	for i := 0; i < slots; i++ {
+		simulateSeqLockWrite(s.Slot(i), uint64(100+i), 0, true, uint64(i))
+	}
+
+	lastSeen := make([]uint64, slots)
+	if got, _ := s.HarvestSlots(lastSeen, sw); got != slots {
+		t.Errorf("HarvestSlots(%d) = %d, want every slot", slots, got)
+	}
+	if lastSeen[11] == 0 {
+		t.Error("slot 11 not harvested")
+	}
+}
+
 func TestHarvestRingBufferWrapAround(t *testing.T) {
 	sw, cleanup := newTestWriter(t)
 	defer cleanup()
@@ -221,7 +294,7 @@ func TestHarvestRingBufferWrapAround(t *testing.T) {
 	simulateSeqLockWrite(&s.Slots[0], 200, 0xFF, false, 999)
 	simulateSeqLockWrite(&s.Slots[1], 201, 0xFE, true, 998)
 
-	if got := s.Harvest(&lastSeen, sw); got != 2 {
+	if got, _ := s.Harvest(&lastSeen, sw); got != 2 {
 		t.Errorf("wrap-around: Harvest = %d, want 2", got)
 	}
 }
@@ -243,7 +316,7 @@ func TestHarvestDiscardsTornRead(t *testing.T) {
 	// seq1=odd and skips (odd check fires before payload copy).
 	atomic.StoreUint64(&s.Slots[0].Seq, 3)
 
-	if got := s.Harvest(&lastSeen, sw); got != 0 {
+	if got, _ := s.Harvest(&lastSeen, sw); got != 0 {
 		t.Errorf("torn read guard: Harvest = %d, want 0", got)
 	}
 }
@@ -282,7 +355,18 @@ func TestHarvestZeroAddrAndInactive(t *testing.T) {
 	// addr=0, is_active=true represents a resume event
 	simulateSeqLockWrite(&s.Slots[0], 500, 0, true, 12345)
 
-	if got := s.Harvest(&lastSeen, sw); got != 1 {
+	if got, _ := s.Harvest(&lastSeen, sw); got != 1 {
 		t.Errorf("zero addr resume: Harvest = %d, want 1", got)
 	}
 }
+
+func TestCheckLayout(t *testing.T) {
+	if err := CheckLayout(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range layoutFields() {
+		if f.got != f.want {
+			t.Errorf("%s = %#x, want %#x", f.name, f.got, f.want)
+		}
+	}
+}